@@ -0,0 +1,32 @@
+package main
+
+import (
+	`fmt`
+	`io`
+
+	"gopkg.in/yaml.v3"
+)
+
+// runCheckConfig validates the configuration file and command line options, and prints the
+// effective configuration with defaults filled in. The serial port is not opened.
+// It returns the exit status.
+func runCheckConfig(w io.Writer) int {
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(w, "Load configuration: %s\n", err)
+		return 1
+	}
+	err = cfg.Validate()
+	if err != nil {
+		fmt.Fprintf(w, "Invalid configuration: %s\n", err)
+		return 1
+	}
+
+	out, err := yaml.Marshal(cfg.Redacted())
+	if err != nil {
+		fmt.Fprintf(w, "Encode configuration: %s\n", err)
+		return 1
+	}
+	fmt.Fprintf(w, "# Configuration is valid.\n%s", out)
+	return 0
+}
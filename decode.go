@@ -0,0 +1,197 @@
+package main
+
+import (
+	`bufio`
+	`encoding/hex`
+	`encoding/json`
+	`errors`
+	`flag`
+	`fmt`
+	`io`
+	`os`
+	`path/filepath`
+	`strings`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/exporter`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+)
+
+var (
+	decodeHex bool
+	decodeRaw bool
+)
+
+// decodeOptions adds the options of the decode command.
+func decodeOptions(fs *flag.FlagSet) {
+	fs.StringVar(&confFile, "c", "", "configuration file")
+	fs.BoolVar(&strict, "strict", false, "reject frames containing registers that cannot be parsed")
+	fs.IntVar(&payloadOffset, "payload-offset", 0, "offset of the COSEM data structure within frames, detected if 0")
+	fs.BoolVar(&decodeHex, "hex", false, "read one frame per line as hex, or packet log records with raw frames")
+	fs.BoolVar(&decodeRaw, "raw", false, "include raw frames in the output")
+}
+
+// runDecode decodes the frames in each file and prints them as JSON lines, in the format of the packet log.
+// Files ending in .hdlc hold a single frame, as saved by the record command, and other files hold frames
+// as read from the serial port. Directories are replayed as a recorded corpus, reporting frames that are
+// decoded differently than when recorded. It returns the exit status.
+func runDecode(args []string) int {
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Load configuration: %s\n", err)
+		return 1
+	}
+	parser := exporter.NewParser(cfg)
+
+	if len(args) == 0 {
+		args = []string{"-"}
+	}
+	d := &decoder{
+		parser: parser,
+		enc:    json.NewEncoder(os.Stdout),
+	}
+	for _, name := range args {
+		if err := d.decodePath(name); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+			d.failed = true
+		}
+	}
+	if d.failed {
+		return 1
+	}
+	return 0
+}
+
+type decoder struct {
+	parser *protocol.Parser
+	enc    *json.Encoder
+	failed bool
+}
+
+func (d *decoder) decodePath(name string) error {
+	if name == "-" {
+		return d.decodeStream(name, os.Stdin)
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return d.replayCorpus(name)
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if filepath.Ext(name) == ".hdlc" && !decodeHex {
+		frame, err := io.ReadAll(file)
+		if err != nil {
+			return err
+		}
+		d.decodeFrame(name, frame)
+		return nil
+	}
+	return d.decodeStream(name, file)
+}
+
+// decodeStream decodes either hex lines, or frames between flag bytes.
+func (d *decoder) decodeStream(name string, r io.Reader) error {
+	if decodeHex {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, 1<<20)
+		for line := 1; scanner.Scan(); line++ {
+			if len(strings.TrimSpace(scanner.Text())) == 0 {
+				continue
+			}
+			frame, err := lineFrame(scanner.Text())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s:%d: %s\n", name, line, err)
+				d.failed = true
+				continue
+			}
+			d.decodeFrame(fmt.Sprintf("%s:%d", name, line), frame)
+		}
+		return scanner.Err()
+	}
+
+	dec := protocol.NewDecoder(r)
+	dec.Parser = d.parser
+	for n := 1; ; n++ {
+		packet, err := dec.NextPacket()
+		var parseErr *protocol.ParseError
+		switch {
+		case err == nil:
+			d.print(packet)
+		case errors.Is(err, io.EOF):
+			return nil
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			fmt.Fprintf(os.Stderr, "%s: frame %d: truncated at end of input\n", name, n)
+			d.failed = true
+			return nil
+		case errors.As(err, &parseErr):
+			fmt.Fprintf(os.Stderr, "%s: frame %d: %s\n", name, n, err)
+			d.failed = true
+		case errors.Is(err, protocol.ErrResynced), errors.Is(err, protocol.ErrAborted),
+			errors.Is(err, protocol.ErrChecksum), errors.Is(err, protocol.ErrFrameTooLong):
+			fmt.Fprintf(os.Stderr, "%s: frame %d: %s\n", name, n, err)
+		default:
+			return err
+		}
+	}
+}
+
+// lineFrame returns the frame on a line of hex, or in the frame field of a packet log record.
+func lineFrame(line string) ([]byte, error) {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "{") {
+		var rec struct {
+			Frame string `json:"frame"`
+		}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			return nil, err
+		}
+		if len(rec.Frame) == 0 {
+			return nil, fmt.Errorf("packet log record without frame; write the packet log with raw set")
+		}
+		line = rec.Frame
+	}
+	text := strings.Join(strings.Fields(line), "")
+	text = strings.TrimSuffix(strings.TrimPrefix(strings.ToLower(text), "7e"), "7e")
+	return hex.DecodeString(text)
+}
+
+func (d *decoder) decodeFrame(name string, frame []byte) {
+	packet, err := d.parser.DecodeFrame(frame)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+		d.failed = true
+		return
+	}
+	d.print(packet)
+}
+
+func (d *decoder) print(packet *protocol.Packet) {
+	d.enc.Encode(exporter.NewPacketRecord(packet, decodeRaw))
+}
+
+// replayCorpus decodes every frame in a recorded corpus, and reports those decoded differently than recorded.
+func (d *decoder) replayCorpus(dir string) error {
+	entries, err := exporter.ReadCorpus(dir)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, entry := range entries {
+		if err := entry.Replay(d.parser); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", filepath.Join(dir, entry.Name), err)
+			failed++
+		}
+	}
+	fmt.Printf("%s: %d of %d frames decoded as recorded\n", dir, len(entries)-failed, len(entries))
+	if failed > 0 {
+		d.failed = true
+	}
+	return nil
+}
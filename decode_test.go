@@ -0,0 +1,60 @@
+package main
+
+import (
+	`bytes`
+	`encoding/hex`
+	`encoding/json`
+	`strings`
+	`testing`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/exporter`
+	`github.com/stretchr/testify/assert`
+)
+
+// A frame with the active power import register, without flag bytes.
+var testFrame = []byte{0xa0, 0x2a, 0x41, 0x08, 0x83, 0x13, 0x04, 0x13, 0xe6, 0xe7, 0x00, 0x0f, 0x40, 0x00, 0x00, 0x00, 0x00, 0x01, 0x01, 0x02, 0x03, 0x09, 0x06, 0x01, 0x00, 0x01, 0x07, 0x00, 0xff, 0x06, 0x00, 0x00, 0x04, 0xe9, 0x02, 0x02, 0x0f, 0x00, 0x16, 0x1b, 0xd1, 0x52}
+
+func newTestDecoder(out *bytes.Buffer) *decoder {
+	return &decoder{
+		parser: exporter.NewParser(exporter.DefaultConfig()),
+		enc:    json.NewEncoder(out),
+	}
+}
+
+func TestDecodeHex(t *testing.T) {
+	decodeHex = true
+	defer func() { decodeHex = false }()
+
+	record, err := json.Marshal(map[string]any{"time": "2024-03-01T12:00:00Z", "frame": hex.EncodeToString(testFrame)})
+	assert.NoError(t, err)
+	input := "7e" + hex.EncodeToString(testFrame) + "7e\n\n" + string(record) + "\n"
+
+	var out bytes.Buffer
+	d := newTestDecoder(&out)
+	assert.NoError(t, d.decodeStream("test", strings.NewReader(input)))
+	assert.False(t, d.failed)
+	assert.Equal(t, 2, strings.Count(out.String(), "\n"))
+
+	// Records of a packet log written without raw frames cannot be decoded.
+	out.Reset()
+	assert.NoError(t, d.decodeStream("test", strings.NewReader(`{"time":"2024-03-01T12:00:00Z"}`)))
+	assert.True(t, d.failed)
+	assert.Empty(t, out.String())
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	stream := append([]byte{0x7e}, testFrame...)
+	stream = append(stream, 0x7e)
+
+	var out bytes.Buffer
+	d := newTestDecoder(&out)
+	assert.NoError(t, d.decodeStream("test", bytes.NewReader(stream)))
+	assert.False(t, d.failed)
+	assert.Equal(t, 1, strings.Count(out.String(), "\n"))
+
+	// A frame cut off at the end of the input fails the command.
+	out.Reset()
+	assert.NoError(t, d.decodeStream("test", bytes.NewReader(stream[:len(stream)-10])))
+	assert.True(t, d.failed)
+	assert.Empty(t, out.String())
+}
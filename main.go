@@ -1,21 +1,16 @@
 package main
 
 import (
-	`bytes`
 	`context`
 	"flag"
 	`fmt`
-	`net/http`
 	"os"
 	`os/signal`
+	`strings`
 	`syscall`
 	"time"
 
-	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
-	"github.com/goburrow/serial"
-	`github.com/lvdlvd/go-hdlc`
-	`github.com/prometheus/client_golang/prometheus`
-	`github.com/prometheus/client_golang/prometheus/promhttp`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/exporter`
 	log "github.com/sirupsen/logrus"
 )
 
@@ -26,21 +21,156 @@ var (
 	stopbits int
 	parity   string
 	verbose  bool
-	listen   string
+	listen   addressList
+	confFile string
+	strict   bool
+	probe    bool
+	check    bool
+
+	metricsPath  string
+	adminListen  string
+	packetLog    string
+	packetLogRaw bool
+
+	payloadOffset int
+	logFile       string
+	namespace     string
+
+	userName  string
+	groupName string
+	chroot    string
+	pidFile   string
 )
 
+// addressList collects the values of an option given several times.
+type addressList []string
+
+func (l *addressList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *addressList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// command is a subcommand, with options of its own.
+type command struct {
+	name    string
+	args    string
+	summary string
+	options func(fs *flag.FlagSet)
+	run     func(args []string) int
+	flags   *flag.FlagSet
+}
+
+// commandFlags holds the options of the command being run, applied by loadConfig
+// after those given before the command.
+var commandFlags *flag.FlagSet
+
 func main() {
-	flag.StringVar(&address, "a", "/dev/ttyUSB0", "address")
-	flag.IntVar(&baudrate, "b", 2400, "baud rate")
-	flag.IntVar(&databits, "d", 8, "data bits")
-	flag.IntVar(&stopbits, "s", 1, "stop bits")
-	flag.StringVar(&parity, "p", "E", "parity (N/E/O)")
-	flag.BoolVar(&verbose, "v", false, "verbose output")
-	flag.StringVar(&listen, "l", "0.0.0.0:8080", "listen address")
+	// Options of the serve command are also accepted before any command, as they were
+	// before the program had commands, and the exporter is served if no command is given.
+	serveOptions(flag.CommandLine)
+
+	commands := []*command{
+		{name: "serve", summary: "read frames from the meter and serve metrics (default)", options: serveOptions, run: runServe},
+		{name: "decode", args: "[file|directory...]", summary: "decode frames from files, a recorded corpus or standard input", options: decodeOptions, run: runDecode},
+		{name: "simulate", summary: "write frames from a simulated meter", options: simulateOptions, run: runSimulate},
+		{name: "scan", args: "[device...]", summary: "find the serial port and settings of the meter", run: runScan},
+		{name: "record", args: "<directory> [count]", summary: "save frames from the meter as regression fixtures", options: configOptions, run: runRecord},
+		{name: "dashboard", summary: "print a Grafana dashboard", options: dashboardOptions, run: runDashboard},
+		{name: "install", summary: "install the exporter as a Windows service", options: serveOptions, run: runInstall},
+		{name: "uninstall", summary: "remove the Windows service", run: runUninstall},
+	}
+
+	// Command options are added before any are parsed, as options shared between commands
+	// write to the same variables, and adding them sets their defaults.
+	for _, cmd := range commands {
+		cmd := cmd
+		cmd.flags = flag.NewFlagSet(cmd.name, flag.ExitOnError)
+		cmd.flags.Usage = func() {
+			fmt.Fprintf(cmd.flags.Output(), "Usage: %s %s [options] %s\n", os.Args[0], cmd.name, cmd.args)
+			cmd.flags.PrintDefaults()
+		}
+		if cmd.options != nil {
+			cmd.options(cmd.flags)
+		}
+	}
+
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: %s [options] [command] [command options] [arguments]\n\nCommands:\n", os.Args[0])
+		for _, cmd := range commands {
+			fmt.Fprintf(out, "  %-10s %s\n", cmd.name, cmd.summary)
+		}
+		fmt.Fprintf(out, "\nRun %s <command> -h for the options of a command. Options of serve:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	name := flag.Arg(0)
+	if len(name) == 0 {
+		name = "serve"
+	}
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		var args []string
+		if flag.NArg() > 0 {
+			args = flag.Args()[1:]
+		}
+		cmd.flags.Parse(args)
+		commandFlags = cmd.flags
+		os.Exit(cmd.run(cmd.flags.Args()))
+	}
+	flag.Usage()
+	os.Exit(2)
+}
+
+// configOptions adds the options overriding the configuration file.
+func configOptions(fs *flag.FlagSet) {
+	defaults := exporter.DefaultConfig()
+	fs.StringVar(&confFile, "c", "", "configuration file")
+	fs.StringVar(&address, "a", defaults.Serial.Address, "address")
+	fs.IntVar(&baudrate, "b", defaults.Serial.BaudRate, "baud rate")
+	fs.IntVar(&databits, "d", defaults.Serial.DataBits, "data bits")
+	fs.IntVar(&stopbits, "s", defaults.Serial.StopBits, "stop bits")
+	fs.StringVar(&parity, "p", defaults.Serial.Parity, "parity (N/E/O)")
+	fs.BoolVar(&probe, "probe", false, "detect baud rate and parity automatically")
+	fs.BoolVar(&strict, "strict", false, "drop frames containing registers that cannot be parsed")
+	fs.IntVar(&payloadOffset, "payload-offset", 0, "offset of the COSEM data structure within frames, detected if 0")
+}
+
+// serveOptions adds the options of the serve command.
+func serveOptions(fs *flag.FlagSet) {
+	defaults := exporter.DefaultConfig()
+	configOptions(fs)
+	fs.BoolVar(&verbose, "v", false, "verbose output")
+	fs.Var(&listen, "l", "listen `address`, given several times to listen on several addresses (default "+strings.Join(defaults.Listen, ", ")+")")
+	fs.StringVar(&metricsPath, "metrics-path", defaults.MetricsPath, "path serving metrics")
+	fs.StringVar(&namespace, "namespace", exporter.DefaultNamespace, "prefix of metric names")
+	fs.StringVar(&adminListen, "admin-listen", "", "separate listen address for health and debug endpoints")
+	fs.StringVar(&packetLog, "packet-log", "", "append decoded packets to this file as JSON lines")
+	fs.BoolVar(&packetLogRaw, "packet-log-raw", false, "include raw frames in the packet log")
+	fs.StringVar(&logFile, "log-file", "", "write log messages to this file, rotated by size, instead of standard error")
+	fs.BoolVar(&check, "check-config", false, "validate the configuration, print it with defaults filled in, and exit")
+	fs.StringVar(&userName, "user", "", "switch to this user once the serial port is open")
+	fs.StringVar(&groupName, "group", "", "switch to this group once the serial port is open, instead of the group of the user")
+	fs.StringVar(&chroot, "chroot", "", "change the root directory to this directory before switching user")
+	fs.StringVar(&pidFile, "pid-file", "", "write the process ID to this file")
+}
+
+// runServe runs the exporter until terminated. It returns the exit status.
+func runServe(args []string) int {
+	if len(args) > 0 {
+		flag.Usage()
+		return 2
+	}
+	if check {
+		return runCheckConfig(os.Stdout)
+	}
 
 	log.SetLevel(log.DebugLevel)
 	log.SetFormatter(&log.TextFormatter{
@@ -50,156 +180,212 @@ func main() {
 
 	log.Infof("Aidon AMS reader V1.0")
 
-	serialPort, err := openSerial()
+	cfg, err := loadConfig()
 	if err != nil {
-		log.Fatalf("open serial port: %s", err)
+		log.Fatalf("load configuration: %s", err)
 	}
-	defer serialPort.Close()
-
-	log.Infof("Serial port opened")
+	setLogLevel(cfg.LogLevel)
 
-	// Set up Prometheus metrics
-	for k := range gauges {
-		prometheus.MustRegister(gauges[k])
-	}
-	msgCounter := counter("messages_processed", "Total number of messages processed")
-	resyncCounter := counter("hdlc_frame_resync", "Total number of HDLC frame re-synchronizations")
-	abortCounter := counter("hdlc_frame_aborted", "Total number of HDLC frame aborts")
-	parseErrorCounter := counter("parse_errors", "Total number of messages dropped due to parsing errors")
-	prometheus.MustRegister(msgCounter, resyncCounter, abortCounter, parseErrorCounter)
-	go func() {
-		log.Infof("Started HTTP server on %s", listen)
-		err := http.ListenAndServe(listen, promhttp.Handler())
+	if cfg.LogFile != nil {
+		file, err := exporter.OpenLogFile(*cfg.LogFile)
 		if err != nil {
-			log.Errorf("HTTP server: %s", err)
-			cancel()
+			log.Fatalf("log file: %s", err)
 		}
-	}()
-
-	// Input stream
-	buf := make([]byte, 1024)
-	unf := hdlc.Unframe(serialPort)
-	packets := make(chan map[string]any, 32)
-
-	go func() {
-		for ctx.Err() == nil {
-			_, err := unf.Read(buf)
-			switch err {
-			case hdlc.ErrResynced:
-				resyncCounter.Inc()
-				log.Debugf("HDLC frame re-synced")
-			case hdlc.ErrAbort:
-				abortCounter.Inc()
-				log.Errorf("HDLC frame aborted")
-			case nil:
-				r := bytes.NewReader(buf[17:])
-				packet, err := protocol.ParseFlattened(r)
-				if err != nil {
-					log.Errorf("Parse data structure: %s", err)
-					parseErrorCounter.Inc()
-					continue
-				}
-				msgCounter.Inc()
-				packets <- packet
-			}
-		}
-		log.Infof("Serial packet reading stopped")
-	}()
+		defer file.Close()
+		log.SetOutput(file)
+		log.Infof("Aidon AMS reader V1.0")
+	}
 
-	signals := make(chan os.Signal, 2)
-	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	if cfg.Syslog != nil {
+		hook, err := exporter.NewSyslogHook(*cfg.Syslog)
+		if err != nil {
+			log.Fatalf("syslog: %s", err)
+		}
+		defer hook.Close()
+		log.AddHook(hook)
+	}
 
-	for ctx.Err() == nil {
+	reload := make(chan exporter.Config, 1)
+	requests := make(chan struct{}, 1)
+	cfg.Reload = reload
+	cfg.RequestReload = func() {
 		select {
-		case packet := <-packets:
-			for k := range packet {
-				g, ok := gauges[k]
-				if !ok {
-					continue
-				}
-				val, err := anytoint(packet[k])
-				if err == nil {
-					g.Set(float64(val))
-				}
-			}
-		case sig := <-signals:
-			log.Infof("Received signal %s", sig)
-			cancel()
+		case requests <- struct{}{}:
+		default:
+			// A reload is already pending, and reads the file anew.
 		}
 	}
+	go reloadOnHangup(cfg.RequestReload)
+	go reloadOnRequest(requests, reload)
+
+	isService, err := runService(cfg)
+	if err != nil {
+		log.Fatalf("service: %s", err)
+	}
+	if isService {
+		log.Infof("Terminating")
+		return 0
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer cancel()
+
+	err = exporter.Run(ctx, cfg)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
 
 	log.Infof("Terminating")
+	return 0
 }
 
-var gauges = map[string]prometheus.Gauge{
-	"1-0:1.7.0.255":  gauge("active_positive_instantaneous_value", "Active- Instantaneous value"),
-	"1-0:2.7.0.255":  gauge("active_negative_instantaneous_value", "Active- Instantaneous value"),
-	"1-0:3.7.0.255":  gauge("reactive_positive_instantaneous_value", "Reactive+ Instantaneous value"),
-	"1-0:4.7.0.255":  gauge("reactive_negative_instantaneous_value", "Reactive- Instantaneous value"),
-	"1-0:31.7.0.255": gauge("l1_current_instantaneous_value", "L1 Current Instantaneous value"),
-	"1-0:51.7.0.255": gauge("l2_current_instantaneous_value", "L2 Current Instantaneous value"),
-	"1-0:71.7.0.255": gauge("l3_current_instantaneous_value", "L3 Current Instantaneous value"),
-	"1-0:32.7.0.255": gauge("l1_voltage_instantaneous_value", "L1 Voltage Instantaneous value"),
-	"1-0:52.7.0.255": gauge("l2_voltage_instantaneous_value", "L2 Voltage Instantaneous value"),
-	"1-0:72.7.0.255": gauge("l3_voltage_instantaneous_value", "L3 Voltage Instantaneous value"),
-	"1-0:1.8.0.255":  gauge("active_positive_energy", "Active+ Energy"),
-	"1-0:2.8.0.255":  gauge("active_negative_energy", "Active- Energy"),
-	"1-0:3.8.0.255":  gauge("reactive_positive_energy", "Reactive+ Energy"),
-	"1-0:4.8.0.255":  gauge("reactive_negative_energy", "Reactive- Energy"),
+// dashboardOptions adds the options of the dashboard command.
+func dashboardOptions(fs *flag.FlagSet) {
+	fs.StringVar(&confFile, "c", "", "configuration file")
+	fs.StringVar(&namespace, "namespace", exporter.DefaultNamespace, "prefix of metric names")
 }
 
-// The type system is where Golang really _shines_...
-// Is there a better way to do this using generics?
-func anytoint(i any) (int, error) {
-	switch x := i.(type) {
-	case int8:
-		return int(x), nil
-	case int16:
-		return int(x), nil
-	case int32:
-		return int(x), nil
-	case int64:
-		return int(x), nil
-	case uint8:
-		return int(x), nil
-	case uint16:
-		return int(x), nil
-	case uint32:
-		return int(x), nil
-	case uint64:
-		return int(x), nil
-	default:
-		return 0, fmt.Errorf("not a number")
+func runDashboard(args []string) int {
+	cfg, err := loadConfig()
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		log.Errorf("Configuration: %s", err)
+		return 1
+	}
+	err = exporter.WriteDashboard(os.Stdout, cfg.Namespace)
+	if err != nil {
+		log.Errorf("Write dashboard: %s", err)
+		return 1
 	}
+	return 0
 }
 
-func openSerial() (serial.Port, error) {
-	config := serial.Config{
-		Address:  address,
-		BaudRate: baudrate,
-		DataBits: databits,
-		StopBits: stopbits,
-		Parity:   parity,
-		Timeout:  1 * time.Second,
+// runInstall installs the Windows service. Options given before and after the command
+// are passed on to the service.
+func runInstall(args []string) int {
+	options := os.Args[1 : len(os.Args)-flag.NArg()]
+	options = append(options, flag.Args()[1:len(flag.Args())-len(args)]...)
+	err := installService(options)
+	if err != nil {
+		log.Errorf("Install service: %s", err)
+		return 1
+	}
+	return 0
+}
+
+func runUninstall(args []string) int {
+	err := removeService()
+	if err != nil {
+		log.Errorf("Uninstall service: %s", err)
+		return 1
 	}
+	return 0
+}
 
-	log.Debugf("Serial port parameters: %+v\n", config)
+// loadConfig reads the configuration file, if any, and applies command line options.
+func loadConfig() (exporter.Config, error) {
+	cfg, err := exporter.LoadConfig(confFile)
+	if err != nil {
+		return cfg, err
+	}
 
-	return serial.Open(&config)
+	// Command line options take precedence over the configuration file.
+	apply := func(f *flag.Flag) {
+		switch f.Name {
+		case "a":
+			cfg.Serial.Address = address
+		case "b":
+			cfg.Serial.BaudRate = baudrate
+		case "d":
+			cfg.Serial.DataBits = databits
+		case "s":
+			cfg.Serial.StopBits = stopbits
+		case "p":
+			cfg.Serial.Parity = parity
+		case "l":
+			cfg.Listen = exporter.Addresses(listen)
+		case "metrics-path":
+			cfg.MetricsPath = metricsPath
+		case "admin-listen":
+			cfg.AdminListen = adminListen
+		case "probe":
+			cfg.Serial.Probe = probe
+		case "strict":
+			cfg.Strict = strict
+		case "payload-offset":
+			cfg.Parser.PayloadOffset = payloadOffset
+		case "namespace":
+			cfg.Namespace = namespace
+		case "user":
+			cfg.User = userName
+		case "group":
+			cfg.Group = groupName
+		case "chroot":
+			cfg.Chroot = chroot
+		case "pid-file":
+			cfg.PIDFile = pidFile
+		}
+	}
+	flag.Visit(apply)
+	if commandFlags != nil {
+		commandFlags.Visit(apply)
+	}
+
+	if len(logFile) > 0 {
+		if cfg.LogFile == nil {
+			cfg.LogFile = &exporter.LogFileConfig{}
+		}
+		cfg.LogFile.Path = logFile
+	}
+
+	if len(packetLog) > 0 {
+		cfg.PacketLog = &exporter.PacketLogConfig{Path: packetLog, Raw: packetLogRaw}
+	} else if packetLogRaw && cfg.PacketLog != nil {
+		cfg.PacketLog.Raw = true
+	}
+
+	return cfg, nil
 }
 
-func counter(key, description string) prometheus.Counter {
-	return prometheus.NewCounter(prometheus.CounterOpts{
-		Namespace: "ams",
-		Name:      key,
-		Help:      description,
-	})
+// reloadOnHangup requests a reload of the configuration file whenever SIGHUP is received.
+func reloadOnHangup(request func()) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		request()
+	}
 }
 
-func gauge(key, description string) prometheus.Gauge {
-	return prometheus.NewGauge(prometheus.GaugeOpts{
-		Namespace: "ams",
-		Name:      key,
-		Help:      description,
-	})
+// reloadOnRequest re-reads the configuration file for every request, and passes it on to the exporter.
+// A configuration the exporter has not taken yet is replaced, so that neither signals nor requests wait
+// for the exporter.
+func reloadOnRequest(requests <-chan struct{}, reload chan exporter.Config) {
+	for range requests {
+		log.Infof("Reloading configuration")
+		cfg, err := loadConfig()
+		if err != nil {
+			log.Errorf("Reload configuration: %s", err)
+			continue
+		}
+		setLogLevel(cfg.LogLevel)
+		select {
+		case <-reload:
+		default:
+		}
+		reload <- cfg
+	}
+}
+
+func setLogLevel(level string) {
+	if len(level) == 0 {
+		return
+	}
+	lvl, err := log.ParseLevel(level)
+	if err != nil {
+		log.Errorf("Invalid log level %q", level)
+		return
+	}
+	log.SetLevel(lvl)
 }
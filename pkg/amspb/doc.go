@@ -0,0 +1,4 @@
+// Package amspb holds the protobuf schema and gRPC service streaming decoded packets.
+package amspb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative ams.proto
@@ -0,0 +1,179 @@
+package exporter
+
+import (
+	`bytes`
+	`context`
+	`encoding/json`
+	`fmt`
+	`net/http`
+	`reflect`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/obis`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// AlertConfig describes a threshold on a single register, and where to send a notification when it is crossed.
+type AlertConfig struct {
+	Name      string   `yaml:"name"`
+	OBIS      string   `yaml:"obis"`
+	Above     *float64 `yaml:"above"`
+	Below     *float64 `yaml:"below"`
+	Webhook   string   `yaml:"webhook"`
+	MQTTTopic string   `yaml:"mqtt_topic"`
+}
+
+func (a AlertConfig) validate() error {
+	switch {
+	case len(a.Name) == 0:
+		return fmt.Errorf("name is required")
+	case len(a.OBIS) == 0:
+		return fmt.Errorf("obis is required")
+	case !obisCodePattern.MatchString(a.OBIS):
+		return fmt.Errorf("obis %q is not an OBIS code", a.OBIS)
+	case a.Above == nil && a.Below == nil:
+		return fmt.Errorf("either above or below is required")
+	case len(a.Webhook) == 0 && len(a.MQTTTopic) == 0:
+		return fmt.Errorf("either webhook or mqtt_topic is required")
+	}
+	if len(a.Webhook) > 0 {
+		return validateURL(a.Webhook, "http", "https")
+	}
+	return nil
+}
+
+// violated reports whether the value is outside the configured threshold.
+func (a AlertConfig) violated(val float64) bool {
+	return (a.Above != nil && val > *a.Above) || (a.Below != nil && val < *a.Below)
+}
+
+// Notification is sent when an alert starts or stops firing.
+type Notification struct {
+	Alert   string    `json:"alert"`
+	State   string    `json:"state"`
+	OBIS    string    `json:"obis"`
+	Value   float64   `json:"value"`
+	Above   *float64  `json:"above,omitempty"`
+	Below   *float64  `json:"below,omitempty"`
+	MeterID string    `json:"meter_id,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// alerter evaluates thresholds on incoming packets and sends a notification whenever an alert changes state.
+type alerter struct {
+	alerts  []AlertConfig
+	firing  []bool
+	meterID string
+	mqtt    mqtt.Client
+	client  *http.Client
+}
+
+func newAlerter(alerts []AlertConfig, mqttClient mqtt.Client) *alerter {
+	return &alerter{
+		alerts: alerts,
+		firing: make([]bool, len(alerts)),
+		mqtt:   mqttClient,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+// inherit takes over the state of unchanged alerts from a previous alerter,
+// so that reloading the configuration does not send duplicate notifications.
+func (a *alerter) inherit(prev *alerter) {
+	a.meterID = prev.meterID
+	for i, alert := range a.alerts {
+		for j, old := range prev.alerts {
+			if reflect.DeepEqual(alert, old) {
+				a.firing[i] = prev.firing[j]
+				break
+			}
+		}
+	}
+}
+
+func (a *alerter) Evaluate(packet *protocol.Packet) {
+	if id, ok := packet.Registers[obis.MeterID].Value.(string); ok {
+		a.meterID = id
+	}
+
+	for i, alert := range a.alerts {
+		reg, ok := packet.Registers[alert.OBIS]
+		if !ok {
+			continue
+		}
+		val, err := reg.Float()
+		if err != nil {
+			continue
+		}
+		firing := alert.violated(val)
+		if firing == a.firing[i] {
+			continue
+		}
+		a.firing[i] = firing
+
+		n := Notification{
+			Alert:   alert.Name,
+			State:   "resolved",
+			OBIS:    alert.OBIS,
+			Value:   val,
+			Above:   alert.Above,
+			Below:   alert.Below,
+			MeterID: a.meterID,
+			Time:    time.Now(),
+		}
+		if firing {
+			n.State = "firing"
+		}
+		log.Infof("Alert %s is %s, value %v", n.Alert, n.State, n.Value)
+
+		go a.notify(alert, n)
+	}
+}
+
+func (a *alerter) notify(alert AlertConfig, n Notification) {
+	payload, err := json.Marshal(n)
+	if err != nil {
+		log.Errorf("Encode alert %s: %s", alert.Name, err)
+		return
+	}
+
+	if len(alert.Webhook) > 0 {
+		err = a.postWebhook(alert.Webhook, payload)
+		if err != nil {
+			log.Errorf("Alert %s webhook: %s", alert.Name, err)
+		}
+	}
+
+	if len(alert.MQTTTopic) > 0 && a.mqtt != nil {
+		token := a.mqtt.Publish(alert.MQTTTopic, 1, false, payload)
+		if token.WaitTimeout(10*time.Second) && token.Error() != nil {
+			log.Errorf("Alert %s MQTT publish: %s", alert.Name, token.Error())
+		}
+	}
+}
+
+func (a *alerter) postWebhook(url string, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package exporter
+
+import (
+	`sync`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/obis`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+	`github.com/prometheus/client_golang/prometheus`
+)
+
+// clockCollector compares the meter clock, sent in the hourly message, with the host clock.
+// A drifting meter clock shifts consumption between hours in the billing data.
+type clockCollector struct {
+	mu      sync.Mutex
+	loc     *time.Location
+	meterID string
+	drift   time.Duration
+	seen    bool
+	desc    *prometheus.Desc
+}
+
+func newClockCollector(namespace string, loc *time.Location) *clockCollector {
+	return &clockCollector{
+		loc:  loc,
+		desc: newDesc(namespace, "meter_clock_drift_seconds", "Meter clock minus host clock when the meter last sent its clock"),
+	}
+}
+
+func (c *clockCollector) Update(packet *protocol.Packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if id, ok := packet.Registers[obis.MeterID].Value.(string); ok {
+		c.meterID = id
+	}
+	clock, ok := packet.Registers[obis.Clock].Value.(protocol.DateTime)
+	if !ok {
+		return
+	}
+	c.drift = clock.Time(c.loc).Sub(packet.Time)
+	c.seen = true
+}
+
+func (c *clockCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *clockCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.seen {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, c.drift.Seconds(), c.meterID)
+}
+
+// Time after the hour by which the hourly message is expected to have arrived.
+const hourlyMessageDelay = time.Minute
+
+// hourBoundary returns the hour the energy readings in an hourly message apply to. This is the meter
+// clock, if sent, or else the time the packet was received, rounded to the nearest hour, as the message
+// is sent a few seconds after the hour and a drifting meter clock may be slightly behind.
+func hourBoundary(packet *protocol.Packet, loc *time.Location) time.Time {
+	t := packet.Time
+	if clock, ok := packet.Registers[obis.Clock].Value.(protocol.DateTime); ok {
+		t = clock.Time(loc)
+	}
+	t = t.In(loc).Add(30 * time.Minute)
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc)
+}
+
+// hourlyMessageCollector counts the hourly messages received, and the hours for which one was expected
+// since the exporter started. A difference means lost messages, and thereby gaps in the energy readings.
+type hourlyMessageCollector struct {
+	mu       sync.Mutex
+	loc      *time.Location
+	meterID  string
+	first    time.Time
+	last     time.Time
+	received int
+	now      func() time.Time
+
+	receivedDesc *prometheus.Desc
+	expectedDesc *prometheus.Desc
+}
+
+func newHourlyMessageCollector(namespace string, loc *time.Location, started time.Time) *hourlyMessageCollector {
+	t := started.In(loc)
+	return &hourlyMessageCollector{
+		loc:          loc,
+		first:        time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc).Add(time.Hour),
+		now:          time.Now,
+		receivedDesc: newDesc(namespace, "hourly_messages_received_total", "Hourly messages with energy readings received since startup, counting each hour once"),
+		expectedDesc: newDesc(namespace, "hourly_messages_expected_total", "Hours passed since startup, for each of which an hourly message is expected"),
+	}
+}
+
+func (c *hourlyMessageCollector) Update(packet *protocol.Packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if id, ok := packet.Registers[obis.MeterID].Value.(string); ok {
+		c.meterID = id
+	}
+	if messageType(packet) != "list3" {
+		return
+	}
+	// Messages for hours begun before startup are not expected, and repeated messages are only counted once.
+	hour := hourBoundary(packet, c.loc)
+	if hour.Before(c.first) || !hour.After(c.last) {
+		return
+	}
+	c.last = hour
+	c.received++
+}
+
+// expected returns the number of hourly messages that should have arrived by now.
+func (c *hourlyMessageCollector) expected() int {
+	elapsed := c.now().Sub(c.first.Add(hourlyMessageDelay))
+	if elapsed < 0 {
+		return 0
+	}
+	return int(elapsed/time.Hour) + 1
+}
+
+func (c *hourlyMessageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.receivedDesc
+	ch <- c.expectedDesc
+}
+
+func (c *hourlyMessageCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(c.receivedDesc, prometheus.CounterValue, float64(c.received), c.meterID)
+	ch <- prometheus.MustNewConstMetric(c.expectedDesc, prometheus.CounterValue, float64(c.expected()), c.meterID)
+}
@@ -0,0 +1,504 @@
+package exporter
+
+import (
+	`math`
+	`net/http`
+	`sort`
+	`strings`
+	`sync`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/obis`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+	`github.com/prometheus/client_golang/prometheus`
+	log "github.com/sirupsen/logrus"
+)
+
+// window tracks the spread of an instantaneous value between two scrapes of the metrics endpoint.
+type window struct {
+	min   float64
+	max   float64
+	sum   float64
+	count int
+}
+
+func (w *window) add(val float64) {
+	if w.count == 0 || val < w.min {
+		w.min = val
+	}
+	if w.count == 0 || val > w.max {
+		w.max = val
+	}
+	w.sum += val
+	w.count++
+}
+
+// merge returns the spread of the values of both windows.
+func (w window) merge(o window) window {
+	switch {
+	case o.count == 0:
+		return w
+	case w.count == 0:
+		return o
+	}
+	w.min = math.Min(w.min, o.min)
+	w.max = math.Max(w.max, o.max)
+	w.sum += o.sum
+	w.count += o.count
+	return w
+}
+
+// instantaneous reports whether an OBIS code denotes an instantaneous value, i.e. value group D is 7.
+func instantaneous(code string) bool {
+	_, rest, ok := strings.Cut(code, ":")
+	groups := strings.Split(rest, ".")
+	return ok && len(groups) == 4 && groups[1] == "7"
+}
+
+// meterCollector exports the most recently received register values.
+// Every series is labeled with the meter serial number once it is known.
+//
+// For instantaneous values, the minimum, maximum and mean value seen since the
+// previous scrape is exported as well, so that short spikes are not lost.
+// Only scrapes of the metrics endpoint start a new window, so that other consumers
+// gathering metrics, such as the Pushgateway pusher, do not take the spikes away.
+//
+// With an expiry period, the series of a meter that stops sending frames are removed after that
+// period, rather than exporting frozen values, and come back with the next frame. The series of
+// other collectors labeled with the meter ID are removed along with them by meterSeries.
+type meterCollector struct {
+	mu          sync.Mutex
+	now         func() time.Time
+	expiry      time.Duration
+	stale       bool
+	meterID     string
+	meterType   string
+	listVersion string
+	phases      string
+	filter      RegisterFilter
+	loc         *time.Location
+	energyTime  time.Time
+	timestamps  bool
+	counters    bool
+	sent        map[string]bool
+	lastFrame   time.Time
+	values      map[string]float64
+	units       map[string]string
+	mismatches  map[string]bool
+	windows     map[string]*window
+	scraped     map[string]window
+	scrapes     int
+	descs       map[string]*prometheus.Desc
+	minDescs    map[string]*prometheus.Desc
+	maxDescs    map[string]*prometheus.Desc
+	avgDescs    map[string]*prometheus.Desc
+
+	registerDesc         *prometheus.Desc
+	registerInfoDesc     *prometheus.Desc
+	meterInfoDesc        *prometheus.Desc
+	phaseConfigDesc      *prometheus.Desc
+	netPowerDesc         *prometheus.Desc
+	voltageImbalanceDesc *prometheus.Desc
+	currentImbalanceDesc *prometheus.Desc
+	phasePowerDescs      []*prometheus.Desc
+	energyTimeDesc       *prometheus.Desc
+	expired              prometheus.Counter
+}
+
+func newMeterCollector(namespace string) *meterCollector {
+	c := &meterCollector{
+		now:        time.Now,
+		loc:        time.Local,
+		sent:       make(map[string]bool),
+		values:     make(map[string]float64),
+		units:      make(map[string]string),
+		mismatches: make(map[string]bool),
+		windows:    make(map[string]*window),
+		descs:      make(map[string]*prometheus.Desc),
+		minDescs:   make(map[string]*prometheus.Desc),
+		maxDescs:   make(map[string]*prometheus.Desc),
+		avgDescs:   make(map[string]*prometheus.Desc),
+
+		registerDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "register_value"),
+			"Value of a register without a dedicated metric",
+			[]string{"meter_id", "obis"},
+			nil,
+		),
+		registerInfoDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "register_info"),
+			"Unit of each register as reported by the meter",
+			[]string{"meter_id", "obis", "unit"},
+			nil,
+		),
+		meterInfoDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "meter_info"),
+			"Meter type and the list version identifier of the data format it sends",
+			[]string{"meter_id", "meter_type", "list_version"},
+			nil,
+		),
+		phaseConfigDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "phase_config_info"),
+			"Phase configuration detected from the registers sent by the meter",
+			[]string{"meter_id", "phases"},
+			nil,
+		),
+		netPowerDesc:         newDesc(namespace, "net_active_power_watts", "Imported minus exported active power, negative while exporting"),
+		voltageImbalanceDesc: newDesc(namespace, "voltage_imbalance_percent", "Largest deviation of a phase voltage from the mean, in percent of the mean"),
+		currentImbalanceDesc: newDesc(namespace, "current_imbalance_percent", "Largest deviation of a phase current from the mean, in percent of the mean"),
+		phasePowerDescs: []*prometheus.Desc{
+			newDesc(namespace, "l1_power_estimate_watts", "Estimated L1 active power, from voltage, current and power factor"),
+			newDesc(namespace, "l2_power_estimate_watts", "Estimated L2 active power, from voltage, current and power factor"),
+			newDesc(namespace, "l3_power_estimate_watts", "Estimated L3 active power, from voltage, current and power factor"),
+		},
+		energyTimeDesc: newDesc(namespace, "energy_reading_timestamp_seconds", "Hour boundary the energy readings apply to, according to the meter clock, in seconds since the epoch"),
+		expired:        counter(namespace, "meters_expired_total", "Total number of times the series of a meter were removed because it stopped sending frames"),
+	}
+	for _, reg := range obis.Registers() {
+		if reg.Type == obis.Info {
+			continue
+		}
+		c.descs[reg.Code] = newDesc(namespace, reg.Name, reg.Description)
+		if !instantaneous(reg.Code) {
+			continue
+		}
+		c.windows[reg.Code] = &window{}
+		c.minDescs[reg.Code] = newDesc(namespace, reg.Name+"_min", reg.Description+", minimum since last scrape")
+		c.maxDescs[reg.Code] = newDesc(namespace, reg.Name+"_max", reg.Description+", maximum since last scrape")
+		c.avgDescs[reg.Code] = newDesc(namespace, reg.Name+"_avg", reg.Description+", mean since last scrape")
+	}
+	return c
+}
+
+// cumulative reports whether a register holds an accumulated value, such as energy.
+func cumulative(code string) bool {
+	reg, _ := obis.Lookup(code)
+	return reg.Type == obis.Counter
+}
+
+func newDesc(namespace, name, help string) *prometheus.Desc {
+	return prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", name),
+		help,
+		[]string{"meter_id"},
+		nil,
+	)
+}
+
+// Update stores the values of all numeric registers in a decoded packet.
+func (c *meterCollector) Update(packet *protocol.Packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastFrame = packet.Time
+	c.stale = false
+	if id, ok := packet.Registers[obis.MeterID].Value.(string); ok {
+		c.meterID = id
+	}
+	if typ, ok := packet.Registers[obis.MeterType].Value.(string); ok {
+		c.meterType = typ
+	}
+	if version, ok := packet.Registers[obis.ListVersion].Value.(string); ok && version != c.listVersion {
+		// Logged when first seen, as the format may differ between firmware versions.
+		log.Infof("Meter sends list version %s", version)
+		c.listVersion = version
+	}
+
+	// Detected before filtering, as it depends on what the meter sends rather than on what is exported.
+	for k := range packet.Registers {
+		c.sent[k] = true
+	}
+	if phases := phaseConfig(c.sent); phases != c.phases {
+		log.Infof("Detected phase configuration %s", phases)
+		c.phases = phases
+	}
+
+	// Cumulative registers are only sent in the hourly message, and hold the readings at the hour boundary.
+	hourly := messageType(packet) == "list3"
+	if hourly {
+		c.energyTime = hourBoundary(packet, c.loc)
+	}
+
+	for k, reg := range packet.Registers {
+		if !c.filter.allows(k) {
+			continue
+		}
+		if cumulative(k) && !hourly {
+			continue
+		}
+		val, err := reg.Float()
+		if err != nil {
+			continue
+		}
+		c.values[k] = val
+		c.units[k] = reg.Unit
+		c.checkUnit(k, reg.Unit)
+		if w, ok := c.windows[k]; ok {
+			w.add(val)
+		}
+	}
+}
+
+// checkUnit warns once per register if the meter reports a different unit than the one the metric is exported as.
+func (c *meterCollector) checkUnit(code, unit string) {
+	reg, ok := obis.Lookup(code)
+	if !ok || len(unit) == 0 || unit == reg.Unit || c.mismatches[code] {
+		return
+	}
+	c.mismatches[code] = true
+	log.Warnf("Register %s is exported as %s in %s, but the meter reports unit %s; the OBIS mapping may be wrong", code, reg.Name, reg.Unit, unit)
+}
+
+func (c *meterCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, descs := range []map[string]*prometheus.Desc{c.descs, c.minDescs, c.maxDescs, c.avgDescs} {
+		for _, desc := range descs {
+			ch <- desc
+		}
+	}
+	ch <- c.registerDesc
+	ch <- c.registerInfoDesc
+	ch <- c.meterInfoDesc
+	ch <- c.phaseConfigDesc
+	ch <- c.netPowerDesc
+	ch <- c.voltageImbalanceDesc
+	ch <- c.currentImbalanceDesc
+	for _, desc := range c.phasePowerDescs {
+		ch <- desc
+	}
+	ch <- c.energyTimeDesc
+	ch <- c.expired.Desc()
+}
+
+// expire forgets the meter once it has sent no frames for the expiry period, so that its series disappear.
+// Units already warned about stay known, as the next meter is most likely of the same kind.
+func (c *meterCollector) expire() {
+	if c.expiry <= 0 || c.stale || c.lastFrame.IsZero() || c.now().Sub(c.lastFrame) < c.expiry {
+		return
+	}
+	log.Warnf("Meter %s has sent no frames since %s; removing its series", c.meterID, c.lastFrame.Format(time.RFC3339))
+	c.expired.Inc()
+	c.stale = true
+	c.meterID = ""
+	c.meterType = ""
+	c.listVersion = ""
+	c.phases = ""
+	c.energyTime = time.Time{}
+	c.sent = make(map[string]bool)
+	c.values = make(map[string]float64)
+	c.units = make(map[string]string)
+	for _, w := range c.windows {
+		*w = window{}
+	}
+}
+
+// setFilter changes the registers exported, and forgets the values of registers no longer exported.
+func (c *meterCollector) setFilter(filter RegisterFilter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.filter = filter
+	for code := range c.values {
+		if !filter.allows(code) {
+			delete(c.values, code)
+			delete(c.units, code)
+		}
+	}
+	for code, w := range c.windows {
+		if !filter.allows(code) {
+			*w = window{}
+		}
+	}
+}
+
+// Expired reports whether the meter has sent no frames for the expiry period.
+func (c *meterCollector) Expired() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expire()
+	return c.stale
+}
+
+// meterSeries collects series labeled with the meter ID from other collectors, unless the meter has
+// expired, so that all of them disappear along with the series of the meter collector.
+type meterSeries struct {
+	meter      *meterCollector
+	collectors []prometheus.Collector
+}
+
+func (m *meterSeries) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors {
+		c.Describe(ch)
+	}
+}
+
+func (m *meterSeries) Collect(ch chan<- prometheus.Metric) {
+	if m.meter.Expired() {
+		return
+	}
+	for _, c := range m.collectors {
+		c.Collect(ch)
+	}
+}
+
+func (c *meterCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expire()
+	ch <- c.expired
+
+	for code, val := range c.values {
+		desc, ok := c.descs[code]
+		if !ok {
+			ch <- prometheus.MustNewConstMetric(c.registerDesc, prometheus.GaugeValue, val, c.meterID, code)
+			continue
+		}
+		typ := prometheus.GaugeValue
+		if c.counters && cumulative(code) {
+			typ = prometheus.CounterValue
+		}
+		metric := prometheus.MustNewConstMetric(desc, typ, val, c.meterID)
+		if cumulative(code) && c.timestamps {
+			metric = prometheus.NewMetricWithTimestamp(c.energyTime, metric)
+		}
+		ch <- metric
+
+		current, ok := c.windows[code]
+		if !ok {
+			continue
+		}
+		w := c.scraped[code].merge(*current)
+		// Without new samples since the previous scrape, the spread is the current value.
+		if w.count == 0 {
+			w.add(val)
+		}
+		ch <- prometheus.MustNewConstMetric(c.minDescs[code], prometheus.GaugeValue, w.min, c.meterID)
+		ch <- prometheus.MustNewConstMetric(c.maxDescs[code], prometheus.GaugeValue, w.max, c.meterID)
+		ch <- prometheus.MustNewConstMetric(c.avgDescs[code], prometheus.GaugeValue, w.sum/float64(w.count), c.meterID)
+	}
+
+	if len(c.listVersion) > 0 {
+		ch <- prometheus.MustNewConstMetric(c.meterInfoDesc, prometheus.GaugeValue, 1, c.meterID, c.meterType, c.listVersion)
+	}
+
+	if len(c.phases) > 0 {
+		ch <- prometheus.MustNewConstMetric(c.phaseConfigDesc, prometheus.GaugeValue, 1, c.meterID, c.phases)
+	}
+
+	for code, unit := range c.units {
+		if len(unit) > 0 {
+			ch <- prometheus.MustNewConstMetric(c.registerInfoDesc, prometheus.GaugeValue, 1, c.meterID, code, unit)
+		}
+	}
+
+	if !c.energyTime.IsZero() {
+		ch <- prometheus.MustNewConstMetric(c.energyTimeDesc, prometheus.GaugeValue, float64(c.energyTime.Unix()), c.meterID)
+	}
+	if val, ok := netPower(c.values); ok {
+		ch <- prometheus.MustNewConstMetric(c.netPowerDesc, prometheus.GaugeValue, val, c.meterID)
+	}
+	if val, ok := imbalance(phaseValues(c.values, voltageCodes)); ok {
+		ch <- prometheus.MustNewConstMetric(c.voltageImbalanceDesc, prometheus.GaugeValue, val, c.meterID)
+	}
+	if val, ok := imbalance(phaseValues(c.values, currentCodes)); ok {
+		ch <- prometheus.MustNewConstMetric(c.currentImbalanceDesc, prometheus.GaugeValue, val, c.meterID)
+	}
+	if power, ok := phasePower(c.values); ok {
+		for i, val := range power {
+			if !math.IsNaN(val) {
+				ch <- prometheus.MustNewConstMetric(c.phasePowerDescs[i], prometheus.GaugeValue, val, c.meterID)
+			}
+		}
+	}
+}
+
+// beginScrape starts a new window for every instantaneous value. The spread so far is held until
+// endScrape, so that the scrape reports it while values arriving meanwhile count towards the next one.
+func (c *meterCollector) beginScrape() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.scrapes == 0 {
+		c.scraped = make(map[string]window)
+	}
+	c.scrapes++
+	for code, w := range c.windows {
+		c.scraped[code] = c.scraped[code].merge(*w)
+		*w = window{}
+	}
+}
+
+func (c *meterCollector) endScrape() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.scrapes--
+	if c.scrapes == 0 {
+		c.scraped = nil
+	}
+}
+
+// scrapeHandler serves the metrics endpoint, starting new minimum, maximum and mean windows with every scrape.
+func scrapeHandler(meter *meterCollector, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		meter.beginScrape()
+		defer meter.endScrape()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Reading is the current value of a single register.
+type Reading struct {
+	OBIS  string  `json:"obis"`
+	Name  string  `json:"name"`
+	Help  string  `json:"help"`
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit"`
+}
+
+// Status is a point-in-time view of the meter state.
+type Status struct {
+	MeterID     string    `json:"meter_id"`
+	MeterType   string    `json:"meter_type"`
+	ListVersion string    `json:"list_version"`
+	Phases      string    `json:"phases,omitempty"`
+	LastFrame   time.Time `json:"last_frame"`
+	Readings    []Reading `json:"readings"`
+}
+
+// Status returns the current meter state, with readings sorted by OBIS code.
+func (c *meterCollector) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expire()
+
+	status := Status{
+		MeterID:     c.meterID,
+		MeterType:   c.meterType,
+		ListVersion: c.listVersion,
+		Phases:      c.phases,
+		LastFrame:   c.lastFrame,
+		Readings:    make([]Reading, 0, len(c.values)),
+	}
+	for code, val := range c.values {
+		reg, _ := obis.Lookup(code)
+		unit := reg.Unit
+		if len(unit) == 0 {
+			unit = c.units[code]
+		}
+		status.Readings = append(status.Readings, Reading{
+			OBIS:  code,
+			Name:  reg.Name,
+			Help:  reg.Description,
+			Value: val,
+			Unit:  unit,
+		})
+	}
+	sort.Slice(status.Readings, func(i, j int) bool {
+		return status.Readings[i].OBIS < status.Readings[j].OBIS
+	})
+
+	return status
+}
@@ -0,0 +1,653 @@
+package exporter
+
+import (
+	`encoding/hex`
+	`fmt`
+	`net`
+	`net/url`
+	`os`
+	`sort`
+	`strings`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+	`github.com/prometheus/client_golang/prometheus`
+	`github.com/prometheus/common/model`
+	log "github.com/sirupsen/logrus"
+	`gopkg.in/yaml.v3`
+)
+
+// Config holds all exporter settings.
+// Apart from the Prometheus registry, all settings can be read from a YAML configuration file.
+type Config struct {
+	// Serial port parameters.
+	Serial SerialConfig `yaml:"serial"`
+
+	// Addresses of the HTTP server, such as an IPv4 and an IPv6 address. Empty addresses are ignored,
+	// and if there are none, no HTTP server is started.
+	Listen Addresses `yaml:"listen"`
+
+	// Optional address of a gRPC server streaming decoded packets.
+	GRPCListen string `yaml:"grpc_listen"`
+
+	// Optional address of a Modbus TCP server exposing the current readings.
+	ModbusListen string `yaml:"modbus_listen"`
+
+	// Optional UDP address of an SNMP agent exposing the current readings.
+	SNMPListen string `yaml:"snmp_listen"`
+
+	// Community accepted by the SNMP agent. Defaults to public.
+	SNMPCommunity string `yaml:"snmp_community"`
+
+	// Optional address of a server relaying every frame with a correct checksum to downstream
+	// exporters, which read it by setting their serial address to tcp://host:port.
+	RelayListen string `yaml:"relay_listen"`
+
+	// Recovery from serial adapters that stop delivering data.
+	Watchdog WatchdogConfig `yaml:"watchdog"`
+
+	// Accept frames from remote readers at /api/v1/frames, which is served on the admin listener if one is
+	// configured. Otherwise, frames_token is required, as anyone able to scrape metrics could inject readings.
+	AcceptFrames bool `yaml:"accept_frames"`
+
+	// Bearer token required in the Authorization header of requests posting frames.
+	FramesToken string `yaml:"frames_token"`
+
+	// Path serving Prometheus metrics.
+	MetricsPath string `yaml:"metrics_path"`
+
+	// Optional separate address serving health and debug endpoints.
+	AdminListen string `yaml:"admin_listen"`
+
+	// Drop frames containing registers that cannot be parsed, instead of skipping those registers.
+	Strict bool `yaml:"strict"`
+
+	// Registry to register metrics with. Defaults to the Prometheus default registry.
+	Registerer prometheus.Registerer `yaml:"-"`
+
+	// Gatherer used to serve and push metrics. Defaults to the Prometheus default registry.
+	Gatherer prometheus.Gatherer `yaml:"-"`
+
+	// Prefix of all metric names, separated from the rest of the name by an underscore. Defaults to ams.
+	Namespace string `yaml:"namespace"`
+
+	// Constant labels attached to every exported metric.
+	Labels map[string]string `yaml:"labels"`
+
+	// Registers exported as metrics.
+	Registers RegisterFilter `yaml:"registers"`
+
+	// Values of registers considered plausible. Others are dropped before being processed.
+	Plausibility []PlausibilityConfig `yaml:"plausibility"`
+
+	// Limits protecting the parser against malformed frames, and where in a frame to find the readings.
+	Parser ParserConfig `yaml:"parser"`
+
+	// Keys of meters ciphering their frames.
+	Security *SecurityConfig `yaml:"security"`
+
+	// Number of decoded packets queued for processing. The oldest packet is dropped when the queue is full.
+	PacketBuffer int `yaml:"packet_buffer"`
+
+	// How long decoded packets are kept in memory for the history API.
+	HistoryRetention time.Duration `yaml:"history_retention"`
+
+	// Time zone deciding where hours, days and months begin, such as Europe/Oslo. Defaults to the local time zone.
+	Timezone string `yaml:"timezone"`
+
+	// Optional energy cost metrics.
+	Cost *CostConfig `yaml:"cost"`
+
+	// Optional capacity tariff tracking.
+	Capacity *CapacityConfig `yaml:"capacity"`
+
+	// Time-of-use tariffs that imported energy is split between. Each hour goes to the first tariff applying to it.
+	Tariffs []TariffConfig `yaml:"tariffs"`
+
+	// Optional counting of voltage sags and swells.
+	VoltageQuality *VoltageQualityConfig `yaml:"voltage_quality"`
+
+	// Optional main fuse size, exporting the load and headroom of each phase.
+	Fuse *FuseConfig `yaml:"fuse"`
+
+	// Export energy registers with the timestamp of the hour boundary they apply to, rather than the scrape time.
+	EnergyTimestamps bool `yaml:"energy_timestamps"`
+
+	// Export energy registers as counters rather than gauges. Off by default, as changing the type of
+	// existing series breaks recording rules and dashboards relying on it.
+	EnergyCounters bool `yaml:"energy_counters"`
+
+	// Remove the series of a meter that has sent no frames for this long, so that a decommissioned or
+	// disconnected meter does not keep exporting its last values. Zero keeps them.
+	MeterExpiry time.Duration `yaml:"meter_expiry"`
+
+	// Optional file keeping monthly peaks, cost and energy accumulators across restarts.
+	StateFile string `yaml:"state_file"`
+
+	// Optional Pushgateway to push metrics to.
+	Pushgateway *PushgatewayConfig `yaml:"pushgateway"`
+
+	// Optional MQTT broker receiving readings and alert notifications.
+	MQTT *MQTTConfig `yaml:"mqtt"`
+
+	// Optional AMQP broker, such as RabbitMQ, receiving readings.
+	AMQP *AMQPConfig `yaml:"amqp"`
+
+	// Optional Redis server receiving readings.
+	Redis *RedisConfig `yaml:"redis"`
+
+	// Optional Zabbix server or proxy receiving readings.
+	Zabbix *ZabbixConfig `yaml:"zabbix"`
+
+	// Optional Elasticsearch server or Logstash input receiving readings.
+	Elasticsearch *ElasticConfig `yaml:"elasticsearch"`
+
+	// Output sinks of types registered with the output package.
+	Sinks []SinkConfig `yaml:"sinks"`
+
+	// Optional command run with the readings of decoded packets.
+	Exec *ExecConfig `yaml:"exec"`
+
+	// Optional dead man's switch pinged while frames are being decoded.
+	Heartbeat *HeartbeatConfig `yaml:"heartbeat"`
+
+	// Thresholds triggering notifications.
+	Alerts []AlertConfig `yaml:"alerts"`
+
+	// Optional file receiving every decoded packet.
+	PacketLog *PacketLogConfig `yaml:"packet_log"`
+
+	// Log level, one of debug, info, warning or error. Applied by the caller; empty keeps the current level.
+	LogLevel string `yaml:"log_level"`
+
+	// Repeated serial and parse errors are logged at most once per interval. Zero logs every occurrence.
+	LogRateLimit time.Duration `yaml:"log_rate_limit"`
+
+	// Optional syslog daemon receiving log messages in addition to standard error. Applied by the caller.
+	Syslog *SyslogConfig `yaml:"syslog"`
+
+	// Optional file receiving log messages instead of standard error. Applied by the caller.
+	LogFile *LogFileConfig `yaml:"log_file"`
+
+	// Optional active/standby coordination with another instance reading the same frames.
+	HA *HAConfig `yaml:"ha"`
+
+	// User and group to switch to once the serial port is open and listeners are bound, so that the
+	// exporter need not keep running as root. The group defaults to the primary group of the user.
+	User  string `yaml:"user"`
+	Group string `yaml:"group"`
+
+	// Directory to change the root directory to before switching user. Requires user.
+	Chroot string `yaml:"chroot"`
+
+	// Optional file receiving the process ID, written before switching user.
+	PIDFile string `yaml:"pid_file"`
+
+	// Updated configurations to apply while running. Only alerts, output settings and registers are reloaded.
+	Reload <-chan Config `yaml:"-"`
+
+	// Requests reading the configuration file again, as on SIGHUP. If set, POST requests to /-/reload
+	// on the admin endpoint call it.
+	RequestReload func() `yaml:"-"`
+}
+
+// Addresses is a list of listen addresses. In configuration files, it is either a list or a single address.
+type Addresses []string
+
+func (a *Addresses) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		var address string
+		if err := value.Decode(&address); err != nil {
+			return err
+		}
+		*a = nil
+		if len(address) > 0 {
+			*a = Addresses{address}
+		}
+		return nil
+	}
+	var addresses []string
+	if err := value.Decode(&addresses); err != nil {
+		return err
+	}
+	*a = addresses
+	return nil
+}
+
+// SerialConfig holds serial port parameters.
+type SerialConfig struct {
+	Address  string `yaml:"address"`
+	BaudRate int    `yaml:"baud_rate"`
+	DataBits int    `yaml:"data_bits"`
+	StopBits int    `yaml:"stop_bits"`
+	Parity   string `yaml:"parity"`
+
+	// Detect baud rate and parity by trying common settings until a valid frame is received.
+	Probe bool `yaml:"probe"`
+}
+
+// ParserConfig holds parser limits and the payload offset. Zero values select the parser defaults.
+type ParserConfig struct {
+	MaxStringLength int `yaml:"max_string_length"`
+	MaxArrayLength  int `yaml:"max_array_length"`
+	MaxDepth        int `yaml:"max_depth"`
+
+	// Offset of the COSEM data structure within each frame. Zero finds it by looking for
+	// the data-notification, which works for most meters.
+	PayloadOffset int `yaml:"payload_offset"`
+}
+
+func (cfg ParserConfig) validate() error {
+	if cfg.MaxStringLength < 0 || cfg.MaxArrayLength < 0 || cfg.MaxDepth < 0 {
+		return fmt.Errorf("max_string_length, max_array_length and max_depth must not be negative")
+	}
+	if cfg.PayloadOffset < 0 {
+		return fmt.Errorf("payload_offset must not be negative")
+	}
+	return nil
+}
+
+// SecurityConfig holds the keys of meters ciphering their frames with DLMS general-glo-ciphering,
+// as hexadecimal strings. They are given by the grid company.
+type SecurityConfig struct {
+	// DLMS security suite, 0 or 1 for 128 bit keys, and 2 for 256 bit keys.
+	Suite int `yaml:"suite"`
+
+	// Global unicast encryption key, needed for encrypted frames.
+	EncryptionKey string `yaml:"encryption_key"`
+
+	// Authentication key. If given, the authentication tags of authenticated frames are validated.
+	// Requires the encryption key, which is the block cipher key for authentication as well.
+	AuthenticationKey string `yaml:"authentication_key"`
+
+	// Reject frames that are not authenticated.
+	RequireAuthentication bool `yaml:"require_authentication"`
+}
+
+// security returns the keys for the parser.
+func (cfg SecurityConfig) security() (*protocol.Security, error) {
+	ek, err := hex.DecodeString(cfg.EncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("encryption_key: %w", err)
+	}
+	ak, err := hex.DecodeString(cfg.AuthenticationKey)
+	if err != nil {
+		return nil, fmt.Errorf("authentication_key: %w", err)
+	}
+	security := &protocol.Security{
+		Suite:                 cfg.Suite,
+		EncryptionKey:         ek,
+		AuthenticationKey:     ak,
+		RequireAuthentication: cfg.RequireAuthentication,
+	}
+	return security, security.Validate()
+}
+
+// DefaultConfig returns the settings used for anything not given in a configuration file.
+func DefaultConfig() Config {
+	return Config{
+		Serial: SerialConfig{
+			Address:  "/dev/ttyUSB0",
+			BaudRate: 2400,
+			DataBits: 8,
+			StopBits: 1,
+			Parity:   "E",
+		},
+		Listen:      Addresses{"0.0.0.0:8080"},
+		MetricsPath: "/metrics",
+		Watchdog: WatchdogConfig{
+			Timeout: time.Minute,
+		},
+		PacketBuffer:     32,
+		HistoryRetention: 10 * time.Minute,
+		LogRateLimit:     time.Minute,
+	}
+}
+
+// LoadConfig reads a YAML configuration file on top of the default settings.
+// If path is empty, the default settings are returned.
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+	if len(path) == 0 {
+		return cfg, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return cfg, err
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	err = dec.Decode(&cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// Validate checks the settings for errors, and fills in defaults for optional sections.
+func (cfg *Config) Validate() error {
+	if len(cfg.Serial.Address) == 0 && !cfg.AcceptFrames {
+		return fmt.Errorf("serial: address is required unless accepting frames over HTTP")
+	}
+	if cfg.AcceptFrames && len(cfg.AdminListen) == 0 && len(cfg.FramesToken) == 0 {
+		return fmt.Errorf("accept_frames: frames_token is required unless admin_listen is set")
+	}
+	if len(cfg.Serial.Address) > 0 {
+		if err := cfg.Serial.validate(); err != nil {
+			return fmt.Errorf("serial: %w", err)
+		}
+	}
+	for i, address := range cfg.Listen {
+		if err := validateListen(address); err != nil {
+			return fmt.Errorf("listen: %w", err)
+		}
+		for _, other := range cfg.Listen[:i] {
+			if len(address) > 0 && (address == other || listenOverlaps(address, other)) {
+				return fmt.Errorf("listen: %q overlaps with %q", address, other)
+			}
+		}
+	}
+	for _, listener := range []struct {
+		key     string
+		address string
+	}{
+		{"admin_listen", cfg.AdminListen},
+		{"grpc_listen", cfg.GRPCListen},
+		{"modbus_listen", cfg.ModbusListen},
+		{"relay_listen", cfg.RelayListen},
+	} {
+		if err := validateListen(listener.address); err != nil {
+			return fmt.Errorf("%s: %w", listener.key, err)
+		}
+	}
+	if len(cfg.SNMPListen) > 0 {
+		if _, _, err := net.SplitHostPort(cfg.SNMPListen); err != nil {
+			return fmt.Errorf("snmp_listen: %w", err)
+		}
+	}
+	if len(cfg.SNMPCommunity) == 0 {
+		cfg.SNMPCommunity = "public"
+	}
+	if len(cfg.Namespace) == 0 {
+		cfg.Namespace = DefaultNamespace
+	}
+	if !model.IsValidMetricName(model.LabelValue(cfg.Namespace)) {
+		return fmt.Errorf("invalid namespace %q", cfg.Namespace)
+	}
+	for k := range cfg.Labels {
+		if !model.LabelName(k).IsValid() {
+			return fmt.Errorf("invalid label name %q", k)
+		}
+	}
+	if err := cfg.Registers.validate(); err != nil {
+		return fmt.Errorf("registers: %w", err)
+	}
+	for _, rule := range cfg.Plausibility {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("plausibility: %w", err)
+		}
+	}
+	if len(cfg.LogLevel) > 0 {
+		if _, err := log.ParseLevel(cfg.LogLevel); err != nil {
+			return fmt.Errorf("log_level: %w", err)
+		}
+	}
+	if cfg.LogFile != nil {
+		if err := cfg.LogFile.validate(); err != nil {
+			return fmt.Errorf("log_file: %w", err)
+		}
+	}
+	if cfg.Syslog != nil {
+		if err := cfg.Syslog.validate(); err != nil {
+			return fmt.Errorf("syslog: %w", err)
+		}
+	}
+	if !strings.HasPrefix(cfg.MetricsPath, "/") || cfg.MetricsPath == "/" {
+		return fmt.Errorf("metrics_path must be a path below /")
+	}
+	if _, err := cfg.location(); err != nil {
+		return fmt.Errorf("timezone: %w", err)
+	}
+	if cfg.Cost != nil {
+		if err := cfg.Cost.validate(); err != nil {
+			return fmt.Errorf("cost: %w", err)
+		}
+	}
+	if cfg.Capacity != nil && !sort.Float64sAreSorted(cfg.Capacity.Steps) {
+		return fmt.Errorf("capacity: steps must be in increasing order")
+	}
+	tariffs := make(map[string]bool)
+	for _, tariff := range cfg.Tariffs {
+		if err := tariff.validate(); err != nil {
+			return fmt.Errorf("tariffs: %w", err)
+		}
+		if tariffs[tariff.Name] {
+			return fmt.Errorf("tariffs: %s is given more than once", tariff.Name)
+		}
+		tariffs[tariff.Name] = true
+	}
+	if cfg.VoltageQuality != nil {
+		if err := cfg.VoltageQuality.validate(); err != nil {
+			return fmt.Errorf("voltage_quality: %w", err)
+		}
+	}
+	if cfg.Fuse != nil {
+		if err := cfg.Fuse.validate(); err != nil {
+			return fmt.Errorf("fuse: %w", err)
+		}
+	}
+	if cfg.Security != nil {
+		if _, err := cfg.Security.security(); err != nil {
+			return fmt.Errorf("security: %w", err)
+		}
+	}
+	if err := cfg.Parser.validate(); err != nil {
+		return fmt.Errorf("parser: %w", err)
+	}
+	if cfg.HA != nil {
+		if err := cfg.HA.validate(); err != nil {
+			return fmt.Errorf("ha: %w", err)
+		}
+	}
+	if len(cfg.Chroot) > 0 && len(cfg.User) == 0 {
+		return fmt.Errorf("chroot requires user, as root can leave the new root directory")
+	}
+	if cfg.MeterExpiry < 0 {
+		return fmt.Errorf("meter_expiry must not be negative")
+	}
+	if cfg.LogRateLimit < 0 {
+		return fmt.Errorf("log_rate_limit must not be negative")
+	}
+	if cfg.Watchdog.Timeout < 0 || cfg.Watchdog.MaxReopens < 0 {
+		return fmt.Errorf("watchdog: timeout and max_reopens must not be negative")
+	}
+	if cfg.PacketBuffer <= 0 {
+		return fmt.Errorf("packet_buffer must be positive")
+	}
+	if cfg.HistoryRetention <= 0 {
+		return fmt.Errorf("history_retention must be positive")
+	}
+	if cfg.Pushgateway != nil {
+		// The Pushgateway rejects pushes of samples with timestamps.
+		if cfg.EnergyTimestamps {
+			return fmt.Errorf("pushgateway: cannot be used with energy_timestamps")
+		}
+		if len(cfg.Pushgateway.URL) == 0 {
+			return fmt.Errorf("pushgateway: url is required")
+		}
+		if err := validateURL(cfg.Pushgateway.URL, "http", "https"); err != nil {
+			return fmt.Errorf("pushgateway: %w", err)
+		}
+		if len(cfg.Pushgateway.Job) == 0 {
+			cfg.Pushgateway.Job = "ams"
+		}
+		if cfg.Pushgateway.Interval <= 0 {
+			cfg.Pushgateway.Interval = 30 * time.Second
+		}
+	}
+	if cfg.PacketLog != nil && len(cfg.PacketLog.Path) == 0 {
+		return fmt.Errorf("packet_log: path is required")
+	}
+	if cfg.MQTT != nil {
+		if err := cfg.MQTT.validate(); err != nil {
+			return fmt.Errorf("mqtt: %w", err)
+		}
+	}
+	if cfg.AMQP != nil {
+		if err := cfg.AMQP.validate(); err != nil {
+			return fmt.Errorf("amqp: %w", err)
+		}
+	}
+	if cfg.Redis != nil {
+		if err := cfg.Redis.validate(); err != nil {
+			return fmt.Errorf("redis: %w", err)
+		}
+	}
+	if cfg.Zabbix != nil {
+		if err := cfg.Zabbix.validate(); err != nil {
+			return fmt.Errorf("zabbix: %w", err)
+		}
+	}
+	if cfg.Elasticsearch != nil {
+		if err := cfg.Elasticsearch.validate(); err != nil {
+			return fmt.Errorf("elasticsearch: %w", err)
+		}
+	}
+	if cfg.Exec != nil {
+		if err := cfg.Exec.validate(); err != nil {
+			return fmt.Errorf("exec: %w", err)
+		}
+	}
+	if cfg.Heartbeat != nil {
+		if err := cfg.Heartbeat.validate(); err != nil {
+			return fmt.Errorf("heartbeat: %w", err)
+		}
+	}
+	sections, err := cfg.sectionSinks()
+	if err != nil {
+		return err
+	}
+	if err := validateSinks(cfg.Sinks, sections); err != nil {
+		return fmt.Errorf("sinks: %w", err)
+	}
+	for i, alert := range cfg.Alerts {
+		if err := alert.validate(); err != nil {
+			return fmt.Errorf("alert %d: %w", i+1, err)
+		}
+		if len(alert.MQTTTopic) > 0 && cfg.MQTT == nil {
+			return fmt.Errorf("alert %d: mqtt_topic requires mqtt configuration", i+1)
+		}
+	}
+	return nil
+}
+
+// Redacted returns a copy of the configuration with passwords hidden, for printing.
+func (cfg Config) Redacted() Config {
+	if len(cfg.Sinks) > 0 {
+		sinks := make([]SinkConfig, len(cfg.Sinks))
+		for i, sink := range cfg.Sinks {
+			sink.Settings = redactNode(sink.Settings)
+			sinks[i] = sink
+		}
+		cfg.Sinks = sinks
+	}
+	if cfg.MQTT != nil && len(cfg.MQTT.Password) > 0 {
+		mqttCfg := *cfg.MQTT
+		mqttCfg.Password = "<redacted>"
+		cfg.MQTT = &mqttCfg
+	}
+	if cfg.Security != nil {
+		securityCfg := *cfg.Security
+		if len(securityCfg.EncryptionKey) > 0 {
+			securityCfg.EncryptionKey = "<redacted>"
+		}
+		if len(securityCfg.AuthenticationKey) > 0 {
+			securityCfg.AuthenticationKey = "<redacted>"
+		}
+		cfg.Security = &securityCfg
+	}
+	if len(cfg.SNMPCommunity) > 0 {
+		cfg.SNMPCommunity = "<redacted>"
+	}
+	if len(cfg.FramesToken) > 0 {
+		cfg.FramesToken = "<redacted>"
+	}
+	if cfg.Redis != nil && len(cfg.Redis.Password) > 0 {
+		redisCfg := *cfg.Redis
+		redisCfg.Password = "<redacted>"
+		cfg.Redis = &redisCfg
+	}
+	if cfg.Elasticsearch != nil && len(cfg.Elasticsearch.Password) > 0 {
+		elasticCfg := *cfg.Elasticsearch
+		elasticCfg.Password = "<redacted>"
+		cfg.Elasticsearch = &elasticCfg
+	}
+	if cfg.AMQP != nil {
+		if u, err := url.Parse(cfg.AMQP.URL); err == nil {
+			amqpCfg := *cfg.AMQP
+			amqpCfg.URL = u.Redacted()
+			cfg.AMQP = &amqpCfg
+		}
+	}
+	return cfg
+}
+
+// validateListen checks a listen address, which is either empty, host:port or a unix socket path.
+func validateListen(address string) error {
+	if len(address) == 0 || strings.HasPrefix(address, unixAddressPrefix) {
+		return nil
+	}
+	_, _, err := net.SplitHostPort(address)
+	return err
+}
+
+// listenOverlaps reports whether two TCP listen addresses cannot both be bound, because they have the
+// same port and one of them is a wildcard address covering the other. The IPv6 wildcard address covers
+// IPv4 as well, as sockets bound to it accept both on most systems.
+func listenOverlaps(a, b string) bool {
+	hostA, portA, errA := net.SplitHostPort(a)
+	hostB, portB, errB := net.SplitHostPort(b)
+	if errA != nil || errB != nil || portA != portB || portA == "0" {
+		return false
+	}
+	return covers(hostA, hostB) || covers(hostB, hostA)
+}
+
+// covers reports whether binding the wildcard host prevents binding the other host on the same port.
+func covers(wildcard, other string) bool {
+	switch wildcard {
+	case "", "::":
+		return true
+	case "0.0.0.0":
+		ip := net.ParseIP(other)
+		return ip != nil && ip.To4() != nil
+	}
+	return false
+}
+
+// validateURL checks that a URL has a host and one of the given schemes.
+func validateURL(s string, schemes ...string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if !contains(schemes, u.Scheme) {
+		return fmt.Errorf("%s: scheme must be one of %s", s, strings.Join(schemes, ", "))
+	}
+	if len(u.Host) == 0 {
+		return fmt.Errorf("%s: host is required", s)
+	}
+	return nil
+}
+
+// location returns the configured time zone.
+func (cfg *Config) location() (*time.Location, error) {
+	if len(cfg.Timezone) == 0 {
+		return time.Local, nil
+	}
+	return time.LoadLocation(cfg.Timezone)
+}
@@ -0,0 +1,177 @@
+package exporter
+
+import (
+	`bytes`
+	`context`
+	`encoding/json`
+	`errors`
+	`fmt`
+	`os`
+	`path/filepath`
+	`sort`
+	`strings`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+	`github.com/goburrow/serial`
+	log "github.com/sirupsen/logrus"
+)
+
+// A corpus is a directory of captured frames used as regression fixtures. Each entry is a pair of files
+// sharing a name: <name>.hdlc holding the frame without flag bytes, and <name>.json holding the result
+// of decoding it at the time it was captured.
+const (
+	corpusFrameExt  = ".hdlc"
+	corpusResultExt = ".json"
+)
+
+// CorpusEntry is a captured frame together with its decoded contents.
+type CorpusEntry struct {
+	Name  string `json:"-"`
+	Frame []byte `json:"-"`
+
+	// Decoded registers, or the error if the frame could not be decoded.
+	Registers []RegisterRecord `json:"registers,omitempty"`
+	Error     string           `json:"error,omitempty"`
+}
+
+// newCorpusEntry decodes a frame into a corpus entry.
+func newCorpusEntry(parser *protocol.Parser, frame []byte) CorpusEntry {
+	entry := CorpusEntry{Frame: frame}
+	packet, err := parser.DecodeFrame(frame)
+	if err != nil {
+		entry.Error = err.Error()
+		return entry
+	}
+	entry.Registers = NewPacketRecord(packet, false).Registers
+	return entry
+}
+
+// RecordCorpus reads frames from the configured serial port until count frames with a correct checksum
+// have been saved to the corpus in dir, or the context is canceled. It returns the number of frames saved.
+func RecordCorpus(ctx context.Context, cfg Config, dir string, count int) (int, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return 0, err
+	}
+	next, err := nextCorpusIndex(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	if cfg.Serial.Probe {
+		cfg.Serial, err = probeSerial(ctx, cfg.Serial)
+		if err != nil {
+			return 0, err
+		}
+	}
+	port, err := openSerial(cfg.Serial)
+	if err != nil {
+		return 0, fmt.Errorf("open serial port: %w", err)
+	}
+	defer port.Close()
+
+	parser := NewParser(cfg)
+	unf := protocol.NewUnframer(port)
+	saved := 0
+	for saved < count && ctx.Err() == nil {
+		frame, err := unf.ReadFrame()
+		switch {
+		case err == nil:
+		case errors.Is(err, serial.ErrTimeout):
+			continue
+		case errors.Is(err, protocol.ErrResynced), errors.Is(err, protocol.ErrAborted),
+			errors.Is(err, protocol.ErrChecksum), errors.Is(err, protocol.ErrFrameTooLong):
+			log.Debugf("Skipping frame: %s", err)
+			continue
+		default:
+			return saved, fmt.Errorf("read serial port: %w", err)
+		}
+
+		entry := newCorpusEntry(parser, frame.Data)
+		entry.Name = fmt.Sprintf("frame-%04d", next)
+		if err := writeCorpusEntry(dir, entry); err != nil {
+			return saved, err
+		}
+		if len(entry.Error) > 0 {
+			log.Infof("Saved %s, which could not be decoded: %s", entry.Name, entry.Error)
+		} else {
+			log.Infof("Saved %s with %d registers", entry.Name, len(entry.Registers))
+		}
+		next++
+		saved++
+	}
+	return saved, nil
+}
+
+// nextCorpusIndex returns the number following the highest numbered entry in a corpus.
+func nextCorpusIndex(dir string) (int, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "frame-*"+corpusFrameExt))
+	if err != nil {
+		return 0, err
+	}
+	next := 1
+	for _, name := range names {
+		var n int
+		if _, err := fmt.Sscanf(filepath.Base(name), "frame-%d"+corpusFrameExt, &n); err == nil && n >= next {
+			next = n + 1
+		}
+	}
+	return next, nil
+}
+
+func writeCorpusEntry(dir string, entry CorpusEntry) error {
+	result, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, entry.Name)
+	if err := os.WriteFile(path+corpusFrameExt, entry.Frame, 0o644); err != nil {
+		return err
+	}
+	return os.WriteFile(path+corpusResultExt, append(result, '\n'), 0o644)
+}
+
+// ReadCorpus returns the entries of a corpus, sorted by name.
+func ReadCorpus(dir string) ([]CorpusEntry, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+corpusFrameExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	entries := make([]CorpusEntry, 0, len(names))
+	for _, name := range names {
+		path := strings.TrimSuffix(name, corpusFrameExt)
+		var entry CorpusEntry
+		result, err := os.ReadFile(path + corpusResultExt)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(result, &entry); err != nil {
+			return nil, fmt.Errorf("%s: %w", path+corpusResultExt, err)
+		}
+		entry.Frame, err = os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		entry.Name = filepath.Base(path)
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Replay decodes the frame of a corpus entry again, and returns an error describing the difference
+// if the result does not match the one recorded.
+func (entry CorpusEntry) Replay(parser *protocol.Parser) error {
+	got := newCorpusEntry(parser, entry.Frame)
+	want, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	have, err := json.Marshal(got)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(want, have) {
+		return fmt.Errorf("decoded as %s, expected %s", have, want)
+	}
+	return nil
+}
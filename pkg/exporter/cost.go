@@ -0,0 +1,207 @@
+package exporter
+
+import (
+	`context`
+	`fmt`
+	`io`
+	`net/http`
+	`strconv`
+	`strings`
+	`sync`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/obis`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+	`github.com/prometheus/client_golang/prometheus`
+	log "github.com/sirupsen/logrus"
+	`gopkg.in/yaml.v3`
+)
+
+// Power is not integrated across longer gaps between samples, as consumption in between is unknown.
+const maxSampleGap = time.Minute
+
+// CostConfig configures energy cost metrics.
+type CostConfig struct {
+	// Energy price per kWh.
+	Price float64 `yaml:"price"`
+
+	// Optional URL returning the current price per kWh as a plain number, overriding the configured price.
+	PriceURL string `yaml:"price_url"`
+
+	// How often to fetch the price. Defaults to 15 minutes.
+	PriceRefresh time.Duration `yaml:"price_refresh"`
+}
+
+// Default interval between fetches of the energy price.
+const defaultPriceRefresh = 15 * time.Minute
+
+// UnmarshalYAML fills in the defaults of settings left out of the cost section.
+func (c *CostConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain CostConfig
+	cfg := plain{PriceRefresh: defaultPriceRefresh}
+	if err := value.Decode(&cfg); err != nil {
+		return err
+	}
+	*c = CostConfig(cfg)
+	return nil
+}
+
+func (c CostConfig) validate() error {
+	if len(c.PriceURL) > 0 && c.PriceRefresh <= 0 {
+		return fmt.Errorf("price_refresh must be positive")
+	}
+	return nil
+}
+
+// costCollector accumulates the cost of imported energy during the current hour, day and month.
+// Energy is computed by integrating the active power samples sent every few seconds,
+// so the figures are available long before the hourly meter readings arrive.
+type costCollector struct {
+	mu        sync.Mutex
+	loc       *time.Location
+	price     float64
+	meterID   string
+	lastTime  time.Time
+	lastPower float64
+	hour      time.Time
+	day       time.Time
+	month     time.Time
+	hourCost  float64
+	dayCost   float64
+	monthCost float64
+
+	priceDesc     *prometheus.Desc
+	hourCostDesc  *prometheus.Desc
+	dayCostDesc   *prometheus.Desc
+	monthCostDesc *prometheus.Desc
+}
+
+func newCostCollector(namespace string, price float64, loc *time.Location) *costCollector {
+	return &costCollector{
+		loc:           loc,
+		price:         price,
+		priceDesc:     newDesc(namespace, "energy_price", "Current energy price per kWh"),
+		hourCostDesc:  newDesc(namespace, "energy_cost_hour", "Cost of energy imported during the current hour"),
+		dayCostDesc:   newDesc(namespace, "energy_cost_today_total", "Cost of energy imported since midnight"),
+		monthCostDesc: newDesc(namespace, "energy_cost_month_total", "Cost of energy imported since the start of the month"),
+	}
+}
+
+func (c *costCollector) setPrice(price float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.price = price
+}
+
+func (c *costCollector) Update(packet *protocol.Packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if id, ok := packet.Registers[obis.MeterID].Value.(string); ok {
+		c.meterID = id
+	}
+
+	power, ok := importPower(packet)
+	if !ok {
+		return
+	}
+
+	t := packet.Time.In(c.loc)
+	c.rollover(t)
+
+	if dt := t.Sub(c.lastTime); !c.lastTime.IsZero() && dt > 0 && dt <= maxSampleGap {
+		cost := c.lastPower / 1000 * dt.Hours() * c.price
+		c.hourCost += cost
+		c.dayCost += cost
+		c.monthCost += cost
+	}
+	c.lastTime = t
+	c.lastPower = power
+}
+
+// rollover resets the accumulated cost of periods that have ended. Hours are truncated in absolute time,
+// as the local hour is ambiguous when clocks are set back at the end of daylight saving time.
+func (c *costCollector) rollover(t time.Time) {
+	hour := t.Truncate(time.Hour)
+	if !hour.Equal(c.hour) {
+		c.hour = hour
+		c.hourCost = 0
+	}
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, c.loc)
+	if !day.Equal(c.day) {
+		c.day = day
+		c.dayCost = 0
+	}
+	month := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, c.loc)
+	if !month.Equal(c.month) {
+		c.month = month
+		c.monthCost = 0
+	}
+}
+
+func (c *costCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.priceDesc
+	ch <- c.hourCostDesc
+	ch <- c.dayCostDesc
+	ch <- c.monthCostDesc
+}
+
+func (c *costCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(c.priceDesc, prometheus.GaugeValue, c.price, c.meterID)
+	if c.lastTime.IsZero() {
+		return
+	}
+	// Periods may have ended without any samples arriving.
+	c.rollover(time.Now().In(c.loc))
+	ch <- prometheus.MustNewConstMetric(c.hourCostDesc, prometheus.GaugeValue, c.hourCost, c.meterID)
+	ch <- prometheus.MustNewConstMetric(c.dayCostDesc, prometheus.CounterValue, c.dayCost, c.meterID)
+	ch <- prometheus.MustNewConstMetric(c.monthCostDesc, prometheus.CounterValue, c.monthCost, c.meterID)
+}
+
+// runPriceFetcher periodically fetches the energy price until the context is canceled.
+func runPriceFetcher(ctx context.Context, cfg CostConfig, set func(float64)) {
+	ticker := time.NewTicker(cfg.PriceRefresh)
+	defer ticker.Stop()
+
+	for {
+		price, err := fetchPrice(ctx, cfg.PriceURL)
+		if err != nil {
+			log.Errorf("Fetch energy price from %s: %s", cfg.PriceURL, err)
+		} else {
+			set(price)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func fetchPrice(ctx context.Context, url string) (float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(strings.TrimSpace(string(body)), 64)
+}
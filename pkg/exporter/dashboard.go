@@ -0,0 +1,205 @@
+package exporter
+
+import (
+	`encoding/json`
+	`fmt`
+	`io`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/obis`
+	`github.com/prometheus/client_golang/prometheus`
+)
+
+// Grafana dashboard model, limited to the fields used here.
+// See https://grafana.com/docs/grafana/latest/dashboards/build-dashboards/view-dashboard-json-model/
+
+type dashboardDatasource struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+type dashboardGridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type dashboardTarget struct {
+	Datasource   dashboardDatasource `json:"datasource"`
+	Expr         string              `json:"expr"`
+	LegendFormat string              `json:"legendFormat"`
+	RefID        string              `json:"refId"`
+}
+
+type dashboardFieldDefaults struct {
+	Unit     string `json:"unit"`
+	Decimals *int   `json:"decimals,omitempty"`
+}
+
+type dashboardFieldConfig struct {
+	Defaults  dashboardFieldDefaults `json:"defaults"`
+	Overrides []any                  `json:"overrides"`
+}
+
+type dashboardPanel struct {
+	ID          int                  `json:"id"`
+	Type        string               `json:"type"`
+	Title       string               `json:"title"`
+	Datasource  dashboardDatasource  `json:"datasource"`
+	GridPos     dashboardGridPos     `json:"gridPos"`
+	FieldConfig dashboardFieldConfig `json:"fieldConfig"`
+	Targets     []dashboardTarget    `json:"targets"`
+}
+
+type dashboardVariable struct {
+	Name       string               `json:"name"`
+	Label      string               `json:"label"`
+	Type       string               `json:"type"`
+	Query      any                  `json:"query"`
+	Datasource *dashboardDatasource `json:"datasource,omitempty"`
+	Refresh    int                  `json:"refresh,omitempty"`
+	Current    map[string]any       `json:"current,omitempty"`
+	Hide       int                  `json:"hide"`
+}
+
+type dashboardInput struct {
+	Name     string `json:"name"`
+	Label    string `json:"label"`
+	Type     string `json:"type"`
+	PluginID string `json:"pluginId"`
+}
+
+type dashboard struct {
+	Inputs        []dashboardInput `json:"__inputs"`
+	Title         string           `json:"title"`
+	UID           string           `json:"uid"`
+	Tags          []string         `json:"tags"`
+	Timezone      string           `json:"timezone"`
+	Refresh       string           `json:"refresh"`
+	SchemaVersion int              `json:"schemaVersion"`
+	Time          map[string]any   `json:"time"`
+	Templating    map[string]any   `json:"templating"`
+	Panels        []dashboardPanel `json:"panels"`
+}
+
+var prometheusDatasource = dashboardDatasource{
+	Type: "prometheus",
+	UID:  "${DS_PROMETHEUS}",
+}
+
+// metricName returns the fully qualified name of the metric exported for an OBIS code.
+func metricName(namespace, code string) string {
+	reg, _ := obis.Lookup(code)
+	return prometheus.BuildFQName(namespace, "", reg.Name)
+}
+
+// selector returns a PromQL selector for the metric exported for an OBIS code,
+// filtered on the meter chosen in the dashboard.
+func selector(namespace, code string) string {
+	return fmt.Sprintf(`%s{meter_id=~"$meter_id"}`, metricName(namespace, code))
+}
+
+func newDashboard(namespace string) dashboard {
+	one := 1
+	id := 0
+	panel := func(title, unit string, pos dashboardGridPos, exprs ...[2]string) dashboardPanel {
+		id++
+		p := dashboardPanel{
+			ID:         id,
+			Type:       "timeseries",
+			Title:      title,
+			Datasource: prometheusDatasource,
+			GridPos:    pos,
+			FieldConfig: dashboardFieldConfig{
+				Defaults:  dashboardFieldDefaults{Unit: unit},
+				Overrides: []any{},
+			},
+		}
+		for i, expr := range exprs {
+			p.Targets = append(p.Targets, dashboardTarget{
+				Datasource:   prometheusDatasource,
+				Expr:         expr[0],
+				LegendFormat: expr[1],
+				RefID:        string(rune('A' + i)),
+			})
+		}
+		return p
+	}
+
+	hourlyEnergy := fmt.Sprintf("increase(%s[1h]) / 1000", selector(namespace, obis.ActiveEnergyImport))
+	cost := panel("Energy cost per hour", "none", dashboardGridPos{H: 8, W: 12, X: 12, Y: 16},
+		[2]string{hourlyEnergy + " * $price", "Cost"},
+	)
+	cost.FieldConfig.Defaults.Decimals = &one
+
+	return dashboard{
+		Inputs: []dashboardInput{
+			{
+				Name:     "DS_PROMETHEUS",
+				Label:    "Prometheus",
+				Type:     "datasource",
+				PluginID: "prometheus",
+			},
+		},
+		Title:         "Aidon AMS",
+		UID:           "aidon-ams",
+		Tags:          []string{"ams", "power"},
+		Timezone:      "browser",
+		Refresh:       "10s",
+		SchemaVersion: 36,
+		Time: map[string]any{
+			"from": "now-6h",
+			"to":   "now",
+		},
+		Templating: map[string]any{
+			"list": []dashboardVariable{
+				{
+					Name:       "meter_id",
+					Label:      "Meter",
+					Type:       "query",
+					Datasource: &prometheusDatasource,
+					Query:      fmt.Sprintf("label_values(%s, meter_id)", metricName(namespace, obis.ActivePowerImport)),
+					Refresh:    2,
+				},
+				{
+					Name:  "price",
+					Label: "Price per kWh",
+					Type:  "textbox",
+					Query: "1",
+					Current: map[string]any{
+						"text":  "1",
+						"value": "1",
+					},
+				},
+			},
+		},
+		Panels: []dashboardPanel{
+			panel("Power", "watt", dashboardGridPos{H: 8, W: 24, X: 0, Y: 0},
+				[2]string{selector(namespace, obis.ActivePowerImport), "Import"},
+				[2]string{selector(namespace, obis.ActivePowerExport), "Export"},
+			),
+			panel("Voltage", "volt", dashboardGridPos{H: 8, W: 12, X: 0, Y: 8},
+				[2]string{selector(namespace, obis.VoltageL1), "L1"},
+				[2]string{selector(namespace, obis.VoltageL2), "L2"},
+				[2]string{selector(namespace, obis.VoltageL3), "L3"},
+			),
+			panel("Current", "amp", dashboardGridPos{H: 8, W: 12, X: 12, Y: 8},
+				[2]string{selector(namespace, obis.CurrentL1), "L1"},
+				[2]string{selector(namespace, obis.CurrentL2), "L2"},
+				[2]string{selector(namespace, obis.CurrentL3), "L3"},
+			),
+			panel("Energy per hour", "kwatth", dashboardGridPos{H: 8, W: 12, X: 0, Y: 16},
+				[2]string{hourlyEnergy, "Import"},
+				[2]string{fmt.Sprintf("increase(%s[1h]) / 1000", selector(namespace, obis.ActiveEnergyExport)), "Export"},
+			),
+			cost,
+		},
+	}
+}
+
+// WriteDashboard writes a Grafana dashboard matching the metrics exported with the given namespace.
+func WriteDashboard(w io.Writer, namespace string) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(newDashboard(namespace))
+}
@@ -0,0 +1,82 @@
+package exporter
+
+import (
+	`encoding/hex`
+	`encoding/json`
+	`net/http`
+	`sync`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+	log "github.com/sirupsen/logrus"
+)
+
+// lastFrame remembers the most recently received frame along with its decode result,
+// to help troubleshooting meters sending unexpected data.
+type lastFrame struct {
+	mu     sync.Mutex
+	time   time.Time
+	frame  []byte
+	packet *protocol.Packet
+	err    error
+}
+
+// LastFrame is the response of the last frame debug endpoint.
+type LastFrame struct {
+	Time      time.Time        `json:"time"`
+	Frame     string           `json:"frame"`
+	Registers []RegisterRecord `json:"registers,omitempty"`
+	Error     string           `json:"error,omitempty"`
+}
+
+func (f *lastFrame) decoded(packet *protocol.Packet) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.time = packet.Time
+	f.frame = packet.Frame
+	f.packet = packet
+	f.err = nil
+}
+
+func (f *lastFrame) failed(frame []byte, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.time = time.Now()
+	f.frame = frame
+	f.packet = nil
+	f.err = err
+}
+
+func (f *lastFrame) get() (LastFrame, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.time.IsZero() {
+		return LastFrame{}, false
+	}
+	resp := LastFrame{
+		Time:  f.time,
+		Frame: hex.EncodeToString(f.frame),
+	}
+	if f.packet != nil {
+		resp.Registers = NewPacketRecord(f.packet, false).Registers
+	}
+	if f.err != nil {
+		resp.Error = f.err.Error()
+	}
+	return resp, true
+}
+
+func lastFrameHandler(f *lastFrame) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp, ok := f.get()
+		if !ok {
+			http.Error(w, "no frame received yet", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(resp)
+		if err != nil {
+			log.Errorf("Encode last frame: %s", err)
+		}
+	}
+}
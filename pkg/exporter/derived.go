@@ -0,0 +1,162 @@
+package exporter
+
+import (
+	`math`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/obis`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+)
+
+// OBIS codes of per-phase instantaneous values, in L1, L2, L3 order.
+var (
+	voltageCodes = []string{obis.VoltageL1, obis.VoltageL2, obis.VoltageL3}
+	currentCodes = []string{obis.CurrentL1, obis.CurrentL2, obis.CurrentL3}
+)
+
+// Phase configurations, as detected from the registers sent by the meter.
+const (
+	singlePhase  = "single_phase"
+	threePhase   = "three_phase"
+	threePhaseIT = "three_phase_it"
+)
+
+// phaseConfig detects the phase configuration from the set of registers the meter has sent.
+// Single-phase meters only send L1 values, and meters on three-phase IT networks measure
+// the current on L1 and L3 only. Empty until the meter has sent any per-phase values.
+func phaseConfig(sent map[string]bool) string {
+	var voltages, currents int
+	for i := range voltageCodes {
+		if sent[voltageCodes[i]] {
+			voltages++
+		}
+		if sent[currentCodes[i]] {
+			currents++
+		}
+	}
+	switch {
+	case voltages == 0 && currents == 0:
+		return ""
+	case voltages <= 1 && currents <= 1:
+		return singlePhase
+	case currents == 2 && !sent[obis.CurrentL2]:
+		return threePhaseIT
+	default:
+		return threePhase
+	}
+}
+
+// phaseValues returns the current values of those phases the meter reports.
+func phaseValues(values map[string]float64, codes []string) []float64 {
+	result := make([]float64, 0, len(codes))
+	for _, code := range codes {
+		if val, ok := values[code]; ok {
+			result = append(result, val)
+		}
+	}
+	return result
+}
+
+// imbalance returns the largest deviation from the mean, in percent of the mean.
+// At least two values are needed to compute an imbalance.
+func imbalance(values []float64) (float64, bool) {
+	if len(values) < 2 {
+		return 0, false
+	}
+
+	var sum float64
+	for _, val := range values {
+		sum += val
+	}
+	mean := sum / float64(len(values))
+	if mean == 0 {
+		return 0, true
+	}
+
+	var deviation float64
+	for _, val := range values {
+		deviation = math.Max(deviation, math.Abs(val-mean))
+	}
+
+	return deviation / mean * 100, true
+}
+
+// netPower returns imported minus exported active power, negative while exporting.
+// The export register is only sent by meters registered for production, and counts as zero
+// when missing. Meters sending a signed import register, negative while exporting, give
+// the net power directly.
+func netPower(values map[string]float64) (float64, bool) {
+	imported, ok := values[obis.ActivePowerImport]
+	if !ok {
+		return 0, false
+	}
+	return imported - values[obis.ActivePowerExport], true
+}
+
+// importPower returns the active power imported according to a packet.
+// Negative power reported in a signed import register is exported, and counts as no import.
+func importPower(packet *protocol.Packet) (float64, bool) {
+	reg, ok := packet.Registers[obis.ActivePowerImport]
+	if !ok {
+		return 0, false
+	}
+	power, err := reg.Float()
+	if err != nil {
+		return 0, false
+	}
+	return math.Max(power, 0), true
+}
+
+// exportPower returns the active power exported according to a packet.
+func exportPower(packet *protocol.Packet) (float64, bool) {
+	reg, ok := packet.Registers[obis.ActivePowerExport]
+	if !ok {
+		return 0, false
+	}
+	power, err := reg.Float()
+	if err != nil {
+		return 0, false
+	}
+	return math.Max(power, 0), true
+}
+
+// phasePower estimates the active power of each phase as voltage times current, for those phases
+// the meter reports both for. The meter only sends the total power, so the estimates are corrected
+// by the power factor if the meter sends it, and otherwise by the ratio of total active power to
+// the sum of voltage times current, so that they add up to the total. The estimates are indexed by
+// phase, and missing phases are NaN.
+func phasePower(values map[string]float64) ([]float64, bool) {
+	result := make([]float64, len(voltageCodes))
+	var apparent float64
+	found := false
+	for i := range voltageCodes {
+		voltage, vok := values[voltageCodes[i]]
+		current, cok := values[currentCodes[i]]
+		if !vok || !cok {
+			result[i] = math.NaN()
+			continue
+		}
+		result[i] = voltage * current
+		apparent += result[i]
+		found = true
+	}
+	if !found {
+		return nil, false
+	}
+
+	factor, ok := values[obis.PowerFactor]
+	if !ok {
+		power, ok := netPower(values)
+		switch {
+		case !ok:
+			factor = 1
+		case apparent == 0:
+			factor = 0
+		default:
+			factor = math.Min(math.Max(power/apparent, -1), 1)
+		}
+	}
+	for i := range result {
+		result[i] *= factor
+	}
+	return result, true
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+
+package exporter
+
+import (
+	`path/filepath`
+)
+
+// Device names used by USB serial adapters and on-board UARTs.
+var serialPatterns = []string{
+	"/dev/ttyUSB*",
+	"/dev/ttyACM*",
+	"/dev/serial0",
+	"/dev/ttyAMA*",
+	"/dev/cu.usbserial*",
+}
+
+// serialCandidates returns the serial devices present that may be connected to a HAN port.
+// Links to a device already found, such as /dev/serial0 on a Raspberry Pi, are left out.
+func serialCandidates() []string {
+	var devices []string
+	seen := make(map[string]bool)
+	for _, pattern := range serialPatterns {
+		matches, _ := filepath.Glob(pattern)
+		for _, path := range matches {
+			target, err := filepath.EvalSymlinks(path)
+			if err != nil || seen[target] {
+				continue
+			}
+			seen[target] = true
+			devices = append(devices, path)
+		}
+	}
+	return devices
+}
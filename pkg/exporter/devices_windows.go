@@ -0,0 +1,15 @@
+package exporter
+
+import (
+	`fmt`
+)
+
+// serialCandidates returns the serial ports that may be connected to a HAN port.
+// Ports that do not exist fail to open, and are skipped when scanning.
+func serialCandidates() []string {
+	devices := make([]string, 0, 16)
+	for i := 1; i <= 16; i++ {
+		devices = append(devices, fmt.Sprintf("COM%d", i))
+	}
+	return devices
+}
@@ -0,0 +1,324 @@
+package exporter
+
+import (
+	`bytes`
+	`context`
+	`encoding/json`
+	`fmt`
+	`io`
+	`net`
+	`net/http`
+	`regexp`
+	`strings`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/obis`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/output`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	output.Register("elasticsearch", newElastic)
+	output.Register("logstash", newLogstash)
+}
+
+// ElasticConfig configures shipping readings to Elasticsearch using the bulk API, to a Logstash TCP input
+// using the json_lines codec, or both. Each decoded packet becomes one JSON document. Elasticsearch and
+// Logstash are separate sinks, so that one being unreachable does not hold up the other.
+type ElasticConfig struct {
+	// Elasticsearch URL, such as http://localhost:9200.
+	URL      string `yaml:"url"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// Name of the index receiving the documents. %{+YYYY.MM.dd} is replaced with the date of the packet
+	// in UTC, in the format given, and %{meter_id} with the meter ID. Defaults to ams-%{+YYYY.MM.dd}.
+	Index string `yaml:"index"`
+
+	// Address of a Logstash TCP input as host:port.
+	Logstash string `yaml:"logstash"`
+
+	// Buffering, batching, retries and circuit breaking, as for sinks. Documents are sent when
+	// batch_size are waiting, or at the flush interval. The buffer and batch size default to 1024 and 100.
+	output.Options `yaml:",inline"`
+}
+
+func (cfg *ElasticConfig) validate() error {
+	if len(cfg.URL) == 0 && len(cfg.Logstash) == 0 {
+		return fmt.Errorf("url or logstash is required")
+	}
+	if len(cfg.URL) > 0 {
+		if err := validateURL(cfg.URL, "http", "https"); err != nil {
+			return fmt.Errorf("url: %w", err)
+		}
+	}
+	if len(cfg.Logstash) > 0 {
+		if _, _, err := net.SplitHostPort(cfg.Logstash); err != nil {
+			return fmt.Errorf("logstash: %w", err)
+		}
+	}
+	if len(cfg.Index) == 0 {
+		cfg.Index = "ams-%{+YYYY.MM.dd}"
+	}
+	if cfg.Buffer <= 0 {
+		cfg.Buffer = elasticBuffer
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	return cfg.Options.Validate()
+}
+
+// Time allowed for a single bulk request or Logstash write.
+const elasticTimeout = 10 * time.Second
+
+// Number of packets buffered by default while Elasticsearch or Logstash is unreachable.
+const elasticBuffer = 1024
+
+// Placeholders in index names.
+var indexPlaceholder = regexp.MustCompile(`%\{([^}]*)\}`)
+
+// Date format letters of index name placeholders, as used by Logstash, and their Go layouts.
+var indexDateFormat = strings.NewReplacer("YYYY", "2006", "yyyy", "2006", "MM", "01", "dd", "02", "HH", "15")
+
+// indexName expands the placeholders of an index name template.
+func indexName(template string, t time.Time, meterID string) string {
+	return indexPlaceholder.ReplaceAllStringFunc(template, func(s string) string {
+		name := s[2 : len(s)-1]
+		switch {
+		case strings.HasPrefix(name, "+"):
+			return t.UTC().Format(indexDateFormat.Replace(name[1:]))
+		case name == "meter_id":
+			return meterID
+		default:
+			return s
+		}
+	})
+}
+
+// elasticDocument converts a packet to a flat JSON document, with registers named as their metrics
+// and values in the units sent by the meter. Unknown registers are named after their OBIS code.
+func elasticDocument(packet *protocol.Packet, meterID string) map[string]any {
+	doc := map[string]any{
+		"@timestamp":   packet.Time.UTC().Format(time.RFC3339Nano),
+		"meter_id":     meterID,
+		"message_type": messageType(packet),
+	}
+	for _, rec := range NewPacketRecord(packet, false).Registers {
+		doc[registerName(rec.OBIS)] = rec.Value
+	}
+	return doc
+}
+
+// registerName returns the metric name of a register without the namespace, or a name
+// made from its OBIS code, such as obis_1_0_99_7_0_255, for unknown registers.
+func registerName(code string) string {
+	if reg, ok := obis.Lookup(code); ok {
+		return reg.Name
+	}
+	return "obis_" + strings.NewReplacer("-", "_", ":", "_", ".", "_").Replace(code)
+}
+
+type elasticDoc struct {
+	index string
+	body  []byte
+}
+
+// elasticEncoder converts packets to documents, keeping track of the meter ID.
+type elasticEncoder struct {
+	cfg     ElasticConfig
+	meterID string
+}
+
+func (e *elasticEncoder) documents(packets []*protocol.Packet) ([]elasticDoc, error) {
+	docs := make([]elasticDoc, 0, len(packets))
+	for _, packet := range packets {
+		if id, ok := packet.Registers[obis.MeterID].Value.(string); ok {
+			e.meterID = id
+		}
+		body, err := json.Marshal(elasticDocument(packet, e.meterID))
+		if err != nil {
+			return nil, fmt.Errorf("encode document: %w", err)
+		}
+		docs = append(docs, elasticDoc{
+			index: indexName(e.cfg.Index, packet.Time, e.meterID),
+			body:  body,
+		})
+	}
+	return docs, nil
+}
+
+// elasticSink indexes documents in Elasticsearch, a batch in each bulk request.
+type elasticSink struct {
+	elasticEncoder
+	client *http.Client
+}
+
+func newElastic(decode func(v any) error) (output.Sink, error) {
+	var cfg ElasticConfig
+	if err := decode(&cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if len(cfg.URL) == 0 {
+		return nil, fmt.Errorf("url is required")
+	}
+	return &elasticSink{elasticEncoder: elasticEncoder{cfg: cfg}}, nil
+}
+
+func (s *elasticSink) Start(ctx context.Context) error {
+	s.client = &http.Client{Timeout: elasticTimeout}
+	return nil
+}
+
+func (s *elasticSink) Write(packet *protocol.Packet) error {
+	return s.WriteBatch([]*protocol.Packet{packet})
+}
+
+func (s *elasticSink) WriteBatch(packets []*protocol.Packet) error {
+	docs, err := s.documents(packets)
+	if err != nil {
+		return err
+	}
+	if err := s.bulk(docs); err != nil {
+		return fmt.Errorf("bulk request to %s: %w", s.cfg.URL, err)
+	}
+	return nil
+}
+
+func (s *elasticSink) Close() error {
+	return nil
+}
+
+// logstashSink writes documents to a Logstash TCP input as JSON lines, a batch in each write.
+type logstashSink struct {
+	elasticEncoder
+
+	// Connection to Logstash, opened again after a failed write.
+	conn net.Conn
+}
+
+func newLogstash(decode func(v any) error) (output.Sink, error) {
+	var cfg ElasticConfig
+	if err := decode(&cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if len(cfg.Logstash) == 0 {
+		return nil, fmt.Errorf("logstash is required")
+	}
+	return &logstashSink{elasticEncoder: elasticEncoder{cfg: cfg}}, nil
+}
+
+func (s *logstashSink) Start(ctx context.Context) error {
+	return nil
+}
+
+func (s *logstashSink) Write(packet *protocol.Packet) error {
+	return s.WriteBatch([]*protocol.Packet{packet})
+}
+
+// WriteBatch writes the documents of a batch as JSON lines, connecting first if needed.
+func (s *logstashSink) WriteBatch(packets []*protocol.Packet) error {
+	docs, err := s.documents(packets)
+	if err != nil {
+		return err
+	}
+	if s.conn == nil {
+		conn, err := net.DialTimeout("tcp", s.cfg.Logstash, elasticTimeout)
+		if err != nil {
+			return fmt.Errorf("connect to %s: %w", s.cfg.Logstash, err)
+		}
+		s.conn = conn
+	}
+	buf := &bytes.Buffer{}
+	for _, doc := range docs {
+		buf.Write(doc.body)
+		buf.WriteByte('\n')
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(elasticTimeout))
+	if _, err := s.conn.Write(buf.Bytes()); err != nil {
+		s.Close()
+		return fmt.Errorf("write to %s: %w", s.cfg.Logstash, err)
+	}
+	return nil
+}
+
+func (s *logstashSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// bulk indexes a batch with a single bulk API request. Documents rejected by Elasticsearch, such as
+// for mapping conflicts, are logged but not retried.
+func (s *elasticSink) bulk(batch []elasticDoc) error {
+	body := &bytes.Buffer{}
+	for _, doc := range batch {
+		action, err := json.Marshal(map[string]any{"index": map[string]string{"_index": doc.index}})
+		if err != nil {
+			return err
+		}
+		body.Write(action)
+		body.WriteByte('\n')
+		body.Write(doc.body)
+		body.WriteByte('\n')
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(s.cfg.URL, "/")+"/_bulk", body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if len(s.cfg.Username) > 0 {
+		req.SetBasicAuth(s.cfg.Username, s.cfg.Password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	var result bulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("parse response: %w", err)
+	}
+	if !result.Errors {
+		return nil
+	}
+	failed := 0
+	var reason string
+	for _, item := range result.Items {
+		for _, status := range item {
+			if status.Status >= 300 {
+				failed++
+				reason = status.Error.Type + ": " + status.Error.Reason
+			}
+		}
+	}
+	log.Warnf("Elasticsearch rejected %d of %d documents: %s", failed, len(batch), reason)
+	return nil
+}
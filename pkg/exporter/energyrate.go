@@ -0,0 +1,139 @@
+package exporter
+
+import (
+	`sync`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/obis`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+	`github.com/prometheus/client_golang/prometheus`
+)
+
+// energyRate compares the average power given by successive readings of an energy register with
+// the average of the instantaneous power readings over the same interval.
+type energyRate struct {
+	direction string
+	energy    string
+	power     func(packet *protocol.Packet) (float64, bool)
+
+	// Last energy reading.
+	lastEnergy float64
+	lastTime   time.Time
+
+	// Instantaneous power integrated since the last energy reading.
+	lastPower     float64
+	lastPowerTime time.Time
+	integral      float64
+	covered       time.Duration
+
+	// Results for the interval between the last two energy readings.
+	valid    bool
+	rate     float64
+	measured float64
+	hasPower bool
+}
+
+func (r *energyRate) update(packet *protocol.Packet) {
+	t := packet.Time
+
+	// Power readings are integrated first, as the power sent together with an energy reading
+	// applies to the following interval.
+	if power, ok := r.power(packet); ok {
+		if dt := t.Sub(r.lastPowerTime); !r.lastPowerTime.IsZero() && dt > 0 && dt <= maxSampleGap {
+			r.integral += r.lastPower * dt.Seconds()
+			r.covered += dt
+		}
+		r.lastPower = power
+		r.lastPowerTime = t
+	}
+
+	reg, ok := packet.Registers[r.energy]
+	if !ok {
+		return
+	}
+	energy, err := reg.Float()
+	if err != nil {
+		return
+	}
+	switch {
+	case r.lastTime.IsZero() || !t.After(r.lastTime):
+	case energy < r.lastEnergy:
+		// The counter was reset or the meter replaced, so there is nothing to compare.
+		r.valid = false
+	default:
+		r.valid = true
+		r.rate = (energy - r.lastEnergy) / t.Sub(r.lastTime).Hours()
+		r.hasPower = r.covered > 0
+		if r.hasPower {
+			r.measured = r.integral / r.covered.Seconds()
+		}
+	}
+	r.lastEnergy = energy
+	r.lastTime = t
+	r.integral = 0
+	r.covered = 0
+}
+
+// energyRateCollector exports the average active power computed from the energy registers, next to
+// the average of the instantaneous power readings over the same interval. The two should agree closely;
+// a large difference points at wrong scalers or parsing errors.
+type energyRateCollector struct {
+	mu        sync.Mutex
+	meterID   string
+	rates     []*energyRate
+	rateDesc  *prometheus.Desc
+	powerDesc *prometheus.Desc
+}
+
+func newEnergyRateCollector(namespace string) *energyRateCollector {
+	return &energyRateCollector{
+		rates: []*energyRate{
+			{direction: "import", energy: obis.ActiveEnergyImport, power: importPower},
+			{direction: "export", energy: obis.ActiveEnergyExport, power: exportPower},
+		},
+		rateDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "energy_average_power_watts"),
+			"Average active power between the last two readings of the energy register",
+			[]string{"meter_id", "direction"},
+			nil,
+		),
+		powerDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "measured_average_power_watts"),
+			"Average of the instantaneous active power readings between the last two readings of the energy register",
+			[]string{"meter_id", "direction"},
+			nil,
+		),
+	}
+}
+
+func (c *energyRateCollector) Update(packet *protocol.Packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if id, ok := packet.Registers[obis.MeterID].Value.(string); ok {
+		c.meterID = id
+	}
+	for _, r := range c.rates {
+		r.update(packet)
+	}
+}
+
+func (c *energyRateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.rateDesc
+	ch <- c.powerDesc
+}
+
+func (c *energyRateCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, r := range c.rates {
+		if !r.valid {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.rateDesc, prometheus.GaugeValue, r.rate, c.meterID, r.direction)
+		if r.hasPower {
+			ch <- prometheus.MustNewConstMetric(c.powerDesc, prometheus.GaugeValue, r.measured, c.meterID, r.direction)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package exporter
+
+import (
+	`encoding/json`
+	`fmt`
+	`net/http`
+	`time`
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Interval between comments sent to keep idle event streams from being closed by proxies.
+const eventKeepalive = 30 * time.Second
+
+// eventsHandler streams every decoded packet as a server-sent event, holding the packet
+// in the same JSON form as the packet log. Clients falling more than subscriberBuffer
+// packets behind are disconnected, and expected to reconnect.
+func eventsHandler(packets *broadcaster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		ch := packets.subscribe(true)
+		defer packets.unsubscribe(ch)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		log.Debugf("Event stream client connected from %s", r.RemoteAddr)
+
+		keepalive := time.NewTicker(eventKeepalive)
+		defer keepalive.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepalive.C:
+				fmt.Fprint(w, ": keepalive\n\n")
+			case packet, ok := <-ch:
+				if !ok {
+					log.Warnf("Disconnected event stream client %s falling behind", r.RemoteAddr)
+					return
+				}
+				data, err := json.Marshal(NewPacketRecord(packet, false))
+				if err != nil {
+					log.Errorf("Encode event: %s", err)
+					continue
+				}
+				_, err = fmt.Fprintf(w, "event: packet\ndata: %s\n\n", data)
+				if err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
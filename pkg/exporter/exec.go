@@ -0,0 +1,193 @@
+package exporter
+
+import (
+	`bytes`
+	`context`
+	`fmt`
+	`os`
+	`os/exec`
+	`strings`
+	`text/template`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/obis`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/output`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	output.Register("exec", newExecHook)
+}
+
+// ExecConfig configures running a command with the readings of decoded packets, for integrations
+// such as switching a relay or a fan that do not warrant an output of their own.
+type ExecConfig struct {
+	// Command and arguments. Arguments are Go templates, expanded with the packet: {{.MeterID}},
+	// {{.Time}}, {{.MessageType}}, and each register value by metric name, such as
+	// {{.Values.active_positive_instantaneous_value}}. The command is not run through a shell.
+	Command []string `yaml:"command"`
+
+	// Run the command at most once per interval. Packets arriving within the interval after the command
+	// last ran are skipped. Zero runs it for every packet.
+	Interval time.Duration `yaml:"interval"`
+
+	// Time allowed for the command to finish before it is killed. Defaults to 10 seconds.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Format of the packet written to the standard input of the command, json or amsreader, as for MQTT.
+	// Defaults to json.
+	Format string `yaml:"format"`
+
+	// Buffering, retries and circuit breaking, as for sinks. The buffer defaults to a single packet,
+	// so that a packet arriving while the command runs replaces the one waiting, and commands are not
+	// retried by default, as running them twice may not be harmless.
+	output.Options `yaml:",inline"`
+}
+
+func (cfg *ExecConfig) validate() error {
+	if len(cfg.Command) == 0 {
+		return fmt.Errorf("command is required")
+	}
+	if _, err := parseExecArgs(cfg.Command); err != nil {
+		return fmt.Errorf("command: %w", err)
+	}
+	if cfg.Interval < 0 {
+		return fmt.Errorf("interval must not be negative")
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if len(cfg.Format) == 0 {
+		cfg.Format = "json"
+	}
+	if _, ok := mqttFormats[cfg.Format]; !ok {
+		return fmt.Errorf("unknown format %q", cfg.Format)
+	}
+	if cfg.Buffer <= 0 {
+		cfg.Buffer = 1
+	}
+	if cfg.Retries == 0 {
+		cfg.Retries = -1
+	}
+	return cfg.Options.Validate()
+}
+
+// execData is the data that command arguments are expanded with.
+type execData struct {
+	MeterID     string
+	Time        time.Time
+	MessageType string
+	Values      map[string]string
+}
+
+// execHook runs the configured command for decoded packets.
+type execHook struct {
+	cfg     ExecConfig
+	args    []*template.Template
+	meterID string
+
+	// Time the command was last run.
+	ran time.Time
+}
+
+func parseExecArgs(args []string) ([]*template.Template, error) {
+	templates := make([]*template.Template, len(args))
+	for i, arg := range args {
+		tmpl, err := template.New(fmt.Sprintf("arg%d", i)).Option("missingkey=zero").Parse(arg)
+		if err != nil {
+			return nil, err
+		}
+		templates[i] = tmpl
+	}
+	return templates, nil
+}
+
+func newExecHook(decode func(v any) error) (output.Sink, error) {
+	var cfg ExecConfig
+	if err := decode(&cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	// The arguments have been parsed when validating the configuration.
+	args, _ := parseExecArgs(cfg.Command)
+	return &execHook{cfg: cfg, args: args}, nil
+}
+
+func (h *execHook) Start(ctx context.Context) error {
+	return nil
+}
+
+// Write runs the command with a packet, unless it ran within the interval.
+func (h *execHook) Write(packet *protocol.Packet) error {
+	if id, ok := packet.Registers[obis.MeterID].Value.(string); ok {
+		h.meterID = id
+	}
+	if time.Since(h.ran) < h.cfg.Interval {
+		return nil
+	}
+	h.ran = time.Now()
+	if err := h.exec(context.Background(), packet, h.meterID); err != nil {
+		return fmt.Errorf("run %s: %w", h.cfg.Command[0], err)
+	}
+	return nil
+}
+
+func (h *execHook) Close() error {
+	return nil
+}
+
+// exec runs the command for a packet, with the packet on standard input and its values in the environment.
+func (h *execHook) exec(ctx context.Context, packet *protocol.Packet, meterID string) error {
+	data := execData{
+		MeterID:     meterID,
+		Time:        packet.Time,
+		MessageType: messageType(packet),
+		Values:      make(map[string]string, len(packet.Registers)),
+	}
+	for code, val := range textValues(packet) {
+		data.Values[registerName(code)] = val
+	}
+
+	args := make([]string, len(h.args))
+	for i, tmpl := range h.args {
+		buf := &strings.Builder{}
+		if err := tmpl.Execute(buf, data); err != nil {
+			return fmt.Errorf("expand argument %q: %w", h.cfg.Command[i], err)
+		}
+		args[i] = buf.String()
+	}
+
+	stdin, err := mqttFormats[h.cfg.Format](packet, meterID)
+	if err != nil {
+		return fmt.Errorf("encode packet: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, h.cfg.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Env = append(os.Environ(), execEnv(data)...)
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		log.Debugf("Output of %s: %s", args[0], bytes.TrimSpace(out))
+	}
+	return err
+}
+
+// execEnv returns the environment variables describing a packet: AMS_METER_ID, AMS_TIME in RFC 3339
+// format, AMS_MESSAGE_TYPE, and each register value named as its metric in upper case, such as
+// AMS_ACTIVE_POSITIVE_INSTANTANEOUS_VALUE.
+func execEnv(data execData) []string {
+	env := []string{
+		"AMS_METER_ID=" + data.MeterID,
+		"AMS_TIME=" + data.Time.Format(time.RFC3339Nano),
+		"AMS_MESSAGE_TYPE=" + data.MessageType,
+	}
+	for name, val := range data.Values {
+		env = append(env, "AMS_"+strings.ToUpper(name)+"="+val)
+	}
+	return env
+}
@@ -0,0 +1,749 @@
+// Package exporter reads data from an Aidon power meter and exports it as Prometheus metrics.
+package exporter
+
+import (
+	`context`
+	`errors`
+	`fmt`
+	`io`
+	`net`
+	`net/http`
+	`os`
+	`strconv`
+	`strings`
+	`sync`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/amspb`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/obis`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/output`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/queue`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/source`
+	"github.com/goburrow/serial"
+	`github.com/prometheus/client_golang/prometheus`
+	`github.com/prometheus/client_golang/prometheus/promhttp`
+	log "github.com/sirupsen/logrus"
+	`google.golang.org/grpc`
+)
+
+// Prefix of listen addresses referring to a Unix domain socket.
+const unixAddressPrefix = "unix://"
+
+// DefaultNamespace is the prefix of metric names unless another namespace is configured.
+const DefaultNamespace = "ams"
+
+// Run reads and decodes data from the meter until the context is canceled,
+// exporting it as Prometheus metrics and serving it over HTTP.
+func Run(ctx context.Context, cfg Config) error {
+	err := cfg.Validate()
+	if err != nil {
+		return fmt.Errorf("configuration: %w", err)
+	}
+	if cfg.Registerer == nil {
+		cfg.Registerer = prometheus.DefaultRegisterer
+	}
+	if cfg.Gatherer == nil {
+		cfg.Gatherer = prometheus.DefaultGatherer
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Addresses with a scheme, such as tcp://host:port, denote other sources than a serial port.
+	remote := len(source.Scheme(cfg.Serial.Address)) > 0
+	if cfg.Serial.Probe && len(cfg.Serial.Address) > 0 && !remote {
+		cfg.Serial, err = probeSerial(ctx, cfg.Serial)
+		if err != nil {
+			return fmt.Errorf("probe serial port: %w", err)
+		}
+	}
+
+	var src source.Source = serialSource{cfg: cfg.Serial}
+	srcName := "serial"
+	if remote {
+		src, err = source.New(cfg.Serial.Address)
+		if err != nil {
+			return fmt.Errorf("input: %w", err)
+		}
+		srcName = source.Scheme(cfg.Serial.Address)
+	}
+
+	// Set up Prometheus metrics
+	namespace := cfg.Namespace
+	registry := prometheus.WrapRegistererWith(cfg.Labels, cfg.Registerer)
+	meter := newMeterCollector(namespace)
+	meter.filter = cfg.Registers
+	meter.expiry = cfg.MeterExpiry
+	msgCounter := counter(namespace, "messages_processed", "Total number of messages processed")
+	resyncCounter := counter(namespace, "hdlc_frame_resync", "Total number of HDLC frame re-synchronizations")
+	abortCounter := counter(namespace, "hdlc_frame_aborted", "Total number of HDLC frame aborts")
+	checksumCounter := counter(namespace, "hdlc_checksum_errors_total", "Total number of HDLC frames dropped due to checksum mismatch")
+	parseErrorCounter := counter(namespace, "parse_errors", "Total number of messages dropped due to parsing errors")
+	authErrorCounter := counter(namespace, "authentication_failures_total", "Total number of ciphered frames dropped because they failed authentication")
+	duplicateCounter := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "duplicate_frames_total",
+		Help:      "Total number of retransmitted UDP datagrams dropped",
+	}, func() float64 {
+		if dedup, ok := src.(source.Deduplicator); ok {
+			return dedup.Duplicates()
+		}
+		return 0
+	})
+	lateCounter := counter(namespace, "late_frames_total", "Total number of UDP frames dropped for arriving after frames the meter sent later")
+	missedCounter := counter(namespace, "missed_frames_total", "Total number of frames expected from the meter that never arrived")
+	reopenCounter := counter(namespace, "serial_reopens_total", "Total number of times the serial port was reopened because no valid frames arrived")
+	droppedCounter := counter(namespace, "packets_dropped_total", "Total number of decoded packets dropped because processing fell behind")
+	skippedCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "skipped_registers_total",
+		Help:      "Total number of registers left out of otherwise valid messages due to parsing errors",
+	}, []string{"tag"})
+	frameSizes := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "frame_size_bytes",
+		Help:      "Size of decoded HDLC frames, by message type",
+		Buckets:   []float64{32, 64, 128, 192, 256, 320, 384, 448, 512, 768, 1024},
+	}, []string{"type"})
+	frameBytes := counter(namespace, "frame_bytes_total", "Total number of bytes in decoded HDLC frames, from all sources")
+	stageLatency := prometheus.NewSummaryVec(prometheus.SummaryOpts{
+		Namespace:  namespace,
+		Name:       "pipeline_latency_seconds",
+		Help:       "Time from reading the start of a frame until a stage of its processing completed: unframe, decrypt, parse, queue or process",
+		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+	}, []string{"stage"})
+	sourceMetrics := source.NewMetrics(namespace)
+	var input *source.Reader
+	if len(cfg.Serial.Address) > 0 {
+		input = source.NewReader(srcName, src, sourceMetrics)
+		// A serial port that cannot be opened is most likely misconfigured, which is best reported at
+		// startup. Other sources may come and go, and are connected on the first read.
+		if !remote {
+			if err := input.Connect(); err != nil {
+				return fmt.Errorf("open serial port: %w", err)
+			}
+			log.Infof("Serial port opened")
+		}
+
+		// Closing the input interrupts a blocking read, letting the reader notice the cancellation.
+		go func() {
+			<-ctx.Done()
+			input.Close()
+		}()
+	}
+	port := portReader{
+		Reader:     input,
+		bytesRead:  counter(namespace, "serial_read_bytes_total", "Total number of bytes read from the serial port"),
+		timeouts:   counter(namespace, "serial_read_timeouts_total", "Total number of serial port reads that timed out without receiving data"),
+		readErrors: counter(namespace, "serial_read_errors_total", "Total number of failed serial port reads, excluding timeouts"),
+	}
+	dec := protocol.NewDecoder(port)
+	discardedCounter := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hdlc_discarded_bytes_total",
+		Help:      "Total number of bytes read from the serial port that were not part of a valid HDLC frame",
+	}, func() float64 {
+		return float64(dec.Stats().Discarded)
+	})
+	multiFrameCounter := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hdlc_multi_frame_reads_total",
+		Help:      "Total number of reads from the input completing more than one HDLC frame, as when frames were held up",
+	}, func() float64 {
+		return float64(dec.Stats().MultiFrameReads)
+	})
+	plausible := newPlausibilityFilter(namespace, cfg.Plausibility)
+	collectors := []prometheus.Collector{meter, plausible.rejected, msgCounter, resyncCounter, abortCounter, checksumCounter, discardedCounter, multiFrameCounter, parseErrorCounter, authErrorCounter, missedCounter, droppedCounter, reopenCounter, skippedCounter, frameSizes, frameBytes, stageLatency, duplicateCounter, lateCounter, sourceMetrics, port.bytesRead, port.timeouts, port.readErrors}
+
+	// Collectors updated with every received packet. Those in perMeter export series labeled with the
+	// meter ID, and expire along with the meter.
+	packetStream := newBroadcaster()
+	updaters := []updater{meter, packetStream}
+	var perMeter []prometheus.Collector
+
+	state := newStateFile(cfg.StateFile)
+	loc, _ := cfg.location()
+	if cfg.Cost != nil {
+		cost := newCostCollector(namespace, cfg.Cost.Price, loc)
+		perMeter = append(perMeter, cost)
+		updaters = append(updaters, cost)
+		state.add("cost", cost)
+		if len(cfg.Cost.PriceURL) > 0 {
+			go runPriceFetcher(ctx, *cfg.Cost, cost.setPrice)
+		}
+	}
+	rates := newEnergyRateCollector(namespace)
+	perMeter = append(perMeter, rates)
+	updaters = append(updaters, rates)
+	hourly := newHourlyAverageCollector(namespace, loc)
+	perMeter = append(perMeter, hourly)
+	updaters = append(updaters, hourly)
+	state.add("hourly_average", hourly)
+	clock := newClockCollector(namespace, loc)
+	perMeter = append(perMeter, clock)
+	updaters = append(updaters, clock)
+	messages := newHourlyMessageCollector(namespace, loc, time.Now())
+	perMeter = append(perMeter, messages)
+	updaters = append(updaters, messages)
+	meter.loc = loc
+	meter.timestamps = cfg.EnergyTimestamps
+	meter.counters = cfg.EnergyCounters
+	var relay *relayServer
+	if len(cfg.RelayListen) > 0 {
+		relay = newRelayServer(namespace)
+		collectors = append(collectors, relay)
+	}
+	periods := newPeriodCollector(namespace, loc)
+	perMeter = append(perMeter, periods)
+	updaters = append(updaters, periods)
+	state.add("periods", periods)
+	if len(cfg.Tariffs) > 0 {
+		tariffs := newTariffCollector(namespace, cfg.Tariffs, loc)
+		perMeter = append(perMeter, tariffs)
+		updaters = append(updaters, tariffs)
+		state.add("tariffs", tariffs)
+	}
+	if cfg.VoltageQuality != nil {
+		quality := newVoltageQualityCollector(namespace, *cfg.VoltageQuality)
+		perMeter = append(perMeter, quality)
+		updaters = append(updaters, quality)
+	}
+	if cfg.Fuse != nil {
+		fuse := newFuseCollector(namespace, *cfg.Fuse)
+		perMeter = append(perMeter, fuse)
+		updaters = append(updaters, fuse)
+	}
+	if cfg.Capacity != nil {
+		peaks := newPeakCollector(namespace, *cfg.Capacity, loc)
+		perMeter = append(perMeter, peaks)
+		updaters = append(updaters, peaks)
+		state.add("peaks", peaks)
+	}
+	collectors = append(collectors, &meterSeries{meter: meter, collectors: perMeter})
+	if len(cfg.StateFile) > 0 {
+		// A broken state file only loses the accumulated values, and should not prevent startup.
+		if err := state.load(); err != nil {
+			log.Errorf("Restore state: %s", err)
+		}
+	}
+	var ha *haCoordinator
+	if cfg.HA != nil {
+		ha = newHACoordinator(namespace, *cfg.HA, time.Now())
+		collectors = append(collectors, ha.activeGauge, ha.transitions)
+	}
+	sinks := output.NewDispatcher(namespace)
+	collectors = append(collectors, sinks)
+
+	for _, c := range collectors {
+		err = registry.Register(c)
+		if err != nil {
+			return fmt.Errorf("register metrics: %w", err)
+		}
+		defer registry.Unregister(c)
+	}
+
+	// A standby instance starts its outputs once it becomes active.
+	out := standbyOutputs(cfg, sinks, ha.Active, nil)
+	defer func() {
+		out.stop()
+	}()
+	if ha == nil {
+		out, err = startOutputs(ctx, cfg, cfg.Gatherer, sinks, ha.Active, nil)
+		if err != nil {
+			return err
+		}
+	}
+	hist := newHistory(cfg.HistoryRetention)
+	last := &lastFrame{}
+
+	var plog *packetLog
+	if cfg.PacketLog != nil {
+		plog, err = openPacketLog(*cfg.PacketLog)
+		if err != nil {
+			return fmt.Errorf("open packet log: %w", err)
+		}
+		defer plog.Close()
+	}
+
+	// Errors caused by a misconfigured or noisy serial line tend to repeat with every frame.
+	limited := newLimitedLogger(cfg.LogRateLimit)
+
+	// Input stream
+	packets := make(chan *protocol.Packet, cfg.PacketBuffer)
+	parser := NewParser(cfg)
+	parser.OnSkip = func(skipped protocol.SkippedRegister) {
+		limited.Warnf("Skipped register %q: %s", skipped.OBIS, skipped.Err)
+		skippedCounter.WithLabelValues(strconv.Itoa(int(skipped.Tag))).Inc()
+	}
+	dec.Parser = parser
+
+	// accept passes a decoded frame on for processing, or records why it could not be decoded.
+	order, _ := src.(source.Reorderer)
+	accept := func(packet *protocol.Packet, err error) {
+		var parseErr *protocol.ParseError
+		if relay != nil {
+			// Frames that cannot be decoded are relayed as well, as downstream parsers may be more lenient.
+			switch {
+			case err == nil:
+				relay.send(packet.Frame)
+			case errors.As(err, &parseErr):
+				relay.send(parseErr.Frame)
+			}
+		}
+		switch {
+		case err == nil && order != nil && order.Late(packet):
+			log.Debugf("Dropped frame overtaken by a later one")
+			lateCounter.Inc()
+		case err == nil:
+			last.decoded(packet)
+			msgCounter.Inc()
+			frameSizes.WithLabelValues(messageType(packet)).Observe(float64(len(packet.Frame)))
+			frameBytes.Add(float64(len(packet.Frame)))
+			// Readers must never block, or frames are lost in the serial port buffer instead.
+			if !queue.Push(packets, packet) {
+				limited.Warnf("Processing is falling behind; dropped the oldest queued packet")
+				droppedCounter.Inc()
+			}
+		case errors.Is(err, protocol.ErrAuthentication) && errors.As(err, &parseErr):
+			last.failed(parseErr.Frame, parseErr.Err)
+			limited.Errorf("Reject frame: %s", parseErr.Err)
+			authErrorCounter.Inc()
+		case errors.As(err, &parseErr):
+			last.failed(parseErr.Frame, parseErr.Err)
+			limited.Errorf("Parse data structure: %s", parseErr.Err)
+			parseErrorCounter.Inc()
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(cfg.MetricsPath, scrapeHandler(meter, promhttp.InstrumentMetricHandler(cfg.Registerer, promhttp.HandlerFor(cfg.Gatherer, promhttp.HandlerOpts{}))))
+	mux.Handle("/api/v1/current", currentHandler(meter))
+	mux.Handle("/api/v1/history", historyHandler(hist))
+	mux.Handle("/api/v1/live", liveDataHandler(meter, periods))
+	mux.Handle("/api/v1/events", eventsHandler(packetStream))
+	mux.Handle("/live", liveHandler())
+	if ha != nil {
+		mux.Handle("/api/v1/ha", haHandler(ha))
+	}
+	mux.Handle("/", statusPageHandler(meter, cfg.MetricsPath))
+
+	// Health and debug endpoints are served separately if an admin listener is configured.
+	adminMux := mux
+	if len(cfg.AdminListen) > 0 {
+		adminMux = http.NewServeMux()
+	}
+	adminMux.Handle("/healthz", healthHandler())
+	adminMux.Handle("/debug/lastframe", lastFrameHandler(last))
+	if cfg.AcceptFrames {
+		adminMux.Handle("/api/v1/frames", framesHandler(parser, cfg.FramesToken, accept))
+	}
+	if cfg.RequestReload != nil {
+		adminMux.Handle("/-/reload", reloadHandler(cfg.RequestReload))
+	}
+
+	type httpServer struct {
+		address string
+		handler http.Handler
+	}
+	servers := make([]httpServer, 0, len(cfg.Listen)+1)
+	for _, address := range cfg.Listen {
+		if len(address) > 0 {
+			servers = append(servers, httpServer{address, mux})
+		}
+	}
+	if len(cfg.AdminListen) > 0 {
+		servers = append(servers, httpServer{cfg.AdminListen, adminMux})
+	}
+
+	errs := make(chan error, 1)
+	for _, srv := range servers {
+		server, err := serve(srv.address, srv.handler, func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+			cancel()
+		})
+		if err != nil {
+			return err
+		}
+		defer server.Close()
+	}
+
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	if len(cfg.StateFile) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			state.run(ctx)
+		}()
+	}
+
+	if ha != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ha.run(ctx)
+		}()
+	}
+
+	if len(cfg.GRPCListen) > 0 {
+		listener, err := listen(cfg.GRPCListen)
+		if err != nil {
+			return fmt.Errorf("gRPC server: %w", err)
+		}
+		server := grpc.NewServer()
+		amspb.RegisterMeterServer(server, &grpcServer{packets: packetStream, meter: meter})
+		defer server.Stop()
+
+		go func() {
+			log.Infof("Started gRPC server on %s", cfg.GRPCListen)
+			err := server.Serve(listener)
+			if err != nil {
+				select {
+				case errs <- fmt.Errorf("gRPC server: %w", err):
+				default:
+				}
+				cancel()
+			}
+		}()
+	}
+
+	if len(cfg.ModbusListen) > 0 {
+		listener, err := listen(cfg.ModbusListen)
+		if err != nil {
+			return fmt.Errorf("Modbus server: %w", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			log.Infof("Started Modbus server on %s", cfg.ModbusListen)
+			newModbusServer(meter).serve(ctx, listener)
+		}()
+	}
+
+	if relay != nil {
+		listener, err := listen(cfg.RelayListen)
+		if err != nil {
+			return fmt.Errorf("frame relay: %w", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			log.Infof("Relaying frames on %s", cfg.RelayListen)
+			relay.serve(ctx, listener)
+		}()
+	}
+
+	if len(cfg.SNMPListen) > 0 {
+		conn, err := net.ListenPacket("udp", cfg.SNMPListen)
+		if err != nil {
+			return fmt.Errorf("SNMP agent: %w", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			log.Infof("Started SNMP agent on %s", cfg.SNMPListen)
+			newSNMPAgent(meter, cfg.SNMPCommunity).serve(ctx, conn)
+		}()
+	}
+
+	// Everything needing root, such as the serial port and privileged ports, is open by now.
+	removePIDFile, err := harden(cfg)
+	defer removePIDFile()
+	if err != nil {
+		return err
+	}
+
+	if input != nil {
+		// Polled sources deliver frames at long intervals, which the watchdog has to allow for,
+		// and which are not missed frames.
+		dogCfg := cfg.Watchdog
+		poller, polled := src.(source.Poller)
+		if polled && dogCfg.Timeout > 0 && dogCfg.Timeout < 2*poller.PollInterval() {
+			dogCfg.Timeout = 2 * poller.PollInterval()
+		}
+		dog := newWatchdog(dogCfg, time.Now())
+		if dogCfg.Timeout > 0 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				dog.run(ctx, func() {
+					reopenCounter.Inc()
+					input.Reopen()
+				}, func(err error) {
+					select {
+					case errs <- fmt.Errorf("watchdog: %w", err):
+					default:
+					}
+					cancel()
+				})
+			}()
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var lastFrame time.Time
+			burst := 0
+			decoded := false
+			frameReceived := func(ok bool) {
+				// Frames arriving back-to-back, such as after a stalled connection, were held up rather
+				// than missed, so the gap before them is accounted for once the last of them is decoded.
+				// Only decoded frames kick the watchdog, as frames that cannot be parsed or authenticated
+				// do not show that the input works.
+				burst++
+				decoded = decoded || ok
+				if dec.Buffered() {
+					return
+				}
+				now := time.Now()
+				if decoded {
+					dog.kick(now)
+				}
+				if !lastFrame.IsZero() && !polled {
+					if n := missedFrames(now.Sub(lastFrame)) - (burst - 1); n > 0 {
+						missedCounter.Add(float64(n))
+						log.Debugf("Missed %d frames", n)
+					}
+				}
+				lastFrame = now
+				burst = 0
+				decoded = false
+			}
+
+			for {
+				packet, err := dec.NextPacket()
+				if ctx.Err() != nil {
+					break
+				}
+				var parseErr *protocol.ParseError
+				switch {
+				case err == nil:
+					frameReceived(true)
+					accept(packet, nil)
+				case errors.Is(err, protocol.ErrResynced):
+					resyncCounter.Inc()
+					log.Debugf("HDLC frame re-synced")
+				case errors.Is(err, protocol.ErrAborted):
+					abortCounter.Inc()
+					limited.Errorf("HDLC frame aborted")
+				case errors.Is(err, protocol.ErrChecksum):
+					checksumCounter.Inc()
+					limited.Errorf("HDLC frame checksum mismatch")
+				case errors.Is(err, protocol.ErrFrameTooLong):
+					resyncCounter.Inc()
+					limited.Errorf("HDLC frame too long")
+				case errors.As(err, &parseErr):
+					frameReceived(false)
+					accept(nil, err)
+				case errors.Is(err, serial.ErrTimeout):
+				case err == io.EOF || err == io.ErrUnexpectedEOF:
+					// Only sources with an end, such as files, return EOF itself. Lost connections
+					// are reported as other errors, and reconnected on the next read.
+					log.Infof("Input ended")
+					return
+				default:
+					limited.Errorf("Read input: %s", err)
+				}
+			}
+			log.Infof("Packet reading stopped")
+		}()
+	}
+
+	for {
+		select {
+		case packet := <-packets:
+			observeStages(stageLatency, packet.Timing, time.Now())
+			packet, dropped := plausible.filter(packet)
+			if len(dropped) > 0 {
+				limited.Warnf("Dropped implausible values of registers %s", strings.Join(dropped, ", "))
+			}
+			for _, u := range updaters {
+				u.Update(packet)
+			}
+			hist.Add(packet)
+			// Only the active instance writes to push-based outputs, while both serve metrics.
+			if ha.Active() {
+				out.alerts.Evaluate(packet)
+				sinks.Write(packet)
+			}
+			if plog != nil {
+				err = plog.Write(packet)
+				if err != nil {
+					log.Errorf("Write packet log: %s", err)
+				}
+			}
+			if received := packet.Timing.Received; !received.IsZero() {
+				stageLatency.WithLabelValues("process").Observe(time.Since(received).Seconds())
+			}
+		case <-ha.Changes():
+			switch {
+			case ha.Active() && !out.started:
+				next, err := startOutputs(ctx, out.cfg, cfg.Gatherer, sinks, ha.Active, out)
+				if err != nil {
+					log.Errorf("Start outputs: %s", err)
+				}
+				out = next
+			case !ha.Active() && out.started:
+				out = out.handOver()
+			}
+		case newCfg := <-cfg.Reload:
+			out, err = out.reload(ctx, newCfg, cfg.Gatherer)
+			if err != nil {
+				log.Errorf("Reload configuration: %s", err)
+				break
+			}
+			meter.setFilter(newCfg.Registers)
+		case <-ctx.Done():
+			select {
+			case err = <-errs:
+				return err
+			default:
+				return nil
+			}
+		}
+	}
+}
+
+// observeStages records the time from reading the start of a frame until each of its decoding stages
+// completed, and until it was taken off the queue at dequeued. Frames not read from a byte stream are skipped.
+func observeStages(latency *prometheus.SummaryVec, timing protocol.Timing, dequeued time.Time) {
+	if timing.Received.IsZero() {
+		return
+	}
+	stages := map[string]time.Time{
+		"unframe": timing.Unframed,
+		"decrypt": timing.Deciphered,
+		"parse":   timing.Parsed,
+		"queue":   dequeued,
+	}
+	for stage, t := range stages {
+		if !t.IsZero() {
+			latency.WithLabelValues(stage).Observe(t.Sub(timing.Received).Seconds())
+		}
+	}
+}
+
+type updater interface {
+	Update(packet *protocol.Packet)
+}
+
+// NewParser returns a frame parser with the limits, payload offset and keys given in the configuration.
+func NewParser(cfg Config) *protocol.Parser {
+	parser := &protocol.Parser{
+		Lenient:         !cfg.Strict,
+		MaxStringLength: cfg.Parser.MaxStringLength,
+		MaxArrayLength:  cfg.Parser.MaxArrayLength,
+		MaxDepth:        cfg.Parser.MaxDepth,
+		PayloadOffset:   cfg.Parser.PayloadOffset,
+	}
+	if cfg.Security != nil {
+		// The keys have been checked when validating the configuration.
+		parser.Security, _ = cfg.Security.security()
+	}
+	return parser
+}
+
+// missedFrames returns the number of frames that should have arrived
+// within the gap between two consecutively received frames.
+func missedFrames(gap time.Duration) int {
+	n := int((gap+frameInterval/2)/frameInterval) - 1
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// messageType tells which of the lists sent by the meter a packet is: list1 with only the active power
+// every 2.5 seconds, list2 with all instantaneous values every 10 seconds, or list3 adding the
+// energy registers every hour. Packets matching none of these are of type unknown.
+func messageType(packet *protocol.Packet) string {
+	_, power := packet.Registers[obis.ActivePowerImport]
+	_, id := packet.Registers[obis.MeterID]
+	_, energy := packet.Registers[obis.ActiveEnergyImport]
+	switch {
+	case energy:
+		return "list3"
+	case id:
+		return "list2"
+	case power:
+		return "list1"
+	default:
+		return "unknown"
+	}
+}
+
+// portReader counts serial port traffic and failures. It also works around the serial
+// library returning a negative count along with read errors, which bufio rejects.
+type portReader struct {
+	io.Reader
+	bytesRead  prometheus.Counter
+	timeouts   prometheus.Counter
+	readErrors prometheus.Counter
+}
+
+func (r portReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n < 0 {
+		n = 0
+	}
+	r.bytesRead.Add(float64(n))
+	switch {
+	case err == nil:
+	case errors.Is(err, serial.ErrTimeout):
+		r.timeouts.Inc()
+	default:
+		r.readErrors.Inc()
+	}
+	return n, err
+}
+
+// serve starts an HTTP server on the address, calling fail if it stops unexpectedly.
+func serve(address string, handler http.Handler, fail func(error)) (*http.Server, error) {
+	listener, err := listen(address)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP server: %w", err)
+	}
+
+	server := &http.Server{
+		Handler: handler,
+	}
+
+	go func() {
+		log.Infof("Started HTTP server on %s", address)
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			fail(fmt.Errorf("HTTP server: %w", err))
+		}
+	}()
+
+	return server, nil
+}
+
+// listen opens a TCP listener, or a Unix domain socket if the address is on the form unix:///path/to/socket.
+func listen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, unixAddressPrefix) {
+		return net.Listen("tcp", address)
+	}
+	path := strings.TrimPrefix(address, unixAddressPrefix)
+	// Remove a socket left behind by an unclean shutdown.
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+func counter(namespace, key, description string) prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      key,
+		Help:      description,
+	})
+}
@@ -0,0 +1,59 @@
+package exporter
+
+import (
+	`fmt`
+	`regexp`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/obis`
+)
+
+var obisCodePattern = regexp.MustCompile(`^\d{1,3}-\d{1,3}:\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}$`)
+
+// RegisterFilter selects the registers exported as metrics. Registers are given
+// either by OBIS code, such as 1-0:3.7.0.255, or by metric name without the namespace,
+// such as reactive_positive_instantaneous_value.
+type RegisterFilter struct {
+	// If set, only these registers are exported.
+	Include []string `yaml:"include"`
+
+	// Registers that are never exported.
+	Exclude []string `yaml:"exclude"`
+}
+
+func (f RegisterFilter) validate() error {
+	for _, list := range [][]string{f.Include, f.Exclude} {
+		for _, entry := range list {
+			if !obisCodePattern.MatchString(entry) && !knownRegisterName(entry) {
+				return fmt.Errorf("%q is neither an OBIS code nor a known register name", entry)
+			}
+		}
+	}
+	return nil
+}
+
+// allows reports whether a register is exported.
+func (f RegisterFilter) allows(code string) bool {
+	if len(f.Include) > 0 && !matchesRegister(f.Include, code) {
+		return false
+	}
+	return !matchesRegister(f.Exclude, code)
+}
+
+func matchesRegister(list []string, code string) bool {
+	reg, known := obis.Lookup(code)
+	for _, entry := range list {
+		if entry == code || (known && entry == reg.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+func knownRegisterName(name string) bool {
+	for _, reg := range obis.Registers() {
+		if reg.Name == name && reg.Type != obis.Info {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+package exporter
+
+import (
+	`fmt`
+	`sync`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/obis`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+	`github.com/prometheus/client_golang/prometheus`
+)
+
+// FuseConfig describes the main fuse of the installation.
+type FuseConfig struct {
+	// Rating of the main fuse in amperes, such as 25 or 63.
+	Amps float64 `yaml:"amps"`
+
+	// Number of phases, 1 or 3. Defaults to 3.
+	Phases int `yaml:"phases"`
+
+	// Voltage converting headroom in amperes to watts for phases the meter sends no voltage for.
+	// Defaults to 230 V.
+	Voltage float64 `yaml:"voltage"`
+}
+
+func (cfg *FuseConfig) validate() error {
+	if cfg.Phases == 0 {
+		cfg.Phases = 3
+	}
+	if cfg.Voltage == 0 {
+		cfg.Voltage = 230
+	}
+	switch {
+	case cfg.Amps <= 0:
+		return fmt.Errorf("amps must be positive")
+	case cfg.Phases != 1 && cfg.Phases != 3:
+		return fmt.Errorf("phases must be 1 or 3")
+	case cfg.Voltage < 0:
+		return fmt.Errorf("voltage must be positive")
+	}
+	return nil
+}
+
+// fuseLoad holds the latest current and voltage of a phase.
+type fuseLoad struct {
+	current float64
+	voltage float64
+}
+
+// fuseCollector exports the load of each phase relative to the main fuse, and the headroom left before
+// reaching its rating, for decisions such as how much an EV charger may draw.
+type fuseCollector struct {
+	mu      sync.Mutex
+	cfg     FuseConfig
+	meterID string
+	phases  []*fuseLoad
+
+	ratioDesc        *prometheus.Desc
+	headroomAmpsDesc *prometheus.Desc
+	headroomDesc     *prometheus.Desc
+}
+
+func newFuseCollector(namespace string, cfg FuseConfig) *fuseCollector {
+	labels := []string{"meter_id", "phase"}
+	return &fuseCollector{
+		cfg:    cfg,
+		phases: make([]*fuseLoad, cfg.Phases),
+		ratioDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "fuse_load_ratio"),
+			"Current of a phase as a fraction of the main fuse rating",
+			labels,
+			nil,
+		),
+		headroomAmpsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "fuse_headroom_amperes"),
+			"Current that may be added to a phase before reaching the main fuse rating, negative when above it",
+			labels,
+			nil,
+		),
+		headroomDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "fuse_headroom_watts"),
+			"Power that may be added to a phase before reaching the main fuse rating, at the voltage of the phase",
+			labels,
+			nil,
+		),
+	}
+}
+
+func (c *fuseCollector) Update(packet *protocol.Packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if id, ok := packet.Registers[obis.MeterID].Value.(string); ok {
+		c.meterID = id
+	}
+	for i := range c.phases {
+		reg, ok := packet.Registers[currentCodes[i]]
+		if !ok {
+			continue
+		}
+		current, err := reg.Float()
+		if err != nil {
+			continue
+		}
+		if c.phases[i] == nil {
+			c.phases[i] = &fuseLoad{voltage: c.cfg.Voltage}
+		}
+		c.phases[i].current = current
+		if reg, ok := packet.Registers[voltageCodes[i]]; ok {
+			if voltage, err := reg.Float(); err == nil {
+				c.phases[i].voltage = voltage
+			}
+		}
+	}
+}
+
+func (c *fuseCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.ratioDesc
+	ch <- c.headroomAmpsDesc
+	ch <- c.headroomDesc
+}
+
+func (c *fuseCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Phases the meter does not measure, such as L2 on IT networks, are left out.
+	for i, load := range c.phases {
+		if load == nil {
+			continue
+		}
+		phase := fmt.Sprintf("l%d", i+1)
+		headroom := c.cfg.Amps - load.current
+		ch <- prometheus.MustNewConstMetric(c.ratioDesc, prometheus.GaugeValue, load.current/c.cfg.Amps, c.meterID, phase)
+		ch <- prometheus.MustNewConstMetric(c.headroomAmpsDesc, prometheus.GaugeValue, headroom, c.meterID, phase)
+		ch <- prometheus.MustNewConstMetric(c.headroomDesc, prometheus.GaugeValue, headroom*load.voltage, c.meterID, phase)
+	}
+}
@@ -0,0 +1,120 @@
+package exporter
+
+import (
+	`sync`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/amspb`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+	log "github.com/sirupsen/logrus"
+	`google.golang.org/protobuf/types/known/timestamppb`
+)
+
+// Number of packets buffered for each subscriber. Packets are dropped for subscribers falling further behind.
+const subscriberBuffer = 16
+
+// broadcaster passes packets on to any number of subscribers.
+type broadcaster struct {
+	mu sync.Mutex
+
+	// Subscribers, and whether each is evicted rather than missing packets when falling behind.
+	subscribers map[chan *protocol.Packet]bool
+}
+
+func newBroadcaster() *broadcaster {
+	return &broadcaster{
+		subscribers: make(map[chan *protocol.Packet]bool),
+	}
+}
+
+// subscribe returns a channel receiving all packets. If evict is set, the channel is closed
+// if the subscriber falls behind, instead of dropping packets.
+func (b *broadcaster) subscribe(evict bool) chan *protocol.Packet {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan *protocol.Packet, subscriberBuffer)
+	b.subscribers[ch] = evict
+	return ch
+}
+
+func (b *broadcaster) unsubscribe(ch chan *protocol.Packet) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscribers, ch)
+}
+
+func (b *broadcaster) Update(packet *protocol.Packet) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch, evict := range b.subscribers {
+		select {
+		case ch <- packet:
+		default:
+			if evict {
+				delete(b.subscribers, ch)
+				close(ch)
+			}
+		}
+	}
+}
+
+// grpcServer implements the Meter service.
+type grpcServer struct {
+	amspb.UnimplementedMeterServer
+	packets *broadcaster
+	meter   *meterCollector
+}
+
+func (s *grpcServer) Subscribe(req *amspb.SubscribeRequest, stream amspb.Meter_SubscribeServer) error {
+	ch := s.packets.subscribe(false)
+	defer s.packets.unsubscribe(ch)
+
+	log.Debugf("gRPC client subscribed")
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case packet := <-ch:
+			err := stream.Send(packetMessage(packet, s.meter.Status().MeterID, req.Obis))
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// packetMessage converts a packet to its protobuf representation, including only the given registers, if any.
+func packetMessage(packet *protocol.Packet, meterID string, include []string) *amspb.Packet {
+	msg := &amspb.Packet{
+		Time:    timestamppb.New(packet.Time),
+		MeterId: meterID,
+	}
+	for _, rec := range NewPacketRecord(packet, false).Registers {
+		if len(include) > 0 && !contains(include, rec.OBIS) {
+			continue
+		}
+		reg := &amspb.Register{
+			Obis: rec.OBIS,
+			Unit: rec.Unit,
+		}
+		switch val := rec.Value.(type) {
+		case float64:
+			reg.Value = &amspb.Register_Number{Number: val}
+		case string:
+			reg.Value = &amspb.Register_Text{Text: val}
+		default:
+			continue
+		}
+		msg.Registers = append(msg.Registers, reg)
+	}
+	return msg
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
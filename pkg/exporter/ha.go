@@ -0,0 +1,304 @@
+package exporter
+
+import (
+	`context`
+	`encoding/json`
+	`fmt`
+	`io`
+	`net/http`
+	`os`
+	`path/filepath`
+	`strings`
+	`sync`
+	`time`
+
+	`github.com/prometheus/client_golang/prometheus`
+	log "github.com/sirupsen/logrus"
+)
+
+// Ways of deciding which instance is active.
+const (
+	haModeFile = "file"
+	haModePeer = "peer"
+)
+
+// HAConfig configures active/standby operation of two instances reading the same frames, such as from
+// a frame relay or MQTT. Both serve metrics, but only the active instance connects to and writes to
+// push-based outputs: MQTT, AMQP, Redis, Zabbix, Elasticsearch, sinks, exec, heartbeat, alerts and the
+// Pushgateway. The standby instance starts them when it takes over.
+type HAConfig struct {
+	// How the instances agree on which is active: file, a lock file on storage shared by both, or peer,
+	// asking the other instance over HTTP.
+	Mode string `yaml:"mode"`
+
+	// Name of this instance, which must differ between the instances. Defaults to the host name.
+	ID string `yaml:"id"`
+
+	// Lock file, in file mode.
+	LockFile string `yaml:"lock_file"`
+
+	// URL of the HTTP server of the other instance, in peer mode, such as http://standby:8080.
+	Peer string `yaml:"peer"`
+
+	// How often the lock is renewed, or the peer asked. Defaults to 5 seconds.
+	Interval time.Duration `yaml:"interval"`
+
+	// Time after which a lock that was not renewed, or a peer that does not respond, counts as failed,
+	// and this instance takes over. Defaults to three intervals.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (cfg *HAConfig) validate() error {
+	if len(cfg.ID) == 0 {
+		host, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("id: %w", err)
+		}
+		cfg.ID = host
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 5 * time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 3 * cfg.Interval
+	}
+	if cfg.Timeout <= cfg.Interval {
+		return fmt.Errorf("timeout must be longer than interval")
+	}
+	switch cfg.Mode {
+	case haModeFile:
+		if len(cfg.LockFile) == 0 {
+			return fmt.Errorf("lock_file is required in file mode")
+		}
+	case haModePeer:
+		if err := validateURL(cfg.Peer, "http", "https"); err != nil {
+			return fmt.Errorf("peer: %w", err)
+		}
+	default:
+		return fmt.Errorf("mode must be %s or %s", haModeFile, haModePeer)
+	}
+	return nil
+}
+
+// haState is the content of the lock file, and the response of the status endpoint.
+type haState struct {
+	ID      string    `json:"id"`
+	Active  bool      `json:"active"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// haCoordinator decides whether this instance is active. A nil coordinator is always active.
+type haCoordinator struct {
+	cfg    HAConfig
+	client *http.Client
+
+	mu       sync.Mutex
+	active   bool
+	claimed  bool
+	lastPeer time.Time
+	changes  chan struct{}
+
+	activeGauge prometheus.Gauge
+	transitions prometheus.Counter
+}
+
+func newHACoordinator(namespace string, cfg HAConfig, now time.Time) *haCoordinator {
+	return &haCoordinator{
+		cfg:      cfg,
+		client:   &http.Client{Timeout: cfg.Interval},
+		lastPeer: now,
+		changes:  make(chan struct{}, 1),
+		activeGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "ha_active",
+			Help:      "Whether this instance is the active one, writing to push-based outputs",
+		}),
+		transitions: counter(namespace, "ha_transitions_total", "Total number of times this instance became active or standby"),
+	}
+}
+
+// Active reports whether this instance should write to push-based outputs.
+func (c *haCoordinator) Active() bool {
+	if c == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.active
+}
+
+// Changes returns a channel receiving a value whenever this instance becomes active or standby.
+// The channel of a nil coordinator never receives.
+func (c *haCoordinator) Changes() <-chan struct{} {
+	if c == nil {
+		return nil
+	}
+	return c.changes
+}
+
+// run checks the lock or the peer every interval until the context is canceled.
+func (c *haCoordinator) run(ctx context.Context) {
+	log.Infof("Starting as standby instance %s, coordinating by %s", c.cfg.ID, c.cfg.Mode)
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		c.check(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			// Let the other instance take over right away, rather than after the lock expires.
+			if c.cfg.Mode == haModeFile && c.Active() {
+				c.release()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check decides whether this instance is active, and records any change.
+func (c *haCoordinator) check(ctx context.Context, now time.Time) {
+	var active bool
+	var err error
+	switch c.cfg.Mode {
+	case haModeFile:
+		active, err = c.checkLock(now)
+	case haModePeer:
+		active, err = c.checkPeer(ctx, now)
+	}
+	if err != nil {
+		log.Debugf("High availability: %s", err)
+	}
+
+	c.mu.Lock()
+	changed := active != c.active
+	c.active = active
+	c.mu.Unlock()
+	if !changed {
+		return
+	}
+	c.transitions.Inc()
+	select {
+	case c.changes <- struct{}{}:
+	default:
+	}
+	if active {
+		c.activeGauge.Set(1)
+		log.Infof("Instance %s is now active", c.cfg.ID)
+	} else {
+		c.activeGauge.Set(0)
+		log.Infof("Instance %s is now standby", c.cfg.ID)
+	}
+}
+
+// checkLock takes the lock if it is free or expired, and renews it until it expires a timeout from now
+// while it is held. An instance taking the lock only becomes active if it still holds it at the next
+// check, so that of two instances taking it at the same time, only the one writing last becomes active.
+func (c *haCoordinator) checkLock(now time.Time) (bool, error) {
+	c.mu.Lock()
+	claimed := c.claimed
+	c.claimed = false
+	c.mu.Unlock()
+
+	lock, err := c.readLock()
+	held := err == nil && lock.ID == c.cfg.ID
+	if err == nil && !held && now.Before(lock.Expires) {
+		return false, nil
+	}
+	if err := c.writeLock(haState{ID: c.cfg.ID, Active: true, Expires: now.Add(c.cfg.Timeout)}); err != nil {
+		// An instance unable to renew its lock cannot tell whether the other has taken over.
+		return false, fmt.Errorf("write lock file: %w", err)
+	}
+	if held && (claimed || c.Active()) {
+		return true, nil
+	}
+	c.mu.Lock()
+	c.claimed = true
+	c.mu.Unlock()
+	return false, nil
+}
+
+func (c *haCoordinator) readLock() (haState, error) {
+	var lock haState
+	data, err := os.ReadFile(c.cfg.LockFile)
+	if err != nil {
+		return lock, err
+	}
+	return lock, json.Unmarshal(data, &lock)
+}
+
+// writeLock replaces the lock file atomically, so that it is never read half written.
+func (c *haCoordinator) writeLock(lock haState) error {
+	data, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.cfg.LockFile), filepath.Base(c.cfg.LockFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.cfg.LockFile)
+}
+
+// release removes the lock file if this instance holds it.
+func (c *haCoordinator) release() {
+	if lock, err := c.readLock(); err == nil && lock.ID == c.cfg.ID {
+		os.Remove(c.cfg.LockFile)
+	}
+}
+
+// checkPeer asks the other instance whether it is active. An instance takes over once the peer has not
+// responded for a timeout. If both or neither are active, the instance with the lowest ID is, so that
+// the instances agree without further coordination, and an instance coming back stays standby.
+func (c *haCoordinator) checkPeer(ctx context.Context, now time.Time) (bool, error) {
+	active := c.Active()
+	peer, err := c.askPeer(ctx)
+	if err != nil {
+		c.mu.Lock()
+		failed := now.Sub(c.lastPeer) >= c.cfg.Timeout
+		c.mu.Unlock()
+		return active || failed, err
+	}
+	c.mu.Lock()
+	c.lastPeer = now
+	c.mu.Unlock()
+	if peer.ID == c.cfg.ID {
+		return active, fmt.Errorf("peer has the same ID %s", peer.ID)
+	}
+	if peer.Active {
+		return active && c.cfg.ID < peer.ID, nil
+	}
+	return active || c.cfg.ID < peer.ID, nil
+}
+
+func (c *haCoordinator) askPeer(ctx context.Context) (haState, error) {
+	var peer haState
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(c.cfg.Peer, "/")+"/api/v1/ha", nil)
+	if err != nil {
+		return peer, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return peer, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return peer, fmt.Errorf("ask peer %s: %s", c.cfg.Peer, resp.Status)
+	}
+	return peer, json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&peer)
+}
+
+// haHandler serves the ID and role of this instance, as asked for by the peer.
+func haHandler(c *haCoordinator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(haState{ID: c.cfg.ID, Active: c.Active()})
+	}
+}
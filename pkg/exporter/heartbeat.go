@@ -0,0 +1,111 @@
+package exporter
+
+import (
+	`context`
+	`fmt`
+	`io`
+	`net/http`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/output`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+)
+
+func init() {
+	output.Register("heartbeat", newHeartbeat)
+}
+
+// HeartbeatConfig configures pinging a dead man's switch, such as healthchecks.io, while frames are being
+// decoded. The service notifies its users when the pings stop, which works even if the host running
+// Prometheus is down as well.
+type HeartbeatConfig struct {
+	// URL requested with GET, such as https://hc-ping.com/<uuid>.
+	URL string `yaml:"url"`
+
+	// Number of successfully decoded frames between pings. Defaults to 24, about once a minute.
+	Frames int `yaml:"frames"`
+
+	// Time allowed for a ping. Defaults to 10 seconds.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Buffering, retries and circuit breaking, as for sinks.
+	output.Options `yaml:",inline"`
+}
+
+func (cfg *HeartbeatConfig) validate() error {
+	if err := validateURL(cfg.URL, "http", "https"); err != nil {
+		return fmt.Errorf("url: %w", err)
+	}
+	if cfg.Frames <= 0 {
+		cfg.Frames = 24
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	return cfg.Options.Validate()
+}
+
+// heartbeat pings the configured URL every number of decoded packets.
+type heartbeat struct {
+	cfg    HeartbeatConfig
+	client *http.Client
+	frames int
+
+	// Set once enough packets have been counted, until the ping succeeds.
+	due bool
+}
+
+func newHeartbeat(decode func(v any) error) (output.Sink, error) {
+	var cfg HeartbeatConfig
+	if err := decode(&cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &heartbeat{cfg: cfg}, nil
+}
+
+func (h *heartbeat) Start(ctx context.Context) error {
+	h.client = &http.Client{Timeout: h.cfg.Timeout}
+	return nil
+}
+
+// Write counts a decoded packet, and pings once enough have been counted. A packet written again
+// after a failed ping is not counted again.
+func (h *heartbeat) Write(packet *protocol.Packet) error {
+	if !h.due {
+		h.frames++
+		if h.frames < h.cfg.Frames {
+			return nil
+		}
+		h.frames = 0
+		h.due = true
+	}
+	if err := h.ping(); err != nil {
+		return err
+	}
+	h.due = false
+	return nil
+}
+
+func (h *heartbeat) Close() error {
+	return nil
+}
+
+func (h *heartbeat) ping() error {
+	req, err := http.NewRequest(http.MethodGet, h.cfg.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("ping %s: %s", h.cfg.URL, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package exporter
+
+import (
+	`encoding/json`
+	`net/http`
+	`strconv`
+	`sync`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+	log "github.com/sirupsen/logrus"
+)
+
+// The meter sends a frame every 2.5 seconds.
+const frameInterval = 2500 * time.Millisecond
+
+// HistorySample is a single register value at a point in time.
+type HistorySample struct {
+	Time  time.Time `json:"time"`
+	OBIS  string    `json:"obis"`
+	Value any       `json:"value"`
+}
+
+// history keeps recently decoded packets in a fixed-size ring buffer.
+type history struct {
+	mu        sync.Mutex
+	retention time.Duration
+	entries   []*protocol.Packet
+	next      int
+}
+
+func newHistory(retention time.Duration) *history {
+	size := int(retention/frameInterval) + 1
+	return &history{
+		retention: retention,
+		entries:   make([]*protocol.Packet, size),
+	}
+}
+
+// Add stores a packet, overwriting the oldest one if the buffer is full.
+func (h *history) Add(packet *protocol.Packet) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.entries[h.next] = packet
+	h.next = (h.next + 1) % len(h.entries)
+}
+
+// Query returns all samples received after since, oldest first.
+// If obis is non-empty, only samples for that register are returned.
+func (h *history) Query(obis string, since time.Time) []HistorySample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	cutoff := time.Now().Add(-h.retention)
+	if since.Before(cutoff) {
+		since = cutoff
+	}
+
+	samples := make([]HistorySample, 0)
+	for i := range h.entries {
+		packet := h.entries[(h.next+i)%len(h.entries)]
+		if packet == nil || !packet.Time.After(since) {
+			continue
+		}
+		for code, reg := range packet.Registers {
+			if len(obis) > 0 && code != obis {
+				continue
+			}
+			var value any = reg.Value
+			if val, err := reg.Float(); err == nil {
+				value = val
+			}
+			samples = append(samples, HistorySample{
+				Time:  packet.Time,
+				OBIS:  code,
+				Value: value,
+			})
+		}
+	}
+
+	return samples
+}
+
+// parseSince accepts either an RFC 3339 timestamp, a UNIX timestamp, or a duration relative to now.
+func parseSince(s string) (time.Time, error) {
+	if len(s) == 0 {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Unix(0, int64(secs*float64(time.Second))), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Now().Add(-d), nil
+}
+
+func historyHandler(h *history) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		since, err := parseSince(query.Get("since"))
+		if err != nil {
+			http.Error(w, "invalid 'since' parameter: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(map[string]any{
+			"samples": h.Query(query.Get("obis"), since),
+		})
+		if err != nil {
+			log.Errorf("Encode history: %s", err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package exporter
+
+import (
+	`bytes`
+	`crypto/subtle`
+	`encoding/hex`
+	`errors`
+	`fmt`
+	`io`
+	`net/http`
+	`strings`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+)
+
+// Maximum size of a request body accepted by the frame ingestion endpoint.
+const maxIngestSize = 64 * 1024
+
+// framesHandler accepts HDLC frames sent by remote readers. The request body is either
+// a single frame without flag bytes, or one or more frames delimited by flag bytes.
+// Text bodies are decoded as hex first. Every decoded frame, or the error preventing it,
+// is passed to accept. If token is set, requests must carry it as a bearer token.
+func framesHandler(parser *protocol.Parser, token string, accept func(*protocol.Packet, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if len(token) > 0 && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxIngestSize+1))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(body) > maxIngestSize {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "text/") {
+			body, err = hex.DecodeString(strings.Join(strings.Fields(string(body)), ""))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("decode hex: %s", err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		errs := decodeFrames(parser, body, accept)
+		if len(errs) > 0 {
+			msgs := make([]string, len(errs))
+			for i, err := range errs {
+				msgs[i] = err.Error()
+			}
+			http.Error(w, strings.Join(msgs, "\n"), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// decodeFrames decodes all frames in the data, returning the errors encountered.
+func decodeFrames(parser *protocol.Parser, data []byte, accept func(*protocol.Packet, error)) []error {
+	var errs []error
+	if len(data) == 0 {
+		return []error{fmt.Errorf("no frame given")}
+	}
+
+	if data[0] != hdlcFlag {
+		packet, err := parser.DecodeFrame(data)
+		accept(packet, err)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		return errs
+	}
+
+	dec := protocol.NewDecoder(bytes.NewReader(data))
+	dec.Parser = parser
+	for {
+		packet, err := dec.NextPacket()
+		switch {
+		case err == nil:
+			accept(packet, nil)
+		case errors.Is(err, io.EOF):
+			return errs
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			return append(errs, fmt.Errorf("frame cut short at the end of the data"))
+		case errors.Is(err, protocol.ErrResynced):
+		default:
+			accept(nil, err)
+			errs = append(errs, err)
+		}
+	}
+}
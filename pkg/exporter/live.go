@@ -0,0 +1,40 @@
+package exporter
+
+import (
+	_ `embed`
+	`encoding/json`
+	`net/http`
+
+	log "github.com/sirupsen/logrus"
+)
+
+//go:embed web/live.html
+var livePage []byte
+
+// liveStatus is the data shown by the live dashboard.
+type liveStatus struct {
+	Status
+	EnergyToday float64 `json:"energy_today_wh"`
+}
+
+func liveHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(livePage)
+	}
+}
+
+// liveDataHandler serves the current readings, and the energy imported today according to the hourly
+// meter readings, so that the dashboard agrees with the energy_today_wh metric.
+func liveDataHandler(meter *meterCollector, periods *periodCollector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(liveStatus{
+			Status:      meter.Status(),
+			EnergyToday: periods.TodayWh(),
+		})
+		if err != nil {
+			log.Errorf("Encode live status: %s", err)
+		}
+	}
+}
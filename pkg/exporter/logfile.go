@@ -0,0 +1,157 @@
+package exporter
+
+import (
+	`fmt`
+	`os`
+	`sync`
+	`time`
+)
+
+// LogFileConfig configures writing log messages to a file, which is rotated when it grows too large.
+type LogFileConfig struct {
+	Path string `yaml:"path"`
+
+	// Size in megabytes at which the file is rotated. Defaults to 10.
+	MaxSizeMB int `yaml:"max_size_mb"`
+
+	// Number of rotated files kept, named after the log file followed by .1, .2 and so on,
+	// with .1 being the most recent. Defaults to 3.
+	MaxBackups int `yaml:"max_backups"`
+
+	// Rotated files older than this are removed, even if fewer than max_backups are kept.
+	// They are checked when the file is opened or rotated, and at most once a minute while writing.
+	// Zero keeps them regardless of age.
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+func (cfg *LogFileConfig) validate() error {
+	if len(cfg.Path) == 0 {
+		return fmt.Errorf("path is required")
+	}
+	if cfg.MaxSizeMB < 0 || cfg.MaxBackups < 0 || cfg.MaxAge < 0 {
+		return fmt.Errorf("max_size_mb, max_backups and max_age must not be negative")
+	}
+	if cfg.MaxSizeMB == 0 {
+		cfg.MaxSizeMB = 10
+	}
+	if cfg.MaxBackups == 0 {
+		cfg.MaxBackups = 3
+	}
+	return nil
+}
+
+// LogFile appends to a log file, rotating it before a write would make it larger than the configured size.
+// It is safe for concurrent use, and meant to be given to log.SetOutput.
+type LogFile struct {
+	cfg LogFileConfig
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	pruned time.Time
+}
+
+// logPruneInterval is how often writes check for rotated files older than max_age.
+const logPruneInterval = time.Minute
+
+// OpenLogFile opens the log file for appending, creating it if it does not exist.
+func OpenLogFile(cfg LogFileConfig) (*LogFile, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	f := &LogFile{cfg: cfg}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	f.prune()
+	return f, nil
+}
+
+func (f *LogFile) open() error {
+	file, err := os.OpenFile(f.cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *LogFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.size > 0 && f.size+int64(len(p)) > int64(f.cfg.MaxSizeMB)<<20 {
+		if err := f.rotate(); err != nil {
+			if f.file == nil {
+				return 0, fmt.Errorf("rotate log file: %w", err)
+			}
+			// Keep writing to the new file, even if the old one could not be kept.
+			fmt.Fprintf(os.Stderr, "Rotate log file: %s\n", err)
+		}
+	} else if time.Since(f.pruned) >= logPruneInterval {
+		f.prune()
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file to .1, shifting older files up and removing those beyond
+// the number or age kept, and starts a new file.
+func (f *LogFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+
+	backup := func(n int) string {
+		return fmt.Sprintf("%s.%d", f.cfg.Path, n)
+	}
+	os.Remove(backup(f.cfg.MaxBackups))
+	for n := f.cfg.MaxBackups - 1; n >= 1; n-- {
+		os.Rename(backup(n), backup(n+1))
+	}
+	err := os.Rename(f.cfg.Path, backup(1))
+	f.prune()
+
+	if openErr := f.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+// prune removes rotated files older than max_age. Older files have higher numbers,
+// so the files kept are still numbered from .1 without gaps.
+func (f *LogFile) prune() {
+	f.pruned = time.Now()
+	if f.cfg.MaxAge <= 0 {
+		return
+	}
+	for n := 1; n <= f.cfg.MaxBackups; n++ {
+		name := fmt.Sprintf("%s.%d", f.cfg.Path, n)
+		if info, err := os.Stat(name); err == nil && time.Since(info.ModTime()) > f.cfg.MaxAge {
+			os.Remove(name)
+		}
+	}
+}
+
+// Close closes the log file. Later writes fail.
+func (f *LogFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
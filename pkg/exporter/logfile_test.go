@@ -0,0 +1,79 @@
+package exporter
+
+import (
+	`bytes`
+	`os`
+	`path/filepath`
+	`testing`
+	`time`
+
+	`github.com/stretchr/testify/assert`
+)
+
+func TestLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ams.log")
+	f, err := OpenLogFile(LogFileConfig{Path: path, MaxSizeMB: 1, MaxBackups: 2})
+	assert.NoError(t, err)
+	defer f.Close()
+
+	chunk := bytes.Repeat([]byte("x"), 600<<10)
+	for _, c := range "abcd" {
+		chunk[0] = byte(c)
+		_, err := f.Write(chunk)
+		assert.NoError(t, err)
+	}
+
+	// Each write after the first overflows the file, which is rotated.
+	for name, first := range map[string]byte{path: 'd', path + ".1": 'c', path + ".2": 'b'} {
+		data, err := os.ReadFile(name)
+		if assert.NoError(t, err) {
+			assert.Len(t, data, len(chunk))
+			assert.Equal(t, first, data[0], name)
+		}
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	// Appending to an existing file continues where it left off.
+	assert.NoError(t, f.Close())
+	f, err = OpenLogFile(LogFileConfig{Path: path, MaxSizeMB: 1, MaxBackups: 2})
+	assert.NoError(t, err)
+	defer f.Close()
+	_, err = f.Write([]byte("e"))
+	assert.NoError(t, err)
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(chunk)+1), info.Size())
+}
+
+func TestLogFileMaxAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ams.log")
+	age := func(name string, d time.Duration) {
+		assert.NoError(t, os.WriteFile(name, []byte("x"), 0o644))
+		old := time.Now().Add(-d)
+		assert.NoError(t, os.Chtimes(name, old, old))
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(name)
+		return err == nil
+	}
+	age(path+".1", time.Hour)
+	age(path+".2", 3*time.Hour)
+
+	// Rotated files past their age are removed on open, without waiting for the file to grow.
+	f, err := OpenLogFile(LogFileConfig{Path: path, MaxBackups: 3, MaxAge: 2 * time.Hour})
+	assert.NoError(t, err)
+	defer f.Close()
+	assert.True(t, exists(path+".1"))
+	assert.False(t, exists(path+".2"))
+
+	// And while writing, once the prune interval has passed.
+	age(path+".1", 3*time.Hour)
+	_, err = f.Write([]byte("a"))
+	assert.NoError(t, err)
+	assert.True(t, exists(path+".1"))
+	f.pruned = time.Now().Add(-logPruneInterval)
+	_, err = f.Write([]byte("b"))
+	assert.NoError(t, err)
+	assert.False(t, exists(path+".1"))
+}
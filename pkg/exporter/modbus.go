@@ -0,0 +1,208 @@
+package exporter
+
+import (
+	`context`
+	`encoding/binary`
+	`io`
+	`math`
+	`net`
+	`sync`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/obis`
+	log "github.com/sirupsen/logrus"
+)
+
+// Modbus function codes answered by the server.
+const (
+	modbusReadHoldingRegisters = 0x03
+	modbusReadInputRegisters   = 0x04
+)
+
+// Modbus exception codes.
+const (
+	modbusIllegalFunction = 0x01
+	modbusIllegalAddress  = 0x02
+	modbusIllegalValue    = 0x03
+)
+
+// Maximum number of registers read by a single request, as given by the Modbus specification.
+const modbusMaxQuantity = 125
+
+// modbusValue is a value in the Modbus register map, occupying two registers as a 32-bit float.
+type modbusValue struct {
+	obis  string
+	scale float64
+}
+
+// Register map served over Modbus. Value i is found at register address 2*i, as a big-endian
+// IEEE 754 float with the high word first. Energy is given in kWh and kvarh, to fit in a float.
+var modbusValues = []modbusValue{
+	{obis.ActivePowerImport, 1},        // 0: imported active power, W
+	{obis.ActivePowerExport, 1},        // 2: exported active power, W
+	{obis.ReactivePowerImport, 1},      // 4: imported reactive power, var
+	{obis.ReactivePowerExport, 1},      // 6: exported reactive power, var
+	{obis.CurrentL1, 1},                // 8: L1 current, A
+	{obis.CurrentL2, 1},                // 10: L2 current, A
+	{obis.CurrentL3, 1},                // 12: L3 current, A
+	{obis.VoltageL1, 1},                // 14: L1 voltage, V
+	{obis.VoltageL2, 1},                // 16: L2 voltage, V
+	{obis.VoltageL3, 1},                // 18: L3 voltage, V
+	{obis.ActiveEnergyImport, 0.001},   // 20: imported active energy, kWh
+	{obis.ActiveEnergyExport, 0.001},   // 22: exported active energy, kWh
+	{obis.ReactiveEnergyImport, 0.001}, // 24: imported reactive energy, kvarh
+	{obis.ReactiveEnergyExport, 0.001}, // 26: exported reactive energy, kvarh
+}
+
+// Addresses of the values computed by the server, following the register map.
+const (
+	modbusNetPowerAddress = 2 * 14 // imported minus exported active power, W
+	modbusAgeAddress      = 2 * 15 // seconds since the last frame
+)
+
+// modbusRegisters lays out the current readings according to the register map.
+// Values not received from the meter are NaN.
+func modbusRegisters(status Status, now time.Time) []uint16 {
+	values := make(map[string]float64, len(status.Readings))
+	for _, r := range status.Readings {
+		values[r.OBIS] = r.Value
+	}
+
+	floats := make([]float64, 0, len(modbusValues)+2)
+	for _, v := range modbusValues {
+		val, ok := values[v.obis]
+		if !ok {
+			val = math.NaN()
+		}
+		floats = append(floats, val*v.scale)
+	}
+
+	net, ok := netPower(values)
+	if !ok {
+		net = math.NaN()
+	}
+	floats = append(floats, net)
+
+	age := math.NaN()
+	if !status.LastFrame.IsZero() {
+		age = now.Sub(status.LastFrame).Seconds()
+	}
+	floats = append(floats, age)
+
+	regs := make([]uint16, 0, 2*len(floats))
+	for _, val := range floats {
+		bits := math.Float32bits(float32(val))
+		regs = append(regs, uint16(bits>>16), uint16(bits))
+	}
+	return regs
+}
+
+// modbusServer serves the current readings as a Modbus TCP slave.
+// Holding and input registers share the same register map, and any unit identifier is accepted.
+type modbusServer struct {
+	meter *meterCollector
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func newModbusServer(meter *meterCollector) *modbusServer {
+	return &modbusServer{
+		meter: meter,
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+// serve accepts connections until the context is canceled, then closes all connections.
+func (s *modbusServer) serve(ctx context.Context, listener net.Listener) {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Errorf("Modbus server: %s", err)
+			continue
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+func (s *modbusServer) serveConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	log.Debugf("Modbus client connected from %s", conn.RemoteAddr())
+
+	// MBAP header: transaction id, protocol id, length of the remainder, unit id.
+	header := make([]byte, 7)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		length := binary.BigEndian.Uint16(header[4:6])
+		if binary.BigEndian.Uint16(header[2:4]) != 0 || length < 2 || length > 254 {
+			log.Debugf("Modbus client %s sent an invalid header", conn.RemoteAddr())
+			return
+		}
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return
+		}
+
+		resp := s.handle(pdu)
+		out := make([]byte, 7, 7+len(resp))
+		copy(out, header)
+		binary.BigEndian.PutUint16(out[4:6], uint16(len(resp)+1))
+		out = append(out, resp...)
+		if _, err := conn.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+// handle answers a single request PDU.
+func (s *modbusServer) handle(pdu []byte) []byte {
+	fn := pdu[0]
+	if fn != modbusReadHoldingRegisters && fn != modbusReadInputRegisters {
+		return []byte{fn | 0x80, modbusIllegalFunction}
+	}
+	if len(pdu) != 5 {
+		return []byte{fn | 0x80, modbusIllegalValue}
+	}
+	address := int(binary.BigEndian.Uint16(pdu[1:3]))
+	quantity := int(binary.BigEndian.Uint16(pdu[3:5]))
+	if quantity < 1 || quantity > modbusMaxQuantity {
+		return []byte{fn | 0x80, modbusIllegalValue}
+	}
+
+	regs := modbusRegisters(s.meter.Status(), time.Now())
+	if address+quantity > len(regs) {
+		return []byte{fn | 0x80, modbusIllegalAddress}
+	}
+
+	resp := make([]byte, 2, 2+2*quantity)
+	resp[0] = fn
+	resp[1] = byte(2 * quantity)
+	for _, reg := range regs[address : address+quantity] {
+		resp = append(resp, byte(reg>>8), byte(reg))
+	}
+	return resp
+}
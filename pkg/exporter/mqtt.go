@@ -0,0 +1,285 @@
+package exporter
+
+import (
+	`context`
+	`encoding/json`
+	`fmt`
+	`strings`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/obis`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/output`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	output.Register("mqtt", newMQTT)
+}
+
+// MQTTConfig configures the connection to an MQTT broker.
+type MQTTConfig struct {
+	Broker   string `yaml:"broker"`
+	ClientID string `yaml:"client_id"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// Topic receiving every decoded packet. If empty, readings are not published.
+	Topic string `yaml:"topic"`
+
+	// Payload format of published readings, either json or amsreader. Defaults to json.
+	// With sparkplugb, readings are published as a Sparkplug B edge node instead, ignoring the
+	// topic and availability topic.
+	Format string `yaml:"format"`
+
+	// Identity of the Sparkplug B edge node, if the format is sparkplugb.
+	Sparkplug SparkplugConfig `yaml:"sparkplug"`
+
+	// Topic receiving the raw frame of every decoded packet, without flag bytes. If empty, frames are not published.
+	FrameTopic string `yaml:"frame_topic"`
+
+	// Topic holding the retained availability of the exporter, either online or offline.
+	// Defaults to ams/availability.
+	AvailabilityTopic string `yaml:"availability_topic"`
+
+	// Buffering, retries and circuit breaking of readings and frames, as for sinks.
+	output.Options `yaml:",inline"`
+}
+
+func (cfg *MQTTConfig) validate() error {
+	if len(cfg.Broker) == 0 {
+		return fmt.Errorf("broker is required")
+	}
+	if err := validateURL(cfg.Broker, "tcp", "ssl", "tls", "mqtt", "mqtts", "ws", "wss"); err != nil {
+		return fmt.Errorf("broker: %w", err)
+	}
+	if len(cfg.Format) == 0 {
+		cfg.Format = "json"
+	}
+	if len(cfg.AvailabilityTopic) == 0 {
+		cfg.AvailabilityTopic = "ams/availability"
+	}
+	if cfg.Format == sparkplugFormat {
+		if err := cfg.Sparkplug.validate(); err != nil {
+			return fmt.Errorf("sparkplug: %w", err)
+		}
+	} else if _, ok := mqttFormats[cfg.Format]; !ok {
+		return fmt.Errorf("unknown format %q", cfg.Format)
+	}
+	return cfg.Options.Validate()
+}
+
+// Payloads published to the availability topic, as expected by Home Assistant.
+const (
+	mqttOnline  = "online"
+	mqttOffline = "offline"
+)
+
+// mqttFormats encode packets for publishing to MQTT.
+var mqttFormats = map[string]func(packet *protocol.Packet, meterID string) ([]byte, error){
+	"json":      jsonPayload,
+	"amsreader": amsReaderPayload,
+}
+
+func jsonPayload(packet *protocol.Packet, meterID string) ([]byte, error) {
+	return json.Marshal(NewPacketRecord(packet, false))
+}
+
+// Fields of the JSON payload published by the AmsToMqttBridge and amsreader firmware,
+// keyed by OBIS code. Energy is published in kWh.
+var amsReaderFields = map[string]string{
+	obis.ActivePowerImport:    "P",
+	obis.ActivePowerExport:    "PO",
+	obis.ReactivePowerImport:  "Q",
+	obis.ReactivePowerExport:  "QO",
+	obis.CurrentL1:            "I1",
+	obis.CurrentL2:            "I2",
+	obis.CurrentL3:            "I3",
+	obis.VoltageL1:            "U1",
+	obis.VoltageL2:            "U2",
+	obis.VoltageL3:            "U3",
+	obis.ActiveEnergyImport:   "tPI",
+	obis.ActiveEnergyExport:   "tPO",
+	obis.ReactiveEnergyImport: "tQI",
+	obis.ReactiveEnergyExport: "tQO",
+	obis.ListVersion:          "lv",
+	obis.MeterID:              "id",
+	obis.MeterType:            "type",
+}
+
+// amsReaderPayload encodes a packet the same way as the AmsToMqttBridge and amsreader firmware,
+// so that existing Home Assistant and Node-RED setups keep working.
+func amsReaderPayload(packet *protocol.Packet, meterID string) ([]byte, error) {
+	data := make(map[string]any)
+	for code, reg := range packet.Registers {
+		field, ok := amsReaderFields[code]
+		if !ok {
+			continue
+		}
+		if val, err := reg.Float(); err == nil {
+			if strings.HasPrefix(field, "t") && field != "type" {
+				val /= 1000
+			}
+			data[field] = val
+		} else {
+			data[field] = reg.Value
+		}
+	}
+	return json.Marshal(struct {
+		ID   string         `json:"id"`
+		T    int64          `json:"t"`
+		Data map[string]any `json:"data"`
+	}{
+		ID:   meterID,
+		T:    packet.Time.Unix(),
+		Data: data,
+	})
+}
+
+// connectMQTT connects to the MQTT broker. The client reconnects automatically if the connection is lost.
+//
+// The broker publishes offline to the availability topic if the connection is lost, as the last
+// will of the client, and online is published again on every successful connection.
+//
+// A Sparkplug B node, if given, replaces the last will and the availability with its own messages.
+func connectMQTT(cfg MQTTConfig, spb *sparkplugNode) (mqtt.Client, error) {
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetWill(cfg.AvailabilityTopic, mqttOffline, 1, true).
+		SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			log.Errorf("MQTT connection lost: %s", err)
+		}).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			log.Infof("Connected to MQTT broker %s", cfg.Broker)
+			client.Publish(cfg.AvailabilityTopic, 1, true, mqttOnline)
+		})
+	if spb != nil {
+		spb.configure(opts)
+	}
+
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(10 * time.Second) {
+		log.Warnf("MQTT broker %s not reachable yet, retrying in the background", cfg.Broker)
+		return client, nil
+	}
+	if err := token.Error(); err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", cfg.Broker, err)
+	}
+	return client, nil
+}
+
+// disconnectMQTT marks the exporter as offline, which the broker does not do for a clean disconnect,
+// and closes the connection.
+func disconnectMQTT(client mqtt.Client, cfg MQTTConfig) {
+	token := client.Publish(cfg.AvailabilityTopic, 1, true, mqttOffline)
+	if !token.WaitTimeout(time.Second) {
+		log.Warnf("Timed out publishing MQTT availability")
+	}
+	client.Disconnect(1000)
+}
+
+// mqttPublisher publishes readings and frames to an MQTT broker, or readings as a Sparkplug B edge node.
+type mqttPublisher struct {
+	cfg     MQTTConfig
+	spb     *sparkplugNode
+	client  mqtt.Client
+	meterID string
+
+	// Set if another connection publishes that the exporter is online, which closing this one must not undo.
+	handedOver bool
+}
+
+func newMQTT(decode func(v any) error) (output.Sink, error) {
+	var cfg MQTTConfig
+	if err := decode(&cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	p := &mqttPublisher{cfg: cfg}
+	if cfg.Format == sparkplugFormat {
+		p.spb = newSparkplugNode(cfg.Sparkplug)
+	}
+	return p, nil
+}
+
+func (p *mqttPublisher) Start(ctx context.Context) error {
+	client, err := connectMQTT(p.cfg, p.spb)
+	if err != nil {
+		return err
+	}
+	p.client = client
+	return nil
+}
+
+// Write publishes a packet to the frame and readings topics, or as Sparkplug B NDATA, and waits until
+// the messages are sent.
+func (p *mqttPublisher) Write(packet *protocol.Packet) error {
+	if id, ok := packet.Registers[obis.MeterID].Value.(string); ok {
+		p.meterID = id
+	}
+	if len(p.cfg.FrameTopic) > 0 {
+		if err := waitMQTT(p.client.Publish(p.cfg.FrameTopic, 0, false, packet.Frame)); err != nil {
+			return fmt.Errorf("publish frame: %w", err)
+		}
+	}
+	if p.spb != nil {
+		if token := p.spb.publish(p.client, packet); token != nil {
+			return waitMQTT(token)
+		}
+		return nil
+	}
+	if len(p.cfg.Topic) == 0 {
+		return nil
+	}
+	payload, err := mqttFormats[p.cfg.Format](packet, p.meterID)
+	if err != nil {
+		return fmt.Errorf("encode payload: %w", err)
+	}
+	return waitMQTT(p.client.Publish(p.cfg.Topic, 0, false, payload))
+}
+
+// Time allowed for publishing a single message.
+const mqttTimeout = 10 * time.Second
+
+// waitMQTT waits for a message to be sent, and returns the error sending it, if any.
+func waitMQTT(token mqtt.Token) error {
+	if !token.WaitTimeout(mqttTimeout) {
+		return fmt.Errorf("timed out")
+	}
+	return token.Error()
+}
+
+// handOver makes Close disconnect without publishing that the exporter is offline, or a Sparkplug B NDEATH,
+// as another connection publishes the exporter as online.
+func (p *mqttPublisher) handOver() {
+	p.handedOver = true
+}
+
+// replacedBy reports whether next publishes the availability of the exporter to the same topic once
+// connected, so that this connection should be handed over to it.
+func (p *mqttPublisher) replacedBy(next output.Sink) bool {
+	n, ok := next.(*mqttPublisher)
+	return ok && p.spb == nil && n.spb == nil && n.cfg.AvailabilityTopic == p.cfg.AvailabilityTopic
+}
+
+func (p *mqttPublisher) Close() error {
+	switch {
+	case p.handedOver:
+		p.client.Disconnect(1000)
+	case p.spb != nil:
+		p.spb.stop(p.client)
+		p.client.Disconnect(1000)
+	default:
+		disconnectMQTT(p.client, p.cfg)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package exporter
+
+import (
+	`context`
+	`fmt`
+	`reflect`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/output`
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	`github.com/prometheus/client_golang/prometheus`
+	log "github.com/sirupsen/logrus"
+)
+
+// outputs holds the parts of the exporter that are replaced when the configuration is reloaded.
+type outputs struct {
+	cfg      Config
+	sinks    *output.Dispatcher
+	running  map[string]runningSink
+	alerts   *alerter
+	stopPush context.CancelFunc
+
+	// Reports whether this instance is active, and should push metrics.
+	active func() bool
+
+	// Set if the outputs are started. The outputs of a standby instance hold the configuration only.
+	started bool
+}
+
+// standbyOutputs returns outputs of a standby instance, which connect nowhere until started, so that
+// the instance neither takes over client IDs nor publishes availability in place of the active one.
+func standbyOutputs(cfg Config, sinks *output.Dispatcher, active func() bool, prev *outputs) *outputs {
+	o := &outputs{
+		cfg:      cfg,
+		sinks:    sinks,
+		alerts:   newAlerter(cfg.Alerts, nil),
+		stopPush: func() {},
+		active:   active,
+	}
+	if prev != nil {
+		o.alerts.inherit(prev.alerts)
+	}
+	return o
+}
+
+// startOutputs adds the sinks of the output sections and the sinks section to the dispatcher, and starts
+// pushing metrics, according to the configuration. Sinks left running by prev are kept if their settings
+// are unchanged. Metrics are only pushed while active reports true. A sink that cannot be started is
+// left out, and the first such error is returned along with the outputs.
+func startOutputs(ctx context.Context, cfg Config, gatherer prometheus.Gatherer, sinks *output.Dispatcher, active func() bool, prev *outputs) (*outputs, error) {
+	o := &outputs{
+		cfg:      cfg,
+		sinks:    sinks,
+		stopPush: func() {},
+		active:   active,
+		started:  true,
+	}
+
+	var running map[string]runningSink
+	if prev != nil {
+		running = prev.running
+	}
+	configs, err := cfg.outputSinks()
+	if err == nil {
+		o.running, err = startSinks(ctx, sinks, configs, running)
+	}
+
+	var client mqtt.Client
+	if p, ok := o.running["mqtt"].sink.(*mqttPublisher); ok {
+		client = p.client
+	}
+	o.alerts = newAlerter(cfg.Alerts, client)
+	if prev != nil {
+		o.alerts.inherit(prev.alerts)
+	}
+
+	if cfg.Pushgateway != nil {
+		ctx, cancel := context.WithCancel(ctx)
+		o.stopPush = cancel
+		go runPushgateway(ctx, *cfg.Pushgateway, gatherer, active)
+	}
+
+	return o, err
+}
+
+// handOver shuts down the outputs as the other instance takes over, and returns standby outputs.
+// MQTT is disconnected without publishing that the exporter is offline, or a Sparkplug B NDEATH,
+// as the other instance publishes the exporter as online.
+func (o *outputs) handOver() *outputs {
+	for _, r := range o.running {
+		if p, ok := r.sink.(*mqttPublisher); ok {
+			p.handOver()
+		}
+	}
+	o.stop()
+	return standbyOutputs(o.cfg, o.sinks, o.active, o)
+}
+
+// stop stops pushing metrics, and closes every sink.
+func (o *outputs) stop() {
+	o.stopPush()
+	if err := o.sinks.Close(); err != nil {
+		log.Errorf("Stop sinks: %s", err)
+	}
+	o.running = nil
+}
+
+// reload replaces the outputs according to a new configuration.
+// Settings that can only be changed by restarting the exporter are left as they are.
+func (o *outputs) reload(ctx context.Context, cfg Config, gatherer prometheus.Gatherer) (*outputs, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return o, fmt.Errorf("configuration: %w", err)
+	}
+
+	for name, changed := range map[string]bool{
+		"serial":            !reflect.DeepEqual(o.cfg.Serial, cfg.Serial),
+		"watchdog":          o.cfg.Watchdog != cfg.Watchdog,
+		"listen":            !reflect.DeepEqual(o.cfg.Listen, cfg.Listen),
+		"metrics_path":      o.cfg.MetricsPath != cfg.MetricsPath,
+		"admin_listen":      o.cfg.AdminListen != cfg.AdminListen,
+		"accept_frames":     o.cfg.AcceptFrames != cfg.AcceptFrames,
+		"frames_token":      o.cfg.FramesToken != cfg.FramesToken,
+		"grpc_listen":       o.cfg.GRPCListen != cfg.GRPCListen,
+		"modbus_listen":     o.cfg.ModbusListen != cfg.ModbusListen,
+		"snmp_listen":       o.cfg.SNMPListen != cfg.SNMPListen,
+		"snmp_community":    o.cfg.SNMPCommunity != cfg.SNMPCommunity,
+		"relay_listen":      o.cfg.RelayListen != cfg.RelayListen,
+		"strict":            o.cfg.Strict != cfg.Strict,
+		"namespace":         o.cfg.Namespace != cfg.Namespace,
+		"labels":            !reflect.DeepEqual(o.cfg.Labels, cfg.Labels),
+		"plausibility":      !reflect.DeepEqual(o.cfg.Plausibility, cfg.Plausibility),
+		"parser":            o.cfg.Parser != cfg.Parser,
+		"security":          !reflect.DeepEqual(o.cfg.Security, cfg.Security),
+		"packet_buffer":     o.cfg.PacketBuffer != cfg.PacketBuffer,
+		"history_retention": o.cfg.HistoryRetention != cfg.HistoryRetention,
+		"packet_log":        !reflect.DeepEqual(o.cfg.PacketLog, cfg.PacketLog),
+		"syslog":            !reflect.DeepEqual(o.cfg.Syslog, cfg.Syslog),
+		"log_file":          !reflect.DeepEqual(o.cfg.LogFile, cfg.LogFile),
+		"log_rate_limit":    o.cfg.LogRateLimit != cfg.LogRateLimit,
+		"timezone":          o.cfg.Timezone != cfg.Timezone,
+		"energy_timestamps": o.cfg.EnergyTimestamps != cfg.EnergyTimestamps,
+		"energy_counters":   o.cfg.EnergyCounters != cfg.EnergyCounters,
+		"cost":              !reflect.DeepEqual(o.cfg.Cost, cfg.Cost),
+		"capacity":          !reflect.DeepEqual(o.cfg.Capacity, cfg.Capacity),
+		"tariffs":           !reflect.DeepEqual(o.cfg.Tariffs, cfg.Tariffs),
+		"voltage_quality":   !reflect.DeepEqual(o.cfg.VoltageQuality, cfg.VoltageQuality),
+		"fuse":              !reflect.DeepEqual(o.cfg.Fuse, cfg.Fuse),
+		"state_file":        o.cfg.StateFile != cfg.StateFile,
+		"meter_expiry":      o.cfg.MeterExpiry != cfg.MeterExpiry,
+		"ha":                !reflect.DeepEqual(o.cfg.HA, cfg.HA),
+		"user":              o.cfg.User != cfg.User,
+		"group":             o.cfg.Group != cfg.Group,
+		"chroot":            o.cfg.Chroot != cfg.Chroot,
+		"pid_file":          o.cfg.PIDFile != cfg.PIDFile,
+	} {
+		if changed {
+			log.Warnf("Configuration setting %s changed, restart to apply", name)
+		}
+	}
+
+	if !o.started {
+		log.Infof("Configuration reloaded")
+		return standbyOutputs(cfg, o.sinks, o.active, o), nil
+	}
+	next, err := startOutputs(ctx, cfg, gatherer, o.sinks, o.active, o)
+	o.stopPush()
+	if err != nil {
+		log.Errorf("Start outputs: %s", err)
+	}
+
+	log.Infof("Configuration reloaded")
+
+	return next, nil
+}
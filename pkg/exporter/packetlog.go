@@ -0,0 +1,101 @@
+package exporter
+
+import (
+	`encoding/hex`
+	`encoding/json`
+	`os`
+	`sort`
+	`strconv`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+)
+
+// PacketLogConfig configures appending decoded packets to a file, one JSON object per line.
+type PacketLogConfig struct {
+	Path string `yaml:"path"`
+
+	// Include the raw HDLC frame as a hex string.
+	Raw bool `yaml:"raw"`
+}
+
+// PacketRecord is a line in the packet log.
+type PacketRecord struct {
+	Time      time.Time        `json:"time"`
+	Registers []RegisterRecord `json:"registers"`
+	Frame     string           `json:"frame,omitempty"`
+}
+
+// RegisterRecord is a register value in the packet log.
+// Numeric values are scaled, other values are written as decoded.
+type RegisterRecord struct {
+	OBIS  string `json:"obis"`
+	Value any    `json:"value"`
+	Unit  string `json:"unit,omitempty"`
+}
+
+// NewPacketRecord converts a packet to a packet log line, with registers sorted by OBIS code.
+func NewPacketRecord(packet *protocol.Packet, raw bool) PacketRecord {
+	rec := PacketRecord{
+		Time:      packet.Time,
+		Registers: make([]RegisterRecord, 0, len(packet.Registers)),
+	}
+	for code, reg := range packet.Registers {
+		r := RegisterRecord{
+			OBIS:  code,
+			Value: reg.Value,
+			Unit:  reg.Unit,
+		}
+		if val, err := reg.Float(); err == nil {
+			r.Value = val
+		}
+		rec.Registers = append(rec.Registers, r)
+	}
+	sort.Slice(rec.Registers, func(i, j int) bool {
+		return rec.Registers[i].OBIS < rec.Registers[j].OBIS
+	})
+	if raw {
+		rec.Frame = hex.EncodeToString(packet.Frame)
+	}
+	return rec
+}
+
+// textValues returns the numeric and text values of a packet as strings, keyed by OBIS code.
+func textValues(packet *protocol.Packet) map[string]string {
+	values := make(map[string]string, len(packet.Registers))
+	for _, rec := range NewPacketRecord(packet, false).Registers {
+		switch val := rec.Value.(type) {
+		case float64:
+			values[rec.OBIS] = strconv.FormatFloat(val, 'f', -1, 64)
+		case string:
+			values[rec.OBIS] = val
+		}
+	}
+	return values
+}
+
+type packetLog struct {
+	file *os.File
+	enc  *json.Encoder
+	raw  bool
+}
+
+func openPacketLog(cfg PacketLogConfig) (*packetLog, error) {
+	file, err := os.OpenFile(cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &packetLog{
+		file: file,
+		enc:  json.NewEncoder(file),
+		raw:  cfg.Raw,
+	}, nil
+}
+
+func (l *packetLog) Write(packet *protocol.Packet) error {
+	return l.enc.Encode(NewPacketRecord(packet, l.raw))
+}
+
+func (l *packetLog) Close() error {
+	return l.file.Close()
+}
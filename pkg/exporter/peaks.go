@@ -0,0 +1,216 @@
+package exporter
+
+import (
+	`sort`
+	`strconv`
+	`sync`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/obis`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+	`github.com/prometheus/client_golang/prometheus`
+)
+
+// Number of daily peaks making up the capacity tariff.
+const peakCount = 3
+
+// CapacityConfig configures tracking of the Norwegian capacity tariff, which is based on
+// the average of the three highest hourly consumptions on different days of the month.
+type CapacityConfig struct {
+	// Upper limits in kW of each capacity step but the last, in increasing order.
+	Steps []float64 `yaml:"steps"`
+}
+
+// Capacity steps used by most Norwegian grid operators.
+var defaultCapacitySteps = []float64{2, 5, 10, 15, 20, 25, 50, 75, 100}
+
+// hourlyEnergy integrates power samples into the energy consumed during each clock hour.
+type hourlyEnergy struct {
+	loc       *time.Location
+	lastTime  time.Time
+	lastPower float64
+	hour      time.Time
+	wh        float64
+	covered   time.Duration
+}
+
+// add integrates a power sample in watts. When the sample belongs to a new hour,
+// done is called with the start and energy in Wh of the hour that ended.
+func (e *hourlyEnergy) add(t time.Time, power float64, done func(hour time.Time, wh float64)) {
+	t = t.In(e.loc)
+	hour := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, e.loc)
+	if !hour.Equal(e.hour) {
+		if !e.hour.IsZero() {
+			done(e.hour, e.wh)
+		}
+		e.hour = hour
+		e.wh = 0
+		e.covered = 0
+	}
+	if dt := t.Sub(e.lastTime); !e.lastTime.IsZero() && dt > 0 && dt <= maxSampleGap {
+		e.wh += e.lastPower * dt.Hours()
+		e.covered += dt
+	}
+	e.lastTime = t
+	e.lastPower = power
+}
+
+// peakCollector tracks the highest hourly consumption of each day in the current month.
+type peakCollector struct {
+	mu      sync.Mutex
+	steps   []float64
+	meterID string
+	energy  hourlyEnergy
+	month   time.Time
+	daily   map[time.Time]float64
+
+	peakDesc *prometheus.Desc
+	stepDesc *prometheus.Desc
+}
+
+func newPeakCollector(namespace string, cfg CapacityConfig, loc *time.Location) *peakCollector {
+	steps := cfg.Steps
+	if len(steps) == 0 {
+		steps = defaultCapacitySteps
+	}
+	return &peakCollector{
+		steps:  steps,
+		energy: hourlyEnergy{loc: loc},
+		daily:  make(map[time.Time]float64),
+		peakDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "monthly_peak_watts"),
+			"Average power during the highest consuming hours on different days of the current month, including the current hour",
+			[]string{"meter_id", "rank"},
+			nil,
+		),
+		stepDesc: newDesc(namespace, "capacity_step", "Capacity tariff step implied by the average of the monthly peaks, starting at 1"),
+	}
+}
+
+func (c *peakCollector) Update(packet *protocol.Packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if id, ok := packet.Registers[obis.MeterID].Value.(string); ok {
+		c.meterID = id
+	}
+
+	power, ok := importPower(packet)
+	if !ok {
+		return
+	}
+	c.energy.add(packet.Time, power, c.hourDone)
+}
+
+// hourDone records the energy of a completed hour, forgetting previous months.
+func (c *peakCollector) hourDone(hour time.Time, wh float64) {
+	month := time.Date(hour.Year(), hour.Month(), 1, 0, 0, 0, 0, hour.Location())
+	if !month.Equal(c.month) {
+		c.month = month
+		c.daily = make(map[time.Time]float64)
+	}
+	day := time.Date(hour.Year(), hour.Month(), hour.Day(), 0, 0, 0, 0, hour.Location())
+	if wh > c.daily[day] {
+		c.daily[day] = wh
+	}
+}
+
+// peaks returns the highest daily peaks in descending order. The energy consumed so far
+// in the current hour is included, so that a new peak shows up as early as possible.
+func (c *peakCollector) peaks() []float64 {
+	daily := make(map[time.Time]float64, len(c.daily)+1)
+	hour := c.energy.hour
+	for day, wh := range c.daily {
+		if day.Year() == hour.Year() && day.Month() == hour.Month() {
+			daily[day] = wh
+		}
+	}
+	day := time.Date(hour.Year(), hour.Month(), hour.Day(), 0, 0, 0, 0, hour.Location())
+	if c.energy.wh > daily[day] {
+		daily[day] = c.energy.wh
+	}
+
+	peaks := make([]float64, 0, len(daily))
+	for _, wh := range daily {
+		peaks = append(peaks, wh)
+	}
+	sort.Sort(sort.Reverse(sort.Float64Slice(peaks)))
+	if len(peaks) > peakCount {
+		peaks = peaks[:peakCount]
+	}
+	return peaks
+}
+
+// step returns the capacity step, starting at 1, for an average peak in watts.
+func (c *peakCollector) step(avg float64) int {
+	return sort.SearchFloat64s(c.steps, avg/1000) + 1
+}
+
+func (c *peakCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.peakDesc
+	ch <- c.stepDesc
+}
+
+func (c *peakCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.energy.hour.IsZero() {
+		return
+	}
+
+	// Energy in Wh during one hour equals the average power in W.
+	peaks := c.peaks()
+	var sum float64
+	for i, wh := range peaks {
+		ch <- prometheus.MustNewConstMetric(c.peakDesc, prometheus.GaugeValue, wh, c.meterID, strconv.Itoa(i+1))
+		sum += wh
+	}
+	ch <- prometheus.MustNewConstMetric(c.stepDesc, prometheus.GaugeValue, float64(c.step(sum/float64(len(peaks)))), c.meterID)
+}
+
+// hourlyAverageCollector exports the average power so far in the current clock hour.
+type hourlyAverageCollector struct {
+	mu      sync.Mutex
+	meterID string
+	energy  hourlyEnergy
+	desc    *prometheus.Desc
+}
+
+func newHourlyAverageCollector(namespace string, loc *time.Location) *hourlyAverageCollector {
+	return &hourlyAverageCollector{
+		energy: hourlyEnergy{loc: loc},
+		desc:   newDesc(namespace, "hourly_average_power_watts", "Average imported active power so far in the current clock hour"),
+	}
+}
+
+func (c *hourlyAverageCollector) Update(packet *protocol.Packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if id, ok := packet.Registers[obis.MeterID].Value.(string); ok {
+		c.meterID = id
+	}
+
+	power, ok := importPower(packet)
+	if !ok {
+		return
+	}
+	c.energy.add(packet.Time, power, func(time.Time, float64) {})
+}
+
+func (c *hourlyAverageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *hourlyAverageCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Only the part of the hour covered by samples counts, so that the average is
+	// meaningful right after startup. Nothing is exported once the hour is over.
+	if c.energy.covered == 0 || time.Since(c.energy.hour) >= time.Hour {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, c.energy.wh/c.energy.covered.Hours(), c.meterID)
+}
@@ -0,0 +1,168 @@
+package exporter
+
+import (
+	`sync`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/obis`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+	`github.com/prometheus/client_golang/prometheus`
+)
+
+// Cumulative registers that daily and monthly energy is computed for, by the direction label they are exported with.
+var periodRegisters = map[string]string{
+	"import": obis.ActiveEnergyImport,
+	"export": obis.ActiveEnergyExport,
+}
+
+// periodEnergy holds the readings of a cumulative register at the start of the current day and month.
+type periodEnergy struct {
+	Reading    float64   `json:"reading"`
+	Hour       time.Time `json:"hour"`
+	Day        time.Time `json:"day"`
+	DayStart   float64   `json:"day_start"`
+	Month      time.Time `json:"month"`
+	MonthStart float64   `json:"month_start"`
+}
+
+// add records a reading at an hour boundary. A reading at midnight starts the new day, and is the
+// reading at its start. If that reading is missing, the last reading before it is used instead.
+func (e *periodEnergy) add(wh float64, hour time.Time) {
+	start := wh
+	if !e.Hour.IsZero() && wh >= e.Reading {
+		start = e.Reading
+	}
+	if day := startOfDay(hour); !day.Equal(e.Day) {
+		e.Day = day
+		e.DayStart = start
+		if hour.Equal(day) {
+			e.DayStart = wh
+		}
+	}
+	if month := time.Date(hour.Year(), hour.Month(), 1, 0, 0, 0, 0, hour.Location()); !month.Equal(e.Month) {
+		e.Month = month
+		e.MonthStart = start
+		if hour.Equal(month) {
+			e.MonthStart = wh
+		}
+	}
+	// A reading below the start of the period means the meter was replaced.
+	if wh < e.DayStart {
+		e.DayStart = wh
+	}
+	if wh < e.MonthStart {
+		e.MonthStart = wh
+	}
+	e.Reading = wh
+	e.Hour = hour
+}
+
+// today returns the energy counted since midnight, or zero if the day has ended since the last reading.
+func (e *periodEnergy) today(now time.Time) float64 {
+	if !startOfDay(now).Equal(e.Day) {
+		return 0
+	}
+	return e.Reading - e.DayStart
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// periodCollector exports the energy imported and exported so far today and this month, computed from
+// the hourly meter readings. The periods begin at midnight in the configured time zone, so that the
+// figures match the bill without increase() queries over long ranges.
+type periodCollector struct {
+	mu      sync.Mutex
+	loc     *time.Location
+	now     func() time.Time
+	meterID string
+	energy  map[string]*periodEnergy
+
+	dayDesc   *prometheus.Desc
+	monthDesc *prometheus.Desc
+}
+
+func newPeriodCollector(namespace string, loc *time.Location) *periodCollector {
+	labels := []string{"meter_id", "direction"}
+	return &periodCollector{
+		loc:    loc,
+		now:    time.Now,
+		energy: make(map[string]*periodEnergy),
+		dayDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "energy_today_wh"),
+			"Active energy imported or exported since midnight, according to the hourly meter readings",
+			labels,
+			nil,
+		),
+		monthDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "energy_month_wh"),
+			"Active energy imported or exported since the start of the month, according to the hourly meter readings",
+			labels,
+			nil,
+		),
+	}
+}
+
+func (c *periodCollector) Update(packet *protocol.Packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if id, ok := packet.Registers[obis.MeterID].Value.(string); ok {
+		c.meterID = id
+	}
+	if messageType(packet) != "list3" {
+		return
+	}
+	hour := hourBoundary(packet, c.loc)
+	for direction, code := range periodRegisters {
+		reg, ok := packet.Registers[code]
+		if !ok {
+			continue
+		}
+		wh, err := reg.Float()
+		if err != nil {
+			continue
+		}
+		e, ok := c.energy[direction]
+		if !ok {
+			e = &periodEnergy{}
+			c.energy[direction] = e
+		}
+		e.add(wh, hour)
+	}
+}
+
+func (c *periodCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.dayDesc
+	ch <- c.monthDesc
+}
+
+func (c *periodCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Periods may have ended without a reading arriving yet.
+	now := c.now().In(c.loc)
+	for direction, e := range c.energy {
+		today := e.today(now)
+		var month float64
+		if now.Year() == e.Month.Year() && now.Month() == e.Month.Month() {
+			month = e.Reading - e.MonthStart
+		}
+		ch <- prometheus.MustNewConstMetric(c.dayDesc, prometheus.GaugeValue, today, c.meterID, direction)
+		ch <- prometheus.MustNewConstMetric(c.monthDesc, prometheus.GaugeValue, month, c.meterID, direction)
+	}
+}
+
+// TodayWh returns the energy imported since midnight, in Wh, as exported in energy_today_wh.
+func (c *periodCollector) TodayWh() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.energy["import"]
+	if !ok {
+		return 0
+	}
+	return e.today(c.now().In(c.loc))
+}
@@ -0,0 +1,138 @@
+package exporter
+
+import (
+	`fmt`
+	`math`
+	`sort`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/obis`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+	`github.com/prometheus/client_golang/prometheus`
+)
+
+// PlausibilityConfig sets the values considered plausible for a register. Corrupted frames occasionally
+// pass the checksum and parse fine, but hold absurd values. Those are dropped instead of being exported.
+type PlausibilityConfig struct {
+	// Register given by OBIS code or by metric name without the namespace, as in the register filter.
+	Register string `yaml:"register"`
+
+	// Values below min or above max are dropped.
+	Min *float64 `yaml:"min"`
+	Max *float64 `yaml:"max"`
+
+	// Largest change per second from the last value accepted. Zero has no limit. As the time since the
+	// last accepted value grows, so does the change allowed, so a lasting step is accepted eventually.
+	MaxRate float64 `yaml:"max_rate"`
+}
+
+func (cfg PlausibilityConfig) validate() error {
+	if !obisCodePattern.MatchString(cfg.Register) && !knownRegisterName(cfg.Register) {
+		return fmt.Errorf("%q is neither an OBIS code nor a known register name", cfg.Register)
+	}
+	if cfg.Min != nil && cfg.Max != nil && *cfg.Min > *cfg.Max {
+		return fmt.Errorf("%s: min must not be above max", cfg.Register)
+	}
+	if cfg.MaxRate < 0 {
+		return fmt.Errorf("%s: max_rate must not be negative", cfg.Register)
+	}
+	return nil
+}
+
+// sampleKey identifies the register of a meter that a value was accepted for.
+type sampleKey struct {
+	meterID string
+	code    string
+}
+
+type acceptedSample struct {
+	value float64
+	time  time.Time
+}
+
+// plausibilityFilter removes implausible values from packets before they are processed.
+// Values are compared with the last accepted value of the same register of the same meter, so that
+// a replaced meter does not start out with its values rejected for changing too fast.
+type plausibilityFilter struct {
+	rules    []PlausibilityConfig
+	meterID  string
+	last     map[sampleKey]acceptedSample
+	rejected *prometheus.CounterVec
+}
+
+func newPlausibilityFilter(namespace string, rules []PlausibilityConfig) *plausibilityFilter {
+	return &plausibilityFilter{
+		rules: rules,
+		last:  make(map[sampleKey]acceptedSample),
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "implausible_samples_total",
+			Help:      "Total number of register values dropped for being out of range or changing too fast",
+		}, []string{"obis", "reason"}),
+	}
+}
+
+// rule returns the plausibility rule of a register, if any.
+func (f *plausibilityFilter) rule(code string) (PlausibilityConfig, bool) {
+	for _, rule := range f.rules {
+		if matchesRegister([]string{rule.Register}, code) {
+			return rule, true
+		}
+	}
+	return PlausibilityConfig{}, false
+}
+
+// check reports why a value of a register received at t is implausible, or an empty string if it is plausible.
+func (f *plausibilityFilter) check(code string, val float64, t time.Time) string {
+	rule, ok := f.rule(code)
+	if !ok {
+		return ""
+	}
+	if (rule.Min != nil && val < *rule.Min) || (rule.Max != nil && val > *rule.Max) {
+		return "range"
+	}
+	key := sampleKey{meterID: f.meterID, code: code}
+	if last, ok := f.last[key]; ok && rule.MaxRate > 0 && t.After(last.time) {
+		if math.Abs(val-last.value)/t.Sub(last.time).Seconds() > rule.MaxRate {
+			return "rate"
+		}
+	}
+	f.last[key] = acceptedSample{value: val, time: t}
+	return ""
+}
+
+// filter returns the packet without the registers holding implausible values, and their OBIS codes in order.
+// The packet itself is left alone, as it may be in use elsewhere, such as for the last frame debug endpoint;
+// a copy is returned if anything is dropped.
+func (f *plausibilityFilter) filter(packet *protocol.Packet) (*protocol.Packet, []string) {
+	if id, ok := packet.Registers[obis.MeterID].Value.(string); ok {
+		f.meterID = id
+	}
+	var dropped []string
+	for code, reg := range packet.Registers {
+		val, err := reg.Float()
+		if err != nil {
+			continue
+		}
+		reason := f.check(code, val, packet.Time)
+		if len(reason) == 0 {
+			continue
+		}
+		f.rejected.WithLabelValues(code, reason).Inc()
+		dropped = append(dropped, code)
+	}
+	if len(dropped) == 0 {
+		return packet, nil
+	}
+	sort.Strings(dropped)
+
+	filtered := *packet
+	filtered.Registers = make(map[string]protocol.Register, len(packet.Registers))
+	for code, reg := range packet.Registers {
+		filtered.Registers[code] = reg
+	}
+	for _, code := range dropped {
+		delete(filtered.Registers, code)
+	}
+	return &filtered, dropped
+}
@@ -0,0 +1,34 @@
+package exporter
+
+import (
+	`fmt`
+	`os`
+	`strconv`
+)
+
+// writePIDFile writes the ID of the process to a file, replacing any file left by an earlier process.
+func writePIDFile(path string) error {
+	return os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// harden writes the PID file, changes the root directory and switches to the configured user and group,
+// as configured. It is called once everything needing root, such as opening the serial port and binding
+// listeners, is done. It returns a function removing the PID file, if it can still be reached.
+func harden(cfg Config) (func(), error) {
+	cleanup := func() {}
+	if len(cfg.PIDFile) > 0 {
+		if err := writePIDFile(cfg.PIDFile); err != nil {
+			return cleanup, fmt.Errorf("write PID file: %w", err)
+		}
+		// The file is outside of a changed root directory, and the user may not be allowed to remove it.
+		if len(cfg.Chroot) == 0 && len(cfg.User) == 0 {
+			cleanup = func() {
+				os.Remove(cfg.PIDFile)
+			}
+		}
+	}
+	if len(cfg.User) == 0 && len(cfg.Group) == 0 {
+		return cleanup, nil
+	}
+	return cleanup, dropPrivileges(cfg.User, cfg.Group, cfg.Chroot)
+}
@@ -0,0 +1,94 @@
+//go:build !windows
+
+package exporter
+
+import (
+	`fmt`
+	`os`
+	`os/user`
+	`strconv`
+	`syscall`
+
+	log "github.com/sirupsen/logrus"
+)
+
+// credentials are the IDs a process runs as.
+type credentials struct {
+	uid    int
+	gid    int
+	groups []int
+}
+
+// lookupCredentials finds the IDs of a user and group, given by name or number. Without a group,
+// the primary group of the user is used. The supplementary groups of the user are kept, so that
+// membership in groups such as dialout still gives access to the serial port. Without a user,
+// only the group is changed.
+func lookupCredentials(userName, groupName string) (credentials, error) {
+	creds := credentials{uid: -1, gid: -1}
+	if len(userName) > 0 {
+		u, err := user.Lookup(userName)
+		if _, ok := err.(user.UnknownUserError); ok {
+			u, err = user.LookupId(userName)
+		}
+		if err != nil {
+			return creds, fmt.Errorf("user %s: %w", userName, err)
+		}
+		creds.uid, _ = strconv.Atoi(u.Uid)
+		creds.gid, _ = strconv.Atoi(u.Gid)
+		ids, err := u.GroupIds()
+		if err != nil {
+			log.Warnf("Supplementary groups of %s: %s", userName, err)
+		}
+		for _, id := range ids {
+			if gid, err := strconv.Atoi(id); err == nil {
+				creds.groups = append(creds.groups, gid)
+			}
+		}
+	}
+	if len(groupName) > 0 {
+		g, err := user.LookupGroup(groupName)
+		if _, ok := err.(user.UnknownGroupError); ok {
+			g, err = user.LookupGroupId(groupName)
+		}
+		if err != nil {
+			return creds, fmt.Errorf("group %s: %w", groupName, err)
+		}
+		creds.gid, _ = strconv.Atoi(g.Gid)
+	}
+	if creds.gid >= 0 && len(creds.groups) == 0 {
+		creds.groups = []int{creds.gid}
+	}
+	return creds, nil
+}
+
+// dropPrivileges changes the root directory, if given, and switches to the user and group.
+// Users and groups are looked up before changing the root directory, which usually lacks /etc.
+func dropPrivileges(userName, groupName, chroot string) error {
+	creds, err := lookupCredentials(userName, groupName)
+	if err != nil {
+		return err
+	}
+	if len(chroot) > 0 {
+		if err := syscall.Chroot(chroot); err != nil {
+			return fmt.Errorf("chroot %s: %w", chroot, err)
+		}
+		if err := os.Chdir("/"); err != nil {
+			return fmt.Errorf("chroot %s: %w", chroot, err)
+		}
+		log.Infof("Changed root directory to %s", chroot)
+	}
+	// The group must be changed first, as changing the user gives up the right to do so.
+	if err := syscall.Setgroups(creds.groups); err != nil {
+		return fmt.Errorf("set supplementary groups: %w", err)
+	}
+	if err := syscall.Setgid(creds.gid); err != nil {
+		return fmt.Errorf("set group ID %d: %w", creds.gid, err)
+	}
+	if creds.uid >= 0 {
+		if err := syscall.Setuid(creds.uid); err != nil {
+			return fmt.Errorf("set user ID %d: %w", creds.uid, err)
+		}
+	}
+	log.Infof("Running as user ID %d and group ID %d", os.Getuid(), os.Getgid())
+	return nil
+}
@@ -0,0 +1,76 @@
+//go:build !windows
+
+package exporter
+
+import (
+	`os`
+	`os/exec`
+	`path/filepath`
+	`strconv`
+	`strings`
+	`testing`
+
+	`github.com/stretchr/testify/assert`
+)
+
+func TestLookupCredentials(t *testing.T) {
+	creds, err := lookupCredentials("root", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, creds.uid)
+	assert.Equal(t, 0, creds.gid)
+	assert.Contains(t, creds.groups, 0)
+
+	byID, err := lookupCredentials("0", "0")
+	assert.NoError(t, err)
+	assert.Equal(t, creds.uid, byID.uid)
+	assert.Equal(t, creds.gid, byID.gid)
+
+	_, err = lookupCredentials("no-such-user-here", "")
+	assert.Error(t, err)
+	_, err = lookupCredentials("root", "no-such-group-here")
+	assert.Error(t, err)
+}
+
+func TestHarden(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ams.pid")
+	remove, err := harden(Config{PIDFile: path})
+	assert.NoError(t, err)
+	pid, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(os.Getpid())+"\n", string(pid))
+	remove()
+	assert.NoFileExists(t, path)
+
+	cfg := DefaultConfig()
+	cfg.Chroot = t.TempDir()
+	assert.Error(t, cfg.Validate())
+}
+
+// TestDropPrivileges switches to nobody in a child process, as the switch cannot be undone.
+func TestDropPrivileges(t *testing.T) {
+	if os.Getenv("AMS_TEST_DROP_PRIVILEGES") == "1" {
+		if err := dropPrivileges("nobody", "", os.Getenv("AMS_TEST_CHROOT")); err != nil {
+			os.Stdout.WriteString("error: " + err.Error())
+			os.Exit(1)
+		}
+		_, err := os.ReadFile("/root-only")
+		os.Stdout.WriteString(strconv.Itoa(os.Getuid()) + " " + strconv.FormatBool(os.IsPermission(err)))
+		os.Exit(0)
+	}
+	if os.Getuid() != 0 {
+		t.Skip("switching user requires root")
+	}
+	creds, err := lookupCredentials("nobody", "")
+	if err != nil {
+		t.Skip("no user nobody")
+	}
+
+	root := t.TempDir()
+	assert.NoError(t, os.Chmod(root, 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "root-only"), []byte("secret"), 0600))
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDropPrivileges$")
+	cmd.Env = append(os.Environ(), "AMS_TEST_DROP_PRIVILEGES=1", "AMS_TEST_CHROOT="+root)
+	out, err := cmd.Output()
+	assert.NoError(t, err, string(out))
+	assert.Equal(t, strconv.Itoa(creds.uid)+" true", strings.TrimSpace(string(out)))
+}
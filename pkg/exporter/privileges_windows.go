@@ -0,0 +1,10 @@
+package exporter
+
+import (
+	`fmt`
+)
+
+// dropPrivileges is not supported on Windows, where the service account decides the privileges.
+func dropPrivileges(userName, groupName, chroot string) error {
+	return fmt.Errorf("switching user and changing root directory are not supported on Windows")
+}
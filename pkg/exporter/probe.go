@@ -0,0 +1,106 @@
+package exporter
+
+import (
+	`context`
+	`errors`
+	`fmt`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+	"github.com/goburrow/serial"
+	log "github.com/sirupsen/logrus"
+)
+
+// probeTimeout is how long each setting is tried. Three frame intervals guarantee
+// at least one complete frame even if listening starts in the middle of one.
+const probeTimeout = 3 * frameInterval
+
+const hdlcFlag = 0x7e
+
+// Serial settings commonly used by HAN ports, in the order they are tried.
+var probeSettings = []SerialConfig{
+	{BaudRate: 2400, DataBits: 8, StopBits: 1, Parity: "E"},
+	{BaudRate: 2400, DataBits: 8, StopBits: 1, Parity: "N"},
+	{BaudRate: 115200, DataBits: 8, StopBits: 1, Parity: "N"},
+}
+
+// probeSerial cycles through common serial settings until a frame with a correct
+// checksum is received, and returns the settings that produced it.
+func probeSerial(ctx context.Context, cfg SerialConfig) (SerialConfig, error) {
+	for {
+		for _, settings := range probeSettings {
+			settings.Address = cfg.Address
+			log.Infof("Probing serial port with %s", settings)
+			found, err := probe(ctx, settings)
+			if err != nil {
+				return cfg, err
+			}
+			if found {
+				log.Infof("Detected serial port settings %s", settings)
+				return settings, nil
+			}
+			if ctx.Err() != nil {
+				return cfg, ctx.Err()
+			}
+		}
+	}
+}
+
+// probe reports whether a valid HDLC frame is received using the given settings.
+func probe(ctx context.Context, cfg SerialConfig) (bool, error) {
+	port, err := openSerial(cfg)
+	if err != nil {
+		return false, err
+	}
+	defer port.Close()
+
+	var data []byte
+	buf := make([]byte, 256)
+	deadline := time.Now().Add(probeTimeout)
+	for time.Now().Before(deadline) && ctx.Err() == nil {
+		n, err := port.Read(buf)
+		if n > 0 {
+			var found bool
+			found, data = scanFrames(append(data, buf[:n]...))
+			if found {
+				return true, nil
+			}
+		}
+		if err != nil && !errors.Is(err, serial.ErrTimeout) {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// scanFrames looks for a checksum-correct frame between flag bytes.
+// It returns whether one was found, along with the data following the last flag,
+// which may hold the beginning of the next frame.
+func scanFrames(data []byte) (bool, []byte) {
+	start := -1
+	for i, b := range data {
+		if b != hdlcFlag {
+			continue
+		}
+		if start >= 0 && validFrame(data[start+1:i]) {
+			return true, nil
+		}
+		start = i
+	}
+	if start < 0 {
+		return false, nil
+	}
+	return false, data[start:]
+}
+
+func validFrame(frame []byte) bool {
+	if len(frame) < 4 {
+		return false
+	}
+	n := len(frame) - 2
+	return protocol.FCS16(frame[:n]) == uint16(frame[n])|uint16(frame[n+1])<<8
+}
+
+func (cfg SerialConfig) String() string {
+	return fmt.Sprintf("%d %d%s%d", cfg.BaudRate, cfg.DataBits, cfg.Parity, cfg.StopBits)
+}
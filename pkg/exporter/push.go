@@ -0,0 +1,47 @@
+package exporter
+
+import (
+	`context`
+	`time`
+
+	`github.com/prometheus/client_golang/prometheus`
+	`github.com/prometheus/client_golang/prometheus/push`
+	log "github.com/sirupsen/logrus"
+)
+
+// PushgatewayConfig configures periodic pushing of metrics to a Prometheus Pushgateway.
+type PushgatewayConfig struct {
+	URL      string            `yaml:"url"`
+	Job      string            `yaml:"job"`
+	Interval time.Duration     `yaml:"interval"`
+	Grouping map[string]string `yaml:"grouping"`
+}
+
+// runPushgateway pushes all metrics from the gatherer at the configured interval until the context is canceled.
+// Intervals are skipped while active reports false.
+func runPushgateway(ctx context.Context, cfg PushgatewayConfig, gatherer prometheus.Gatherer, active func() bool) {
+	pusher := push.New(cfg.URL, cfg.Job).Gatherer(gatherer)
+	for k, v := range cfg.Grouping {
+		pusher = pusher.Grouping(k, v)
+	}
+
+	log.Infof("Pushing metrics to %s every %s", cfg.URL, cfg.Interval)
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !active() {
+				continue
+			}
+			err := pusher.PushContext(ctx)
+			if err != nil {
+				log.Errorf("Push metrics to %s: %s", cfg.URL, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package exporter
+
+import (
+	`fmt`
+	`sync`
+	`time`
+
+	log "github.com/sirupsen/logrus"
+)
+
+// limitedLogger logs messages with the same format at most once per interval,
+// reporting how many were suppressed in between. A zero interval disables rate limiting.
+type limitedLogger struct {
+	interval time.Duration
+	now      func() time.Time
+	mu       sync.Mutex
+	entries  map[string]*limitedEntry
+}
+
+type limitedEntry struct {
+	next       time.Time
+	suppressed int
+}
+
+func newLimitedLogger(interval time.Duration) *limitedLogger {
+	return &limitedLogger{
+		interval: interval,
+		now:      time.Now,
+		entries:  make(map[string]*limitedEntry),
+	}
+}
+
+func (l *limitedLogger) Errorf(format string, args ...any) {
+	l.logf(log.ErrorLevel, format, args...)
+}
+
+func (l *limitedLogger) Warnf(format string, args ...any) {
+	l.logf(log.WarnLevel, format, args...)
+}
+
+func (l *limitedLogger) logf(level log.Level, format string, args ...any) {
+	if !log.IsLevelEnabled(level) {
+		return
+	}
+
+	msg := fmt.Sprintf(format, args...)
+	if l.interval > 0 {
+		l.mu.Lock()
+		now := l.now()
+		entry := l.entries[format]
+		if entry != nil && now.Before(entry.next) {
+			entry.suppressed++
+			l.mu.Unlock()
+			return
+		}
+		if entry != nil && entry.suppressed > 0 {
+			msg = fmt.Sprintf("%s (%d similar messages suppressed)", msg, entry.suppressed)
+		}
+		l.entries[format] = &limitedEntry{next: now.Add(l.interval)}
+		l.mu.Unlock()
+	}
+
+	log.StandardLogger().Log(level, msg)
+}
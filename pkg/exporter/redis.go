@@ -0,0 +1,127 @@
+package exporter
+
+import (
+	`context`
+	`fmt`
+	`net`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/obis`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/output`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+	`github.com/redis/go-redis/v9`
+)
+
+func init() {
+	output.Register("redis", newRedis)
+}
+
+// RedisConfig configures publishing of readings to a Redis server.
+type RedisConfig struct {
+	// Server address as host:port.
+	Address  string `yaml:"address"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+
+	// Pub/sub channel receiving every decoded packet. Defaults to ams:readings.
+	Channel string `yaml:"channel"`
+
+	// Payload format of published readings, either json or amsreader, as for MQTT. Defaults to json.
+	Format string `yaml:"format"`
+
+	// If set, the latest value of each register is stored under this prefix followed by its OBIS code.
+	KeyPrefix string `yaml:"key_prefix"`
+
+	// Expiry of the stored values, so that stale readings disappear. Zero keeps them forever.
+	TTL time.Duration `yaml:"ttl"`
+
+	// Buffering, retries and circuit breaking, as for sinks.
+	output.Options `yaml:",inline"`
+}
+
+func (cfg *RedisConfig) validate() error {
+	if len(cfg.Address) == 0 {
+		return fmt.Errorf("address is required")
+	}
+	if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+		return fmt.Errorf("address: %w", err)
+	}
+	if len(cfg.Channel) == 0 {
+		cfg.Channel = "ams:readings"
+	}
+	if len(cfg.Format) == 0 {
+		cfg.Format = "json"
+	}
+	if _, ok := mqttFormats[cfg.Format]; !ok {
+		return fmt.Errorf("unknown format %q", cfg.Format)
+	}
+	if cfg.TTL < 0 {
+		return fmt.Errorf("ttl must not be negative")
+	}
+	return cfg.Options.Validate()
+}
+
+// Time allowed for writing a single packet to Redis.
+const redisTimeout = 5 * time.Second
+
+// redisPublisher writes readings to Redis. The client reconnects by itself whenever a command fails.
+type redisPublisher struct {
+	cfg     RedisConfig
+	client  *redis.Client
+	meterID string
+}
+
+func newRedis(decode func(v any) error) (output.Sink, error) {
+	var cfg RedisConfig
+	if err := decode(&cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &redisPublisher{cfg: cfg}, nil
+}
+
+func (p *redisPublisher) Start(ctx context.Context) error {
+	p.client = redis.NewClient(&redis.Options{
+		Addr:     p.cfg.Address,
+		Username: p.cfg.Username,
+		Password: p.cfg.Password,
+		DB:       p.cfg.DB,
+	})
+	return nil
+}
+
+// Write publishes the readings of a packet and stores its values in one round trip.
+func (p *redisPublisher) Write(packet *protocol.Packet) error {
+	if id, ok := packet.Registers[obis.MeterID].Value.(string); ok {
+		p.meterID = id
+	}
+	payload, err := mqttFormats[p.cfg.Format](packet, p.meterID)
+	if err != nil {
+		return fmt.Errorf("encode payload: %w", err)
+	}
+	var values map[string]string
+	if len(p.cfg.KeyPrefix) > 0 {
+		values = textValues(packet)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	_, err = p.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Publish(ctx, p.cfg.Channel, payload)
+		for code, val := range values {
+			pipe.Set(ctx, p.cfg.KeyPrefix+code, val, p.cfg.TTL)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("write to %s: %w", p.cfg.Address, err)
+	}
+	return nil
+}
+
+func (p *redisPublisher) Close() error {
+	return p.client.Close()
+}
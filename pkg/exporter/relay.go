@@ -0,0 +1,137 @@
+package exporter
+
+import (
+	`context`
+	`net`
+	`sync`
+	`time`
+
+	`github.com/prometheus/client_golang/prometheus`
+	log "github.com/sirupsen/logrus"
+)
+
+// Number of frames buffered for each relay client. Frames are dropped for clients falling further behind.
+const relayClientBuffer = 16
+
+// Time allowed for writing a frame to a relay client, after which it is disconnected.
+const relayWriteTimeout = 10 * time.Second
+
+// relayServer passes every frame with a correct checksum on to its clients, with flag bytes, in the same
+// form as read from the serial port. Downstream exporters read it by setting their serial address to
+// tcp://host:port, which decouples the host attached to the meter from the one storing the metrics.
+type relayServer struct {
+	mu      sync.Mutex
+	clients map[net.Conn]chan []byte
+	dropped prometheus.Counter
+	desc    *prometheus.Desc
+}
+
+func newRelayServer(namespace string) *relayServer {
+	return &relayServer{
+		clients: make(map[net.Conn]chan []byte),
+		dropped: counter(namespace, "relay_dropped_frames_total", "Total number of frames not relayed to a client because it fell behind"),
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "relay_clients"),
+			"Number of clients connected to the frame relay",
+			nil,
+			nil,
+		),
+	}
+}
+
+// send queues a frame, given without flag bytes, for every connected client.
+func (s *relayServer) send(frame []byte) {
+	data := make([]byte, 0, len(frame)+2)
+	data = append(append(append(data, hdlcFlag), frame...), hdlcFlag)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, frames := range s.clients {
+		select {
+		case frames <- data:
+		default:
+			log.Debugf("Relay client %s is falling behind; dropped a frame", conn.RemoteAddr())
+			s.dropped.Inc()
+		}
+	}
+}
+
+func (s *relayServer) serve(ctx context.Context, listener net.Listener) {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for conn := range s.clients {
+			conn.Close()
+		}
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Errorf("Frame relay: %s", err)
+			continue
+		}
+		frames := make(chan []byte, relayClientBuffer)
+		s.mu.Lock()
+		s.clients[conn] = frames
+		s.mu.Unlock()
+		go s.serveConn(ctx, conn, frames)
+	}
+}
+
+func (s *relayServer) serveConn(ctx context.Context, conn net.Conn, frames chan []byte) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	log.Infof("Relay client connected from %s", conn.RemoteAddr())
+
+	// Clients never send anything, so a read only returns once the connection is closed.
+	closed := make(chan struct{})
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-closed:
+			log.Infof("Relay client %s disconnected", conn.RemoteAddr())
+			return
+		case data := <-frames:
+			conn.SetWriteDeadline(time.Now().Add(relayWriteTimeout))
+			if _, err := conn.Write(data); err != nil {
+				log.Errorf("Relay to %s: %s", conn.RemoteAddr(), err)
+				return
+			}
+		}
+	}
+}
+
+func (s *relayServer) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.desc
+	s.dropped.Describe(ch)
+}
+
+func (s *relayServer) Collect(ch chan<- prometheus.Metric) {
+	s.mu.Lock()
+	n := len(s.clients)
+	s.mu.Unlock()
+	ch <- prometheus.MustNewConstMetric(s.desc, prometheus.GaugeValue, float64(n))
+	s.dropped.Collect(ch)
+}
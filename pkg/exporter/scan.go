@@ -0,0 +1,51 @@
+package exporter
+
+import (
+	`context`
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ScanResult is the outcome of scanning a single serial device.
+type ScanResult struct {
+	// Device address, and the settings yielding valid frames if any were found.
+	Settings SerialConfig
+
+	// Whether valid frames were received.
+	Found bool
+
+	// Error opening or reading the device, if any.
+	Err error
+}
+
+// Scan tries the serial settings commonly used by HAN ports on each device, stopping at the
+// first one yielding valid frames. If no devices are given, all likely serial devices are scanned.
+func Scan(ctx context.Context, devices []string) []ScanResult {
+	if len(devices) == 0 {
+		devices = serialCandidates()
+	}
+	results := make([]ScanResult, 0, len(devices))
+	for _, address := range devices {
+		result := ScanResult{Settings: SerialConfig{Address: address}}
+		for _, settings := range probeSettings {
+			if ctx.Err() != nil {
+				return results
+			}
+			settings.Address = address
+			log.Infof("Trying %s with %s", address, settings)
+			found, err := probe(ctx, settings)
+			if err != nil {
+				log.Infof("Skipping %s: %s", address, err)
+				result.Err = err
+				break
+			}
+			if found {
+				result.Settings = settings
+				result.Found = true
+				break
+			}
+		}
+		results = append(results, result)
+	}
+	return results
+}
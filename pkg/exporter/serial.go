@@ -0,0 +1,171 @@
+package exporter
+
+import (
+	`context`
+	`errors`
+	`fmt`
+	`io`
+	`runtime`
+	`strings`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/source`
+	"github.com/goburrow/serial"
+	log "github.com/sirupsen/logrus"
+)
+
+// Prefix of serial port addresses identifying a USB adapter instead of a device file.
+const usbAddressPrefix = "usb:"
+
+func init() {
+	// Sources reading a serial port of their own, such as an optical probe, accept the same addresses.
+	source.ResolveDevice = resolveAddress
+}
+
+// usbDevice identifies a USB serial adapter. Empty fields match any device.
+type usbDevice struct {
+	VendorID  string
+	ProductID string
+	Serial    string
+}
+
+// parseUSBAddress parses addresses on the forms usb:VID:PID, usb:VID:PID:SERIAL and usb:SERIAL.
+func parseUSBAddress(address string) (usbDevice, error) {
+	fields := strings.Split(strings.TrimPrefix(address, usbAddressPrefix), ":")
+	var dev usbDevice
+	switch len(fields) {
+	case 1:
+		dev.Serial = fields[0]
+	case 2:
+		dev.VendorID, dev.ProductID = fields[0], fields[1]
+	case 3:
+		dev.VendorID, dev.ProductID, dev.Serial = fields[0], fields[1], fields[2]
+	default:
+		return dev, fmt.Errorf("invalid USB address %q", address)
+	}
+	if dev == (usbDevice{}) {
+		return dev, fmt.Errorf("invalid USB address %q", address)
+	}
+	return dev, nil
+}
+
+func (dev usbDevice) matches(vendorID, productID, serial string) bool {
+	return (len(dev.VendorID) == 0 || strings.EqualFold(dev.VendorID, vendorID)) &&
+		(len(dev.ProductID) == 0 || strings.EqualFold(dev.ProductID, productID)) &&
+		(len(dev.Serial) == 0 || dev.Serial == serial)
+}
+
+// resolveAddress returns the device file of the serial port.
+func resolveAddress(address string) (string, error) {
+	if runtime.GOOS == "windows" {
+		return windowsDevicePath(address), nil
+	}
+	if !strings.HasPrefix(address, usbAddressPrefix) {
+		return address, nil
+	}
+	dev, err := parseUSBAddress(address)
+	if err != nil {
+		return "", err
+	}
+	path, err := findUSBDevice(dev)
+	if err != nil {
+		return "", err
+	}
+	log.Debugf("Resolved %s to %s", address, path)
+	return path, nil
+}
+
+// windowsDevicePath turns COM port names into device paths.
+// Plain names only work for COM1 through COM9.
+func windowsDevicePath(address string) string {
+	if len(address) > 3 && strings.EqualFold(address[:3], "COM") {
+		return `\\.\` + address
+	}
+	return address
+}
+
+// validate checks the serial port parameters without opening the port.
+func (cfg SerialConfig) validate() error {
+	if len(source.Scheme(cfg.Address)) > 0 {
+		_, err := source.New(cfg.Address)
+		return err
+	}
+	if strings.HasPrefix(cfg.Address, usbAddressPrefix) {
+		if _, err := parseUSBAddress(cfg.Address); err != nil {
+			return err
+		}
+	}
+	switch {
+	case cfg.BaudRate <= 0:
+		return fmt.Errorf("baud_rate must be positive")
+	case cfg.DataBits < 5 || cfg.DataBits > 8:
+		return fmt.Errorf("data_bits must be between 5 and 8")
+	case cfg.StopBits != 1 && cfg.StopBits != 2:
+		return fmt.Errorf("stop_bits must be 1 or 2")
+	case cfg.Parity != "N" && cfg.Parity != "E" && cfg.Parity != "O":
+		return fmt.Errorf("parity must be N, E or O")
+	}
+	return nil
+}
+
+func openSerial(cfg SerialConfig) (serial.Port, error) {
+	address, err := resolveAddress(cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	config := serial.Config{
+		Address:  address,
+		BaudRate: cfg.BaudRate,
+		DataBits: cfg.DataBits,
+		StopBits: cfg.StopBits,
+		Parity:   cfg.Parity,
+		Timeout:  1 * time.Second,
+	}
+
+	log.Debugf("Serial port parameters: %+v\n", config)
+
+	return serial.Open(&config)
+}
+
+// serialSource opens the serial port each time the input reader connects, looking up USB adapters
+// again, so that the exporter recovers when the adapter is unplugged and plugged back in.
+type serialSource struct {
+	cfg SerialConfig
+}
+
+func (s serialSource) Open(ctx context.Context) (io.ReadCloser, error) {
+	port, err := openSerial(s.cfg)
+	if err != nil {
+		return nil, err
+	}
+	return serialStream{port}, nil
+}
+
+// serialStream reports read timeouts as such to the input reader, which keeps the port open after them.
+type serialStream struct {
+	serial.Port
+}
+
+func (s serialStream) Read(p []byte) (int, error) {
+	n, err := s.Port.Read(p)
+	if errors.Is(err, serial.ErrTimeout) {
+		err = serialTimeout{}
+	}
+	return n, err
+}
+
+// serialTimeout is serial.ErrTimeout, with a Timeout method.
+type serialTimeout struct{}
+
+func (serialTimeout) Error() string {
+	return serial.ErrTimeout.Error()
+}
+
+func (serialTimeout) Timeout() bool {
+	return true
+}
+
+func (serialTimeout) Unwrap() error {
+	return serial.ErrTimeout
+}
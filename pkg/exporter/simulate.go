@@ -0,0 +1,159 @@
+package exporter
+
+import (
+	`context`
+	`io`
+	`math`
+	`math/rand`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/obis`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+)
+
+// SimulatorConfig configures a simulated meter.
+type SimulatorConfig struct {
+	// Meter ID sent in list2 and list3 messages.
+	MeterID string
+
+	// Seed of the random power consumption, so that runs can be repeated.
+	Seed int64
+
+	// How much faster than real time the simulated clock runs. Values below 1 are taken as 1.
+	Speed float64
+
+	// Number of frames to write before returning. Zero writes frames until the context is canceled.
+	Count int
+}
+
+// Simulator produces the messages sent by an Aidon meter, with a power consumption drifting randomly.
+// It is meant for trying out the exporter and anything consuming its output without a meter at hand.
+type Simulator struct {
+	meterID string
+	rand    *rand.Rand
+
+	// Active and reactive power in W and VAr, and energy in Wh.
+	power          float64
+	reactive       float64
+	energy         float64
+	reactiveEnergy float64
+	last           time.Time
+}
+
+func NewSimulator(meterID string, seed int64) *Simulator {
+	r := rand.New(rand.NewSource(seed))
+	return &Simulator{
+		meterID:        meterID,
+		rand:           r,
+		power:          1000 + 2000*r.Float64(),
+		energy:         1e7 * r.Float64(),
+		reactiveEnergy: 1e6 * r.Float64(),
+	}
+}
+
+// Frame advances the simulated meter to t, and returns the frame it sends at that time, without flag bytes.
+// Like the meter, it sends list3 just after every hour, list2 every 10 seconds, and list1 otherwise.
+func (s *Simulator) Frame(t time.Time) ([]byte, error) {
+	s.advance(t)
+
+	regs := []protocol.Register{
+		{OBIS: obis.ActivePowerImport, Value: uint32(s.power), Unit: "W"},
+	}
+	sinceHour := t.Sub(t.Truncate(time.Hour))
+	list3 := sinceHour >= 10*time.Second && sinceHour < 10*time.Second+frameInterval
+	if list3 || t.Sub(t.Truncate(10*time.Second)) < frameInterval {
+		regs = s.list2()
+	}
+	if list3 {
+		regs = append(regs, s.list3(t)...)
+	}
+	return protocol.EncodeFrame(regs)
+}
+
+// advance lets the power drift, and accumulates the energy consumed since the last frame.
+func (s *Simulator) advance(t time.Time) {
+	if !s.last.IsZero() && t.After(s.last) {
+		hours := t.Sub(s.last).Hours()
+		s.energy += s.power * hours
+		s.reactiveEnergy += s.reactive * hours
+	}
+	s.last = t
+	s.power = math.Min(math.Max(s.power+100*s.rand.NormFloat64(), 200), 10000)
+	s.reactive = s.power * (0.1 + 0.05*s.rand.Float64())
+}
+
+func (s *Simulator) list2() []protocol.Register {
+	regs := []protocol.Register{
+		{OBIS: obis.ListVersion, Value: "AIDON_V0001"},
+		{OBIS: obis.MeterID, Value: s.meterID},
+		{OBIS: obis.MeterType, Value: "6525"},
+		{OBIS: obis.ActivePowerImport, Value: uint32(s.power), Unit: "W"},
+		{OBIS: obis.ActivePowerExport, Value: uint32(0), Unit: "W"},
+		{OBIS: obis.ReactivePowerImport, Value: uint32(s.reactive), Unit: "VAr"},
+		{OBIS: obis.ReactivePowerExport, Value: uint32(0), Unit: "VAr"},
+	}
+	for _, code := range []string{obis.CurrentL1, obis.CurrentL2, obis.CurrentL3} {
+		current := s.power / 3 / 230 * (0.9 + 0.2*s.rand.Float64())
+		regs = append(regs, protocol.Register{OBIS: code, Value: int16(current * 10), Scaler: -1, Unit: "A"})
+	}
+	for _, code := range []string{obis.VoltageL1, obis.VoltageL2, obis.VoltageL3} {
+		voltage := 230 + 3*s.rand.NormFloat64()
+		regs = append(regs, protocol.Register{OBIS: code, Value: uint16(voltage * 10), Scaler: -1, Unit: "V"})
+	}
+	return regs
+}
+
+// list3 returns the registers added to list2 once an hour: the meter clock and energy registers.
+func (s *Simulator) list3(t time.Time) []protocol.Register {
+	return []protocol.Register{
+		{OBIS: obis.Clock, Value: protocol.DateTime{
+			Year:      uint16(t.Year()),
+			Month:     uint8(t.Month()),
+			Day:       uint8(t.Day()),
+			Weekday:   uint8((int(t.Weekday())+6)%7 + 1),
+			Hour:      uint8(t.Hour()),
+			Minute:    uint8(t.Minute()),
+			Second:    uint8(t.Second()),
+			Deviation: protocol.DeviationUnspecified,
+		}},
+		{OBIS: obis.ActiveEnergyImport, Value: uint32(s.energy / 10), Scaler: 1, Unit: "Wh"},
+		{OBIS: obis.ActiveEnergyExport, Value: uint32(0), Scaler: 1, Unit: "Wh"},
+		{OBIS: obis.ReactiveEnergyImport, Value: uint32(s.reactiveEnergy / 10), Scaler: 1, Unit: "VArh"},
+		{OBIS: obis.ReactiveEnergyExport, Value: uint32(0), Scaler: 1, Unit: "VArh"},
+	}
+}
+
+// Simulate writes the frames of a simulated meter to w, including flag bytes, at the pace of a real meter
+// multiplied by the configured speed. It returns when the context is canceled or all frames are written.
+func Simulate(ctx context.Context, w io.Writer, cfg SimulatorConfig) error {
+	speed := cfg.Speed
+	if speed < 1 {
+		speed = 1
+	}
+	sim := NewSimulator(cfg.MeterID, cfg.Seed)
+
+	ticker := time.NewTicker(time.Duration(float64(frameInterval) / speed))
+	defer ticker.Stop()
+
+	t := time.Now().Truncate(frameInterval)
+	for n := 1; ; n++ {
+		frame, err := sim.Frame(t)
+		if err != nil {
+			return err
+		}
+		buf := append(append([]byte{hdlcFlag}, frame...), hdlcFlag)
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		if n == cfg.Count {
+			return nil
+		}
+		t = t.Add(frameInterval)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package exporter
+
+import (
+	`bytes`
+	`context`
+	`fmt`
+	`reflect`
+	`strings`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/output`
+	log "github.com/sirupsen/logrus"
+	`gopkg.in/yaml.v3`
+)
+
+// SinkConfig configures an output sink of a type registered with the output package.
+type SinkConfig struct {
+	// Type of the sink, such as influxdb.
+	Type string `yaml:"type"`
+
+	// Name of the sink in logs and metrics. Defaults to the type.
+	Name string `yaml:"name"`
+
+	// Buffering, batching, retries and circuit breaking.
+	output.Options `yaml:",inline"`
+
+	// Settings of the sink, depending on its type.
+	Settings yaml.Node `yaml:"settings"`
+}
+
+// decode decodes the settings of the sink. Missing settings leave v as it is.
+func (cfg SinkConfig) decode(v any) error {
+	if cfg.Settings.Kind == 0 {
+		return nil
+	}
+	return cfg.Settings.Decode(v)
+}
+
+// sameSink reports whether two sinks have the same type, name, options and settings, regardless of where
+// in the configuration file they are given.
+func sameSink(a, b SinkConfig) bool {
+	if a.Type != b.Type || a.Name != b.Name || a.Options != b.Options {
+		return false
+	}
+	settingsA, errA := yaml.Marshal(&a.Settings)
+	settingsB, errB := yaml.Marshal(&b.Settings)
+	return errA == nil && errB == nil && bytes.Equal(settingsA, settingsB)
+}
+
+// validateSinks checks the sinks of the sinks section, whose names must differ from each other
+// and from the sinks of the output sections.
+func validateSinks(sinks []SinkConfig, sections []SinkConfig) error {
+	names := make(map[string]bool)
+	for _, section := range sections {
+		names[section.Name] = true
+	}
+	for i := range sinks {
+		cfg := &sinks[i]
+		if len(cfg.Name) == 0 {
+			cfg.Name = cfg.Type
+		}
+		if names[cfg.Name] {
+			return fmt.Errorf("%s: name is given more than once", cfg.Name)
+		}
+		names[cfg.Name] = true
+		if err := cfg.Options.Validate(); err != nil {
+			return fmt.Errorf("%s: %w", cfg.Name, err)
+		}
+		if _, err := output.New(cfg.Type, cfg.decode); err != nil {
+			return fmt.Errorf("%s: %w", cfg.Name, err)
+		}
+	}
+	return nil
+}
+
+// sectionSinks returns the sinks configured by the output sections, such as mqtt, each named and typed
+// after its section, with the section as its settings and delivery options. The elasticsearch section
+// configures an elasticsearch and a logstash sink, for each of its destinations.
+func (cfg Config) sectionSinks() ([]SinkConfig, error) {
+	type outputSection struct {
+		name     string
+		settings any
+	}
+	sections := []outputSection{
+		{"mqtt", cfg.MQTT},
+		{"amqp", cfg.AMQP},
+		{"redis", cfg.Redis},
+		{"zabbix", cfg.Zabbix},
+		{"exec", cfg.Exec},
+		{"heartbeat", cfg.Heartbeat},
+	}
+	if cfg.Elasticsearch != nil && len(cfg.Elasticsearch.URL) > 0 {
+		sections = append(sections, outputSection{"elasticsearch", cfg.Elasticsearch})
+	}
+	if cfg.Elasticsearch != nil && len(cfg.Elasticsearch.Logstash) > 0 {
+		sections = append(sections, outputSection{"logstash", cfg.Elasticsearch})
+	}
+
+	var sinks []SinkConfig
+	for _, section := range sections {
+		if reflect.ValueOf(section.settings).IsNil() {
+			continue
+		}
+		sink := SinkConfig{Type: section.name, Name: section.name}
+		if err := sink.Settings.Encode(section.settings); err != nil {
+			return nil, fmt.Errorf("%s: %w", section.name, err)
+		}
+		// The options are inlined in the section, as in the sinks section.
+		if err := sink.Settings.Decode(&sink.Options); err != nil {
+			return nil, fmt.Errorf("%s: %w", section.name, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+// outputSinks returns the sinks of the output sections followed by those of the sinks section.
+func (cfg Config) outputSinks() ([]SinkConfig, error) {
+	sections, err := cfg.sectionSinks()
+	if err != nil {
+		return nil, err
+	}
+	return append(sections, cfg.Sinks...), nil
+}
+
+// runningSink is a sink added to the dispatcher, and its configuration.
+type runningSink struct {
+	cfg  SinkConfig
+	sink output.Sink
+}
+
+// startSinks adds the sinks to the dispatcher. Sinks in running with the same configuration are kept
+// as they are, while other sinks in running are closed, and their replacements started afresh.
+// It returns the sinks now running, and the first error of a sink that could not be started.
+func startSinks(ctx context.Context, dispatcher *output.Dispatcher, sinks []SinkConfig, running map[string]runningSink) (map[string]runningSink, error) {
+	next := make(map[string]runningSink, len(sinks))
+	wanted := make(map[string]bool, len(sinks))
+	for _, cfg := range sinks {
+		wanted[cfg.Name] = true
+	}
+	for name := range running {
+		if !wanted[name] {
+			stopSink(dispatcher, name)
+		}
+	}
+
+	var first error
+	for _, cfg := range sinks {
+		prev, ok := running[cfg.Name]
+		if ok && sameSink(prev.cfg, cfg) {
+			next[cfg.Name] = prev
+			continue
+		}
+		sink, err := output.New(cfg.Type, cfg.decode)
+		if ok {
+			if p, isMQTT := prev.sink.(*mqttPublisher); isMQTT && err == nil && p.replacedBy(sink) {
+				p.handOver()
+			}
+			stopSink(dispatcher, cfg.Name)
+		}
+		if err == nil {
+			err = dispatcher.Add(ctx, cfg.Name, sink, cfg.Options)
+		}
+		if err != nil {
+			if first == nil {
+				first = fmt.Errorf("sink %s: %w", cfg.Name, err)
+			}
+			continue
+		}
+		next[cfg.Name] = runningSink{cfg: cfg, sink: sink}
+	}
+	return next, first
+}
+
+func stopSink(dispatcher *output.Dispatcher, name string) {
+	if err := dispatcher.Remove(name); err != nil {
+		log.Errorf("Stop sink %s: %s", name, err)
+	}
+}
+
+// redactNode returns a copy of a YAML node with the values of keys that look like credentials replaced.
+func redactNode(node yaml.Node) yaml.Node {
+	if len(node.Content) == 0 {
+		return node
+	}
+	content := make([]*yaml.Node, len(node.Content))
+	for i, child := range node.Content {
+		redacted := redactNode(*child)
+		content[i] = &redacted
+	}
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(content); i += 2 {
+			key := strings.ToLower(content[i].Value)
+			if strings.Contains(key, "password") || strings.Contains(key, "token") || strings.Contains(key, "secret") {
+				content[i+1] = &yaml.Node{Kind: yaml.ScalarNode, Value: "<redacted>"}
+			}
+		}
+	}
+	node.Content = content
+	return node
+}
@@ -0,0 +1,425 @@
+package exporter
+
+import (
+	`context`
+	`encoding/asn1`
+	`math`
+	`net`
+	`sort`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/obis`
+	log "github.com/sirupsen/logrus"
+)
+
+// SNMP versions, as given in messages.
+const (
+	snmpV1  = 0
+	snmpV2c = 1
+)
+
+// SNMP PDU types, as context-specific tags.
+const (
+	snmpGetRequest     = 0
+	snmpGetNextRequest = 1
+	snmpResponse       = 2
+	snmpSetRequest     = 3
+	snmpGetBulkRequest = 5
+)
+
+// SNMP error statuses.
+const (
+	snmpNoSuchName  = 2
+	snmpReadOnly    = 4
+	snmpNotWritable = 17
+)
+
+// SNMPv2 exceptions, given as values of variable bindings.
+const (
+	snmpNoSuchInstance = 1
+	snmpEndOfMibView   = 2
+)
+
+// SNMP application types.
+const (
+	snmpGauge32   = 2
+	snmpTimeTicks = 3
+	snmpCounter64 = 6
+)
+
+// Largest SNMP message read, and largest number of variable bindings in a response.
+const (
+	snmpMaxMessage  = 4096
+	snmpMaxBindings = 100
+)
+
+// Readings are found below this OID, in enterprise 32473, which is reserved for examples by RFC 5612.
+var snmpBaseOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 32473, 1}
+
+// OIDs of the system group (RFC 3418) answered by the agent.
+var (
+	snmpSysDescr    = asn1.ObjectIdentifier{1, 3, 6, 1, 2, 1, 1, 1, 0}
+	snmpSysObjectID = asn1.ObjectIdentifier{1, 3, 6, 1, 2, 1, 1, 2, 0}
+	snmpSysUpTime   = asn1.ObjectIdentifier{1, 3, 6, 1, 2, 1, 1, 3, 0}
+)
+
+// snmpReading is a reading in the private MIB. SNMP has no floating point types,
+// so values are scaled to integers of a suitable unit.
+type snmpReading struct {
+	obis  string
+	scale float64
+	typ   int
+}
+
+// Readings in the private MIB. Reading i is found at the scalar object base.i.0, counting from 1.
+var snmpReadings = []snmpReading{
+	{obis.ActivePowerImport, 1, snmpGauge32},      // 1: imported active power, W
+	{obis.ActivePowerExport, 1, snmpGauge32},      // 2: exported active power, W
+	{obis.ReactivePowerImport, 1, snmpGauge32},    // 3: imported reactive power, var
+	{obis.ReactivePowerExport, 1, snmpGauge32},    // 4: exported reactive power, var
+	{obis.CurrentL1, 1000, snmpGauge32},           // 5: L1 current, mA
+	{obis.CurrentL2, 1000, snmpGauge32},           // 6: L2 current, mA
+	{obis.CurrentL3, 1000, snmpGauge32},           // 7: L3 current, mA
+	{obis.VoltageL1, 10, snmpGauge32},             // 8: L1 voltage, 0.1 V
+	{obis.VoltageL2, 10, snmpGauge32},             // 9: L2 voltage, 0.1 V
+	{obis.VoltageL3, 10, snmpGauge32},             // 10: L3 voltage, 0.1 V
+	{obis.ActiveEnergyImport, 1, snmpCounter64},   // 11: imported active energy, Wh
+	{obis.ActiveEnergyExport, 1, snmpCounter64},   // 12: exported active energy, Wh
+	{obis.ReactiveEnergyImport, 1, snmpCounter64}, // 13: imported reactive energy, varh
+	{obis.ReactiveEnergyExport, 1, snmpCounter64}, // 14: exported reactive energy, varh
+}
+
+// Objects computed by the agent, following the readings.
+const (
+	snmpNetPowerIndex = 15 // imported minus exported active power, W, as a signed integer
+	snmpAgeIndex      = 16 // seconds since the last frame
+	snmpMeterIDIndex  = 17 // meter ID, as a string
+)
+
+type snmpMessage struct {
+	Version   int
+	Community []byte
+	PDU       asn1.RawValue
+}
+
+type snmpVarBind struct {
+	Name  asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+// snmpObject is an object answered by the agent.
+type snmpObject struct {
+	oid   asn1.ObjectIdentifier
+	value asn1.RawValue
+}
+
+// snmpObjects returns the objects currently available in lexicographic order of their OIDs.
+// Readings not received from the meter are left out.
+func snmpObjects(status Status, started, now time.Time) []snmpObject {
+	values := make(map[string]float64, len(status.Readings))
+	for _, r := range status.Readings {
+		values[r.OBIS] = r.Value
+	}
+	reading := func(index int) asn1.ObjectIdentifier {
+		oid := make(asn1.ObjectIdentifier, len(snmpBaseOID), len(snmpBaseOID)+2)
+		copy(oid, snmpBaseOID)
+		return append(oid, index, 0)
+	}
+
+	objects := []snmpObject{
+		{snmpSysDescr, snmpString("AMS power meter exporter")},
+		{snmpSysObjectID, snmpOID(snmpBaseOID)},
+		{snmpSysUpTime, snmpUnsigned(snmpTimeTicks, uint64(now.Sub(started)/(10*time.Millisecond)))},
+	}
+	for i, r := range snmpReadings {
+		val, ok := values[r.obis]
+		if !ok {
+			continue
+		}
+		objects = append(objects, snmpObject{reading(i + 1), snmpUnsigned(r.typ, uint64(math.Max(0, math.Round(val*r.scale))))})
+	}
+	if power, ok := netPower(values); ok {
+		objects = append(objects, snmpObject{reading(snmpNetPowerIndex), snmpInteger(int64(math.Round(power)))})
+	}
+	if !status.LastFrame.IsZero() {
+		age := uint64(math.Max(0, now.Sub(status.LastFrame).Seconds()))
+		objects = append(objects, snmpObject{reading(snmpAgeIndex), snmpUnsigned(snmpGauge32, age)})
+	}
+	if len(status.MeterID) > 0 {
+		objects = append(objects, snmpObject{reading(snmpMeterIDIndex), snmpString(status.MeterID)})
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return oidLess(objects[i].oid, objects[j].oid)
+	})
+	return objects
+}
+
+func oidLess(a, b asn1.ObjectIdentifier) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
+
+func snmpInteger(v int64) asn1.RawValue {
+	data, _ := asn1.Marshal(v)
+	return asn1.RawValue{FullBytes: data}
+}
+
+func snmpString(s string) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagOctetString, Bytes: []byte(s)}
+}
+
+func snmpOID(oid asn1.ObjectIdentifier) asn1.RawValue {
+	data, _ := asn1.Marshal(oid)
+	return asn1.RawValue{FullBytes: data}
+}
+
+// snmpUnsigned encodes an unsigned application type, such as Gauge32 or Counter64.
+// 32-bit types are capped at their maximum value.
+func snmpUnsigned(typ int, v uint64) asn1.RawValue {
+	if typ != snmpCounter64 && v > math.MaxUint32 {
+		v = math.MaxUint32
+	}
+	data := []byte{0}
+	for i := 56; i >= 0; i -= 8 {
+		if b := byte(v >> i); len(data) > 1 || b != 0 {
+			data = append(data, b)
+		}
+	}
+	// Keep the leading zero only if needed to make the value positive.
+	if len(data) > 1 && data[1] < 0x80 {
+		data = data[1:]
+	}
+	return asn1.RawValue{Class: asn1.ClassApplication, Tag: typ, Bytes: data}
+}
+
+func snmpException(tag int) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag}
+}
+
+// snmpAgent answers SNMP v1 and v2c requests for the current readings. It is read only.
+type snmpAgent struct {
+	meter     *meterCollector
+	community string
+	started   time.Time
+}
+
+func newSNMPAgent(meter *meterCollector, community string) *snmpAgent {
+	return &snmpAgent{
+		meter:     meter,
+		community: community,
+		started:   time.Now(),
+	}
+}
+
+// serve answers requests until the context is canceled.
+func (a *snmpAgent) serve(ctx context.Context, conn net.PacketConn) {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	buf := make([]byte, snmpMaxMessage)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Errorf("SNMP agent: %s", err)
+			continue
+		}
+		resp := a.handle(buf[:n], time.Now())
+		if resp == nil {
+			log.Debugf("SNMP agent ignored request from %s", addr)
+			continue
+		}
+		if _, err := conn.WriteTo(resp, addr); err != nil {
+			log.Debugf("SNMP agent: %s", err)
+		}
+	}
+}
+
+// handle answers a single message, or returns nil if it is invalid or has the wrong community.
+func (a *snmpAgent) handle(data []byte, now time.Time) []byte {
+	var msg snmpMessage
+	if _, err := asn1.Unmarshal(data, &msg); err != nil {
+		return nil
+	}
+	if msg.Version != snmpV1 && msg.Version != snmpV2c {
+		return nil
+	}
+	if string(msg.Community) != a.community {
+		return nil
+	}
+	pdu := msg.PDU
+	if pdu.Class != asn1.ClassContextSpecific || !pdu.IsCompound {
+		return nil
+	}
+
+	// The error status and index fields hold the non-repeaters and max-repetitions of GetBulk requests.
+	var requestID, nonRepeaters, maxRepetitions int
+	rest, err := asn1.Unmarshal(pdu.Bytes, &requestID)
+	if err == nil {
+		rest, err = asn1.Unmarshal(rest, &nonRepeaters)
+	}
+	if err == nil {
+		rest, err = asn1.Unmarshal(rest, &maxRepetitions)
+	}
+	var bindings []snmpVarBind
+	if err == nil {
+		_, err = asn1.Unmarshal(rest, &bindings)
+	}
+	if err != nil {
+		return nil
+	}
+
+	objects := snmpObjects(a.meter.Status(), a.started, now)
+	if msg.Version == snmpV1 {
+		objects = snmpV1Objects(objects)
+	}
+	errorStatus, errorIndex := 0, 0
+
+	switch pdu.Tag {
+	case snmpGetRequest:
+		for i := range bindings {
+			obj, ok := snmpGet(objects, bindings[i].Name)
+			if ok {
+				bindings[i].Value = obj.value
+			} else if msg.Version == snmpV1 {
+				errorStatus, errorIndex = snmpNoSuchName, i+1
+				break
+			} else {
+				bindings[i].Value = snmpException(snmpNoSuchInstance)
+			}
+		}
+	case snmpGetNextRequest:
+		for i := range bindings {
+			obj, ok := snmpGetNext(objects, bindings[i].Name)
+			if ok {
+				bindings[i] = snmpVarBind{obj.oid, obj.value}
+			} else if msg.Version == snmpV1 {
+				errorStatus, errorIndex = snmpNoSuchName, i+1
+				break
+			} else {
+				bindings[i].Value = snmpException(snmpEndOfMibView)
+			}
+		}
+	case snmpGetBulkRequest:
+		if msg.Version == snmpV1 {
+			return nil
+		}
+		bindings = snmpGetBulk(objects, bindings, nonRepeaters, maxRepetitions)
+	case snmpSetRequest:
+		errorStatus, errorIndex = snmpNotWritable, 1
+		if msg.Version == snmpV1 {
+			errorStatus = snmpReadOnly
+		}
+	default:
+		return nil
+	}
+
+	// On errors, the request is returned with only the error fields set.
+	if errorStatus != 0 {
+		bindings = nil
+		if _, err := asn1.Unmarshal(rest, &bindings); err != nil {
+			return nil
+		}
+	}
+
+	var body []byte
+	for _, v := range []any{requestID, errorStatus, errorIndex, bindings} {
+		data, err := asn1.Marshal(v)
+		if err != nil {
+			log.Errorf("Encode SNMP response: %s", err)
+			return nil
+		}
+		body = append(body, data...)
+	}
+	resp, err := asn1.Marshal(snmpMessage{
+		Version:   msg.Version,
+		Community: msg.Community,
+		PDU:       asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: snmpResponse, IsCompound: true, Bytes: body},
+	})
+	if err != nil {
+		log.Errorf("Encode SNMP response: %s", err)
+		return nil
+	}
+	return resp
+}
+
+// snmpV1Objects leaves out objects of types not supported by SNMPv1.
+func snmpV1Objects(objects []snmpObject) []snmpObject {
+	v1 := make([]snmpObject, 0, len(objects))
+	for _, obj := range objects {
+		if obj.value.Class == asn1.ClassApplication && obj.value.Tag == snmpCounter64 {
+			continue
+		}
+		v1 = append(v1, obj)
+	}
+	return v1
+}
+
+func snmpGet(objects []snmpObject, oid asn1.ObjectIdentifier) (snmpObject, bool) {
+	for _, obj := range objects {
+		if obj.oid.Equal(oid) {
+			return obj, true
+		}
+	}
+	return snmpObject{}, false
+}
+
+// snmpGetNext returns the first object following the given OID.
+func snmpGetNext(objects []snmpObject, oid asn1.ObjectIdentifier) (snmpObject, bool) {
+	i := sort.Search(len(objects), func(i int) bool {
+		return oidLess(oid, objects[i].oid)
+	})
+	if i == len(objects) {
+		return snmpObject{}, false
+	}
+	return objects[i], true
+}
+
+// snmpGetBulk answers a GetBulk request: one successor for each of the first nonRepeaters bindings,
+// then up to maxRepetitions successors for each of the rest, in turn.
+func snmpGetBulk(objects []snmpObject, bindings []snmpVarBind, nonRepeaters, maxRepetitions int) []snmpVarBind {
+	if nonRepeaters < 0 {
+		nonRepeaters = 0
+	}
+	if nonRepeaters > len(bindings) {
+		nonRepeaters = len(bindings)
+	}
+	next := func(oid asn1.ObjectIdentifier) snmpVarBind {
+		if obj, ok := snmpGetNext(objects, oid); ok {
+			return snmpVarBind{obj.oid, obj.value}
+		}
+		return snmpVarBind{oid, snmpException(snmpEndOfMibView)}
+	}
+
+	resp := make([]snmpVarBind, 0, len(bindings))
+	for _, b := range bindings[:nonRepeaters] {
+		resp = append(resp, next(b.Name))
+	}
+	repeaters := bindings[nonRepeaters:]
+	for r := 0; r < maxRepetitions && len(repeaters) > 0; r++ {
+		done := true
+		for i, b := range repeaters {
+			if len(resp) == snmpMaxBindings {
+				return resp
+			}
+			repeaters[i] = next(b.Name)
+			resp = append(resp, repeaters[i])
+			if repeaters[i].Value.Class != asn1.ClassContextSpecific {
+				done = false
+			}
+		}
+		if done {
+			break
+		}
+	}
+	return resp
+}
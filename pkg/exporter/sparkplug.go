@@ -0,0 +1,299 @@
+package exporter
+
+import (
+	`fmt`
+	`math`
+	`strings`
+	`sync`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/obis`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+	`google.golang.org/protobuf/encoding/protowire`
+)
+
+// MQTT payload format publishing Sparkplug B messages instead of readings on a topic of choice.
+const sparkplugFormat = "sparkplugb"
+
+// SparkplugConfig identifies the exporter as a Sparkplug B edge node.
+type SparkplugConfig struct {
+	// Group of edge nodes the exporter belongs to. Defaults to ams.
+	GroupID string `yaml:"group_id"`
+
+	// Name of the edge node. Defaults to aidon.
+	EdgeNodeID string `yaml:"edge_node_id"`
+}
+
+func (cfg *SparkplugConfig) validate() error {
+	if len(cfg.GroupID) == 0 {
+		cfg.GroupID = "ams"
+	}
+	if len(cfg.EdgeNodeID) == 0 {
+		cfg.EdgeNodeID = "aidon"
+	}
+	for _, id := range []string{cfg.GroupID, cfg.EdgeNodeID} {
+		if strings.ContainsAny(id, "/+#") {
+			return fmt.Errorf("%q must not contain /, + or #", id)
+		}
+	}
+	return nil
+}
+
+// Sparkplug B data types of metrics.
+const (
+	sparkplugUInt64  = 8
+	sparkplugDouble  = 10
+	sparkplugBoolean = 11
+	sparkplugString  = 12
+)
+
+// Names of the node metrics required by the specification.
+const (
+	sparkplugBdSeq   = "bdSeq"
+	sparkplugRebirth = "Node Control/Rebirth"
+)
+
+// sparkplugMetric is a single metric of a Sparkplug B payload. A nil value is sent as null.
+type sparkplugMetric struct {
+	name     string
+	alias    uint64
+	datatype uint32
+	value    any
+}
+
+// sparkplugNode publishes readings as a Sparkplug B edge node, so that SCADA systems such as Ignition
+// discover the meter by themselves. Every known register becomes a metric, announced with its name
+// and an alias in NBIRTH when connecting, after which NDATA messages only carry aliases and values.
+// NDEATH is the last will of the connection, and a rebirth is published when requested with NCMD.
+type sparkplugNode struct {
+	cfg SparkplugConfig
+
+	mu    sync.Mutex
+	seq   uint64
+	bdSeq uint64
+	last  map[string]protocol.Register
+	born  bool
+}
+
+func newSparkplugNode(cfg SparkplugConfig) *sparkplugNode {
+	return &sparkplugNode{
+		cfg:  cfg,
+		last: make(map[string]protocol.Register),
+	}
+}
+
+func (n *sparkplugNode) topic(messageType string) string {
+	return "spBv1.0/" + n.cfg.GroupID + "/" + messageType + "/" + n.cfg.EdgeNodeID
+}
+
+// configure sets NDEATH as the last will, and publishes NBIRTH on every connection.
+func (n *sparkplugNode) configure(opts *mqtt.ClientOptions) {
+	death := sparkplugPayload(time.Now(), nil, []sparkplugMetric{{name: sparkplugBdSeq, datatype: sparkplugUInt64, value: n.bdSeq}})
+	opts.SetBinaryWill(n.topic("NDEATH"), death, 1, false)
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		log.Infof("Connected to MQTT broker as Sparkplug B edge node %s/%s", n.cfg.GroupID, n.cfg.EdgeNodeID)
+		client.Subscribe(n.topic("NCMD"), 1, func(client mqtt.Client, msg mqtt.Message) {
+			if sparkplugRebirthRequested(msg.Payload()) {
+				log.Infof("Sparkplug B rebirth requested")
+				n.birth(client)
+			}
+		})
+		n.birth(client)
+	})
+}
+
+// birth publishes NBIRTH with every known register, restarting the sequence numbers.
+func (n *sparkplugNode) birth(client mqtt.Client) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.born = true
+	n.seq = 0
+	metrics := []sparkplugMetric{
+		{name: sparkplugBdSeq, datatype: sparkplugUInt64, value: n.bdSeq},
+		{name: sparkplugRebirth, datatype: sparkplugBoolean, value: false},
+	}
+	for i, reg := range obis.Registers() {
+		m := sparkplugMetric{name: reg.Name, alias: uint64(i + 1), datatype: sparkplugDouble}
+		if reg.Type == obis.Info {
+			m.datatype = sparkplugString
+		}
+		if last, ok := n.last[reg.Code]; ok {
+			m.value = sparkplugValue(m.datatype, last)
+		}
+		metrics = append(metrics, m)
+	}
+	client.Publish(n.topic("NBIRTH"), 0, false, n.payload(time.Now(), metrics))
+}
+
+// publish publishes the registers of a packet in NDATA, by alias. It returns the token of the message,
+// or nil if nothing was published.
+func (n *sparkplugNode) publish(client mqtt.Client, packet *protocol.Packet) mqtt.Token {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var metrics []sparkplugMetric
+	for i, reg := range obis.Registers() {
+		r, ok := packet.Registers[reg.Code]
+		if !ok {
+			continue
+		}
+		n.last[reg.Code] = r
+		datatype := uint32(sparkplugDouble)
+		if reg.Type == obis.Info {
+			datatype = sparkplugString
+		}
+		metrics = append(metrics, sparkplugMetric{alias: uint64(i + 1), datatype: datatype, value: sparkplugValue(datatype, r)})
+	}
+	// Data published before the birth certificate would be discarded by the host application.
+	if len(metrics) == 0 || !n.born {
+		return nil
+	}
+	return client.Publish(n.topic("NDATA"), 0, false, n.payload(packet.Time, metrics))
+}
+
+// stop publishes NDEATH, which the broker does not do for a clean disconnect.
+func (n *sparkplugNode) stop(client mqtt.Client) {
+	death := sparkplugPayload(time.Now(), nil, []sparkplugMetric{{name: sparkplugBdSeq, datatype: sparkplugUInt64, value: n.bdSeq}})
+	token := client.Publish(n.topic("NDEATH"), 1, false, death)
+	if !token.WaitTimeout(time.Second) {
+		log.Warnf("Timed out publishing Sparkplug B NDEATH")
+	}
+}
+
+// payload encodes a payload with the next sequence number, which wraps after 255.
+func (n *sparkplugNode) payload(t time.Time, metrics []sparkplugMetric) []byte {
+	seq := n.seq
+	n.seq = (n.seq + 1) % 256
+	return sparkplugPayload(t, &seq, metrics)
+}
+
+// sparkplugValue returns the value of a register as a metric of the data type, or nil if it cannot be converted.
+func sparkplugValue(datatype uint32, reg protocol.Register) any {
+	if datatype == sparkplugString {
+		return fmt.Sprint(reg.Value)
+	}
+	val, err := reg.Float()
+	if err != nil {
+		return nil
+	}
+	return val
+}
+
+// sparkplugPayload encodes a Sparkplug B payload in the protobuf wire format of sparkplug_b.proto.
+func sparkplugPayload(t time.Time, seq *uint64, metrics []sparkplugMetric) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(t.UnixMilli()))
+	for _, m := range metrics {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.encode(t))
+	}
+	if seq != nil {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, *seq)
+	}
+	return b
+}
+
+func (m sparkplugMetric) encode(t time.Time) []byte {
+	var b []byte
+	if len(m.name) > 0 {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, m.name)
+	}
+	if m.alias > 0 {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.alias)
+	}
+	b = protowire.AppendTag(b, 3, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(t.UnixMilli()))
+	b = protowire.AppendTag(b, 4, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(m.datatype))
+	switch v := m.value.(type) {
+	case nil:
+		b = protowire.AppendTag(b, 7, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	case uint64:
+		b = protowire.AppendTag(b, 11, protowire.VarintType)
+		b = protowire.AppendVarint(b, v)
+	case float64:
+		b = protowire.AppendTag(b, 13, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(v))
+	case bool:
+		b = protowire.AppendTag(b, 14, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(v))
+	case string:
+		b = protowire.AppendTag(b, 15, protowire.BytesType)
+		b = protowire.AppendString(b, v)
+	}
+	return b
+}
+
+// sparkplugRebirthRequested reports whether an NCMD payload sets the rebirth metric to true.
+func sparkplugRebirthRequested(payload []byte) bool {
+	for _, metric := range protowireFields(payload, 2) {
+		var name string
+		var value bool
+		for len(metric) > 0 {
+			num, typ, n := protowire.ConsumeTag(metric)
+			if n < 0 {
+				return false
+			}
+			metric = metric[n:]
+			switch {
+			case num == 1 && typ == protowire.BytesType:
+				s, n := protowire.ConsumeString(metric)
+				if n < 0 {
+					return false
+				}
+				name = s
+				metric = metric[n:]
+			case num == 14 && typ == protowire.VarintType:
+				v, n := protowire.ConsumeVarint(metric)
+				if n < 0 {
+					return false
+				}
+				value = protowire.DecodeBool(v)
+				metric = metric[n:]
+			default:
+				n := protowire.ConsumeFieldValue(num, typ, metric)
+				if n < 0 {
+					return false
+				}
+				metric = metric[n:]
+			}
+		}
+		if name == sparkplugRebirth && value {
+			return true
+		}
+	}
+	return false
+}
+
+// protowireFields returns the contents of every length-delimited field with the number in a protobuf message.
+func protowireFields(b []byte, field protowire.Number) [][]byte {
+	var fields [][]byte
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fields
+		}
+		b = b[n:]
+		if num == field && typ == protowire.BytesType {
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return fields
+			}
+			fields = append(fields, v)
+			b = b[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return fields
+		}
+		b = b[n:]
+	}
+	return fields
+}
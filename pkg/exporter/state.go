@@ -0,0 +1,310 @@
+package exporter
+
+import (
+	`context`
+	`encoding/json`
+	`errors`
+	`fmt`
+	`io/fs`
+	`os`
+	`path/filepath`
+	`time`
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How often derived state is saved while running. It is also saved on shutdown.
+const stateSaveInterval = time.Minute
+
+// persistent is implemented by collectors whose accumulated state survives restarts.
+type persistent interface {
+	saveState() (json.RawMessage, error)
+	restoreState(json.RawMessage) error
+}
+
+// stateFile keeps the state of collectors in a JSON file, keyed by collector name.
+type stateFile struct {
+	path       string
+	collectors map[string]persistent
+}
+
+type stateDocument struct {
+	Saved      time.Time                  `json:"saved"`
+	Collectors map[string]json.RawMessage `json:"collectors"`
+}
+
+func newStateFile(path string) *stateFile {
+	return &stateFile{
+		path:       path,
+		collectors: make(map[string]persistent),
+	}
+}
+
+func (f *stateFile) add(name string, c persistent) {
+	f.collectors[name] = c
+}
+
+// load restores the state of all collectors found in the file. A missing file is not an error.
+// State left behind by collectors that are no longer enabled is ignored.
+func (f *stateFile) load() error {
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var doc stateDocument
+	err = json.Unmarshal(data, &doc)
+	if err != nil {
+		return fmt.Errorf("parse %s: %w", f.path, err)
+	}
+	for name, c := range f.collectors {
+		state, ok := doc.Collectors[name]
+		if !ok {
+			continue
+		}
+		if err := c.restoreState(state); err != nil {
+			return fmt.Errorf("restore %s: %w", name, err)
+		}
+	}
+	log.Infof("Restored state saved at %s from %s", doc.Saved.Format(time.RFC3339), f.path)
+	return nil
+}
+
+// save writes the state of all collectors. The file is replaced atomically,
+// so that a crash while writing leaves the previous state intact.
+func (f *stateFile) save() error {
+	doc := stateDocument{
+		Saved:      time.Now(),
+		Collectors: make(map[string]json.RawMessage, len(f.collectors)),
+	}
+	for name, c := range f.collectors {
+		state, err := c.saveState()
+		if err != nil {
+			return fmt.Errorf("save %s: %w", name, err)
+		}
+		doc.Collectors[name] = state
+	}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// run saves the state periodically until the context is canceled, and a final time before returning.
+func (f *stateFile) run(ctx context.Context) {
+	ticker := time.NewTicker(stateSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := f.save(); err != nil {
+				log.Errorf("Save state: %s", err)
+			}
+			return
+		case <-ticker.C:
+			if err := f.save(); err != nil {
+				log.Errorf("Save state: %s", err)
+			}
+		}
+	}
+}
+
+// energyState is the persisted form of hourlyEnergy.
+type energyState struct {
+	LastTime  time.Time     `json:"last_time"`
+	LastPower float64       `json:"last_power"`
+	Hour      time.Time     `json:"hour"`
+	Wh        float64       `json:"wh"`
+	Covered   time.Duration `json:"covered"`
+}
+
+func (e *hourlyEnergy) state() energyState {
+	return energyState{
+		LastTime:  e.lastTime,
+		LastPower: e.lastPower,
+		Hour:      e.hour,
+		Wh:        e.wh,
+		Covered:   e.covered,
+	}
+}
+
+func (e *hourlyEnergy) restore(s energyState) {
+	e.lastTime = s.LastTime.In(e.loc)
+	e.lastPower = s.LastPower
+	e.hour = s.Hour.In(e.loc)
+	e.wh = s.Wh
+	e.covered = s.Covered
+}
+
+type peakState struct {
+	Energy energyState           `json:"energy"`
+	Month  time.Time             `json:"month"`
+	Daily  map[time.Time]float64 `json:"daily"`
+}
+
+func (c *peakCollector) saveState() (json.RawMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return json.Marshal(peakState{
+		Energy: c.energy.state(),
+		Month:  c.month,
+		Daily:  c.daily,
+	})
+}
+
+func (c *peakCollector) restoreState(data json.RawMessage) error {
+	var s peakState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.energy.restore(s.Energy)
+	c.month = s.Month.In(c.energy.loc)
+	c.daily = make(map[time.Time]float64, len(s.Daily))
+	for day, wh := range s.Daily {
+		c.daily[day.In(c.energy.loc)] = wh
+	}
+	return nil
+}
+
+type costState struct {
+	LastTime  time.Time `json:"last_time"`
+	LastPower float64   `json:"last_power"`
+	Hour      time.Time `json:"hour"`
+	Day       time.Time `json:"day"`
+	Month     time.Time `json:"month"`
+	HourCost  float64   `json:"hour_cost"`
+	DayCost   float64   `json:"day_cost"`
+	MonthCost float64   `json:"month_cost"`
+}
+
+func (c *costCollector) saveState() (json.RawMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return json.Marshal(costState{
+		LastTime:  c.lastTime,
+		LastPower: c.lastPower,
+		Hour:      c.hour,
+		Day:       c.day,
+		Month:     c.month,
+		HourCost:  c.hourCost,
+		DayCost:   c.dayCost,
+		MonthCost: c.monthCost,
+	})
+}
+
+func (c *costCollector) restoreState(data json.RawMessage) error {
+	var s costState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastTime = s.LastTime.In(c.loc)
+	c.lastPower = s.LastPower
+	c.hour = s.Hour.In(c.loc)
+	c.day = s.Day.In(c.loc)
+	c.month = s.Month.In(c.loc)
+	c.hourCost = s.HourCost
+	c.dayCost = s.DayCost
+	c.monthCost = s.MonthCost
+	return nil
+}
+
+func (c *hourlyAverageCollector) saveState() (json.RawMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return json.Marshal(c.energy.state())
+}
+
+func (c *hourlyAverageCollector) restoreState(data json.RawMessage) error {
+	var s energyState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.energy.restore(s)
+	return nil
+}
+
+type tariffState struct {
+	Reading float64            `json:"reading"`
+	Hour    time.Time          `json:"hour"`
+	Energy  map[string]float64 `json:"energy"`
+}
+
+func (c *tariffCollector) saveState() (json.RawMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return json.Marshal(tariffState{
+		Reading: c.reading,
+		Hour:    c.hour,
+		Energy:  c.energy,
+	})
+}
+
+// restoreState restores the accumulated energy. Energy of tariffs that are no longer configured is dropped.
+func (c *tariffCollector) restoreState(data json.RawMessage) error {
+	var s tariffState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reading = s.Reading
+	c.hour = s.Hour.In(c.loc)
+	c.energy = make(map[string]float64, len(s.Energy))
+	for name, wh := range s.Energy {
+		if name == otherTariff || c.configured(name) {
+			c.energy[name] = wh
+		}
+	}
+	return nil
+}
+
+func (c *periodCollector) saveState() (json.RawMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return json.Marshal(c.energy)
+}
+
+func (c *periodCollector) restoreState(data json.RawMessage) error {
+	var energy map[string]*periodEnergy
+	if err := json.Unmarshal(data, &energy); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.energy = make(map[string]*periodEnergy, len(energy))
+	for direction, e := range energy {
+		if _, ok := periodRegisters[direction]; !ok || e == nil {
+			continue
+		}
+		e.Hour = e.Hour.In(c.loc)
+		e.Day = e.Day.In(c.loc)
+		e.Month = e.Month.In(c.loc)
+		c.energy[direction] = e
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package exporter
+
+import (
+	`encoding/json`
+	`fmt`
+	`html/template`
+	`net/http`
+
+	log "github.com/sirupsen/logrus"
+)
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Aidon AMS exporter</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.2em 1em; text-align: left; }
+td.value { text-align: right; }
+</style>
+</head>
+<body>
+<h1>Aidon AMS exporter</h1>
+<table>
+<tr><th>Meter ID</th><td>{{ .MeterID }}</td></tr>
+<tr><th>Meter type</th><td>{{ .MeterType }}</td></tr>
+<tr><th>List version</th><td>{{ .ListVersion }}</td></tr>
+<tr><th>Phases</th><td>{{ .Phases }}</td></tr>
+<tr><th>Last frame</th><td>{{ if .LastFrame.IsZero }}never{{ else }}{{ .LastFrame.Format "2006-01-02 15:04:05 MST" }}{{ end }}</td></tr>
+</table>
+<h2>Readings</h2>
+<table>
+<tr><th>OBIS</th><th>Description</th><th>Value</th><th>Unit</th></tr>
+{{ range .Readings }}<tr><td>{{ .OBIS }}</td><td>{{ .Help }}</td><td class="value">{{ .Value }}</td><td>{{ .Unit }}</td></tr>
+{{ end }}</table>
+<p><a href="/live">Live</a> | <a href="{{ .MetricsPath }}">Metrics</a> | <a href="/api/v1/current">API</a></p>
+</body>
+</html>
+`))
+
+func statusPageHandler(meter *meterCollector, metricsPath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := statusTemplate.Execute(w, struct {
+			Status
+			MetricsPath string
+		}{meter.Status(), metricsPath})
+		if err != nil {
+			log.Errorf("Render status page: %s", err)
+		}
+	}
+}
+
+func currentHandler(meter *meterCollector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(meter.Status())
+		if err != nil {
+			log.Errorf("Encode status: %s", err)
+		}
+	}
+}
+
+// reloadHandler requests a reload of the configuration file. The reload itself happens in the
+// background, and its outcome is logged.
+func reloadHandler(request func()) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		request()
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func healthHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "ok")
+	}
+}
@@ -0,0 +1,173 @@
+package exporter
+
+import (
+	`fmt`
+	`net`
+	`os`
+	`sync`
+	`time`
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SyslogConfig configures sending log messages to a syslog daemon in RFC 5424 format.
+type SyslogConfig struct {
+	// One of udp, tcp, unix or unixgram. Defaults to udp.
+	Network string `yaml:"network"`
+	Address string `yaml:"address"`
+
+	// Syslog facility name, such as daemon or local0. Defaults to daemon.
+	Facility string `yaml:"facility"`
+
+	// Application name in each message. Defaults to ams-exporter.
+	Tag string `yaml:"tag"`
+}
+
+var syslogFacilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+var syslogSeverities = map[log.Level]int{
+	log.PanicLevel: 2,
+	log.FatalLevel: 2,
+	log.ErrorLevel: 3,
+	log.WarnLevel:  4,
+	log.InfoLevel:  6,
+	log.DebugLevel: 7,
+	log.TraceLevel: 7,
+}
+
+func (cfg *SyslogConfig) validate() error {
+	if len(cfg.Address) == 0 {
+		return fmt.Errorf("address is required")
+	}
+	if len(cfg.Network) == 0 {
+		cfg.Network = "udp"
+	}
+	switch cfg.Network {
+	case "udp", "tcp", "unix", "unixgram":
+	default:
+		return fmt.Errorf("unsupported network %q", cfg.Network)
+	}
+	if len(cfg.Facility) == 0 {
+		cfg.Facility = "daemon"
+	}
+	if _, ok := syslogFacilities[cfg.Facility]; !ok {
+		return fmt.Errorf("unknown facility %q", cfg.Facility)
+	}
+	if len(cfg.Tag) == 0 {
+		cfg.Tag = "ams-exporter"
+	}
+	return nil
+}
+
+// SyslogHook is a logrus hook sending log messages to a syslog daemon.
+// The connection is re-established if sending fails.
+type SyslogHook struct {
+	cfg      SyslogConfig
+	facility int
+	hostname string
+	mu       sync.Mutex
+	conn     net.Conn
+}
+
+// NewSyslogHook validates the configuration and connects to the syslog daemon.
+func NewSyslogHook(cfg SyslogConfig) (*SyslogHook, error) {
+	err := cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+	h := &SyslogHook{
+		cfg:      cfg,
+		facility: syslogFacilities[cfg.Facility],
+		hostname: hostname,
+	}
+	h.conn, err = h.dial()
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *SyslogHook) dial() (net.Conn, error) {
+	return net.DialTimeout(h.cfg.Network, h.cfg.Address, 5*time.Second)
+}
+
+func (h *SyslogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *SyslogHook) Fire(entry *log.Entry) error {
+	msg := h.format(entry)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.conn == nil {
+		conn, err := h.dial()
+		if err != nil {
+			return err
+		}
+		h.conn = conn
+	}
+	h.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := h.conn.Write(msg)
+	if err != nil {
+		h.conn.Close()
+		h.conn = nil
+	}
+	return err
+}
+
+// format renders the entry as an RFC 5424 message. Messages sent over stream
+// sockets are prefixed with their length, as described in RFC 6587.
+func (h *SyslogHook) format(entry *log.Entry) []byte {
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d - - %s",
+		h.facility*8+syslogSeverities[entry.Level],
+		entry.Time.Format(time.RFC3339Nano),
+		h.hostname,
+		h.cfg.Tag,
+		os.Getpid(),
+		entry.Message,
+	)
+	switch h.cfg.Network {
+	case "tcp", "unix":
+		return []byte(fmt.Sprintf("%d %s", len(msg), msg))
+	}
+	return []byte(msg)
+}
+
+// Close closes the connection to the syslog daemon.
+func (h *SyslogHook) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conn == nil {
+		return nil
+	}
+	err := h.conn.Close()
+	h.conn = nil
+	return err
+}
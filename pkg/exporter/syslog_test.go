@@ -0,0 +1,34 @@
+package exporter
+
+import (
+	`net`
+	`regexp`
+	`testing`
+	`time`
+
+	log "github.com/sirupsen/logrus"
+	`github.com/stretchr/testify/assert`
+)
+
+func TestSyslogHook(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	hook, err := NewSyslogHook(SyslogConfig{Address: conn.LocalAddr().String(), Facility: "local0"})
+	assert.NoError(t, err)
+	defer hook.Close()
+
+	err = hook.Fire(&log.Entry{
+		Level:   log.WarnLevel,
+		Time:    time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC),
+		Message: "Serial port closed",
+	})
+	assert.NoError(t, err)
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Regexp(t, regexp.MustCompile(`^<132>1 2022-09-01T12:00:00Z \S+ ams-exporter \d+ - - Serial port closed$`), string(buf[:n]))
+}
@@ -0,0 +1,185 @@
+package exporter
+
+import (
+	`fmt`
+	`strings`
+	`sync`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/obis`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+	`github.com/prometheus/client_golang/prometheus`
+)
+
+// Tariff of hours not matching any configured tariff.
+const otherTariff = "other"
+
+// TariffConfig is a time-of-use period, such as night or weekend, that consumption is billed separately for.
+type TariffConfig struct {
+	Name string `yaml:"name"`
+
+	// Days of the week the tariff applies to, such as saturday. Empty means every day.
+	Days []string `yaml:"days"`
+
+	// Hours of the day the tariff applies to, from and up to but not including, wrapping past midnight
+	// if from is after to. The same hour for both, such as 0 and 0, means the whole day.
+	From int `yaml:"from"`
+	To   int `yaml:"to"`
+}
+
+func (cfg TariffConfig) validate() error {
+	if len(cfg.Name) == 0 {
+		return fmt.Errorf("name is required")
+	}
+	for _, day := range cfg.Days {
+		if _, ok := parseWeekday(day); !ok {
+			return fmt.Errorf("%s: unknown day %q", cfg.Name, day)
+		}
+	}
+	if cfg.From < 0 || cfg.From > 24 || cfg.To < 0 || cfg.To > 24 {
+		return fmt.Errorf("%s: from and to must be hours between 0 and 24", cfg.Name)
+	}
+	return nil
+}
+
+func parseWeekday(s string) (time.Weekday, bool) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if strings.EqualFold(s, day.String()) {
+			return day, true
+		}
+	}
+	return 0, false
+}
+
+// matches reports whether the tariff applies to the hour starting at t.
+func (cfg TariffConfig) matches(t time.Time) bool {
+	if len(cfg.Days) > 0 {
+		found := false
+		for _, s := range cfg.Days {
+			if day, _ := parseWeekday(s); day == t.Weekday() {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	from, to, h := cfg.From%24, cfg.To%24, t.Hour()
+	switch {
+	case from == to:
+		return true
+	case from < to:
+		return h >= from && h < to
+	default:
+		return h >= from || h < to
+	}
+}
+
+// tariffCollector splits the imported energy between time-of-use tariffs, the way it is billed. The energy
+// of each hour is taken from the hourly meter readings, and goes to the first tariff applying to that hour.
+type tariffCollector struct {
+	mu      sync.Mutex
+	loc     *time.Location
+	tariffs []TariffConfig
+	meterID string
+
+	// Last hourly reading of imported energy in Wh, and the hour boundary it applies to.
+	reading float64
+	hour    time.Time
+	energy  map[string]float64
+
+	desc *prometheus.Desc
+}
+
+func newTariffCollector(namespace string, tariffs []TariffConfig, loc *time.Location) *tariffCollector {
+	return &tariffCollector{
+		loc:     loc,
+		tariffs: tariffs,
+		energy:  make(map[string]float64),
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "tariff_energy_wh_total"),
+			"Active energy imported during the hours of a time-of-use tariff, from the hourly meter readings",
+			[]string{"meter_id", "tariff"},
+			nil,
+		),
+	}
+}
+
+// tariff returns the name of the tariff applying to the hour starting at t.
+func (c *tariffCollector) tariff(t time.Time) string {
+	for _, tariff := range c.tariffs {
+		if tariff.matches(t) {
+			return tariff.Name
+		}
+	}
+	return otherTariff
+}
+
+// configured reports whether a tariff is configured.
+func (c *tariffCollector) configured(name string) bool {
+	for _, tariff := range c.tariffs {
+		if tariff.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *tariffCollector) Update(packet *protocol.Packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if id, ok := packet.Registers[obis.MeterID].Value.(string); ok {
+		c.meterID = id
+	}
+	if messageType(packet) != "list3" {
+		return
+	}
+	reg, ok := packet.Registers[obis.ActiveEnergyImport]
+	if !ok {
+		return
+	}
+	wh, err := reg.Float()
+	if err != nil {
+		return
+	}
+	hour := hourBoundary(packet, c.loc)
+	switch {
+	case c.hour.IsZero() || wh < c.reading:
+		// The first reading, or a replaced meter, only sets the starting point.
+	case !hour.After(c.hour):
+		return
+	default:
+		// Energy consumed across hours without readings is split evenly between them.
+		hours := int(hour.Sub(c.hour) / time.Hour)
+		if hours < 1 {
+			hours = 1
+		}
+		for i := 0; i < hours; i++ {
+			c.energy[c.tariff(c.hour.Add(time.Duration(i)*time.Hour))] += (wh - c.reading) / float64(hours)
+		}
+	}
+	c.reading = wh
+	c.hour = hour
+}
+
+func (c *tariffCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *tariffCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.hour.IsZero() {
+		return
+	}
+	for _, tariff := range c.tariffs {
+		if _, ok := c.energy[tariff.Name]; !ok {
+			ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, 0, c.meterID, tariff.Name)
+		}
+	}
+	for name, wh := range c.energy {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, wh, c.meterID, name)
+	}
+}
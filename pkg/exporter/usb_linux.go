@@ -0,0 +1,39 @@
+package exporter
+
+import (
+	`bytes`
+	`fmt`
+	`os`
+	`path/filepath`
+)
+
+// Root of the sysfs file system, replaced in tests.
+var sysfsRoot = "/sys"
+
+// findUSBDevice searches sysfs for a tty belonging to a matching USB device.
+func findUSBDevice(dev usbDevice) (string, error) {
+	ttys, err := os.ReadDir(filepath.Join(sysfsRoot, "class", "tty"))
+	if err != nil {
+		return "", err
+	}
+	for _, tty := range ttys {
+		path, err := filepath.EvalSymlinks(filepath.Join(sysfsRoot, "class", "tty", tty.Name(), "device"))
+		if err != nil {
+			continue
+		}
+		// Walk up from the tty until reaching the USB device it belongs to.
+		for ; len(path) > len(sysfsRoot); path = filepath.Dir(path) {
+			vendorID, err := os.ReadFile(filepath.Join(path, "idVendor"))
+			if err != nil {
+				continue
+			}
+			productID, _ := os.ReadFile(filepath.Join(path, "idProduct"))
+			serial, _ := os.ReadFile(filepath.Join(path, "serial"))
+			if dev.matches(string(bytes.TrimSpace(vendorID)), string(bytes.TrimSpace(productID)), string(bytes.TrimSpace(serial))) {
+				return filepath.Join("/dev", tty.Name()), nil
+			}
+			break
+		}
+	}
+	return "", fmt.Errorf("no serial port found for USB device %+v", dev)
+}
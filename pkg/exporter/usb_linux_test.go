@@ -0,0 +1,39 @@
+package exporter
+
+import (
+	`os`
+	`path/filepath`
+	`testing`
+
+	`github.com/stretchr/testify/assert`
+)
+
+func TestFindUSBDevice(t *testing.T) {
+	root := t.TempDir()
+	usb := filepath.Join(root, "devices", "pci0000:00", "usb1", "1-1")
+	port := filepath.Join(usb, "1-1:1.0", "ttyUSB3")
+	assert.NoError(t, os.MkdirAll(port, 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(usb, "idVendor"), []byte("0403\n"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(usb, "idProduct"), []byte("6001\n"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(usb, "serial"), []byte("A50285BI\n"), 0o644))
+	tty := filepath.Join(root, "class", "tty", "ttyUSB3")
+	assert.NoError(t, os.MkdirAll(tty, 0o755))
+	assert.NoError(t, os.Symlink(port, filepath.Join(tty, "device")))
+
+	sysfsRoot = root
+	defer func() { sysfsRoot = "/sys" }()
+
+	for _, address := range []string{"usb:0403:6001", "usb:0403:6001:A50285BI", "usb:A50285BI"} {
+		dev, err := parseUSBAddress(address)
+		assert.NoError(t, err)
+		path, err := findUSBDevice(dev)
+		assert.NoError(t, err, address)
+		assert.Equal(t, "/dev/ttyUSB3", path)
+	}
+
+	_, err := findUSBDevice(usbDevice{VendorID: "067b", ProductID: "2303"})
+	assert.Error(t, err)
+
+	_, err = parseUSBAddress("usb:")
+	assert.Error(t, err)
+}
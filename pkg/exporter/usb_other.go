@@ -0,0 +1,11 @@
+//go:build !linux
+
+package exporter
+
+import (
+	`fmt`
+)
+
+func findUSBDevice(dev usbDevice) (string, error) {
+	return "", fmt.Errorf("USB device lookup is only supported on Linux")
+}
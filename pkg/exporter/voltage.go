@@ -0,0 +1,170 @@
+package exporter
+
+import (
+	`fmt`
+	`sync`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/obis`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+	`github.com/prometheus/client_golang/prometheus`
+)
+
+// VoltageQualityConfig sets the limits of the normal voltage range. Voltages outside it are sags or swells.
+type VoltageQualityConfig struct {
+	// Voltages below this are sags. Defaults to 207 V, 10% below the nominal 230 V.
+	Sag float64 `yaml:"sag"`
+
+	// Voltages above this are swells. Defaults to 253 V, 10% above the nominal 230 V.
+	Swell float64 `yaml:"swell"`
+}
+
+func (cfg *VoltageQualityConfig) validate() error {
+	if cfg.Sag == 0 {
+		cfg.Sag = 207
+	}
+	if cfg.Swell == 0 {
+		cfg.Swell = 253
+	}
+	if cfg.Sag < 0 || cfg.Sag >= cfg.Swell {
+		return fmt.Errorf("sag must be positive and below swell")
+	}
+	return nil
+}
+
+// Kinds of voltage excursions.
+const (
+	voltageSag   = "sag"
+	voltageSwell = "swell"
+)
+
+// voltageExcursions tracks the excursions of a single phase.
+type voltageExcursions struct {
+	// Kind of the ongoing excursion, empty if the voltage is normal, and when it started.
+	current string
+	start   time.Time
+	last    time.Time
+
+	events  map[string]float64
+	seconds map[string]float64
+}
+
+// voltageQualityCollector counts the sags and swells of each phase and their duration, as a basic
+// power quality monitor. The meter only sends voltages every 10 seconds, so shorter excursions
+// may be missed, and durations are rounded to the interval.
+type voltageQualityCollector struct {
+	mu      sync.Mutex
+	cfg     VoltageQualityConfig
+	meterID string
+	phases  [3]*voltageExcursions
+
+	eventsDesc   *prometheus.Desc
+	secondsDesc  *prometheus.Desc
+	durationDesc *prometheus.Desc
+}
+
+func newVoltageQualityCollector(namespace string, cfg VoltageQualityConfig) *voltageQualityCollector {
+	labels := []string{"meter_id", "phase", "type"}
+	return &voltageQualityCollector{
+		cfg: cfg,
+		eventsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "voltage_events_total"),
+			"Number of times the voltage of a phase went outside the normal range",
+			labels,
+			nil,
+		),
+		secondsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "voltage_event_seconds_total"),
+			"Total time the voltage of a phase has been outside the normal range",
+			labels,
+			nil,
+		),
+		durationDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "voltage_event_duration_seconds"),
+			"Duration of the ongoing excursion of the voltage of a phase, or zero if the voltage is normal",
+			labels,
+			nil,
+		),
+	}
+}
+
+func (c *voltageQualityCollector) Update(packet *protocol.Packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if id, ok := packet.Registers[obis.MeterID].Value.(string); ok {
+		c.meterID = id
+	}
+	for i, code := range voltageCodes {
+		reg, ok := packet.Registers[code]
+		if !ok {
+			continue
+		}
+		voltage, err := reg.Float()
+		if err != nil {
+			continue
+		}
+		if c.phases[i] == nil {
+			c.phases[i] = &voltageExcursions{
+				events:  map[string]float64{voltageSag: 0, voltageSwell: 0},
+				seconds: map[string]float64{voltageSag: 0, voltageSwell: 0},
+			}
+		}
+		c.phases[i].add(c.kind(voltage), packet.Time)
+	}
+}
+
+// kind returns the kind of excursion a voltage is, or an empty string if it is normal.
+func (c *voltageQualityCollector) kind(voltage float64) string {
+	switch {
+	case voltage < c.cfg.Sag:
+		return voltageSag
+	case voltage > c.cfg.Swell:
+		return voltageSwell
+	default:
+		return ""
+	}
+}
+
+// add records a voltage sample of the given kind. An excursion lasts until the first sample of another kind,
+// and the time up to that sample counts towards its duration.
+func (e *voltageExcursions) add(kind string, t time.Time) {
+	if len(e.current) > 0 && t.After(e.last) {
+		e.seconds[e.current] += t.Sub(e.last).Seconds()
+	}
+	if kind != e.current {
+		if len(kind) > 0 {
+			e.events[kind]++
+		}
+		e.current = kind
+		e.start = t
+	}
+	e.last = t
+}
+
+func (c *voltageQualityCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.eventsDesc
+	ch <- c.secondsDesc
+	ch <- c.durationDesc
+}
+
+func (c *voltageQualityCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, e := range c.phases {
+		if e == nil {
+			continue
+		}
+		phase := fmt.Sprintf("l%d", i+1)
+		for _, kind := range []string{voltageSag, voltageSwell} {
+			var duration float64
+			if e.current == kind {
+				duration = e.last.Sub(e.start).Seconds()
+			}
+			ch <- prometheus.MustNewConstMetric(c.eventsDesc, prometheus.CounterValue, e.events[kind], c.meterID, phase, kind)
+			ch <- prometheus.MustNewConstMetric(c.secondsDesc, prometheus.CounterValue, e.seconds[kind], c.meterID, phase, kind)
+			ch <- prometheus.MustNewConstMetric(c.durationDesc, prometheus.GaugeValue, duration, c.meterID, phase, kind)
+		}
+	}
+}
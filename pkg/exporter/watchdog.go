@@ -0,0 +1,83 @@
+package exporter
+
+import (
+	`context`
+	`fmt`
+	`sync`
+	`time`
+
+	log "github.com/sirupsen/logrus"
+)
+
+// WatchdogConfig configures recovery from serial adapters that stop delivering data.
+type WatchdogConfig struct {
+	// Reopen the serial port when no valid frame has been received for this long. Zero disables the watchdog.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Give up after this many reopens without a valid frame in between, so that a supervisor
+	// can restart the process. Zero keeps reopening forever.
+	MaxReopens int `yaml:"max_reopens"`
+}
+
+// watchdog tracks the time since the last valid frame.
+type watchdog struct {
+	cfg     WatchdogConfig
+	mu      sync.Mutex
+	last    time.Time
+	reopens int
+}
+
+func newWatchdog(cfg WatchdogConfig, now time.Time) *watchdog {
+	return &watchdog{cfg: cfg, last: now}
+}
+
+// kick records the reception of a valid frame.
+func (w *watchdog) kick(now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.last = now
+	w.reopens = 0
+}
+
+// check reports whether the port should be reopened, or an error if the watchdog gives up.
+func (w *watchdog) check(now time.Time) (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if now.Sub(w.last) < w.cfg.Timeout {
+		return false, nil
+	}
+	if w.cfg.MaxReopens > 0 && w.reopens >= w.cfg.MaxReopens {
+		return false, fmt.Errorf("no valid frames received after reopening the serial port %d times", w.reopens)
+	}
+	w.reopens++
+	w.last = now
+	return true, nil
+}
+
+// run checks the watchdog until the context is canceled, calling reopen when no frames have arrived
+// in time, and fail when giving up.
+func (w *watchdog) run(ctx context.Context, reopen func(), fail func(error)) {
+	interval := w.cfg.Timeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			ok, err := w.check(now)
+			if err != nil {
+				fail(err)
+				return
+			}
+			if ok {
+				log.Warnf("No valid frames received for %s; reopening serial port", w.cfg.Timeout)
+				reopen()
+			}
+		}
+	}
+}
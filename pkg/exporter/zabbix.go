@@ -0,0 +1,222 @@
+package exporter
+
+import (
+	`bytes`
+	`context`
+	`encoding/binary`
+	`encoding/json`
+	`fmt`
+	`io`
+	`net`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/output`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	output.Register("zabbix", newZabbix)
+}
+
+// ZabbixConfig configures sending readings to a Zabbix server or proxy, as zabbix_sender does.
+// Readings are received by items of type Zabbix trapper.
+type ZabbixConfig struct {
+	// Server or proxy address as host:port.
+	Server string `yaml:"server"`
+
+	// Name of the host in Zabbix the items belong to.
+	Host string `yaml:"host"`
+
+	// Item keys by OBIS code. Only the registers listed are sent. If empty, all registers
+	// are sent with keys of the form ams[1-0:1.7.0.255].
+	Items map[string]string `yaml:"items"`
+
+	// Time between sending the latest value of each item. Defaults to 1 minute.
+	Interval time.Duration `yaml:"interval"`
+
+	// Buffering, retries and circuit breaking, as for sinks.
+	output.Options `yaml:",inline"`
+}
+
+func (cfg *ZabbixConfig) validate() error {
+	if len(cfg.Server) == 0 {
+		return fmt.Errorf("server is required")
+	}
+	if _, _, err := net.SplitHostPort(cfg.Server); err != nil {
+		return fmt.Errorf("server: %w", err)
+	}
+	if len(cfg.Host) == 0 {
+		return fmt.Errorf("host is required")
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Minute
+	}
+	return cfg.Options.Validate()
+}
+
+// Header of messages in the Zabbix sender protocol, followed by the data length.
+var zabbixHeader = []byte("ZBXD\x01")
+
+// Time allowed for connecting to Zabbix and exchanging a single message.
+const zabbixTimeout = 10 * time.Second
+
+// Largest response accepted from Zabbix.
+const zabbixMaxResponse = 1 << 16
+
+// zabbixValue is a single value in a sender data request.
+type zabbixValue struct {
+	Host  string `json:"host"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Clock int64  `json:"clock"`
+	NS    int    `json:"ns"`
+}
+
+type zabbixRequest struct {
+	Request string        `json:"request"`
+	Data    []zabbixValue `json:"data"`
+}
+
+type zabbixResponse struct {
+	Response string `json:"response"`
+	Info     string `json:"info"`
+}
+
+// zabbixSender keeps the latest value of each item, and sends them to Zabbix at the configured interval.
+type zabbixSender struct {
+	cfg    ZabbixConfig
+	values map[string]zabbixValue
+
+	// Time the values were last sent.
+	sent time.Time
+}
+
+func newZabbix(decode func(v any) error) (output.Sink, error) {
+	var cfg ZabbixConfig
+	if err := decode(&cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &zabbixSender{cfg: cfg, values: make(map[string]zabbixValue)}, nil
+}
+
+func (s *zabbixSender) Start(ctx context.Context) error {
+	log.Infof("Sending readings to Zabbix at %s every %s", s.cfg.Server, s.cfg.Interval)
+	return nil
+}
+
+// itemKey returns the item key of a register, or false if it is not sent.
+func (s *zabbixSender) itemKey(code string) (string, bool) {
+	if len(s.cfg.Items) == 0 {
+		return "ams[" + code + "]", true
+	}
+	key, ok := s.cfg.Items[code]
+	return key, ok
+}
+
+// Write keeps the values of a packet, replacing those of earlier packets, and sends the values kept
+// once the interval has passed since they were last sent. Values not sent are kept for the next write.
+func (s *zabbixSender) Write(packet *protocol.Packet) error {
+	for code, val := range textValues(packet) {
+		key, ok := s.itemKey(code)
+		if !ok {
+			continue
+		}
+		s.values[key] = zabbixValue{
+			Host:  s.cfg.Host,
+			Key:   key,
+			Value: val,
+			Clock: packet.Time.Unix(),
+			NS:    packet.Time.Nanosecond(),
+		}
+	}
+	if len(s.values) == 0 || time.Since(s.sent) < s.cfg.Interval {
+		return nil
+	}
+
+	values := make([]zabbixValue, 0, len(s.values))
+	for _, v := range s.values {
+		values = append(values, v)
+	}
+	if err := s.send(values); err != nil {
+		return fmt.Errorf("send to %s: %w", s.cfg.Server, err)
+	}
+	s.values = make(map[string]zabbixValue)
+	s.sent = time.Now()
+	return nil
+}
+
+func (s *zabbixSender) Close() error {
+	return nil
+}
+
+// send delivers values in a single sender data request. Values rejected by Zabbix, usually because
+// the item does not exist or has the wrong type, are logged but not treated as an error.
+func (s *zabbixSender) send(values []zabbixValue) error {
+	body, err := json.Marshal(zabbixRequest{
+		Request: "sender data",
+		Data:    values,
+	})
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", s.cfg.Server, zabbixTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(zabbixTimeout))
+
+	if _, err := conn.Write(zabbixMessage(body)); err != nil {
+		return err
+	}
+	data, err := readZabbixMessage(conn)
+	if err != nil {
+		return fmt.Errorf("read response: %w", err)
+	}
+
+	var resp zabbixResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return fmt.Errorf("parse response: %w", err)
+	}
+	if resp.Response != "success" {
+		return fmt.Errorf("%s: %s", resp.Response, resp.Info)
+	}
+	var processed, failed int
+	if _, err := fmt.Sscanf(resp.Info, "processed: %d; failed: %d", &processed, &failed); err == nil && failed > 0 {
+		log.Warnf("Zabbix rejected %d of %d values; check that trapper items exist for host %s", failed, processed+failed, s.cfg.Host)
+	}
+	return nil
+}
+
+// zabbixMessage wraps data in the header of the Zabbix protocol.
+func zabbixMessage(data []byte) []byte {
+	msg := make([]byte, len(zabbixHeader)+8, len(zabbixHeader)+8+len(data))
+	copy(msg, zabbixHeader)
+	binary.LittleEndian.PutUint64(msg[len(zabbixHeader):], uint64(len(data)))
+	return append(msg, data...)
+}
+
+// readZabbixMessage reads a single message of the Zabbix protocol and returns its data.
+func readZabbixMessage(r io.Reader) ([]byte, error) {
+	header := make([]byte, len(zabbixHeader)+8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(zabbixHeader)], zabbixHeader) {
+		return nil, fmt.Errorf("invalid header %q", header[:len(zabbixHeader)])
+	}
+	length := binary.LittleEndian.Uint64(header[len(zabbixHeader):])
+	if length > zabbixMaxResponse {
+		return nil, fmt.Errorf("message of %d bytes too long", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
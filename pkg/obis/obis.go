@@ -0,0 +1,171 @@
+// Package obis describes the registers sent by Norwegian AMS meters, identified by their OBIS codes.
+//
+// The registry is the single source of metric names, descriptions and units
+// used by the exporter, the JSON API and the documentation.
+package obis
+
+import (
+	`fmt`
+	`io`
+)
+
+// OBIS codes of the registers sent by the Aidon meter.
+const (
+	ListVersion          = "1-1:0.2.129.255"
+	MeterID              = "0-0:96.1.0.255"
+	MeterType            = "0-0:96.1.7.255"
+	ActivePowerImport    = "1-0:1.7.0.255"
+	ActivePowerExport    = "1-0:2.7.0.255"
+	ReactivePowerImport  = "1-0:3.7.0.255"
+	ReactivePowerExport  = "1-0:4.7.0.255"
+	CurrentL1            = "1-0:31.7.0.255"
+	CurrentL2            = "1-0:51.7.0.255"
+	CurrentL3            = "1-0:71.7.0.255"
+	VoltageL1            = "1-0:32.7.0.255"
+	VoltageL2            = "1-0:52.7.0.255"
+	VoltageL3            = "1-0:72.7.0.255"
+	ActiveEnergyImport   = "1-0:1.8.0.255"
+	ActiveEnergyExport   = "1-0:2.8.0.255"
+	ReactiveEnergyImport = "1-0:3.8.0.255"
+	ReactiveEnergyExport = "1-0:4.8.0.255"
+
+	// Meter clock, sent along with the hourly energy readings.
+	Clock = "0-0:1.0.0.255"
+)
+
+// OBIS codes of per-phase and status registers, included in extended lists by some list versions.
+const (
+	ActivePowerImportL1   = "1-0:21.7.0.255"
+	ActivePowerExportL1   = "1-0:22.7.0.255"
+	ReactivePowerImportL1 = "1-0:23.7.0.255"
+	ReactivePowerExportL1 = "1-0:24.7.0.255"
+	ActivePowerImportL2   = "1-0:41.7.0.255"
+	ActivePowerExportL2   = "1-0:42.7.0.255"
+	ReactivePowerImportL2 = "1-0:43.7.0.255"
+	ReactivePowerExportL2 = "1-0:44.7.0.255"
+	ActivePowerImportL3   = "1-0:61.7.0.255"
+	ActivePowerExportL3   = "1-0:62.7.0.255"
+	ReactivePowerImportL3 = "1-0:63.7.0.255"
+	ReactivePowerExportL3 = "1-0:64.7.0.255"
+	PowerFactor           = "1-0:13.7.0.255"
+	PowerFactorL1         = "1-0:33.7.0.255"
+	PowerFactorL2         = "1-0:53.7.0.255"
+	PowerFactorL3         = "1-0:73.7.0.255"
+	ErrorRegister         = "0-0:97.97.0.255"
+)
+
+// MetricType tells how a register is exported.
+type MetricType int
+
+const (
+	// Info registers hold text identifying the meter, exported as labels rather than values.
+	Info MetricType = iota
+	// Gauge registers hold instantaneous values.
+	Gauge
+	// Counter registers hold accumulated values that only increase.
+	Counter
+)
+
+func (t MetricType) String() string {
+	switch t {
+	case Info:
+		return "info"
+	case Gauge:
+		return "gauge"
+	case Counter:
+		return "counter"
+	default:
+		return fmt.Sprintf("MetricType(%d)", int(t))
+	}
+}
+
+// Register describes a single register.
+type Register struct {
+	// OBIS code, such as 1-0:1.7.0.255.
+	Code string
+
+	// Canonical name, used as the metric name without the namespace.
+	Name string
+
+	Description string
+
+	// Unit the meter is expected to report values in.
+	Unit string
+
+	Type MetricType
+}
+
+// Known registers, in the order sent by the meter, followed by those only found in extended lists.
+var registers = []Register{
+	{ListVersion, "list_version", "List version identifier", "", Info},
+	{MeterID, "meter_id", "Meter serial number", "", Info},
+	{MeterType, "meter_type", "Meter type", "", Info},
+	{ActivePowerImport, "active_positive_instantaneous_value", "Active+ Instantaneous value", "W", Gauge},
+	{ActivePowerExport, "active_negative_instantaneous_value", "Active- Instantaneous value", "W", Gauge},
+	{ReactivePowerImport, "reactive_positive_instantaneous_value", "Reactive+ Instantaneous value", "VAr", Gauge},
+	{ReactivePowerExport, "reactive_negative_instantaneous_value", "Reactive- Instantaneous value", "VAr", Gauge},
+	{CurrentL1, "l1_current_instantaneous_value", "L1 Current Instantaneous value", "A", Gauge},
+	{CurrentL2, "l2_current_instantaneous_value", "L2 Current Instantaneous value", "A", Gauge},
+	{CurrentL3, "l3_current_instantaneous_value", "L3 Current Instantaneous value", "A", Gauge},
+	{VoltageL1, "l1_voltage_instantaneous_value", "L1 Voltage Instantaneous value", "V", Gauge},
+	{VoltageL2, "l2_voltage_instantaneous_value", "L2 Voltage Instantaneous value", "V", Gauge},
+	{VoltageL3, "l3_voltage_instantaneous_value", "L3 Voltage Instantaneous value", "V", Gauge},
+	{ActiveEnergyImport, "active_positive_energy", "Active+ Energy", "Wh", Counter},
+	{ActiveEnergyExport, "active_negative_energy", "Active- Energy", "Wh", Counter},
+	{ReactiveEnergyImport, "reactive_positive_energy", "Reactive+ Energy", "VArh", Counter},
+	{ReactiveEnergyExport, "reactive_negative_energy", "Reactive- Energy", "VArh", Counter},
+
+	// Extended lists.
+	{ActivePowerImportL1, "l1_active_positive_instantaneous_value", "L1 Active+ Instantaneous value", "W", Gauge},
+	{ActivePowerExportL1, "l1_active_negative_instantaneous_value", "L1 Active- Instantaneous value", "W", Gauge},
+	{ReactivePowerImportL1, "l1_reactive_positive_instantaneous_value", "L1 Reactive+ Instantaneous value", "VAr", Gauge},
+	{ReactivePowerExportL1, "l1_reactive_negative_instantaneous_value", "L1 Reactive- Instantaneous value", "VAr", Gauge},
+	{ActivePowerImportL2, "l2_active_positive_instantaneous_value", "L2 Active+ Instantaneous value", "W", Gauge},
+	{ActivePowerExportL2, "l2_active_negative_instantaneous_value", "L2 Active- Instantaneous value", "W", Gauge},
+	{ReactivePowerImportL2, "l2_reactive_positive_instantaneous_value", "L2 Reactive+ Instantaneous value", "VAr", Gauge},
+	{ReactivePowerExportL2, "l2_reactive_negative_instantaneous_value", "L2 Reactive- Instantaneous value", "VAr", Gauge},
+	{ActivePowerImportL3, "l3_active_positive_instantaneous_value", "L3 Active+ Instantaneous value", "W", Gauge},
+	{ActivePowerExportL3, "l3_active_negative_instantaneous_value", "L3 Active- Instantaneous value", "W", Gauge},
+	{ReactivePowerImportL3, "l3_reactive_positive_instantaneous_value", "L3 Reactive+ Instantaneous value", "VAr", Gauge},
+	{ReactivePowerExportL3, "l3_reactive_negative_instantaneous_value", "L3 Reactive- Instantaneous value", "VAr", Gauge},
+	{PowerFactor, "power_factor_instantaneous_value", "Power factor Instantaneous value", "", Gauge},
+	{PowerFactorL1, "l1_power_factor_instantaneous_value", "L1 Power factor Instantaneous value", "", Gauge},
+	{PowerFactorL2, "l2_power_factor_instantaneous_value", "L2 Power factor Instantaneous value", "", Gauge},
+	{PowerFactorL3, "l3_power_factor_instantaneous_value", "L3 Power factor Instantaneous value", "", Gauge},
+	{ErrorRegister, "error_register", "Error register status word, zero if no errors", "", Gauge},
+}
+
+var byCode = func() map[string]Register {
+	m := make(map[string]Register, len(registers))
+	for _, reg := range registers {
+		m[reg.Code] = reg
+	}
+	return m
+}()
+
+// Lookup returns the description of a register.
+func Lookup(code string) (Register, bool) {
+	reg, ok := byCode[code]
+	return reg, ok
+}
+
+// Registers returns all known registers, in the order sent by the meter, followed by those only found in extended lists.
+func Registers() []Register {
+	return append([]Register(nil), registers...)
+}
+
+// WriteMarkdown writes a table of all known registers, as included in the documentation.
+func WriteMarkdown(w io.Writer, namespace string) error {
+	_, err := fmt.Fprintf(w, "| OBIS code | Metric | Unit | Type | Description |\n|---|---|---|---|---|\n")
+	for _, reg := range registers {
+		if err != nil {
+			return err
+		}
+		metric := fmt.Sprintf("`%s_%s`", namespace, reg.Name)
+		if reg.Type == Info {
+			metric = fmt.Sprintf("label `%s`", reg.Name)
+		}
+		_, err = fmt.Fprintf(w, "| %s | %s | %s | %s | %s |\n", reg.Code, metric, reg.Unit, reg.Type, reg.Description)
+	}
+	return err
+}
@@ -0,0 +1,54 @@
+package obis_test
+
+import (
+	`bytes`
+	`flag`
+	`os`
+	`strings`
+	`testing`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/obis`
+	`github.com/stretchr/testify/assert`
+)
+
+var update = flag.Bool("update", false, "update the register table in README.md")
+
+const (
+	tableStart = "<!-- registers -->\n"
+	tableEnd   = "<!-- end registers -->\n"
+)
+
+func TestLookup(t *testing.T) {
+	reg, ok := obis.Lookup(obis.ActiveEnergyImport)
+	assert.True(t, ok)
+	assert.Equal(t, "Wh", reg.Unit)
+	assert.Equal(t, obis.Counter, reg.Type)
+
+	_, ok = obis.Lookup("1-0:99.7.0.255")
+	assert.False(t, ok)
+}
+
+// TestReadme checks that the register table in README.md is up to date.
+// Run with -update to regenerate it.
+func TestReadme(t *testing.T) {
+	const path = "../../README.md"
+	readme, err := os.ReadFile(path)
+	assert.NoError(t, err)
+
+	before, rest, ok := strings.Cut(string(readme), tableStart)
+	assert.True(t, ok, "README.md lacks %q", tableStart)
+	_, after, ok := strings.Cut(rest, tableEnd)
+	assert.True(t, ok, "README.md lacks %q", tableEnd)
+
+	table := &bytes.Buffer{}
+	err = obis.WriteMarkdown(table, "ams")
+	assert.NoError(t, err)
+
+	generated := before + tableStart + table.String() + tableEnd + after
+	if *update {
+		err = os.WriteFile(path, []byte(generated), 0644)
+		assert.NoError(t, err)
+		return
+	}
+	assert.Equal(t, generated, string(readme), "README.md is out of date; run go test ./pkg/obis -update")
+}
@@ -0,0 +1,48 @@
+package output
+
+import (
+	`time`
+)
+
+// States of a circuit breaker, as exported in the sink_circuit_state metric.
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// breaker stops writing to a sink after failing a number of times in a row, so that a sink behind
+// a broken link neither spends its time on requests bound to fail nor floods the logs. After the
+// timeout, a single write is let through, closing the circuit if it succeeds.
+type breaker struct {
+	threshold int
+	timeout   time.Duration
+	failures  int
+	state     int
+	opened    time.Time
+}
+
+// allow reports whether a write may be attempted.
+func (b *breaker) allow(now time.Time) bool {
+	if b.state == circuitOpen {
+		if now.Sub(b.opened) < b.timeout {
+			return false
+		}
+		b.state = circuitHalfOpen
+	}
+	return true
+}
+
+// record records the outcome of a write.
+func (b *breaker) record(ok bool, now time.Time) {
+	if ok {
+		b.failures = 0
+		b.state = circuitClosed
+		return
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.threshold {
+		b.state = circuitOpen
+		b.opened = now
+	}
+}
@@ -0,0 +1,269 @@
+package output
+
+import (
+	`context`
+	`crypto/tls`
+	`crypto/x509`
+	`encoding/json`
+	`fmt`
+	`net`
+	`os`
+	`strconv`
+	`sync`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/obis`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	Register("awsiot", func(decode func(v any) error) (Sink, error) {
+		return newCloudIoT(decode, awsIoT{})
+	})
+	Register("azureiot", func(decode func(v any) error) (Sink, error) {
+		return newCloudIoT(decode, azureIoT{})
+	})
+}
+
+// CloudIoTConfig configures a connection to AWS IoT Core or Azure IoT Hub with X.509 device credentials.
+type CloudIoTConfig struct {
+	// Host name of the service, such as abc123-ats.iot.eu-west-1.amazonaws.com or myhub.azure-devices.net,
+	// optionally with a port. The port defaults to 8883.
+	Endpoint string `yaml:"endpoint"`
+
+	// Name of the thing in AWS IoT, or the device ID in Azure IoT Hub.
+	DeviceID string `yaml:"device_id"`
+
+	// PEM files holding the device certificate and its private key.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+
+	// Optional PEM file holding the certificate authorities trusted for the endpoint, instead of the system roots.
+	CAFile string `yaml:"ca_file"`
+
+	// Topic receiving readings in AWS IoT. Defaults to ams/DEVICE_ID/readings. Azure IoT Hub always
+	// receives readings as device-to-cloud messages.
+	Topic string `yaml:"topic"`
+
+	// Time allowed for each publish to be acknowledged. Defaults to 10 seconds.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// cloud holds what differs between the IoT services.
+type cloud interface {
+	// username returns the MQTT user name, if any.
+	username(cfg CloudIoTConfig) string
+
+	// telemetryTopic returns the topic receiving readings.
+	telemetryTopic(cfg CloudIoTConfig) string
+
+	// report returns the topic updating the reported state of the device shadow or twin,
+	// and the document reporting the state.
+	report(cfg CloudIoTConfig, state map[string]string) (string, any)
+}
+
+// awsIoT reports meter info to the classic device shadow.
+type awsIoT struct{}
+
+func (awsIoT) username(cfg CloudIoTConfig) string {
+	return ""
+}
+
+func (awsIoT) telemetryTopic(cfg CloudIoTConfig) string {
+	if len(cfg.Topic) > 0 {
+		return cfg.Topic
+	}
+	return "ams/" + cfg.DeviceID + "/readings"
+}
+
+func (awsIoT) report(cfg CloudIoTConfig, state map[string]string) (string, any) {
+	return "$aws/things/" + cfg.DeviceID + "/shadow/update", map[string]any{
+		"state": map[string]any{"reported": state},
+	}
+}
+
+// azureIoT reports meter info as reported properties of the device twin.
+type azureIoT struct{}
+
+func (azureIoT) username(cfg CloudIoTConfig) string {
+	host, _, err := net.SplitHostPort(cfg.Endpoint)
+	if err != nil {
+		host = cfg.Endpoint
+	}
+	return host + "/" + cfg.DeviceID + "/?api-version=2021-04-12"
+}
+
+func (azureIoT) telemetryTopic(cfg CloudIoTConfig) string {
+	return "devices/" + cfg.DeviceID + "/messages/events/"
+}
+
+func (azureIoT) report(cfg CloudIoTConfig, state map[string]string) (string, any) {
+	return "$iothub/twin/PATCH/properties/reported/?$rid=" + strconv.FormatInt(time.Now().UnixNano(), 10), state
+}
+
+// Registers reported to the device shadow or twin, by their names there.
+var cloudReported = map[string]string{
+	obis.MeterID:     "meter_id",
+	obis.MeterType:   "meter_type",
+	obis.ListVersion: "list_version",
+}
+
+// cloudIoT publishes readings to an IoT service over MQTT, and reports the meter info to the device
+// shadow or twin whenever it changes, and after every reconnect. The client reconnects by itself.
+type cloudIoT struct {
+	cfg    CloudIoTConfig
+	cloud  cloud
+	tls    *tls.Config
+	client mqtt.Client
+
+	mu       sync.Mutex
+	meterID  string
+	state    map[string]string
+	reported bool
+}
+
+func newCloudIoT(decode func(v any) error, c cloud) (Sink, error) {
+	var cfg CloudIoTConfig
+	if err := decode(&cfg); err != nil {
+		return nil, err
+	}
+	switch {
+	case len(cfg.Endpoint) == 0:
+		return nil, fmt.Errorf("endpoint is required")
+	case len(cfg.DeviceID) == 0:
+		return nil, fmt.Errorf("device_id is required")
+	case len(cfg.CertFile) == 0 || len(cfg.KeyFile) == 0:
+		return nil, fmt.Errorf("cert_file and key_file are required")
+	}
+	if _, _, err := net.SplitHostPort(cfg.Endpoint); err != nil {
+		cfg.Endpoint = net.JoinHostPort(cfg.Endpoint, "8883")
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load device certificate: %w", err)
+	}
+	tlsCfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if len(cfg.CAFile) > 0 {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("load CA: %w", err)
+		}
+		tlsCfg.RootCAs = x509.NewCertPool()
+		if !tlsCfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+	}
+	return &cloudIoT{cfg: cfg, cloud: c, tls: tlsCfg, state: make(map[string]string)}, nil
+}
+
+func (s *cloudIoT) Start(ctx context.Context) error {
+	opts := mqtt.NewClientOptions().
+		AddBroker("ssl://" + s.cfg.Endpoint).
+		SetClientID(s.cfg.DeviceID).
+		SetUsername(s.cloud.username(s.cfg)).
+		SetTLSConfig(s.tls).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			log.Errorf("Connection to %s lost: %s", s.cfg.Endpoint, err)
+		}).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			log.Infof("Connected to %s as %s", s.cfg.Endpoint, s.cfg.DeviceID)
+			s.mu.Lock()
+			s.reported = false
+			s.mu.Unlock()
+		})
+	s.client = mqtt.NewClient(opts)
+	// The connection is retried in the background, and writes fail until it succeeds.
+	s.client.Connect()
+	return nil
+}
+
+func (s *cloudIoT) Write(packet *protocol.Packet) error {
+	if !s.client.IsConnectionOpen() {
+		return fmt.Errorf("not connected to %s", s.cfg.Endpoint)
+	}
+	if err := s.report(packet); err != nil {
+		return fmt.Errorf("report meter info: %w", err)
+	}
+
+	s.mu.Lock()
+	meterID := s.meterID
+	s.mu.Unlock()
+	values := make(map[string]any, len(packet.Registers))
+	for code, reg := range packet.Registers {
+		if val, err := reg.Float(); err == nil {
+			values[fieldName(code)] = val
+		}
+	}
+	payload, err := json.Marshal(map[string]any{
+		"time":     packet.Time.UTC().Format(time.RFC3339Nano),
+		"meter_id": meterID,
+		"values":   values,
+	})
+	if err != nil {
+		return err
+	}
+	return s.publish(s.cloud.telemetryTopic(s.cfg), payload)
+}
+
+// report updates the device shadow or twin if the meter info has changed, or has not been reported
+// since connecting.
+func (s *cloudIoT) report(packet *protocol.Packet) error {
+	s.mu.Lock()
+	changed := !s.reported
+	for code, name := range cloudReported {
+		reg, ok := packet.Registers[code]
+		if !ok {
+			continue
+		}
+		val := fmt.Sprint(reg.Value)
+		if code == obis.MeterID {
+			s.meterID = val
+		}
+		if s.state[name] != val {
+			s.state[name] = val
+			changed = true
+		}
+	}
+	state := make(map[string]string, len(s.state))
+	for k, v := range s.state {
+		state[k] = v
+	}
+	s.mu.Unlock()
+	if !changed || len(state) == 0 {
+		return nil
+	}
+
+	topic, doc := s.cloud.report(s.cfg, state)
+	payload, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	if err := s.publish(topic, payload); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.reported = true
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *cloudIoT) publish(topic string, payload []byte) error {
+	token := s.client.Publish(topic, 1, false, payload)
+	if !token.WaitTimeout(s.cfg.Timeout) {
+		return fmt.Errorf("publish to %s: timed out", topic)
+	}
+	return token.Error()
+}
+
+func (s *cloudIoT) Close() error {
+	s.client.Disconnect(1000)
+	return nil
+}
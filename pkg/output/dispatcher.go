@@ -0,0 +1,307 @@
+package output
+
+import (
+	`context`
+	`fmt`
+	`sync`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/queue`
+	`github.com/prometheus/client_golang/prometheus`
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultBuffer is the number of packets buffered for each sink unless configured otherwise.
+const DefaultBuffer = 64
+
+// sinkQueue buffers the packets of a single sink, and writes them from its own goroutine.
+type sinkQueue struct {
+	name    string
+	sink    Sink
+	opts    Options
+	breaker breaker
+	packets chan *protocol.Packet
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// Dispatcher fans packets out to sinks. Every sink has a buffer of its own, so that a slow or failing
+// sink neither holds up reading the meter nor the other sinks. When a buffer is full, the oldest
+// packet is dropped. Packets are written in batches, failed writes are retried with exponential
+// backoff, and a circuit breaker stops writing to sinks that keep failing. The dispatcher is
+// a Prometheus collector counting the packets written, failed and dropped for each sink.
+type Dispatcher struct {
+	mu     sync.Mutex
+	queues []*sinkQueue
+
+	written *prometheus.CounterVec
+	failed  *prometheus.CounterVec
+	dropped *prometheus.CounterVec
+	retries *prometheus.CounterVec
+	circuit *prometheus.GaugeVec
+	latency *prometheus.SummaryVec
+}
+
+// NewDispatcher returns a dispatcher without sinks, with metric names prefixed by the namespace.
+func NewDispatcher(namespace string) *Dispatcher {
+	counter := func(name, help string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      name,
+			Help:      help,
+		}, []string{"sink"})
+	}
+	return &Dispatcher{
+		written: counter("sink_packets_written_total", "Total number of packets written to an output sink"),
+		failed:  counter("sink_write_errors_total", "Total number of packets an output sink failed to write, after retries"),
+		dropped: counter("sink_packets_dropped_total", "Total number of packets dropped because an output sink fell behind, or its circuit was open"),
+		retries: counter("sink_retries_total", "Total number of retried writes to an output sink"),
+		circuit: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "sink_circuit_state",
+			Help:      "State of the circuit breaker of an output sink: 0 closed, 1 open, 2 half-open",
+		}, []string{"sink"}),
+		latency: prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Namespace:  namespace,
+			Name:       "sink_latency_seconds",
+			Help:       "Time from reading the start of a frame until an output sink wrote it",
+			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		}, []string{"sink"}),
+	}
+}
+
+// Add starts a sink, and writes every packet dispatched from now on to it. The name identifies the sink
+// in logs and metrics, and must be unique.
+func (d *Dispatcher) Add(ctx context.Context, name string, sink Sink, opts Options) error {
+	if err := opts.Validate(); err != nil {
+		return fmt.Errorf("sink %s: %w", name, err)
+	}
+	d.mu.Lock()
+	added := d.find(name) >= 0
+	d.mu.Unlock()
+	if added {
+		return fmt.Errorf("sink %s is already added", name)
+	}
+	if err := sink.Start(ctx); err != nil {
+		return fmt.Errorf("start sink %s: %w", name, err)
+	}
+	q := &sinkQueue{
+		name:    name,
+		sink:    sink,
+		opts:    opts,
+		breaker: breaker{threshold: opts.BreakerThreshold, timeout: opts.BreakerTimeout},
+		packets: make(chan *protocol.Packet, opts.Buffer),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	d.written.WithLabelValues(name)
+	d.failed.WithLabelValues(name)
+	d.dropped.WithLabelValues(name)
+	d.retries.WithLabelValues(name)
+	d.circuit.WithLabelValues(name).Set(circuitClosed)
+
+	d.mu.Lock()
+	d.queues = append(d.queues, q)
+	d.mu.Unlock()
+
+	go d.run(q)
+	return nil
+}
+
+// Write queues a packet for every sink without blocking.
+func (d *Dispatcher) Write(packet *protocol.Packet) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, q := range d.queues {
+		if !queue.Push(q.packets, packet) {
+			d.dropped.WithLabelValues(q.name).Inc()
+		}
+	}
+}
+
+// run collects packets into batches, writing each when it is full or the flush interval has passed.
+func (d *Dispatcher) run(q *sinkQueue) {
+	defer close(q.done)
+
+	ticker := time.NewTicker(q.opts.FlushInterval)
+	defer ticker.Stop()
+
+	failing := false
+	batch := make([]*protocol.Packet, 0, q.opts.BatchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			failing = d.flush(q, batch, failing)
+			batch = make([]*protocol.Packet, 0, q.opts.BatchSize)
+		}
+	}
+	for {
+		select {
+		case packet, ok := <-q.packets:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, packet)
+			if len(batch) >= q.opts.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// flush writes a batch, retrying as configured unless the circuit is open. It returns whether the sink
+// is failing, given whether it was before, so that only changes are logged.
+func (d *Dispatcher) flush(q *sinkQueue, batch []*protocol.Packet, failing bool) bool {
+	if !q.breaker.allow(time.Now()) {
+		d.dropped.WithLabelValues(q.name).Add(float64(len(batch)))
+		return failing
+	}
+	d.circuit.WithLabelValues(q.name).Set(float64(q.breaker.state))
+
+	backoff := q.opts.RetryBackoff
+	remaining, err := q.write(batch)
+	for retry := 0; err != nil && retry < q.opts.Retries; retry++ {
+		if !q.wait(backoff) {
+			break
+		}
+		backoff *= 2
+		if backoff > q.opts.MaxRetryBackoff {
+			backoff = q.opts.MaxRetryBackoff
+		}
+		d.retries.WithLabelValues(q.name).Inc()
+		remaining, err = q.write(remaining)
+	}
+	written := batch[:len(batch)-len(remaining)]
+	d.written.WithLabelValues(q.name).Add(float64(len(written)))
+	now := time.Now()
+	for _, packet := range written {
+		if received := packet.Timing.Received; !received.IsZero() {
+			d.latency.WithLabelValues(q.name).Observe(now.Sub(received).Seconds())
+		}
+	}
+	d.failed.WithLabelValues(q.name).Add(float64(len(remaining)))
+
+	state := q.breaker.state
+	q.breaker.record(err == nil, time.Now())
+	d.circuit.WithLabelValues(q.name).Set(float64(q.breaker.state))
+
+	switch {
+	case err != nil && !failing:
+		log.Errorf("Sink %s: %s", q.name, err)
+	case err == nil && failing:
+		log.Infof("Sink %s is writing again", q.name)
+	}
+	if q.breaker.state == circuitOpen && state != circuitOpen {
+		log.Warnf("Sink %s keeps failing; dropping packets for %s", q.name, q.opts.BreakerTimeout)
+	}
+	return err != nil
+}
+
+// write writes packets to the sink, in a single batch if the sink supports it, and returns those not written.
+func (q *sinkQueue) write(packets []*protocol.Packet) ([]*protocol.Packet, error) {
+	if bs, ok := q.sink.(BatchSink); ok {
+		if err := bs.WriteBatch(packets); err != nil {
+			return packets, err
+		}
+		return nil, nil
+	}
+	for i, packet := range packets {
+		if err := q.sink.Write(packet); err != nil {
+			return packets[i:], err
+		}
+	}
+	return nil, nil
+}
+
+// wait waits before a retry, and reports whether to retry. Retrying stops when the dispatcher is closed.
+func (q *sinkQueue) wait(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-q.stop:
+		return false
+	}
+}
+
+// Remove writes the packets already queued for a sink, without retrying, closes it, and removes its metrics.
+func (d *Dispatcher) Remove(name string) error {
+	d.mu.Lock()
+	i := d.find(name)
+	if i < 0 {
+		d.mu.Unlock()
+		return fmt.Errorf("no sink %s", name)
+	}
+	q := d.queues[i]
+	d.queues = append(d.queues[:i:i], d.queues[i+1:]...)
+	d.mu.Unlock()
+
+	err := q.close()
+	d.written.DeleteLabelValues(name)
+	d.failed.DeleteLabelValues(name)
+	d.dropped.DeleteLabelValues(name)
+	d.retries.DeleteLabelValues(name)
+	d.circuit.DeleteLabelValues(name)
+	d.latency.DeleteLabelValues(name)
+	return err
+}
+
+// find returns the index of the named sink, or -1. The caller must hold the lock.
+func (d *Dispatcher) find(name string) int {
+	for i, q := range d.queues {
+		if q.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Close writes the packets already queued, without retrying, and closes every sink.
+// Packets written after Close are dropped.
+func (d *Dispatcher) Close() error {
+	d.mu.Lock()
+	queues := d.queues
+	d.queues = nil
+	d.mu.Unlock()
+
+	var first error
+	for _, q := range queues {
+		if err := q.close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// close stops the goroutine of the queue once the packets queued are written, and closes the sink.
+func (q *sinkQueue) close() error {
+	close(q.stop)
+	close(q.packets)
+	<-q.done
+	if err := q.sink.Close(); err != nil {
+		return fmt.Errorf("close sink %s: %w", q.name, err)
+	}
+	return nil
+}
+
+func (d *Dispatcher) Describe(ch chan<- *prometheus.Desc) {
+	d.written.Describe(ch)
+	d.failed.Describe(ch)
+	d.dropped.Describe(ch)
+	d.retries.Describe(ch)
+	d.circuit.Describe(ch)
+	d.latency.Describe(ch)
+}
+
+func (d *Dispatcher) Collect(ch chan<- prometheus.Metric) {
+	d.written.Collect(ch)
+	d.failed.Collect(ch)
+	d.dropped.Collect(ch)
+	d.retries.Collect(ch)
+	d.circuit.Collect(ch)
+	d.latency.Collect(ch)
+}
@@ -0,0 +1,152 @@
+package output
+
+import (
+	`bytes`
+	`context`
+	`fmt`
+	`io`
+	`net/http`
+	`net/url`
+	`sort`
+	`strconv`
+	`strings`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/obis`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+)
+
+func init() {
+	Register("influxdb", newInfluxDB)
+}
+
+// InfluxDBConfig configures writing readings to an InfluxDB 2 bucket, one point per packet.
+type InfluxDBConfig struct {
+	// Address of the server, such as http://localhost:8086.
+	URL    string `yaml:"url"`
+	Org    string `yaml:"org"`
+	Bucket string `yaml:"bucket"`
+	Token  string `yaml:"token"`
+
+	// Measurement holding the readings. Defaults to ams.
+	Measurement string `yaml:"measurement"`
+
+	// Time allowed for each write. Defaults to 10 seconds.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// influxDB writes every packet as a point with the meter ID as tag, and each numeric register as
+// a field named as its metric, without the namespace, or by OBIS code if unknown.
+type influxDB struct {
+	cfg     InfluxDBConfig
+	client  *http.Client
+	meterID string
+}
+
+func newInfluxDB(decode func(v any) error) (Sink, error) {
+	var cfg InfluxDBConfig
+	if err := decode(&cfg); err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("url: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return nil, fmt.Errorf("url must be an http or https URL")
+	}
+	if len(cfg.Bucket) == 0 {
+		return nil, fmt.Errorf("bucket is required")
+	}
+	if len(cfg.Measurement) == 0 {
+		cfg.Measurement = "ams"
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	return &influxDB{cfg: cfg}, nil
+}
+
+func (s *influxDB) Start(ctx context.Context) error {
+	s.client = &http.Client{Timeout: s.cfg.Timeout}
+	return nil
+}
+
+func (s *influxDB) Write(packet *protocol.Packet) error {
+	return s.WriteBatch([]*protocol.Packet{packet})
+}
+
+// WriteBatch writes the packets as points in a single request.
+func (s *influxDB) WriteBatch(packets []*protocol.Packet) error {
+	var lines []byte
+	for _, packet := range packets {
+		if id, ok := packet.Registers[obis.MeterID].Value.(string); ok {
+			s.meterID = id
+		}
+		lines = append(lines, influxLine(s.cfg.Measurement, s.meterID, packet)...)
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	query := url.Values{"org": {s.cfg.Org}, "bucket": {s.cfg.Bucket}, "precision": {"ns"}}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(s.cfg.URL, "/")+"/api/v2/write?"+query.Encode(), bytes.NewReader(lines))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if len(s.cfg.Token) > 0 {
+		req.Header.Set("Authorization", "Token "+s.cfg.Token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("write to %s: %s: %s", s.cfg.URL, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func (s *influxDB) Close() error {
+	return nil
+}
+
+// fieldName returns the name of a register in the output, which is its metric name without the namespace,
+// or its OBIS code if unknown.
+func fieldName(code string) string {
+	if r, ok := obis.Lookup(code); ok {
+		return r.Name
+	}
+	return code
+}
+
+// Characters escaped in measurements, tag keys, tag values and field keys of the line protocol.
+var influxEscaper = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+
+// influxLine formats a packet in the InfluxDB line protocol, or returns nothing if it holds no numeric values.
+func influxLine(measurement, meterID string, packet *protocol.Packet) []byte {
+	var fields []string
+	for code, reg := range packet.Registers {
+		val, err := reg.Float()
+		if err != nil {
+			continue
+		}
+		fields = append(fields, influxEscaper.Replace(fieldName(code))+"="+strconv.FormatFloat(val, 'f', -1, 64))
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	sort.Strings(fields)
+
+	buf := &bytes.Buffer{}
+	buf.WriteString(influxEscaper.Replace(measurement))
+	if len(meterID) > 0 {
+		buf.WriteString(",meter_id=" + influxEscaper.Replace(meterID))
+	}
+	buf.WriteString(" " + strings.Join(fields, ","))
+	buf.WriteString(" " + strconv.FormatInt(packet.Time.UnixNano(), 10) + "\n")
+	return buf.Bytes()
+}
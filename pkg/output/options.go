@@ -0,0 +1,71 @@
+package output
+
+import (
+	`fmt`
+	`time`
+)
+
+// Options configures how packets are delivered to a sink. Zero values select the defaults.
+type Options struct {
+	// Number of packets queued while the sink is busy. The oldest packet is dropped when the queue is full.
+	// Defaults to 64.
+	Buffer int `yaml:"buffer"`
+
+	// Number of packets written at once. Sinks that cannot write several packets at once are given
+	// them one at a time. Defaults to 1.
+	BatchSize int `yaml:"batch_size"`
+
+	// Longest time a packet waits for the batch to fill up. Defaults to 10 seconds.
+	FlushInterval time.Duration `yaml:"flush_interval"`
+
+	// Number of times a failed write is retried before the packets are dropped. Negative disables
+	// retrying. Defaults to 3.
+	Retries int `yaml:"retries"`
+
+	// Time to wait before the first retry, doubling with every retry up to the maximum.
+	// Default to 1 second and 30 seconds.
+	RetryBackoff    time.Duration `yaml:"retry_backoff"`
+	MaxRetryBackoff time.Duration `yaml:"max_retry_backoff"`
+
+	// Number of writes failing in a row, after retries, that opens the circuit breaker. While the circuit
+	// is open, packets are dropped without writing them. Defaults to 5.
+	BreakerThreshold int `yaml:"breaker_threshold"`
+
+	// Time the circuit stays open before a single write is tried again. Defaults to 1 minute.
+	BreakerTimeout time.Duration `yaml:"breaker_timeout"`
+}
+
+// Validate checks the options for errors, and fills in defaults.
+func (o *Options) Validate() error {
+	if o.Buffer <= 0 {
+		o.Buffer = DefaultBuffer
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = 1
+	}
+	if o.BatchSize > o.Buffer {
+		return fmt.Errorf("batch_size must not exceed buffer")
+	}
+	if o.FlushInterval <= 0 {
+		o.FlushInterval = 10 * time.Second
+	}
+	if o.Retries == 0 {
+		o.Retries = 3
+	}
+	if o.RetryBackoff <= 0 {
+		o.RetryBackoff = time.Second
+	}
+	if o.MaxRetryBackoff <= 0 {
+		o.MaxRetryBackoff = 30 * time.Second
+	}
+	if o.MaxRetryBackoff < o.RetryBackoff {
+		return fmt.Errorf("max_retry_backoff must not be shorter than retry_backoff")
+	}
+	if o.BreakerThreshold <= 0 {
+		o.BreakerThreshold = 5
+	}
+	if o.BreakerTimeout <= 0 {
+		o.BreakerTimeout = time.Minute
+	}
+	return nil
+}
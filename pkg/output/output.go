@@ -0,0 +1,82 @@
+// Package output defines sinks receiving decoded packets, and dispatches packets to them.
+//
+// Sinks are registered by type name, usually from the init function of the package implementing them,
+// and configured by their type and settings in the sinks section of the configuration file.
+// Adding a sink only takes importing its package from the main package.
+//
+// The outputs built into the exporter, such as MQTT, AMQP and Redis, are sinks as well, registered by
+// the exporter package. Their sections of the configuration file configure a sink named after the section.
+package output
+
+import (
+	`context`
+	`fmt`
+	`sort`
+	`sync`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+)
+
+// Sink receives decoded packets.
+type Sink interface {
+	// Start prepares the sink for writing, such as by connecting to a server. Sinks that cannot be
+	// reached should rather retry in Write, so that an unavailable server does not prevent startup.
+	Start(ctx context.Context) error
+
+	// Write sends a packet. It is never called concurrently, and may block, as every sink
+	// is written to from its own goroutine.
+	Write(packet *protocol.Packet) error
+
+	// Close flushes anything buffered and releases the resources of the sink.
+	Close() error
+}
+
+// BatchSink is implemented by sinks that write several packets more efficiently at once, such as in
+// a single request. The dispatcher calls WriteBatch instead of Write for such sinks.
+type BatchSink interface {
+	Sink
+	WriteBatch(packets []*protocol.Packet) error
+}
+
+// Factory creates a sink from its settings. decode decodes the settings into a value, such as a struct
+// with yaml tags. Factories should validate the settings, as they are called when the configuration is
+// validated, but should not connect anywhere.
+type Factory func(decode func(v any) error) (Sink, error)
+
+var (
+	mu        sync.Mutex
+	factories = make(map[string]Factory)
+)
+
+// Register makes a sink type available. It panics if the type is already registered.
+func Register(typ string, factory Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := factories[typ]; ok {
+		panic(fmt.Sprintf("output: sink type %s registered twice", typ))
+	}
+	factories[typ] = factory
+}
+
+// Types returns the registered sink types, in alphabetical order.
+func Types() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	types := make([]string, 0, len(factories))
+	for typ := range factories {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// New creates a sink of a registered type.
+func New(typ string, decode func(v any) error) (Sink, error) {
+	mu.Lock()
+	factory, ok := factories[typ]
+	mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown sink type %q", typ)
+	}
+	return factory(decode)
+}
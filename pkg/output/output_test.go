@@ -0,0 +1,360 @@
+package output
+
+import (
+	`context`
+	`crypto/ecdsa`
+	`crypto/elliptic`
+	`crypto/rand`
+	`crypto/tls`
+	`crypto/x509`
+	`crypto/x509/pkix`
+	`encoding/json`
+	`encoding/pem`
+	`errors`
+	`fmt`
+	`io`
+	`math/big`
+	`net`
+	`net/http`
+	`net/http/httptest`
+	`os`
+	`path/filepath`
+	`strings`
+	`sync`
+	`testing`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/obis`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+	`github.com/eclipse/paho.mqtt.golang/packets`
+	`github.com/prometheus/client_golang/prometheus`
+	`github.com/prometheus/client_golang/prometheus/testutil`
+	`github.com/stretchr/testify/assert`
+	`gopkg.in/yaml.v3`
+)
+
+func testPacket(registers ...protocol.Register) *protocol.Packet {
+	packet := &protocol.Packet{
+		Time:      time.Now(),
+		Registers: make(map[string]protocol.Register),
+	}
+	for _, reg := range registers {
+		packet.Registers[reg.OBIS] = reg
+	}
+	return packet
+}
+
+// settings returns a function decoding sink settings from YAML, as given in the configuration file.
+func settings(text string) func(v any) error {
+	return func(v any) error {
+		return yaml.Unmarshal([]byte(text), v)
+	}
+}
+
+func TestInfluxDB(t *testing.T) {
+	lines := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, "ams", r.URL.Query().Get("bucket"))
+		assert.Equal(t, "Token secret", r.Header.Get("Authorization"))
+		lines <- string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sink, err := New("influxdb", settings("url: "+server.URL+"\nbucket: ams\ntoken: secret\n"))
+	assert.NoError(t, err)
+	sinks := NewDispatcher("ams")
+	assert.NoError(t, sinks.Add(context.Background(), "influxdb", sink, Options{}))
+	packet := testPacket(
+		protocol.Register{OBIS: obis.MeterID, Value: "7359992895803632"},
+		protocol.Register{OBIS: obis.ActivePowerImport, Value: uint32(1234), Unit: "W"},
+	)
+	sinks.Write(packet)
+	assert.NoError(t, sinks.Close())
+	assert.Equal(t, fmt.Sprintf("ams,meter_id=7359992895803632 active_positive_instantaneous_value=1234 %d\n", packet.Time.UnixNano()), <-lines)
+	expected := `
+# HELP ams_sink_packets_written_total Total number of packets written to an output sink
+# TYPE ams_sink_packets_written_total counter
+ams_sink_packets_written_total{sink="influxdb"} 1
+`
+	assert.NoError(t, testutil.CollectAndCompare(sinks, strings.NewReader(expected), "ams_sink_packets_written_total"))
+
+	_, err = New("nonexistent", settings(""))
+	assert.Error(t, err)
+}
+
+// batchSink records the batches written to it, failing while err is set.
+type batchSink struct {
+	mu      sync.Mutex
+	err     error
+	batches [][]*protocol.Packet
+}
+
+func (s *batchSink) Start(ctx context.Context) error { return nil }
+func (s *batchSink) Close() error                    { return nil }
+
+func (s *batchSink) Write(packet *protocol.Packet) error {
+	return s.WriteBatch([]*protocol.Packet{packet})
+}
+
+func (s *batchSink) WriteBatch(packets []*protocol.Packet) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.batches = append(s.batches, packets)
+	return nil
+}
+
+func TestSinkLatency(t *testing.T) {
+	received := time.Now()
+	sinks := NewDispatcher("ams")
+	assert.NoError(t, sinks.Add(context.Background(), "batched", &batchSink{}, Options{}))
+	packet := testPacket()
+	packet.Timing = protocol.Timing{Received: received, Parsed: received.Add(30 * time.Millisecond)}
+	sinks.Write(packet)
+	// Packets not read from a stream are skipped.
+	sinks.Write(testPacket())
+	assert.NoError(t, sinks.Close())
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(sinks)
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() == "ams_sink_latency_seconds" {
+			assert.Equal(t, uint64(1), family.GetMetric()[0].GetSummary().GetSampleCount())
+		}
+	}
+	assert.Equal(t, 1, testutil.CollectAndCount(sinks, "ams_sink_latency_seconds"))
+}
+
+func TestSinkDelivery(t *testing.T) {
+	sinks := NewDispatcher("ams")
+	batched := &batchSink{}
+	assert.NoError(t, sinks.Add(context.Background(), "batched", batched, Options{BatchSize: 2, FlushInterval: time.Hour}))
+	failing := &batchSink{err: errors.New("unreachable")}
+	assert.NoError(t, sinks.Add(context.Background(), "failing", failing, Options{
+		Retries:          1,
+		RetryBackoff:     time.Millisecond,
+		BreakerThreshold: 1,
+		BreakerTimeout:   time.Hour,
+	}))
+
+	// The first packet fails after a retry, opening the circuit, so that the second is dropped.
+	sinks.Write(testPacket())
+	assert.Eventually(t, func() bool {
+		return testutil.CollectAndCompare(sinks, strings.NewReader(`
+# HELP ams_sink_circuit_state State of the circuit breaker of an output sink: 0 closed, 1 open, 2 half-open
+# TYPE ams_sink_circuit_state gauge
+ams_sink_circuit_state{sink="batched"} 0
+ams_sink_circuit_state{sink="failing"} 1
+`), "ams_sink_circuit_state") == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	sinks.Write(testPacket())
+	assert.NoError(t, sinks.Close())
+
+	expected := `
+# HELP ams_sink_packets_dropped_total Total number of packets dropped because an output sink fell behind, or its circuit was open
+# TYPE ams_sink_packets_dropped_total counter
+ams_sink_packets_dropped_total{sink="batched"} 0
+ams_sink_packets_dropped_total{sink="failing"} 1
+# HELP ams_sink_packets_written_total Total number of packets written to an output sink
+# TYPE ams_sink_packets_written_total counter
+ams_sink_packets_written_total{sink="batched"} 2
+ams_sink_packets_written_total{sink="failing"} 0
+# HELP ams_sink_retries_total Total number of retried writes to an output sink
+# TYPE ams_sink_retries_total counter
+ams_sink_retries_total{sink="batched"} 0
+ams_sink_retries_total{sink="failing"} 1
+# HELP ams_sink_write_errors_total Total number of packets an output sink failed to write, after retries
+# TYPE ams_sink_write_errors_total counter
+ams_sink_write_errors_total{sink="batched"} 0
+ams_sink_write_errors_total{sink="failing"} 1
+`
+	assert.NoError(t, testutil.CollectAndCompare(sinks, strings.NewReader(expected),
+		"ams_sink_packets_dropped_total", "ams_sink_packets_written_total", "ams_sink_retries_total", "ams_sink_write_errors_total"))
+	if assert.Len(t, batched.batches, 1) {
+		assert.Len(t, batched.batches[0], 2)
+	}
+}
+
+func TestSinkRemove(t *testing.T) {
+	sinks := NewDispatcher("ams")
+	kept, removed := &batchSink{}, &batchSink{}
+	assert.NoError(t, sinks.Add(context.Background(), "kept", kept, Options{}))
+	assert.NoError(t, sinks.Add(context.Background(), "removed", removed, Options{}))
+	assert.Error(t, sinks.Add(context.Background(), "kept", &batchSink{}, Options{}))
+
+	// Packets queued before removing a sink are still written to it, and its metrics are gone.
+	sinks.Write(testPacket())
+	assert.NoError(t, sinks.Remove("removed"))
+	assert.Len(t, removed.batches, 1)
+	assert.Error(t, sinks.Remove("removed"))
+	sinks.Write(testPacket())
+	assert.NoError(t, sinks.Close())
+	assert.Len(t, kept.batches, 2)
+	assert.Len(t, removed.batches, 1)
+	assert.Equal(t, 1, testutil.CollectAndCount(sinks, "ams_sink_packets_written_total"))
+}
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and its key as PEM files, returning their paths.
+func writeTestCertificate(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "meter1"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+// cloudBroker is an MQTT broker over TLS requiring a client certificate, acknowledging and recording
+// the connection and the messages published to it.
+type cloudBroker struct {
+	listener net.Listener
+	connects chan *packets.ConnectPacket
+	messages chan *packets.PublishPacket
+}
+
+func newCloudBroker(t *testing.T, certFile, keyFile string) *cloudBroker {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	assert.NoError(t, err)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	assert.NoError(t, err)
+	b := &cloudBroker{
+		listener: l,
+		connects: make(chan *packets.ConnectPacket, 4),
+		messages: make(chan *packets.PublishPacket, 16),
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *cloudBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			b.connects <- p
+			packets.NewControlPacket(packets.Connack).Write(conn)
+		case *packets.PublishPacket:
+			b.messages <- p
+			ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+			ack.MessageID = p.MessageID
+			ack.Write(conn)
+		case *packets.PingreqPacket:
+			packets.NewControlPacket(packets.Pingresp).Write(conn)
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+func TestCloudIoT(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+	broker := newCloudBroker(t, certFile, keyFile)
+	defer broker.listener.Close()
+	endpoint := broker.listener.Addr().String()
+
+	for _, test := range []struct {
+		typ       string
+		username  string
+		telemetry string
+		report    string
+		reported  string
+	}{
+		{
+			typ:       "awsiot",
+			telemetry: "ams/meter1/readings",
+			report:    "$aws/things/meter1/shadow/update",
+			reported:  `{"state":{"reported":{"list_version":"AIDON_V0001","meter_id":"7359992895803632"}}}`,
+		},
+		{
+			typ:       "azureiot",
+			username:  "127.0.0.1/meter1/?api-version=2021-04-12",
+			telemetry: "devices/meter1/messages/events/",
+			report:    "$iothub/twin/PATCH/properties/reported/?$rid=",
+			reported:  `{"list_version":"AIDON_V0001","meter_id":"7359992895803632"}`,
+		},
+	} {
+		t.Run(test.typ, func(t *testing.T) {
+			sink, err := New(test.typ, settings(`endpoint: `+endpoint+`
+device_id: meter1
+cert_file: `+certFile+`
+key_file: `+keyFile+`
+ca_file: `+certFile))
+			assert.NoError(t, err)
+			sinks := NewDispatcher("ams")
+			assert.NoError(t, sinks.Add(context.Background(), test.typ, sink, Options{RetryBackoff: 10 * time.Millisecond}))
+			defer sinks.Close()
+
+			connect := <-broker.connects
+			assert.Equal(t, "meter1", connect.ClientIdentifier)
+			assert.Equal(t, test.username, connect.Username)
+
+			packet := testPacket(
+				protocol.Register{OBIS: obis.ListVersion, Value: "AIDON_V0001"},
+				protocol.Register{OBIS: obis.MeterID, Value: "7359992895803632"},
+				protocol.Register{OBIS: obis.ActivePowerImport, Value: uint32(1234), Unit: "W"},
+			)
+			sinks.Write(packet)
+			sinks.Write(packet)
+
+			report := <-broker.messages
+			assert.True(t, strings.HasPrefix(report.TopicName, test.report), report.TopicName)
+			assert.JSONEq(t, test.reported, string(report.Payload))
+
+			// The meter info is reported once, and readings every time.
+			for i := 0; i < 2; i++ {
+				msg := <-broker.messages
+				assert.Equal(t, test.telemetry, msg.TopicName)
+				assert.Equal(t, byte(1), msg.Qos)
+				var reading struct {
+					MeterID string             `json:"meter_id"`
+					Values  map[string]float64 `json:"values"`
+				}
+				assert.NoError(t, json.Unmarshal(msg.Payload, &reading))
+				assert.Equal(t, "7359992895803632", reading.MeterID)
+				assert.Equal(t, map[string]float64{"active_positive_instantaneous_value": 1234}, reading.Values)
+			}
+		})
+	}
+
+	_, err := New("awsiot", settings(""))
+	assert.Error(t, err)
+}
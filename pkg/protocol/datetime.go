@@ -0,0 +1,100 @@
+package protocol
+
+import (
+	`encoding/binary`
+	`fmt`
+	`time`
+)
+
+// Size of an encoded COSEM date-time.
+const dateTimeSize = 12
+
+// DeviationUnspecified is the deviation of a date-time in local time without a known offset from UTC.
+const DeviationUnspecified = -0x8000
+
+// DateTime is a COSEM date-time, sent as a 12 byte octet string by meters including their clock.
+type DateTime struct {
+	Year       uint16
+	Month      uint8
+	Day        uint8
+	Weekday    uint8
+	Hour       uint8
+	Minute     uint8
+	Second     uint8
+	Hundredths uint8
+
+	// Minutes to add to the local time to get UTC, or DeviationUnspecified.
+	Deviation int16
+
+	ClockStatus uint8
+}
+
+func parseDateTime(b []byte) DateTime {
+	return DateTime{
+		Year:        binary.BigEndian.Uint16(b[0:2]),
+		Month:       b[2],
+		Day:         b[3],
+		Weekday:     b[4],
+		Hour:        b[5],
+		Minute:      b[6],
+		Second:      b[7],
+		Hundredths:  b[8],
+		Deviation:   int16(binary.BigEndian.Uint16(b[9:11])),
+		ClockStatus: b[11],
+	}
+}
+
+func (d DateTime) bytes() []byte {
+	b := make([]byte, dateTimeSize)
+	binary.BigEndian.PutUint16(b[0:2], d.Year)
+	b[2], b[3], b[4] = d.Month, d.Day, d.Weekday
+	b[5], b[6], b[7], b[8] = d.Hour, d.Minute, d.Second, d.Hundredths
+	binary.BigEndian.PutUint16(b[9:11], uint16(d.Deviation))
+	b[11] = d.ClockStatus
+	return b
+}
+
+// Time converts the date-time to a point in time. Local times with an unspecified
+// deviation are taken to be in loc. Unspecified seconds and hundredths count as zero.
+func (d DateTime) Time(loc *time.Location) time.Time {
+	sec, nsec := int(d.Second), int(d.Hundredths)*int(10*time.Millisecond)
+	if d.Second == 0xff {
+		sec = 0
+	}
+	if d.Hundredths == 0xff {
+		nsec = 0
+	}
+	if d.Deviation == DeviationUnspecified {
+		return time.Date(int(d.Year), time.Month(d.Month), int(d.Day), int(d.Hour), int(d.Minute), sec, nsec, loc)
+	}
+	t := time.Date(int(d.Year), time.Month(d.Month), int(d.Day), int(d.Hour), int(d.Minute), sec, nsec, time.UTC)
+	return t.Add(time.Duration(d.Deviation) * time.Minute)
+}
+
+// String formats the date-time in RFC 3339 format, in the local time zone if the deviation is unspecified.
+func (d DateTime) String() string {
+	return d.Time(time.Local).Format(time.RFC3339Nano)
+}
+
+func (d DateTime) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// parseOctetString parses an octet string holding either an OBIS code or a date-time.
+func parseOctetString(s source) (any, error) {
+	strlen, err := readLength(s)
+	if err != nil {
+		return nil, err
+	}
+	if strlen != 6 && strlen != dateTimeSize {
+		return nil, fmt.Errorf("octet string of %d bytes is neither a code nor a date-time", strlen)
+	}
+	buf, err := s.next(strlen)
+	if err != nil {
+		return nil, err
+	}
+	if strlen == dateTimeSize {
+		return parseDateTime(buf), nil
+	}
+	return formatCode(buf), nil
+}
@@ -0,0 +1,256 @@
+package protocol
+
+import (
+	`bytes`
+	`errors`
+	`fmt`
+	`io`
+	`time`
+)
+
+// Offset of the COSEM data structure within an HDLC frame sent by the Aidon meter.
+const payloadOffset = 17
+
+// Tag of the data-notification APDU, which the meter pushes its readings in.
+const dataNotificationTag = 0x0f
+
+// LLC header in front of the APDU in HDLC frames: destination and source LSAP, and control.
+var llcHeader = []byte{0xe6, 0xe7, 0x00}
+
+// Maximum size of a single HDLC frame.
+const maxFrameSize = 1024
+
+var (
+	// ErrResynced is returned when bytes had to be discarded to find the start of the next frame.
+	ErrResynced = errors.New("HDLC frame re-synced")
+
+	// ErrAborted is returned for frames ending with an abort sequence.
+	ErrAborted = errors.New("HDLC frame aborted")
+
+	// ErrFrameTooLong is returned for frames exceeding the maximum frame size.
+	ErrFrameTooLong = errors.New("HDLC frame too long")
+
+	// ErrChecksum is returned for frames with an incorrect header or frame check sequence.
+	ErrChecksum = errors.New("HDLC frame checksum mismatch")
+)
+
+// ParseError is returned when a complete frame was received, but its contents could not be parsed.
+type ParseError struct {
+	Frame []byte
+	Err   error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parse data structure: %s", e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Packet is a single decoded message from the meter.
+type Packet struct {
+	// Time of reception.
+	Time time.Time
+
+	// Contents of the HDLC frame.
+	Frame []byte
+
+	// Register values, keyed by OBIS code.
+	Registers map[string]Register
+
+	// When the frame was received and decoded, for measuring latency.
+	Timing Timing
+}
+
+// Timing records when a frame was received, and when each decoding stage completed.
+// Times are zero where unknown or not applicable.
+type Timing struct {
+	// Time the start of the frame was read from the byte stream. Zero for frames decoded on their own.
+	Received time.Time
+
+	// Time the complete frame was available, and decoding started.
+	Unframed time.Time
+
+	// Time a ciphered frame was deciphered. Zero for plain frames.
+	Deciphered time.Time
+
+	// Time the registers were parsed.
+	Parsed time.Time
+}
+
+// Decoder reads HDLC framed messages from a byte stream and decodes them into packets.
+type Decoder struct {
+	// Parser used for frame contents. If nil, a strict parser with default limits is used.
+	Parser *Parser
+
+	unf *Unframer
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		unf: NewUnframer(r),
+	}
+}
+
+// Stats returns the byte counts of the underlying unframer. It is safe to call concurrently with NextPacket.
+func (d *Decoder) Stats() UnframerStats {
+	return d.unf.Stats()
+}
+
+// Buffered reports whether a complete frame is already buffered, so that the next call to NextPacket returns
+// without reading. It is not safe to call concurrently with NextPacket.
+func (d *Decoder) Buffered() bool {
+	return d.unf.Buffered()
+}
+
+// NextPacket blocks until the next frame has been read, and returns it as a decoded packet.
+//
+// ErrResynced, ErrAborted, ErrChecksum and ErrFrameTooLong signal framing problems, and
+// *ParseError signals a frame with invalid contents. After any of these, reading can
+// continue with the next frame. All other errors come from the underlying reader.
+func (d *Decoder) NextPacket() (*Packet, error) {
+	frame, err := d.unf.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+
+	parser := d.Parser
+	if parser == nil {
+		parser = defaultParser
+	}
+	packet, err := parser.DecodeFrame(frame.Data)
+	if packet != nil {
+		packet.Timing.Received = frame.Received
+	}
+	return packet, err
+}
+
+// DecodeFrame decodes the contents of a single HDLC frame, without flag bytes, into a packet.
+// Errors are of type *ParseError.
+func (p *Parser) DecodeFrame(frame []byte) (*Packet, error) {
+	packet := &Packet{
+		Time:  time.Now(),
+		Frame: make([]byte, len(frame)),
+	}
+	copy(packet.Frame, frame)
+	packet.Timing.Unframed = packet.Time
+
+	data, ciphered, err := p.plainAPDU(packet.Frame)
+	if err != nil {
+		return nil, &ParseError{
+			Frame: packet.Frame,
+			Err:   err,
+		}
+	}
+	if ciphered {
+		packet.Timing.Deciphered = time.Now()
+	}
+
+	// The payload offset applies to plain frames only, as the header is gone once deciphered.
+	offset := p.PayloadOffset
+	if offset == 0 || ciphered {
+		offset = findPayload(data)
+	}
+	if offset < 0 {
+		return nil, &ParseError{
+			Frame: packet.Frame,
+			Err:   fmt.Errorf("no data-notification found"),
+		}
+	}
+	if len(data) < offset {
+		return nil, &ParseError{
+			Frame: packet.Frame,
+			Err:   fmt.Errorf("frame of %d bytes too short", len(data)),
+		}
+	}
+
+	packet.Registers, err = p.parseRegisters(data[offset:])
+	if err != nil {
+		return nil, &ParseError{
+			Frame: packet.Frame,
+			Err:   err,
+		}
+	}
+	packet.Timing.Parsed = time.Now()
+
+	return packet, nil
+}
+
+// plainAPDU returns the frame itself if it is plain, or the deciphered APDU if it is ciphered,
+// and whether it was.
+// Ciphered frames are only looked for if keys are configured, or if no plain data-notification is found,
+// to report them as such.
+func (p *Parser) plainAPDU(frame []byte) ([]byte, bool, error) {
+	if p.Security == nil {
+		if findPayload(frame) < 0 && findCiphered(frame) >= 0 {
+			return nil, true, fmt.Errorf("frame is ciphered, but no keys are configured")
+		}
+		return frame, false, nil
+	}
+	at := findCiphered(frame)
+	if at < 0 {
+		if p.Security.RequireAuthentication {
+			return nil, false, fmt.Errorf("frame is not ciphered: %w", ErrAuthentication)
+		}
+		return frame, false, nil
+	}
+	plain, err := p.Security.decipher(frame[at:])
+	if err != nil {
+		return nil, true, fmt.Errorf("decipher: %w", err)
+	}
+	return plain, true, nil
+}
+
+// findPayload returns the offset of the COSEM data structure in a frame, or -1 if none is found.
+//
+// The header in front of the data-notification varies between meters and bridges, so it is found by
+// looking for the LLC header, which the data-notification must follow directly. Deciphered APDUs have
+// no LLC header, and start with the data-notification. It must be followed by the
+// long-invoke-id-and-priority field, a date-time, and an array or structure holding the registers.
+func findPayload(frame []byte) int {
+	if off := dataNotification(frame, 0); off >= 0 {
+		return off
+	}
+	for i := 0; i+len(llcHeader) <= len(frame); i++ {
+		if !bytes.Equal(frame[i:i+len(llcHeader)], llcHeader) {
+			continue
+		}
+		if off := dataNotification(frame, i+len(llcHeader)); off >= 0 {
+			return off
+		}
+	}
+	return -1
+}
+
+// dataNotification returns the offset of the COSEM data structure in a data-notification starting at i,
+// or -1 if there is none.
+func dataNotification(frame []byte, i int) int {
+	if i >= len(frame) || frame[i] != dataNotificationTag {
+		return -1
+	}
+	off := i + 5
+	if off+1 >= len(frame) {
+		return -1
+	}
+	// The date-time is an octet string, either empty or of 12 bytes, with or without its type tag.
+	switch {
+	case frame[off] == 0x00:
+		off++
+	case frame[off] == 12:
+		off += 13
+	case frame[off] == 0x09 && frame[off+1] == 12:
+		off += 14
+	default:
+		return -1
+	}
+	if off < len(frame) && (frame[off] == 0x01 || frame[off] == 0x02) {
+		return off
+	}
+	return -1
+}
+
+// DecodeFrame decodes a single HDLC frame using a strict parser with default limits.
+func DecodeFrame(frame []byte) (*Packet, error) {
+	return defaultParser.DecodeFrame(frame)
+}
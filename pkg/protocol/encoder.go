@@ -0,0 +1,181 @@
+package protocol
+
+import (
+	`bytes`
+	`encoding/binary`
+	`fmt`
+	`io`
+)
+
+// Encode writes a single value in the form read by ParseAny.
+//
+// Strings formatted as OBIS codes are encoded as such, and all other strings as visible strings.
+// Integers and floats are encoded as the COSEM type of the same size and signedness.
+func Encode(w io.Writer, v any) error {
+	var err error
+	switch x := v.(type) {
+	case nil:
+		_, err = w.Write([]byte{0})
+	case Array:
+		err = encodeElements(w, 1, x)
+	case Struct:
+		err = encodeElements(w, 2, x)
+	case BitString:
+		_, err = w.Write(appendLength([]byte{4}, x.Length))
+		if err == nil {
+			_, err = w.Write(x.Bytes[:(x.Length+7)/8])
+		}
+	case string:
+		if code, ok := codeBytes(x); ok {
+			_, err = w.Write(append([]byte{9, 6}, code...))
+			break
+		}
+		_, err = w.Write(appendLength([]byte{10}, len(x)))
+		if err == nil {
+			_, err = io.WriteString(w, x)
+		}
+	case DateTime:
+		_, err = w.Write(append([]byte{9, dateTimeSize}, x.bytes()...))
+	case Unit:
+		for idx, unit := range units {
+			if unit == x {
+				_, err = w.Write([]byte{22, idx})
+				return err
+			}
+		}
+		return fmt.Errorf("unknown unit %q", x)
+	case Enum:
+		_, err = w.Write([]byte{22, byte(x)})
+	case int8:
+		err = encodeNumber(w, 15, x)
+	case int16:
+		err = encodeNumber(w, 16, x)
+	case uint8:
+		err = encodeNumber(w, 17, x)
+	case uint16:
+		err = encodeNumber(w, 18, x)
+	case int32:
+		err = encodeNumber(w, 5, x)
+	case uint32:
+		err = encodeNumber(w, 6, x)
+	case int64:
+		err = encodeNumber(w, 20, x)
+	case uint64:
+		err = encodeNumber(w, 21, x)
+	case float32:
+		err = encodeNumber(w, 23, x)
+	case float64:
+		err = encodeNumber(w, 24, x)
+	default:
+		return fmt.Errorf("cannot encode value of type %T", v)
+	}
+	return err
+}
+
+func encodeElements(w io.Writer, tag byte, elements []any) error {
+	_, err := w.Write(appendLength([]byte{tag}, len(elements)))
+	if err != nil {
+		return err
+	}
+	for _, element := range elements {
+		err = Encode(w, element)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeNumber(w io.Writer, tag byte, v any) error {
+	_, err := w.Write([]byte{tag})
+	if err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, v)
+}
+
+// appendLength appends an A-XDR encoded length; the counterpart of readLength.
+func appendLength(buf []byte, length int) []byte {
+	switch {
+	case length < 0x80:
+		return append(buf, byte(length))
+	case length <= 0xff:
+		return append(buf, 0x81, byte(length))
+	default:
+		return append(buf, 0x82, byte(length>>8), byte(length))
+	}
+}
+
+// codeBytes converts an OBIS code in the form returned by ParseCode back into its six bytes.
+func codeBytes(s string) ([]byte, bool) {
+	code := make([]byte, 6)
+	var rest string
+	n, err := fmt.Sscanf(s, "%d-%d:%d.%d.%d.%d%s", &code[0], &code[1], &code[2], &code[3], &code[4], &code[5], &rest)
+	if n != 6 || err != io.EOF {
+		return nil, false
+	}
+	if fmt.Sprintf("%d-%d:%d.%d.%d.%d", code[0], code[1], code[2], code[3], code[4], code[5]) != s {
+		return nil, false
+	}
+	return code, true
+}
+
+// EncodeRegisters writes registers as an array of register structures; the counterpart of ParseRegisters.
+func EncodeRegisters(w io.Writer, regs []Register) error {
+	arr := make(Array, len(regs))
+	for i, reg := range regs {
+		st := Struct{reg.OBIS, reg.Value}
+		if len(reg.Unit) > 0 {
+			st = append(st, Struct{reg.Scaler, Unit(reg.Unit)})
+		}
+		arr[i] = st
+	}
+	return Encode(w, arr)
+}
+
+// EncodeFrame returns a complete HDLC frame, without flags, holding the registers
+// as a data notification in the same form as sent by the Aidon meter.
+func EncodeFrame(regs []Register) ([]byte, error) {
+	payload := &bytes.Buffer{}
+	err := EncodeRegisters(payload, regs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Frame format and length, destination address, source address, control field.
+	// Frames are limited to what the unframer accepts, rather than what the length field can hold.
+	length := payloadOffset + payload.Len() + 2
+	if length > maxFrameSize {
+		return nil, fmt.Errorf("frame length %d exceeds maximum of %d", length, maxFrameSize)
+	}
+	frame := []byte{0xa0 | byte(length>>8), byte(length), 0x41, 0x08, 0x83, 0x13}
+	frame = appendFCS(frame)
+
+	// LLC header, data-notification, long-invoke-id-and-priority, and an empty date-time.
+	frame = append(frame, 0xe6, 0xe7, 0x00, 0x0f, 0x40, 0x00, 0x00, 0x00, 0x00)
+	frame = append(frame, payload.Bytes()...)
+
+	return appendFCS(frame), nil
+}
+
+// appendFCS appends the HDLC frame check sequence of buf, least significant byte first.
+func appendFCS(buf []byte) []byte {
+	fcs := FCS16(buf)
+	return append(buf, byte(fcs), byte(fcs>>8))
+}
+
+// FCS16 computes the 16-bit HDLC frame check sequence (CRC-16/X.25) as defined in RFC 1662.
+func FCS16(data []byte) uint16 {
+	fcs := uint16(0xffff)
+	for _, b := range data {
+		fcs ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if fcs&1 != 0 {
+				fcs = fcs>>1 ^ 0x8408
+			} else {
+				fcs >>= 1
+			}
+		}
+	}
+	return ^fcs
+}
@@ -0,0 +1,367 @@
+package protocol
+
+import (
+	`bytes`
+	`fmt`
+	`io`
+	`sync/atomic`
+	`time`
+)
+
+// HDLC special bytes.
+const (
+	hdlcFlag   = 0x7e
+	hdlcEscape = 0x7d
+)
+
+// Frame format type 3, used by all DLMS meters, given by the high nibble of the frame format field.
+const frameFormatType3 = 0xa
+
+// Smallest possible frame: format field, one byte addresses, control field and frame check sequence.
+const minFrameSize = 7
+
+// Maximum number of bytes in a single address field.
+const maxAddressSize = 4
+
+// FrameHeader holds the fields at the start of an HDLC frame.
+type FrameHeader struct {
+	// Frame length as given by the frame format field, excluding flags.
+	Length int
+
+	// Set if the frame is one segment of a message continued in the next frame.
+	Segmented bool
+
+	// Destination and source addresses, as sent, including the extension bits.
+	Destination []byte
+	Source      []byte
+
+	Control byte
+
+	// Offset of the information field within the frame, following the header check sequence.
+	infoOffset int
+}
+
+// Frame is a single HDLC frame with a valid frame check sequence.
+type Frame struct {
+	FrameHeader
+
+	// Frame contents between flags, from the frame format field up to and including the frame check sequence.
+	Data []byte
+
+	// Time the read delivering the start of the frame returned. For frames following another within
+	// a single read, this is the time of the latest read, so the time spent unframing is slightly underestimated.
+	Received time.Time
+}
+
+// Info returns the information field of the frame, or nil if it has none.
+func (f Frame) Info() []byte {
+	if f.infoOffset == 0 {
+		return nil
+	}
+	return f.Data[f.infoOffset : len(f.Data)-2]
+}
+
+// ParseFrameHeader parses the header of a frame given without flags, and checks the
+// header and frame check sequences. The returned header refers to the frame data.
+func ParseFrameHeader(frame []byte) (FrameHeader, error) {
+	var h FrameHeader
+	if len(frame) < 2 {
+		return h, fmt.Errorf("frame of %d bytes too short", len(frame))
+	}
+	if frame[0]>>4 != frameFormatType3 {
+		return h, fmt.Errorf("unsupported frame format %#02x", frame[0])
+	}
+	h.Segmented = frame[0]&0x08 != 0
+	h.Length = int(frame[0]&0x07)<<8 | int(frame[1])
+	if h.Length != len(frame) {
+		return h, fmt.Errorf("frame length %d does not match %d bytes received", h.Length, len(frame))
+	}
+	if h.Length < minFrameSize {
+		return h, fmt.Errorf("frame of %d bytes too short", h.Length)
+	}
+	if !checkFCS(frame) {
+		return h, ErrChecksum
+	}
+
+	off := 2
+	var err error
+	h.Destination, off, err = parseAddress(frame, off)
+	if err != nil {
+		return h, fmt.Errorf("destination address: %w", err)
+	}
+	h.Source, off, err = parseAddress(frame, off)
+	if err != nil {
+		return h, fmt.Errorf("source address: %w", err)
+	}
+	if off >= len(frame)-2 {
+		return h, fmt.Errorf("frame ends before control field")
+	}
+	h.Control = frame[off]
+	off++
+
+	// Frames without an information field end with the control field.
+	if off == len(frame)-2 {
+		return h, nil
+	}
+	if off+2 > len(frame)-2 {
+		return h, fmt.Errorf("frame ends within header check sequence")
+	}
+	if !checkFCS(frame[:off+2]) {
+		return h, ErrChecksum
+	}
+	h.infoOffset = off + 2
+	return h, nil
+}
+
+// parseAddress reads an address field, which ends with the first byte having its least significant bit set.
+func parseAddress(frame []byte, off int) ([]byte, int, error) {
+	end := len(frame) - 2
+	for i := off; i < end && i < off+maxAddressSize; i++ {
+		if frame[i]&1 != 0 {
+			return frame[off : i+1], i + 1, nil
+		}
+	}
+	return nil, off, fmt.Errorf("no address found")
+}
+
+// checkFCS reports whether the data ends with its own frame check sequence.
+func checkFCS(data []byte) bool {
+	n := len(data) - 2
+	return FCS16(data[:n]) == uint16(data[n])|uint16(data[n+1])<<8
+}
+
+// UnframerStats counts the bytes passing through an Unframer.
+type UnframerStats struct {
+	// Bytes read from the underlying reader.
+	Bytes uint64
+
+	// Valid frames returned.
+	Frames uint64
+
+	// Bytes discarded, either outside of frames or as part of invalid frames. Flags are not counted.
+	Discarded uint64
+
+	// Reads completing more than one valid frame, as when frames are held up and arrive back-to-back.
+	MultiFrameReads uint64
+}
+
+// Unframer reads HDLC frames of frame format type 3 from a byte stream, as sent by meters
+// on the HAN port (IEC 62056-46).
+//
+// The extent of each frame is given by the length in its frame format field, so flag
+// bytes within a frame need no escaping, and frames split across several reads are
+// put back together, while frames arriving back-to-back in a single read are each
+// returned before reading again. A frame is only returned if it ends with a flag and its check
+// sequences are correct; otherwise the search for the next frame starts over right
+// after the opening flag of the bad one, so that no valid frame is lost.
+type Unframer struct {
+	r     io.Reader
+	buf   []byte
+	start int
+	end   int
+	stats UnframerStats
+
+	// Time of the latest read, and of the read that delivered the data following the start of the buffer.
+	lastRead time.Time
+	received time.Time
+
+	// Valid frames returned since the latest read.
+	frames int
+}
+
+func NewUnframer(r io.Reader) *Unframer {
+	return &Unframer{
+		r:   r,
+		buf: make([]byte, 2*(maxFrameSize+2)),
+	}
+}
+
+// Stats returns the byte counts so far. It is safe to call concurrently with ReadFrame.
+func (u *Unframer) Stats() UnframerStats {
+	return UnframerStats{
+		Bytes:           atomic.LoadUint64(&u.stats.Bytes),
+		Frames:          atomic.LoadUint64(&u.stats.Frames),
+		Discarded:       atomic.LoadUint64(&u.stats.Discarded),
+		MultiFrameReads: atomic.LoadUint64(&u.stats.MultiFrameReads),
+	}
+}
+
+// Buffered reports whether a complete frame is already buffered, as when several frames arrived in a single
+// read, so that the next call to ReadFrame returns without reading. The frame may still turn out invalid.
+// It is not safe to call concurrently with ReadFrame.
+func (u *Unframer) Buffered() bool {
+	data := u.buf[u.start:u.end]
+	for len(data) > 1 && data[0] == hdlcFlag && data[1] == hdlcFlag {
+		data = data[1:]
+	}
+	if len(data) < 3 || data[0] != hdlcFlag {
+		return false
+	}
+	length := int(data[1]&0x07)<<8 | int(data[2])
+	return length >= minFrameSize && length <= maxFrameSize && len(data) >= length+2
+}
+
+// ReadFrame blocks until the next frame has been read. The frame data is only valid until the following call.
+//
+// ErrResynced, ErrAborted, ErrChecksum and ErrFrameTooLong signal framing problems,
+// after which reading can continue with the next frame. Errors from the underlying reader
+// are returned as is, except for io.EOF in the middle of a frame, which becomes
+// io.ErrUnexpectedEOF. Any partial frame is kept, so reading can resume after errors
+// such as timeouts.
+func (u *Unframer) ReadFrame() (Frame, error) {
+	for {
+		data := u.buf[u.start:u.end]
+
+		// Skip anything up to the opening flag.
+		i := bytes.IndexByte(data, hdlcFlag)
+		if i < 0 {
+			u.discard(len(data))
+			if len(data) > 0 {
+				return Frame{}, ErrResynced
+			}
+			if err := u.fill(false); err != nil {
+				return Frame{}, err
+			}
+			continue
+		}
+		if i > 0 {
+			u.discard(i)
+			return Frame{}, ErrResynced
+		}
+
+		// The frame format field follows the flag. Consecutive flags are fill between frames.
+		if len(data) < 3 {
+			if err := u.fill(len(data) > 1); err != nil {
+				return Frame{}, err
+			}
+			continue
+		}
+		if data[1] == hdlcFlag {
+			u.start++
+			continue
+		}
+		if data[1]>>4 != frameFormatType3 {
+			u.skipFlag()
+			return Frame{}, ErrResynced
+		}
+		length := int(data[1]&0x07)<<8 | int(data[2])
+		if length > maxFrameSize {
+			u.skipFlag()
+			return Frame{}, ErrFrameTooLong
+		}
+		if length < minFrameSize {
+			u.skipFlag()
+			return Frame{}, ErrResynced
+		}
+
+		// Wait for the whole frame and its closing flag.
+		if len(data) < length+2 {
+			if err := u.fill(true); err != nil {
+				return Frame{}, err
+			}
+			continue
+		}
+
+		frame := data[1 : length+1]
+		if data[length+1] != hdlcFlag {
+			if i := abortIndex(data[1 : length+2]); i >= 0 {
+				// Resume at the flag of the abort sequence, which may open the next frame.
+				u.discard(i + 2)
+				return Frame{}, ErrAborted
+			}
+			u.skipFlag()
+			return Frame{}, ErrResynced
+		}
+
+		header, err := ParseFrameHeader(frame)
+		if err != nil {
+			if i := abortIndex(data[1 : length+1]); i >= 0 {
+				u.discard(i + 2)
+				return Frame{}, ErrAborted
+			}
+			u.skipFlag()
+			if err == ErrChecksum {
+				return Frame{}, ErrChecksum
+			}
+			return Frame{}, ErrResynced
+		}
+
+		// The closing flag may also open the next frame, and is left in the buffer.
+		received := u.received
+		u.start += length + 1
+		u.advanced()
+		atomic.AddUint64(&u.stats.Frames, 1)
+		if u.frames++; u.frames == 2 {
+			atomic.AddUint64(&u.stats.MultiFrameReads, 1)
+		}
+		return Frame{FrameHeader: header, Data: frame, Received: received}, nil
+	}
+}
+
+// abortIndex returns the index of the escape byte of the first abort sequence in data, or -1 if there is none.
+func abortIndex(data []byte) int {
+	for i := 0; i+1 < len(data); i++ {
+		if data[i] == hdlcEscape && data[i+1] == hdlcFlag {
+			return i
+		}
+	}
+	return -1
+}
+
+// discard drops n bytes from the start of the buffer.
+func (u *Unframer) discard(n int) {
+	u.start += n
+	u.advanced()
+	atomic.AddUint64(&u.stats.Discarded, uint64(n))
+}
+
+// advanced updates the time the data at the start of the buffer was received, after dropping data before it.
+// Anything beyond an opening flag was received by the latest read at the earliest; otherwise, the next frame
+// starts with the next read.
+func (u *Unframer) advanced() {
+	if u.end-u.start > 1 {
+		u.received = u.lastRead
+	} else {
+		u.received = time.Time{}
+	}
+}
+
+// skipFlag drops the opening flag of an invalid frame, so that the search for the next frame starts within it.
+func (u *Unframer) skipFlag() {
+	u.start++
+	n := bytes.IndexByte(u.buf[u.start:u.end], hdlcFlag)
+	if n < 0 {
+		n = u.end - u.start
+	}
+	u.discard(n)
+}
+
+// fill reads more data into the buffer. If inFrame is set, EOF is reported as io.ErrUnexpectedEOF.
+func (u *Unframer) fill(inFrame bool) error {
+	if u.start > 0 {
+		u.end = copy(u.buf, u.buf[u.start:u.end])
+		u.start = 0
+	}
+	// Readers returning neither data nor an error are retried a few times, like bufio does.
+	for i := 0; i < 100; i++ {
+		n, err := u.r.Read(u.buf[u.end:])
+		u.end += n
+		atomic.AddUint64(&u.stats.Bytes, uint64(n))
+		if n > 0 {
+			u.frames = 0
+			u.lastRead = time.Now()
+			if u.received.IsZero() {
+				u.received = u.lastRead
+			}
+		}
+		switch {
+		case n > 0:
+			return nil
+		case err == io.EOF && inFrame:
+			return io.ErrUnexpectedEOF
+		case err != nil:
+			return err
+		}
+	}
+	return io.ErrNoProgress
+}
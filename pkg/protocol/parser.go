@@ -0,0 +1,254 @@
+package protocol
+
+import (
+	`bytes`
+	`errors`
+	`fmt`
+	`io`
+)
+
+// SkippedRegister describes a register left out by a lenient parser.
+type SkippedRegister struct {
+	// OBIS code of the register, if it could be determined.
+	OBIS string
+	// Data type tag that could not be parsed, if that was the cause.
+	Tag byte
+	Err error
+}
+
+// Default limits protecting the parser against malformed data.
+const (
+	DefaultMaxStringLength = 1024
+	DefaultMaxArrayLength  = 256
+	DefaultMaxDepth        = 8
+)
+
+// LimitError is returned when data exceeds one of the parser limits.
+type LimitError struct {
+	Limit string
+	Value int
+	Max   int
+}
+
+func (e LimitError) Error() string {
+	return fmt.Sprintf("%s %d exceeds maximum of %d", e.Limit, e.Value, e.Max)
+}
+
+// Parser parses meter data with configurable behavior.
+// The zero value is a strict parser with default limits.
+type Parser struct {
+	// Skip registers that cannot be parsed instead of rejecting the whole frame.
+	Lenient bool
+
+	// Called for every register skipped in lenient mode.
+	OnSkip func(SkippedRegister)
+
+	// Maximum length of strings, in bytes.
+	MaxStringLength int
+
+	// Maximum number of elements in arrays and structures.
+	MaxArrayLength int
+
+	// Maximum nesting depth of arrays and structures.
+	MaxDepth int
+
+	// Offset of the COSEM data structure within each frame. If zero, it is found by
+	// looking for the data-notification, which works for any header length.
+	PayloadOffset int
+
+	// Keys of meters ciphering their frames. Without them, ciphered frames cannot be parsed.
+	Security *Security
+}
+
+var defaultParser = &Parser{}
+
+func (p *Parser) maxStringLength() int {
+	if p.MaxStringLength > 0 {
+		return p.MaxStringLength
+	}
+	return DefaultMaxStringLength
+}
+
+func (p *Parser) maxArrayLength() int {
+	if p.MaxArrayLength > 0 {
+		return p.MaxArrayLength
+	}
+	return DefaultMaxArrayLength
+}
+
+func (p *Parser) maxDepth() int {
+	if p.MaxDepth > 0 {
+		return p.MaxDepth
+	}
+	return DefaultMaxDepth
+}
+
+// readLength reads an A-XDR encoded length. Lengths below 128 are encoded in a single byte.
+// Longer lengths are prefixed with a byte holding 0x80 plus the number of length bytes that follow.
+func readLength(s source) (int, error) {
+	b, err := s.readByte()
+	if err != nil {
+		return 0, err
+	}
+	if b&0x80 == 0 {
+		return int(b), nil
+	}
+	n := int(b & 0x7f)
+	if n == 0 || n > 3 {
+		return 0, fmt.Errorf("invalid length encoding 0x%02x", b)
+	}
+	buf, err := s.next(n)
+	if err != nil {
+		return 0, err
+	}
+	length := 0
+	for _, b := range buf {
+		length = length<<8 | int(b)
+	}
+	return length, nil
+}
+
+// Start of a register structure: a structure of two or three entries, beginning with an OBIS code.
+var registerPrefixes = [][]byte{
+	{2, 2, 9, 6},
+	{2, 3, 9, 6},
+}
+
+// ParseRegisters parses an array of register structures into a map keyed by OBIS code.
+//
+// In lenient mode, registers that cannot be parsed are reported to OnSkip and left out.
+// The parser then continues from the start of the next register structure it can find.
+func (p *Parser) ParseRegisters(r io.Reader) (map[string]Register, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return p.parseRegisters(data)
+}
+
+func (p *Parser) parseRegisters(data []byte) (map[string]Register, error) {
+	if len(data) < 2 || data[0] != 1 {
+		return nil, fmt.Errorf("top-level structure not of array type")
+	}
+	src := &byteSource{data: data, off: 1}
+	count, err := readLength(src)
+	if err != nil {
+		return nil, err
+	}
+	if count > p.maxArrayLength() {
+		return nil, LimitError{Limit: "array length", Value: count, Max: p.maxArrayLength()}
+	}
+	offset := src.off
+
+	result := make(map[string]Register, count)
+	for i := 0; i < count && offset < len(data); i++ {
+		src.off = offset
+		reg, err := p.parseRegister(src)
+		if err == nil {
+			result[reg.OBIS] = reg
+			offset = src.off
+			continue
+		}
+
+		if !p.Lenient {
+			return nil, err
+		}
+
+		p.skip(data[offset:], err)
+		next := nextRegister(data, offset+1)
+		if next < 0 {
+			break
+		}
+		offset = next
+	}
+
+	return result, nil
+}
+
+// parseRegister parses a single register structure. The common layout of an OBIS code, a value,
+// and an optional scaler and unit is read directly, without building the intermediate structures.
+// Anything else is parsed generically, which also produces the errors.
+func (p *Parser) parseRegister(src *byteSource) (Register, error) {
+	start := src.off
+	if reg, ok := p.parseCommonRegister(src); ok {
+		return reg, nil
+	}
+	src.off = start
+	item, err := p.parseAny(src, 1)
+	if err != nil {
+		return Register{}, err
+	}
+	return registerFromStruct(item)
+}
+
+func (p *Parser) parseCommonRegister(src *byteSource) (Register, bool) {
+	head, err := src.next(4)
+	if err != nil || head[0] != 2 || (head[1] != 2 && head[1] != 3) || head[2] != 9 || head[3] != 6 {
+		return Register{}, false
+	}
+	code, err := src.next(6)
+	if err != nil {
+		return Register{}, false
+	}
+	reg := Register{
+		OBIS: formatCode(code),
+	}
+	reg.Value, err = p.parseAny(src, 2)
+	if err != nil {
+		return Register{}, false
+	}
+	if head[1] == 3 {
+		// Structure of an int8 scaler and an enum unit.
+		su, err := src.next(6)
+		if err != nil || su[0] != 2 || su[1] != 2 || su[2] != 15 || su[4] != 22 {
+			return Register{}, false
+		}
+		unit, ok := units[su[5]]
+		if !ok {
+			return Register{}, false
+		}
+		reg.Scaler = int8(su[3])
+		reg.Unit = string(unit)
+	}
+	return reg, true
+}
+
+func (p *Parser) skip(data []byte, err error) {
+	if p.OnSkip == nil {
+		return
+	}
+	skipped := SkippedRegister{
+		OBIS: peekCode(data),
+		Err:  err,
+	}
+	var typeErr UnknownTypeError
+	if errors.As(err, &typeErr) {
+		skipped.Tag = typeErr.Tag
+	}
+	p.OnSkip(skipped)
+}
+
+// peekCode returns the OBIS code at the start of a register structure, or an empty string.
+func peekCode(data []byte) string {
+	for _, prefix := range registerPrefixes {
+		if bytes.HasPrefix(data, prefix) {
+			code, err := parseCode(&byteSource{data: data, off: 3})
+			if err == nil {
+				return code
+			}
+		}
+	}
+	return ""
+}
+
+// nextRegister returns the offset of the next register structure at or after offset, or -1.
+func nextRegister(data []byte, offset int) int {
+	next := -1
+	for _, prefix := range registerPrefixes {
+		i := bytes.Index(data[offset:], prefix)
+		if i >= 0 && (next < 0 || offset+i < next) {
+			next = offset + i
+		}
+	}
+	return next
+}
@@ -13,51 +13,171 @@ import (
 	`encoding/binary`
 	`fmt`
 	`io`
+	`math`
+	`strconv`
+	`sync`
 )
 
 func ParseString(r io.Reader) (string, error) {
-	buf := make([]byte, 1)
-	_, err := io.ReadFull(r, buf)
+	return defaultParser.ParseString(r)
+}
+
+// ParseString parses an octet string or UTF-8 string.
+func (p *Parser) ParseString(r io.Reader) (string, error) {
+	return parseFrom(r, p.parseString)
+}
+
+func (p *Parser) parseString(s source) (string, error) {
+	strlen, err := readLength(s)
 	if err != nil {
 		return "", err
 	}
-	strlen := int(buf[0])
-	buf = make([]byte, strlen)
-	_, err = io.ReadFull(r, buf)
+	if strlen > p.maxStringLength() {
+		return "", LimitError{Limit: "string length", Value: strlen, Max: p.maxStringLength()}
+	}
+	buf, err := s.next(strlen)
 	if err != nil {
 		return "", err
 	}
 	return string(buf), nil
 }
 
-func ParseCode(r io.Reader) (string, error) {
-	buf := make([]byte, 1)
-	_, err := io.ReadFull(r, buf)
+// BitString is a COSEM bit-string.
+// Bits are numbered from the most significant bit of the first byte.
+type BitString struct {
+	Bytes  []byte
+	Length int
+}
+
+// Bit returns the value of bit i.
+func (b BitString) Bit(i int) bool {
+	if i < 0 || i >= b.Length {
+		return false
+	}
+	return b.Bytes[i/8]&(0x80>>(i%8)) != 0
+}
+
+// String returns the bits as a string of ones and zeroes.
+func (b BitString) String() string {
+	buf := make([]byte, b.Length)
+	for i := range buf {
+		buf[i] = '0'
+		if b.Bit(i) {
+			buf[i] = '1'
+		}
+	}
+	return string(buf)
+}
+
+func (b BitString) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+func ParseBitString(r io.Reader) (BitString, error) {
+	return defaultParser.ParseBitString(r)
+}
+
+// ParseBitString parses a bit-string, whose length is given in bits.
+func (p *Parser) ParseBitString(r io.Reader) (BitString, error) {
+	return parseFrom(r, p.parseBitString)
+}
+
+func (p *Parser) parseBitString(s source) (BitString, error) {
+	bits, err := readLength(s)
 	if err != nil {
-		return "", err
+		return BitString{}, err
+	}
+	if (bits+7)/8 > p.maxStringLength() {
+		return BitString{}, LimitError{Limit: "string length", Value: (bits + 7) / 8, Max: p.maxStringLength()}
 	}
-	strlen := int(buf[0])
-	buf = make([]byte, strlen)
-	_, err = io.ReadFull(r, buf)
+	buf, err := s.next((bits + 7) / 8)
+	if err != nil {
+		return BitString{}, err
+	}
+	return BitString{
+		Bytes:  append([]byte(nil), buf...),
+		Length: bits,
+	}, nil
+}
+
+func ParseCode(r io.Reader) (string, error) {
+	return parseFrom(r, parseCode)
+}
+
+func parseCode(s source) (string, error) {
+	strlen, err := readLength(s)
 	if err != nil {
 		return "", err
 	}
 	if strlen != 6 {
 		return "", fmt.Errorf("not a code")
 	}
-	return fmt.Sprintf("%d-%d:%d.%d.%d.%d", buf[0], buf[1], buf[2], buf[3], buf[4], buf[5]), nil
+	buf, err := s.next(strlen)
+	if err != nil {
+		return "", err
+	}
+	return formatCode(buf), nil
+}
+
+// Maximum number of distinct OBIS codes remembered by formatCode.
+const maxCachedCodes = 1024
+
+// OBIS codes formatted so far. Meters send the same few codes in every frame,
+// so each is only formatted and allocated once.
+var codeCache = struct {
+	sync.RWMutex
+	codes map[[6]byte]string
+}{
+	codes: make(map[[6]byte]string),
+}
+
+// formatCode formats six bytes as an OBIS code, such as 1-0:1.7.0.255.
+func formatCode(b []byte) string {
+	var key [6]byte
+	copy(key[:], b)
+
+	codeCache.RLock()
+	code, ok := codeCache.codes[key]
+	codeCache.RUnlock()
+	if ok {
+		return code
+	}
+
+	buf := make([]byte, 0, 24)
+	for i, sep := range []byte("-:...") {
+		buf = strconv.AppendUint(buf, uint64(key[i]), 10)
+		buf = append(buf, sep)
+	}
+	code = string(strconv.AppendUint(buf, uint64(key[5]), 10))
+
+	codeCache.Lock()
+	if len(codeCache.codes) < maxCachedCodes {
+		codeCache.codes[key] = code
+	}
+	codeCache.Unlock()
+	return code
 }
 
-func ParseArray(r io.Reader) (any, error) {
-	buf := make([]byte, 1)
-	_, err := io.ReadFull(r, buf)
+// Array is a COSEM array; a sequence of elements of the same type.
+type Array []any
+
+// Struct is a COSEM structure; a sequence of elements of any type.
+type Struct []any
+
+func (p *Parser) parseElements(s source, depth int) ([]any, error) {
+	if depth > p.maxDepth() {
+		return nil, LimitError{Limit: "nesting depth", Value: depth, Max: p.maxDepth()}
+	}
+	le, err := readLength(s)
 	if err != nil {
 		return nil, err
 	}
-	le := int(buf[0])
+	if le > p.maxArrayLength() {
+		return nil, LimitError{Limit: "array length", Value: le, Max: p.maxArrayLength()}
+	}
 	arr := make([]any, le)
 	for i := 0; i < le; i++ {
-		arr[i], err = ParseAny(r)
+		arr[i], err = p.parseAny(s, depth)
 		if err != nil {
 			return arr, err
 		}
@@ -65,101 +185,268 @@ func ParseArray(r io.Reader) (any, error) {
 	return arr, nil
 }
 
+func ParseArray(r io.Reader) (Array, error) {
+	return defaultParser.ParseArray(r)
+}
+
+func (p *Parser) ParseArray(r io.Reader) (Array, error) {
+	return parseFrom(r, func(s source) (Array, error) {
+		return p.parseElements(s, 1)
+	})
+}
+
+func ParseStruct(r io.Reader) (Struct, error) {
+	return defaultParser.ParseStruct(r)
+}
+
+func (p *Parser) ParseStruct(r io.Reader) (Struct, error) {
+	return parseFrom(r, func(s source) (Struct, error) {
+		return p.parseElements(s, 1)
+	})
+}
+
 func ParseUint8(r io.Reader) (any, error) {
-	var i uint8
-	err := binary.Read(r, binary.BigEndian, &i)
-	return i, err
+	return parseFrom(r, parseUint8)
 }
 
 func ParseUint16(r io.Reader) (any, error) {
-	var i uint16
-	err := binary.Read(r, binary.BigEndian, &i)
-	return i, err
+	return parseFrom(r, parseUint16)
 }
 
 func ParseUint32(r io.Reader) (any, error) {
-	var i uint32
-	err := binary.Read(r, binary.BigEndian, &i)
-	return i, err
+	return parseFrom(r, parseUint32)
+}
+
+func ParseUint64(r io.Reader) (any, error) {
+	return parseFrom(r, parseUint64)
 }
 
 func ParseInt8(r io.Reader) (any, error) {
-	var i int8
-	err := binary.Read(r, binary.BigEndian, &i)
-	return i, err
+	return parseFrom(r, parseInt8)
 }
 
 func ParseInt16(r io.Reader) (any, error) {
-	var i int16
-	err := binary.Read(r, binary.BigEndian, &i)
-	return i, err
+	return parseFrom(r, parseInt16)
 }
 
 func ParseInt32(r io.Reader) (any, error) {
-	var i int32
-	err := binary.Read(r, binary.BigEndian, &i)
-	return i, err
+	return parseFrom(r, parseInt32)
+}
+
+func ParseInt64(r io.Reader) (any, error) {
+	return parseFrom(r, parseInt64)
+}
+
+// ParseBCD parses a single binary coded decimal byte holding two digits.
+func ParseBCD(r io.Reader) (any, error) {
+	return parseFrom(r, parseBCD)
+}
+
+func ParseFloat32(r io.Reader) (any, error) {
+	return parseFrom(r, parseFloat32)
+}
+
+func ParseFloat64(r io.Reader) (any, error) {
+	return parseFrom(r, parseFloat64)
+}
+
+// Numbers are decoded by hand rather than with binary.Read, which allocates and relies on reflection.
+
+func parseUint8(s source) (any, error) {
+	b, err := s.readByte()
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func parseUint16(s source) (any, error) {
+	b, err := s.next(2)
+	if err != nil {
+		return nil, err
+	}
+	return binary.BigEndian.Uint16(b), nil
+}
+
+func parseUint32(s source) (any, error) {
+	b, err := s.next(4)
+	if err != nil {
+		return nil, err
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+func parseUint64(s source) (any, error) {
+	b, err := s.next(8)
+	if err != nil {
+		return nil, err
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+func parseInt8(s source) (any, error) {
+	b, err := s.readByte()
+	if err != nil {
+		return nil, err
+	}
+	return int8(b), nil
+}
+
+func parseInt16(s source) (any, error) {
+	b, err := s.next(2)
+	if err != nil {
+		return nil, err
+	}
+	return int16(binary.BigEndian.Uint16(b)), nil
+}
+
+func parseInt32(s source) (any, error) {
+	b, err := s.next(4)
+	if err != nil {
+		return nil, err
+	}
+	return int32(binary.BigEndian.Uint32(b)), nil
+}
+
+func parseInt64(s source) (any, error) {
+	b, err := s.next(8)
+	if err != nil {
+		return nil, err
+	}
+	return int64(binary.BigEndian.Uint64(b)), nil
+}
+
+func parseBCD(s source) (any, error) {
+	b, err := s.readByte()
+	if err != nil {
+		return nil, err
+	}
+	hi, lo := b>>4, b&0x0f
+	if hi > 9 || lo > 9 {
+		return nil, fmt.Errorf("invalid BCD value 0x%02x", b)
+	}
+	return hi*10 + lo, nil
+}
+
+func parseFloat32(s source) (any, error) {
+	b, err := s.next(4)
+	if err != nil {
+		return nil, err
+	}
+	return math.Float32frombits(binary.BigEndian.Uint32(b)), nil
+}
+
+func parseFloat64(s source) (any, error) {
+	b, err := s.next(8)
+	if err != nil {
+		return nil, err
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
 }
 
+// Unit is a physical unit, sent as an enumerated value.
+type Unit string
+
+var units = map[byte]Unit{
+	27: "W",
+	28: "VA",
+	29: "VAr",
+	30: "Wh",   // guessed based on received values
+	32: "VArh", // guessed based on received values
+	33: "A",
+	31: "VAh",
+	35: "V",
+	44: "Hz",
+
+	// Dimensionless values, such as the power factor.
+	255: "",
+}
+
+// Enum is an enumerated value that is not a known unit, such as a status code.
+type Enum uint8
+
 func ParseEnum(r io.Reader) (any, error) {
-	buf := make([]byte, 1)
-	_, err := io.ReadFull(r, buf)
+	return parseFrom(r, parseEnum)
+}
+
+func parseEnum(s source) (any, error) {
+	b, err := s.readByte()
 	if err != nil {
 		return nil, err
 	}
-	switch buf[0] {
-	case 27:
-		return "W", nil
-	case 28:
-		return "VA", nil
-	case 29:
-		return "VAr", nil
-	case 30:
-		return "Wh", nil // guessed based on received values
-	case 32:
-		return "VArh", nil // guessed based on received values
-	case 33:
-		return "A", nil
-	case 35:
-		return "V", nil
-	default:
-		return "", fmt.Errorf("unknown enum index %d", buf[0])
+	unit, ok := units[b]
+	if !ok {
+		return Enum(b), nil
 	}
+	return unit, nil
+}
+
+// UnknownTypeError is returned when encountering a data type the parser does not support.
+type UnknownTypeError struct {
+	Tag byte
+}
+
+func (e UnknownTypeError) Error() string {
+	return fmt.Sprintf("unrecognized datatype: %d", e.Tag)
 }
 
 func ParseAny(r io.Reader) (any, error) {
-	buf := make([]byte, 1)
-	_, err := io.ReadFull(r, buf)
+	return defaultParser.ParseAny(r)
+}
+
+// ParseAny parses a single value of any supported type.
+func (p *Parser) ParseAny(r io.Reader) (any, error) {
+	return parseFrom(r, func(s source) (any, error) {
+		return p.parseAny(s, 0)
+	})
+}
+
+func (p *Parser) parseAny(s source, depth int) (any, error) {
+	tag, err := s.readByte()
 	if err != nil {
 		return nil, err
 	}
-	switch buf[0] {
+	switch tag {
 	case 0: // null
 		return nil, nil
 	case 1: // array
-		fallthrough
+		arr, err := p.parseElements(s, depth+1)
+		return Array(arr), err
 	case 2: // structure
-		return ParseArray(r)
-	case 9: // OBIS code
-		return ParseCode(r)
+		arr, err := p.parseElements(s, depth+1)
+		return Struct(arr), err
+	case 4: // bit-string
+		return p.parseBitString(s)
+	case 9: // octet string; OBIS code or date-time
+		return parseOctetString(s)
 	case 10, 12: // string/utf-8
-		return ParseString(r)
+		return p.parseString(s)
+	case 13: // bcd
+		return parseBCD(s)
 	case 15: // int
-		return ParseInt8(r)
+		return parseInt8(s)
 	case 16: // long
-		return ParseInt16(r)
+		return parseInt16(s)
 	case 17: // unsigned int
-		return ParseUint8(r)
+		return parseUint8(s)
 	case 18: // unsigned long
-		return ParseUint16(r)
+		return parseUint16(s)
 	case 5: // double
-		return ParseInt32(r)
+		return parseInt32(s)
 	case 6: // unsigned double
-		return ParseUint32(r)
+		return parseUint32(s)
+	case 20: // long64
+		return parseInt64(s)
+	case 21: // unsigned long64
+		return parseUint64(s)
 	case 22: // enum
-		return ParseEnum(r)
+		return parseEnum(s)
+	case 7, 23: // floating-point/float32
+		return parseFloat32(s)
+	case 24: // float64
+		return parseFloat64(s)
 	default:
-		return nil, fmt.Errorf("unrecognized datatype: %d", buf[0])
+		return nil, UnknownTypeError{Tag: tag}
 	}
 }
 
@@ -187,15 +474,15 @@ func ParseFlattened(r io.Reader) (map[string]any, error) {
 	if err != nil {
 		return nil, err
 	}
-	arr, ok := data.([]any)
+	arr, ok := data.(Array)
 	if !ok {
 		return nil, fmt.Errorf("top-level structure not of array type")
 	}
 
 	for _, item := range arr {
-		subarr, ok := item.([]any)
+		subarr, ok := item.(Struct)
 		if !ok {
-			return nil, fmt.Errorf("sub-level data not of array type")
+			return nil, fmt.Errorf("sub-level data not of structure type")
 		}
 		if len(subarr) < 2 {
 			return nil, fmt.Errorf("sub-level data does not contain at least two entries")
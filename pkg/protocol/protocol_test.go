@@ -2,9 +2,15 @@ package protocol_test
 
 import (
 	`bytes`
+	`crypto/aes`
+	`crypto/cipher`
 	`encoding/json`
+	`errors`
+	`io`
 	`os`
+	`strings`
 	`testing`
+	`time`
 
 	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
 	`github.com/stretchr/testify/assert`
@@ -69,6 +75,87 @@ func TestParseAny(t *testing.T) {
 	enc.Encode(s)
 }
 
+func TestParseBitString(t *testing.T) {
+	data := []byte{
+		0x04, 0x0a, // bit-string of 10 bits
+		0xa0, 0x40,
+	}
+	r := bytes.NewReader(data)
+	b, err := protocol.ParseAny(r)
+	assert.NoError(t, err)
+	bits, ok := b.(protocol.BitString)
+	assert.True(t, ok)
+	assert.Equal(t, "1010000001", bits.String())
+	assert.True(t, bits.Bit(0))
+	assert.False(t, bits.Bit(1))
+	assert.True(t, bits.Bit(9))
+	assert.False(t, bits.Bit(10))
+}
+
+func TestParseBCD(t *testing.T) {
+	r := bytes.NewReader([]byte{0x0d, 0x42})
+	i, err := protocol.ParseAny(r)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(42), i)
+
+	r = bytes.NewReader([]byte{0x0d, 0x4a})
+	_, err = protocol.ParseAny(r)
+	assert.Error(t, err)
+}
+
+func TestParseLong64(t *testing.T) {
+	data := []byte{
+		0x14, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe, // long64 -2
+		0x15, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, // unsigned long64 2^32
+	}
+	r := bytes.NewReader(data)
+	i, err := protocol.ParseAny(r)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-2), i)
+	i, err = protocol.ParseAny(r)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1<<32), i)
+}
+
+func TestParseFloat(t *testing.T) {
+	data := []byte{
+		0x17, 0x43, 0x71, 0x00, 0x00, // float32 241.0
+		0x18, 0x40, 0x6e, 0x20, 0x00, 0x00, 0x00, 0x00, 0x00, // float64 241.0
+	}
+	r := bytes.NewReader(data)
+	f, err := protocol.ParseAny(r)
+	assert.NoError(t, err)
+	assert.Equal(t, float32(241), f)
+	f, err = protocol.ParseAny(r)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(241), f)
+}
+
+func TestParseArrayStruct(t *testing.T) {
+	data := []byte{
+		0x01, 0x01, // array of one element
+		0x02, 0x02, // structure of two elements
+		0x11, 0x01, // unsigned int
+		0x0a, 0x01, 0x41, // string
+	}
+	r := bytes.NewReader(data)
+	s, err := protocol.ParseAny(r)
+	assert.NoError(t, err)
+	assert.Equal(t, protocol.Array{protocol.Struct{uint8(1), "A"}}, s)
+}
+
+func TestParseFlattenedRejectsStructAtTopLevel(t *testing.T) {
+	data := []byte{
+		0x02, 0x01, // structure of one element
+		0x02, 0x02, // structure of two elements
+		0x0a, 0x01, 0x41, // string
+		0x11, 0x01, // unsigned int
+	}
+	r := bytes.NewReader(data)
+	_, err := protocol.ParseFlattened(r)
+	assert.Error(t, err)
+}
+
 func TestParseFlattened(t *testing.T) {
 	r := bytes.NewReader(data4[17:])
 	s, err := protocol.ParseFlattened(r)
@@ -77,3 +164,600 @@ func TestParseFlattened(t *testing.T) {
 	enc.Encode(s)
 	assert.NoError(t, err)
 }
+
+func TestParseRegisters(t *testing.T) {
+	r := bytes.NewReader(data4[17:])
+	regs, err := protocol.ParseRegisters(r)
+	assert.NoError(t, err)
+	assert.Len(t, regs, 12)
+
+	assert.Equal(t, protocol.Register{OBIS: "0-0:96.1.0.255", Value: "7359992895803632"}, regs["0-0:96.1.0.255"])
+	assert.Equal(t, protocol.Register{OBIS: "1-0:1.7.0.255", Value: uint32(1273), Scaler: 0, Unit: "W"}, regs["1-0:1.7.0.255"])
+
+	current := regs["1-0:31.7.0.255"]
+	assert.Equal(t, int8(-1), current.Scaler)
+	assert.Equal(t, "A", current.Unit)
+	val, err := current.Float()
+	assert.NoError(t, err)
+	assert.InDelta(t, 2.8, val, 1e-9)
+
+	voltage := regs["1-0:32.7.0.255"]
+	val, err = voltage.Float()
+	assert.NoError(t, err)
+	assert.InDelta(t, 241.0, val, 1e-9)
+
+	_, err = regs["1-1:0.2.129.255"].Float()
+	assert.Error(t, err)
+}
+
+func TestParseExtendedRegisters(t *testing.T) {
+	data := []byte{
+		0x01, 0x03,
+		// Power factor 0.950, dimensionless.
+		0x02, 0x03, 0x09, 0x06, 0x01, 0x00, 0x0d, 0x07, 0x00, 0xff, 0x12, 0x03, 0xb6, 0x02, 0x02, 0x0f, 0xfd, 0x16, 0xff,
+		// Error register as a 16 bit status word.
+		0x02, 0x02, 0x09, 0x06, 0x00, 0x00, 0x61, 0x61, 0x00, 0xff, 0x04, 0x10, 0x00, 0x05,
+		// Enumerated status.
+		0x02, 0x02, 0x09, 0x06, 0x00, 0x00, 0x60, 0x05, 0x00, 0xff, 0x16, 0x03,
+	}
+	regs, err := protocol.ParseRegisters(bytes.NewReader(data))
+	assert.NoError(t, err)
+
+	val, err := regs["1-0:13.7.0.255"].Float()
+	assert.NoError(t, err)
+	assert.Equal(t, 0.95, val)
+	assert.Equal(t, "", regs["1-0:13.7.0.255"].Unit)
+
+	val, err = regs["0-0:97.97.0.255"].Float()
+	assert.NoError(t, err)
+	assert.Equal(t, 5.0, val)
+
+	assert.Equal(t, protocol.Enum(3), regs["0-0:96.5.0.255"].Value)
+}
+
+func TestParserLenient(t *testing.T) {
+	data := make([]byte, len(data4)-17)
+	copy(data, data4[17:])
+
+	// Replace the data type of the L1 current value with an unknown one.
+	code := []byte{0x09, 0x06, 0x01, 0x00, 0x1f, 0x07, 0x00, 0xff}
+	i := bytes.Index(data, code) + len(code)
+	assert.Equal(t, byte(0x10), data[i])
+	data[i] = 0x30
+
+	strict := &protocol.Parser{}
+	_, err := strict.ParseRegisters(bytes.NewReader(data))
+	assert.Equal(t, protocol.UnknownTypeError{Tag: 0x30}, err)
+
+	skipped := make([]protocol.SkippedRegister, 0)
+	lenient := &protocol.Parser{
+		Lenient: true,
+		OnSkip: func(s protocol.SkippedRegister) {
+			skipped = append(skipped, s)
+		},
+	}
+	regs, err := lenient.ParseRegisters(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Len(t, regs, 11)
+	assert.NotContains(t, regs, "1-0:31.7.0.255")
+	assert.Contains(t, regs, "1-0:72.7.0.255")
+	assert.Len(t, skipped, 1)
+	assert.Equal(t, "1-0:31.7.0.255", skipped[0].OBIS)
+	assert.Equal(t, byte(0x30), skipped[0].Tag)
+}
+
+func TestParserLimits(t *testing.T) {
+	p := &protocol.Parser{
+		MaxStringLength: 4,
+		MaxArrayLength:  2,
+		MaxDepth:        2,
+	}
+
+	_, err := p.ParseAny(bytes.NewReader([]byte{0x0a, 0x05, 0x41, 0x41, 0x41, 0x41, 0x41}))
+	assert.Equal(t, protocol.LimitError{Limit: "string length", Value: 5, Max: 4}, err)
+
+	_, err = p.ParseAny(bytes.NewReader([]byte{0x01, 0x03, 0x11, 0x01, 0x11, 0x02, 0x11, 0x03}))
+	assert.Equal(t, protocol.LimitError{Limit: "array length", Value: 3, Max: 2}, err)
+
+	_, err = p.ParseAny(bytes.NewReader([]byte{0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x11, 0x01}))
+	assert.Equal(t, protocol.LimitError{Limit: "nesting depth", Value: 3, Max: 2}, err)
+
+	// Multi-byte length of 0x010000 elements exceeds the default limit without allocating.
+	_, err = protocol.ParseAny(bytes.NewReader([]byte{0x01, 0x83, 0x01, 0x00, 0x00}))
+	assert.Equal(t, protocol.LimitError{Limit: "array length", Value: 0x10000, Max: protocol.DefaultMaxArrayLength}, err)
+
+	s, err := p.ParseAny(bytes.NewReader([]byte{0x01, 0x01, 0x01, 0x01, 0x11, 0x01}))
+	assert.NoError(t, err)
+	assert.Equal(t, protocol.Array{protocol.Array{uint8(1)}}, s)
+}
+
+// withFCS returns a copy of a frame with its frame check sequence appended.
+func withFCS(frame []byte) []byte {
+	fcs := protocol.FCS16(frame)
+	return append(append([]byte(nil), frame...), byte(fcs), byte(fcs>>8))
+}
+
+// flagged joins frames into a stream, with flags between them.
+func flagged(frames ...[]byte) []byte {
+	buf := []byte{0x7e}
+	for _, frame := range frames {
+		buf = append(buf, frame...)
+		buf = append(buf, 0x7e)
+	}
+	return buf
+}
+
+func TestDecoder(t *testing.T) {
+	frame4 := withFCS(data4)
+	invalid, err := protocol.EncodeFrame(nil)
+	assert.NoError(t, err)
+	invalid[17] = 0xff
+	invalid = withFCS(invalid[:len(invalid)-2])
+	stream := append([]byte{0x01, 0x02}, flagged(frame4, []byte{0xa0, 0x01, 0x02}, invalid, data1)...)
+
+	dec := protocol.NewDecoder(bytes.NewReader(stream))
+
+	_, err = dec.NextPacket()
+	assert.ErrorIs(t, err, protocol.ErrResynced)
+
+	packet, err := dec.NextPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, frame4, packet.Frame)
+	assert.Len(t, packet.Registers, 12)
+
+	_, err = dec.NextPacket()
+	assert.ErrorIs(t, err, protocol.ErrResynced)
+
+	_, err = dec.NextPacket()
+	var parseErr *protocol.ParseError
+	assert.ErrorAs(t, err, &parseErr)
+
+	packet, err = dec.NextPacket()
+	assert.NoError(t, err)
+	assert.Len(t, packet.Registers, 1)
+	assert.Equal(t, uint32(0x04f9), packet.Registers["1-0:1.7.0.255"].Value)
+
+	_, err = dec.NextPacket()
+	assert.ErrorIs(t, err, io.EOF)
+
+	stats := dec.Stats()
+	assert.Equal(t, uint64(len(stream)), stats.Bytes)
+	assert.Equal(t, uint64(3), stats.Frames)
+	assert.Equal(t, uint64(5), stats.Discarded)
+}
+
+// chunkReader returns one chunk per read, with a timeout error between each.
+type chunkReader struct {
+	chunks [][]byte
+	wait   bool
+}
+
+var errTimeout = errors.New("timeout")
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	r.wait = !r.wait
+	if !r.wait {
+		return 0, errTimeout
+	}
+	n := copy(p, r.chunks[0])
+	r.chunks[0] = r.chunks[0][n:]
+	if len(r.chunks[0]) == 0 {
+		r.chunks = r.chunks[1:]
+	}
+	return n, nil
+}
+
+// timedReader returns one chunk per read, recording the time each read started.
+type timedReader struct {
+	chunks [][]byte
+	reads  []time.Time
+}
+
+func (r *timedReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(time.Millisecond)
+	r.reads = append(r.reads, time.Now())
+	n := copy(p, r.chunks[0])
+	r.chunks = r.chunks[1:]
+	return n, nil
+}
+
+func TestDecoderTiming(t *testing.T) {
+	stream := flagged(data1, data2)
+	r := &timedReader{chunks: [][]byte{stream[:10], stream[10:]}}
+	dec := protocol.NewDecoder(r)
+
+	// The first frame was received with the read delivering its start, the second with the one completing the first.
+	packet, err := dec.NextPacket()
+	assert.NoError(t, err)
+	timing := packet.Timing
+	assert.False(t, timing.Received.Before(r.reads[0]))
+	assert.True(t, timing.Received.Before(r.reads[1]))
+	assert.False(t, timing.Unframed.Before(r.reads[1]))
+	assert.False(t, timing.Parsed.Before(timing.Unframed))
+	assert.True(t, timing.Deciphered.IsZero())
+
+	packet, err = dec.NextPacket()
+	assert.NoError(t, err)
+	assert.False(t, packet.Timing.Received.Before(r.reads[1]))
+
+	packet, err = protocol.DecodeFrame(data1)
+	assert.NoError(t, err)
+	assert.True(t, packet.Timing.Received.IsZero())
+	assert.False(t, packet.Timing.Parsed.IsZero())
+}
+
+func TestUnframerSplitReads(t *testing.T) {
+	stream := flagged(data1, data2)
+	r := &chunkReader{}
+	for _, n := range []int{1, 2, 5, 30, 20, 3} {
+		r.chunks = append(r.chunks, stream[:n])
+		stream = stream[n:]
+	}
+	r.chunks = append(r.chunks, stream)
+
+	unf := protocol.NewUnframer(r)
+	var frames [][]byte
+	for {
+		frame, err := unf.ReadFrame()
+		if errors.Is(err, errTimeout) {
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		frames = append(frames, append([]byte(nil), frame.Data...))
+	}
+	assert.Equal(t, [][]byte{data1, data2}, frames)
+}
+
+func TestUnframerMultiFrameReads(t *testing.T) {
+	// Two frames in one read, then one split across two reads along with another.
+	stream := flagged(data1, data2, data1, data2)
+	split := len(flagged(data1, data2)) + 10
+	r := &timedReader{chunks: [][]byte{stream[:split], stream[split:]}}
+	unf := protocol.NewUnframer(r)
+
+	assert.False(t, unf.Buffered())
+	for i, buffered := range []bool{true, false, true, false} {
+		frame, err := unf.ReadFrame()
+		assert.NoError(t, err)
+		assert.NotEmpty(t, frame.Data)
+		assert.Equal(t, buffered, unf.Buffered(), "after frame %d", i)
+	}
+	_, err := unf.ReadFrame()
+	assert.ErrorIs(t, err, io.EOF)
+
+	stats := unf.Stats()
+	assert.Equal(t, uint64(4), stats.Frames)
+	assert.Equal(t, uint64(2), stats.MultiFrameReads)
+}
+
+func TestUnframerHeader(t *testing.T) {
+	unf := protocol.NewUnframer(bytes.NewReader(flagged(data1)))
+	frame, err := unf.ReadFrame()
+	assert.NoError(t, err)
+	assert.Equal(t, 42, frame.Length)
+	assert.False(t, frame.Segmented)
+	assert.Equal(t, []byte{0x41}, frame.Destination)
+	assert.Equal(t, []byte{0x08, 0x83}, frame.Source)
+	assert.Equal(t, byte(0x13), frame.Control)
+	assert.Equal(t, data1[8:40], frame.Info())
+
+	frame, err = protocol.NewUnframer(bytes.NewReader(flagged(frame4Segmented()))).ReadFrame()
+	assert.NoError(t, err)
+	assert.True(t, frame.Segmented)
+}
+
+// frame4Segmented returns the frame of data4 with the segmentation bit set.
+func frame4Segmented() []byte {
+	frame := append([]byte(nil), data4...)
+	frame[0] |= 0x08
+	hcs := protocol.FCS16(frame[:6])
+	frame[6], frame[7] = byte(hcs), byte(hcs>>8)
+	return withFCS(frame)
+}
+
+func TestUnframerFlagWithinFrame(t *testing.T) {
+	frame, err := protocol.EncodeFrame([]protocol.Register{{OBIS: "1-0:1.7.0.255", Value: uint32(0x7e7d7e)}})
+	assert.NoError(t, err)
+	assert.Contains(t, string(frame), "\x7e")
+
+	dec := protocol.NewDecoder(bytes.NewReader(flagged(frame)))
+	packet, err := dec.NextPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0x7e7d7e), packet.Registers["1-0:1.7.0.255"].Value)
+}
+
+func TestUnframerAbort(t *testing.T) {
+	stream := append([]byte{0x7e}, data1[:20]...)
+	stream = append(stream, 0x7d)
+	stream = append(stream, flagged(data2)...)
+
+	unf := protocol.NewUnframer(bytes.NewReader(stream))
+	_, err := unf.ReadFrame()
+	assert.ErrorIs(t, err, protocol.ErrAborted)
+
+	frame, err := unf.ReadFrame()
+	assert.NoError(t, err)
+	assert.Equal(t, data2, frame.Data)
+}
+
+func TestUnframerChecksum(t *testing.T) {
+	corrupt := append([]byte(nil), data1...)
+	corrupt[30] ^= 0x01
+	unf := protocol.NewUnframer(bytes.NewReader(flagged(corrupt, data2)))
+
+	_, err := unf.ReadFrame()
+	assert.ErrorIs(t, err, protocol.ErrChecksum)
+
+	frame, err := unf.ReadFrame()
+	assert.NoError(t, err)
+	assert.Equal(t, data2, frame.Data)
+
+	_, err = unf.ReadFrame()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestUnframerTruncated(t *testing.T) {
+	unf := protocol.NewUnframer(bytes.NewReader(flagged(data1)[:20]))
+	_, err := unf.ReadFrame()
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestDecodeFrame(t *testing.T) {
+	packet, err := protocol.DecodeFrame(data1)
+	assert.NoError(t, err)
+	assert.Equal(t, data1, packet.Frame)
+	assert.Len(t, packet.Registers, 1)
+
+	_, err = protocol.DecodeFrame(data1[:10])
+	var parseErr *protocol.ParseError
+	assert.ErrorAs(t, err, &parseErr)
+	assert.Equal(t, data1[:10], parseErr.Frame)
+}
+
+func TestDecodeFramePayloadOffset(t *testing.T) {
+	dateTime := []byte{0x07, 0xe3, 0x0a, 0x10, 0x03, 0x0c, 0x1e, 0x00, 0xff, 0x80, 0x00, 0x00}
+	header := []byte{0xa0, 0x00, 0x01, 0x02, 0x01, 0x10, 0x00, 0x00, 0xe6, 0xe7, 0x00, 0x0f, 0x00, 0x00, 0x00, 0x00}
+
+	// Date-time with and without its octet string tag, as sent by different meters.
+	for _, prefix := range [][]byte{{0x0c}, {0x09, 0x0c}} {
+		frame := append(append(append([]byte{}, header...), prefix...), dateTime...)
+		frame = append(frame, data1[17:]...)
+		packet, err := protocol.DecodeFrame(frame)
+		assert.NoError(t, err)
+		assert.Len(t, packet.Registers, 1)
+	}
+
+	parser := &protocol.Parser{PayloadOffset: 17}
+	packet, err := parser.DecodeFrame(data1)
+	assert.NoError(t, err)
+	assert.Len(t, packet.Registers, 1)
+
+	// A header byte that looks like the start of a data-notification is not mistaken for it.
+	frame := []byte{0xa0, 0x00, 0x0f, 0x08, 0x83, 0x13, 0x04, 0x00, 0x02, 0xe6, 0xe7, 0x00}
+	frame = append(frame, data1[11:]...)
+	packet, err = protocol.DecodeFrame(frame)
+	assert.NoError(t, err)
+	assert.Len(t, packet.Registers, 1)
+
+	frame = append([]byte{}, data1...)
+	frame[11] = 0x0e
+	_, err = protocol.DecodeFrame(frame)
+	var parseErr *protocol.ParseError
+	assert.ErrorAs(t, err, &parseErr)
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	for _, data := range [][]byte{data1[17:], data4[17:]} {
+		v, err := protocol.ParseAny(bytes.NewReader(data))
+		assert.NoError(t, err)
+		buf := &bytes.Buffer{}
+		err = protocol.Encode(buf, v)
+		assert.NoError(t, err)
+		assert.Equal(t, data[:buf.Len()], buf.Bytes())
+	}
+}
+
+func TestEncodeFrame(t *testing.T) {
+	regs, err := protocol.ParseRegisters(bytes.NewReader(data1[17:]))
+	assert.NoError(t, err)
+	frame, err := protocol.EncodeFrame([]protocol.Register{regs["1-0:1.7.0.255"]})
+	assert.NoError(t, err)
+	assert.Equal(t, data1, frame)
+
+	regs, err = protocol.ParseRegisters(bytes.NewReader(data4[17:]))
+	assert.NoError(t, err)
+	order := []string{
+		"1-1:0.2.129.255", "0-0:96.1.0.255", "0-0:96.1.7.255",
+		"1-0:1.7.0.255", "1-0:2.7.0.255", "1-0:3.7.0.255", "1-0:4.7.0.255",
+		"1-0:31.7.0.255", "1-0:71.7.0.255",
+		"1-0:32.7.0.255", "1-0:52.7.0.255", "1-0:72.7.0.255",
+	}
+	ordered := make([]protocol.Register, 0, len(order))
+	for _, code := range order {
+		ordered = append(ordered, regs[code])
+	}
+	frame, err = protocol.EncodeFrame(ordered)
+	assert.NoError(t, err)
+	// data4 was captured without its frame check sequence.
+	assert.Equal(t, data4, frame[:len(frame)-2])
+}
+
+func TestEncodeFrameSize(t *testing.T) {
+	frame := func(n int) ([]byte, error) {
+		return protocol.EncodeFrame([]protocol.Register{{OBIS: "0-0:96.1.0.255", Value: strings.Repeat("x", n)}})
+	}
+	shorter, err := frame(300)
+	assert.NoError(t, err)
+
+	// The largest frame encoded is decoded by the unframer.
+	n := 300 + 1024 - len(shorter)
+	largest, err := frame(n)
+	assert.NoError(t, err)
+	assert.Len(t, largest, 1024)
+	packet, err := protocol.NewDecoder(bytes.NewReader(flagged(largest))).NextPacket()
+	if assert.NoError(t, err) {
+		assert.Equal(t, largest, packet.Frame)
+	}
+
+	_, err = frame(n + 1)
+	assert.Error(t, err)
+}
+
+func BenchmarkDecodeFrame(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, err := protocol.DecodeFrame(data4)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseAny(b *testing.B) {
+	b.ReportAllocs()
+	r := bytes.NewReader(data4[17:])
+	for i := 0; i < b.N; i++ {
+		r.Reset(data4[17:])
+		_, err := protocol.ParseAny(r)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestParseDateTime(t *testing.T) {
+	// 2022-08-17 02:00:10, Wednesday, deviation unspecified.
+	data := []byte{0x09, 0x0c, 0x07, 0xe6, 0x08, 0x11, 0x03, 0x02, 0x00, 0x0a, 0xff, 0x80, 0x00, 0x00}
+	v, err := protocol.ParseAny(bytes.NewReader(data))
+	assert.NoError(t, err)
+	dt, ok := v.(protocol.DateTime)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2022, 8, 17, 2, 0, 10, 0, time.UTC), dt.Time(time.UTC))
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, protocol.Encode(buf, dt))
+	assert.Equal(t, data, buf.Bytes())
+
+	// Deviation of -120 minutes; local time is two hours ahead of UTC.
+	dt.Deviation = -120
+	assert.Equal(t, time.Date(2022, 8, 17, 0, 0, 10, 0, time.UTC), dt.Time(time.Local).UTC())
+}
+
+// cipherFrame wraps the data-notification of an encoded frame in a general-glo-ciphering APDU,
+// ciphered as given by the security control byte.
+func cipherFrame(t *testing.T, frame []byte, sc byte, ek, ak []byte) []byte {
+	apdu := frame[11 : len(frame)-2]
+	systemTitle := []byte("AMS\x00\x00\x00\x00\x01")
+	counter := []byte{0x00, 0x00, 0x01, 0x02}
+	block, err := aes.NewCipher(ek)
+	assert.NoError(t, err)
+	gcm, err := cipher.NewGCMWithTagSize(block, 12)
+	assert.NoError(t, err)
+	iv := append(append([]byte{}, systemTitle...), counter...)
+	aad := append([]byte{sc}, ak...)
+
+	var info []byte
+	switch sc & 0x30 {
+	case 0x30:
+		info = gcm.Seal(nil, iv, apdu, aad)
+	case 0x20:
+		sealed := gcm.Seal(nil, iv, apdu, nil)
+		info = sealed[:len(apdu)]
+	case 0x10:
+		info = append(append([]byte{}, apdu...), gcm.Seal(nil, iv, nil, append(aad, apdu...))...)
+	default:
+		info = append([]byte{}, apdu...)
+	}
+
+	body := append(append([]byte{sc}, counter...), info...)
+	ciphered := append([]byte{}, frame[:11]...)
+	ciphered = append(ciphered, 0xdb, 0x08)
+	ciphered = append(ciphered, systemTitle...)
+	if len(body) > 0x7f {
+		ciphered = append(ciphered, 0x82, byte(len(body)>>8), byte(len(body)))
+	} else {
+		ciphered = append(ciphered, byte(len(body)))
+	}
+	ciphered = append(ciphered, body...)
+	return append(ciphered, 0x00, 0x00)
+}
+
+func TestDecodeCipheredFrame(t *testing.T) {
+	regs, err := protocol.ParseRegisters(bytes.NewReader(data4[17:]))
+	assert.NoError(t, err)
+	list := make([]protocol.Register, 0, len(regs))
+	for _, reg := range regs {
+		list = append(list, reg)
+	}
+	frame, err := protocol.EncodeFrame(list)
+	assert.NoError(t, err)
+
+	ek := bytes.Repeat([]byte{0x11}, 16)
+	ak := bytes.Repeat([]byte{0x22}, 16)
+	security := &protocol.Security{EncryptionKey: ek, AuthenticationKey: ak}
+	assert.NoError(t, security.Validate())
+	parser := &protocol.Parser{Security: security}
+
+	// Encrypted and authenticated, encrypted only, authenticated only, and neither.
+	for _, sc := range []byte{0x30, 0x20, 0x10, 0x00} {
+		ciphered := cipherFrame(t, frame, sc, ek, ak)
+		packet, err := parser.DecodeFrame(ciphered)
+		assert.NoError(t, err, "security control 0x%02x", sc)
+		if assert.NotNil(t, packet) {
+			assert.Equal(t, regs, packet.Registers)
+			assert.Equal(t, ciphered, packet.Frame)
+		}
+	}
+
+	// Tampering with the ciphertext or the tag fails authentication.
+	for _, sc := range []byte{0x30, 0x10} {
+		ciphered := cipherFrame(t, frame, sc, ek, ak)
+		ciphered[len(ciphered)-20] ^= 0x01
+		_, err = parser.DecodeFrame(ciphered)
+		assert.ErrorIs(t, err, protocol.ErrAuthentication)
+	}
+	_, err = parser.DecodeFrame(cipherFrame(t, frame, 0x30, ek, bytes.Repeat([]byte{0x33}, 16)))
+	assert.ErrorIs(t, err, protocol.ErrAuthentication)
+
+	// Unauthenticated frames are rejected when authentication is required.
+	security.RequireAuthentication = true
+	_, err = parser.DecodeFrame(cipherFrame(t, frame, 0x20, ek, ak))
+	assert.ErrorIs(t, err, protocol.ErrAuthentication)
+	_, err = parser.DecodeFrame(frame)
+	assert.ErrorIs(t, err, protocol.ErrAuthentication)
+	_, err = parser.DecodeFrame(cipherFrame(t, frame, 0x10, ek, ak))
+	assert.NoError(t, err)
+
+	// Security suite 2 uses 256 bit keys, and frames must use the configured suite.
+	ek256 := bytes.Repeat([]byte{0x44}, 32)
+	ak256 := bytes.Repeat([]byte{0x55}, 32)
+	suite2 := &protocol.Parser{Security: &protocol.Security{Suite: 2, EncryptionKey: ek256, AuthenticationKey: ak256}}
+	assert.NoError(t, suite2.Security.Validate())
+	packet, err := suite2.DecodeFrame(cipherFrame(t, frame, 0x32, ek256, ak256))
+	assert.NoError(t, err)
+	if assert.NotNil(t, packet) {
+		assert.Equal(t, regs, packet.Registers)
+	}
+	_, err = suite2.DecodeFrame(cipherFrame(t, frame, 0x30, ek, ak))
+	var parseErr *protocol.ParseError
+	assert.ErrorAs(t, err, &parseErr)
+	assert.NotErrorIs(t, err, protocol.ErrAuthentication)
+
+	// Ciphered frames cannot be decoded without keys.
+	_, err = protocol.DecodeFrame(cipherFrame(t, frame, 0x30, ek, ak))
+	assert.ErrorAs(t, err, &parseErr)
+	assert.Contains(t, err.Error(), "ciphered")
+
+	assert.Error(t, (&protocol.Security{Suite: 2, EncryptionKey: ek}).Validate())
+	assert.Error(t, (&protocol.Security{Suite: 3}).Validate())
+	assert.Error(t, (&protocol.Security{EncryptionKey: ek, RequireAuthentication: true}).Validate())
+}
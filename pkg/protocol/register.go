@@ -0,0 +1,131 @@
+package protocol
+
+import (
+	`fmt`
+	`io`
+	`math`
+)
+
+// Register is a single value sent by the meter, along with its scaler and unit, if any.
+type Register struct {
+	OBIS   string
+	Value  any
+	Scaler int8
+	Unit   string
+}
+
+// Float returns the numeric value of the register with the scaler applied.
+func (reg Register) Float() (float64, error) {
+	val, err := tofloat(reg.Value)
+	if err != nil {
+		return 0, err
+	}
+	// Dividing by a power of ten keeps values such as 2.8 exact.
+	if reg.Scaler < 0 {
+		return val / math.Pow10(-int(reg.Scaler)), nil
+	}
+	return val * math.Pow10(int(reg.Scaler)), nil
+}
+
+// The type system is where Golang really _shines_...
+// Is there a better way to do this using generics?
+func tofloat(i any) (float64, error) {
+	switch x := i.(type) {
+	case int8:
+		return float64(x), nil
+	case int16:
+		return float64(x), nil
+	case int32:
+		return float64(x), nil
+	case int64:
+		return float64(x), nil
+	case uint8:
+		return float64(x), nil
+	case uint16:
+		return float64(x), nil
+	case uint32:
+		return float64(x), nil
+	case uint64:
+		return float64(x), nil
+	case float32:
+		return float64(x), nil
+	case float64:
+		return x, nil
+	case Enum:
+		return float64(x), nil
+	case BitString:
+		// Status words are sent as bit-strings, and read as unsigned integers.
+		if x.Length > 64 {
+			return 0, fmt.Errorf("bit-string of %d bits too long for a number", x.Length)
+		}
+		var val uint64
+		for i := 0; i < x.Length; i++ {
+			val <<= 1
+			if x.Bit(i) {
+				val |= 1
+			}
+		}
+		return float64(val), nil
+	default:
+		return 0, fmt.Errorf("not a number")
+	}
+}
+
+// Parses structured data into a map of registers, keyed by OBIS code.
+// Only works for this particular data format.
+//
+// Unlike ParseFlattened, the scaler and unit of each register is kept.
+// This input data:
+//
+//	[
+//	   "1-0:32.7.0.255",
+//	   2500,
+//	   [
+//	      -1,
+//	      35
+//	   ]
+//	]
+//
+// Gives a register with OBIS code "1-0:32.7.0.255", value 2500, scaler -1 and unit "V".
+func ParseRegisters(r io.Reader) (map[string]Register, error) {
+	p := &Parser{}
+	return p.ParseRegisters(r)
+}
+
+// registerFromStruct converts a parsed register structure into a Register.
+func registerFromStruct(item any) (Register, error) {
+	subarr, ok := item.(Struct)
+	if !ok {
+		return Register{}, fmt.Errorf("sub-level data not of structure type")
+	}
+	if len(subarr) < 2 {
+		return Register{}, fmt.Errorf("sub-level data does not contain at least two entries")
+	}
+	key, ok := subarr[0].(string)
+	if !ok {
+		return Register{}, fmt.Errorf("first entry not string type; unusable as key")
+	}
+	reg := Register{
+		OBIS:  key,
+		Value: subarr[1],
+	}
+	if len(subarr) > 2 {
+		scalerUnit, ok := subarr[2].(Struct)
+		if !ok || len(scalerUnit) != 2 {
+			return reg, fmt.Errorf("%s: scaler and unit not a structure of two entries", key)
+		}
+		reg.Scaler, ok = scalerUnit[0].(int8)
+		if !ok {
+			return reg, fmt.Errorf("%s: scaler not integer type", key)
+		}
+		unit, ok := scalerUnit[1].(Unit)
+		if enum, isEnum := scalerUnit[1].(Enum); isEnum {
+			return reg, fmt.Errorf("%s: unknown unit %d", key, enum)
+		}
+		if !ok {
+			return reg, fmt.Errorf("%s: unit not enum type", key)
+		}
+		reg.Unit = string(unit)
+	}
+	return reg, nil
+}
@@ -0,0 +1,181 @@
+package protocol
+
+import (
+	`crypto/aes`
+	`crypto/cipher`
+	`encoding/binary`
+	`errors`
+	`fmt`
+)
+
+// Tag of the general-glo-ciphering APDU, which ciphered data-notifications are wrapped in.
+const generalGloCipheringTag = 0xdb
+
+// Bits of the security control byte preceding the ciphered APDU.
+const (
+	securitySuiteMask     = 0x0f
+	securityAuthenticated = 0x10
+	securityEncrypted     = 0x20
+	securityCompressed    = 0x80
+)
+
+// Length of the authentication tag of authenticated APDUs.
+const authTagLength = 12
+
+// ErrAuthentication is returned, wrapped in a *ParseError, for frames whose authentication tag does not
+// match, or that are not authenticated although authentication is required.
+var ErrAuthentication = errors.New("authentication failed")
+
+// Security holds the keys of a meter ciphering its data-notifications, such as Kamstrup and Landis+Gyr
+// meters in some grids. Frames are wrapped in general-glo-ciphering APDUs, either encrypted, authenticated,
+// or both, using AES-GCM with the system title and frame counter as the initialization vector.
+type Security struct {
+	// DLMS security suite: 0 and 1 use AES-GCM-128, and 2 uses AES-GCM-256 with 32 byte keys.
+	Suite int
+
+	// Global unicast encryption key, needed for encrypted frames.
+	EncryptionKey []byte
+
+	// Authentication key, needed for authenticated frames. The authentication tag is validated
+	// whenever the key is given.
+	AuthenticationKey []byte
+
+	// Reject frames that are not authenticated, including plain ones.
+	RequireAuthentication bool
+}
+
+// Validate checks that the suite is known and the keys are of the length it requires.
+func (s *Security) Validate() error {
+	size := 16
+	switch s.Suite {
+	case 0, 1:
+	case 2:
+		size = 32
+	default:
+		return fmt.Errorf("unknown security suite %d", s.Suite)
+	}
+	if len(s.EncryptionKey) != 0 && len(s.EncryptionKey) != size {
+		return fmt.Errorf("encryption key must be %d bytes for security suite %d", size, s.Suite)
+	}
+	if len(s.AuthenticationKey) != 0 && len(s.AuthenticationKey) != size {
+		return fmt.Errorf("authentication key must be %d bytes for security suite %d", size, s.Suite)
+	}
+	// The encryption key is the block cipher key for authentication tags as well.
+	if len(s.AuthenticationKey) != 0 && len(s.EncryptionKey) == 0 {
+		return fmt.Errorf("encryption key is required to verify authenticated frames")
+	}
+	if s.RequireAuthentication && len(s.AuthenticationKey) == 0 {
+		return fmt.Errorf("authentication key is required to require authentication")
+	}
+	return nil
+}
+
+// findCiphered returns the offset of the general-glo-ciphering APDU in a frame, or -1 if none is found.
+// The APDU holds the system title, and the length of the rest of the APDU, which must end the information
+// field, right before the frame check sequence, or at the end of the frame if that was stripped.
+func findCiphered(frame []byte) int {
+	for i, b := range frame {
+		if b != generalGloCipheringTag || i+10 >= len(frame) || frame[i+1] != 8 {
+			continue
+		}
+		src := &byteSource{data: frame[i+10:]}
+		length, err := readLength(src)
+		if err != nil {
+			continue
+		}
+		end := i + 10 + src.off + length
+		if end == len(frame) || end == len(frame)-2 {
+			return i
+		}
+	}
+	return -1
+}
+
+// decipher returns the plain APDU held by the general-glo-ciphering APDU at the start of data.
+// Authentication failures are reported as ErrAuthentication.
+func (s *Security) decipher(data []byte) ([]byte, error) {
+	if len(data) < 10 {
+		return nil, fmt.Errorf("ciphered APDU too short")
+	}
+	systemTitle := data[2:10]
+	src := &byteSource{data: data[10:]}
+	length, err := readLength(src)
+	if err != nil {
+		return nil, fmt.Errorf("ciphered APDU: %w", err)
+	}
+	body, err := src.next(length)
+	if err != nil || length < 5 {
+		return nil, fmt.Errorf("ciphered APDU of %d bytes truncated", length)
+	}
+
+	sc := body[0]
+	counter := body[1:5]
+	info := body[5:]
+	if suite := int(sc & securitySuiteMask); suite != s.Suite {
+		return nil, fmt.Errorf("frame uses security suite %d, but %d is configured", suite, s.Suite)
+	}
+	if sc&securityCompressed != 0 {
+		return nil, fmt.Errorf("compressed APDUs are not supported")
+	}
+	encrypted := sc&securityEncrypted != 0
+	authenticated := sc&securityAuthenticated != 0
+	if s.RequireAuthentication && !authenticated {
+		return nil, fmt.Errorf("frame is not authenticated: %w", ErrAuthentication)
+	}
+
+	iv := make([]byte, 0, 12)
+	iv = append(iv, systemTitle...)
+	iv = append(iv, counter...)
+
+	var tag []byte
+	if authenticated {
+		if len(info) < authTagLength {
+			return nil, fmt.Errorf("authentication tag truncated")
+		}
+		tag = info[len(info)-authTagLength:]
+		info = info[:len(info)-authTagLength]
+	}
+
+	verify := authenticated && len(s.AuthenticationKey) > 0
+	if !encrypted && !verify {
+		return info, nil
+	}
+	// The block cipher key is the encryption key, also for authenticated-only APDUs.
+	if len(s.EncryptionKey) == 0 {
+		return nil, fmt.Errorf("frame is ciphered, but no encryption key is configured")
+	}
+	block, err := aes.NewCipher(s.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if !verify {
+		// Without checking the tag, GCM decryption is plain AES-CTR, starting at the counter block
+		// following the one reserved for the tag.
+		ctr := make([]byte, aes.BlockSize)
+		copy(ctr, iv)
+		binary.BigEndian.PutUint32(ctr[12:], 2)
+		plain := make([]byte, len(info))
+		cipher.NewCTR(block, ctr).XORKeyStream(plain, info)
+		return plain, nil
+	}
+
+	gcm, err := cipher.NewGCMWithTagSize(block, authTagLength)
+	if err != nil {
+		return nil, err
+	}
+	aad := append([]byte{sc}, s.AuthenticationKey...)
+	if !encrypted {
+		// Authenticated-only APDUs carry the plain APDU in the clear, authenticated with GMAC.
+		aad = append(aad, info...)
+		if _, err := gcm.Open(nil, iv, tag, aad); err != nil {
+			return nil, ErrAuthentication
+		}
+		return info, nil
+	}
+	plain, err := gcm.Open(nil, iv, append(append([]byte{}, info...), tag...), aad)
+	if err != nil {
+		return nil, ErrAuthentication
+	}
+	return plain, nil
+}
@@ -0,0 +1,94 @@
+package protocol
+
+import (
+	`io`
+	`sync`
+)
+
+// source provides the bytes read by the parser.
+//
+// Frames already in memory are read without copying. Other readers go through a scratch
+// buffer that is reused between calls, so that fixed size values can be decoded without allocating.
+type source interface {
+	readByte() (byte, error)
+
+	// next returns the next n bytes. The slice is only valid until the following call,
+	// and must be copied if retained.
+	next(n int) ([]byte, error)
+}
+
+// byteSource reads from a byte slice.
+type byteSource struct {
+	data []byte
+	off  int
+}
+
+func (s *byteSource) readByte() (byte, error) {
+	if s.off >= len(s.data) {
+		return 0, io.EOF
+	}
+	b := s.data[s.off]
+	s.off++
+	return b, nil
+}
+
+func (s *byteSource) next(n int) ([]byte, error) {
+	remaining := len(s.data) - s.off
+	switch {
+	case remaining >= n:
+		b := s.data[s.off : s.off+n]
+		s.off += n
+		return b, nil
+	case remaining == 0:
+		return nil, io.EOF
+	default:
+		s.off = len(s.data)
+		return nil, io.ErrUnexpectedEOF
+	}
+}
+
+// readerSource reads from an io.Reader into a scratch buffer.
+type readerSource struct {
+	r   io.Reader
+	buf []byte
+}
+
+func (s *readerSource) readByte() (byte, error) {
+	b, err := s.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (s *readerSource) next(n int) ([]byte, error) {
+	if cap(s.buf) < n {
+		s.buf = make([]byte, n)
+	}
+	b := s.buf[:n]
+	_, err := io.ReadFull(s.r, b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+var readerSources = sync.Pool{
+	New: func() any {
+		return &readerSource{buf: make([]byte, 64)}
+	},
+}
+
+// parseFrom runs a parse function on a reader, using a pooled scratch buffer.
+func parseFrom[T any](r io.Reader, parse func(source) (T, error)) (T, error) {
+	s := readerSources.Get().(*readerSource)
+	s.r = r
+	defer func() {
+		s.r = nil
+		// Buffers grown by long strings are not kept around.
+		if cap(s.buf) <= DefaultMaxStringLength {
+			readerSources.Put(s)
+		}
+	}()
+	return parse(s)
+}
@@ -0,0 +1,21 @@
+// Package queue sends to buffered channels used as queues between the meter reader and slower consumers.
+package queue
+
+// Push sends a value on a channel without blocking. If the channel is full, the oldest values are
+// dropped to make room, so that a slow consumer gets the latest values rather than holding up the sender.
+// It reports whether the value was queued without dropping another.
+func Push[T any](ch chan T, v T) bool {
+	queued := true
+	for {
+		select {
+		case ch <- v:
+			return queued
+		default:
+		}
+		select {
+		case <-ch:
+			queued = false
+		default:
+		}
+	}
+}
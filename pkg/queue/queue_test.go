@@ -0,0 +1,18 @@
+package queue_test
+
+import (
+	`testing`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/queue`
+	`github.com/stretchr/testify/assert`
+)
+
+func TestPush(t *testing.T) {
+	ch := make(chan int, 2)
+
+	assert.True(t, queue.Push(ch, 1))
+	assert.True(t, queue.Push(ch, 2))
+	assert.False(t, queue.Push(ch, 3))
+	assert.Equal(t, 2, <-ch)
+	assert.Equal(t, 3, <-ch)
+}
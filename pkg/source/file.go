@@ -0,0 +1,121 @@
+package source
+
+import (
+	`context`
+	`errors`
+	`fmt`
+	`io`
+	`os`
+	`strings`
+	`sync`
+)
+
+func init() {
+	Register("file", newFile)
+	Register("stdin", newStdin)
+}
+
+// fileSource reads frames from a file once, such as a capture of the serial port made with cat.
+type fileSource struct {
+	path string
+}
+
+func newFile(address string) (Source, error) {
+	path := strings.TrimPrefix(address, "file://")
+	if len(path) == 0 {
+		return nil, fmt.Errorf("file address %q has no path", address)
+	}
+	return &fileSource{path: path}, nil
+}
+
+func (s *fileSource) Open(ctx context.Context) (io.ReadCloser, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	return &finiteStream{ReadCloser: f}, nil
+}
+
+// stdinSource reads frames from standard input, such as when piped from another program.
+type stdinSource struct {
+	in io.Reader
+}
+
+func newStdin(address string) (Source, error) {
+	return &stdinSource{in: os.Stdin}, nil
+}
+
+func (s *stdinSource) Open(ctx context.Context) (io.ReadCloser, error) {
+	// Standard input is not closed along with the stream, as it cannot be opened again.
+	return &finiteStream{ReadCloser: newDetachedStream(s.in)}, nil
+}
+
+// detachedStream reads from a reader that cannot be interrupted, such as standard input, in a goroutine
+// of its own. Closing the stream interrupts a blocking read by abandoning the goroutine, which ends once
+// the underlying read returns. Whatever it reads then is lost.
+type detachedStream struct {
+	in      io.Reader
+	results chan detachedRead
+	closed  chan struct{}
+	once    sync.Once
+	pending bool
+	rest    []byte
+}
+
+type detachedRead struct {
+	data []byte
+	err  error
+}
+
+func newDetachedStream(in io.Reader) *detachedStream {
+	return &detachedStream{
+		in:      in,
+		results: make(chan detachedRead, 1),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (s *detachedStream) Read(p []byte) (int, error) {
+	if len(s.rest) > 0 {
+		n := copy(p, s.rest)
+		s.rest = s.rest[n:]
+		return n, nil
+	}
+	if !s.pending {
+		s.pending = true
+		buf := make([]byte, len(p))
+		go func() {
+			n, err := s.in.Read(buf)
+			s.results <- detachedRead{data: buf[:n], err: err}
+		}()
+	}
+	select {
+	case <-s.closed:
+		return 0, os.ErrClosed
+	case result := <-s.results:
+		s.pending = false
+		n := copy(p, result.data)
+		s.rest = result.data[n:]
+		return n, result.err
+	}
+}
+
+func (s *detachedStream) Close() error {
+	s.once.Do(func() {
+		close(s.closed)
+	})
+	return nil
+}
+
+// finiteStream returns ErrDone at the end of the data, so that it is not read again.
+type finiteStream struct {
+	io.ReadCloser
+}
+
+func (s *finiteStream) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	if errors.Is(err, io.EOF) {
+		err = ErrDone
+	}
+	return n, err
+}
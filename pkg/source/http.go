@@ -0,0 +1,73 @@
+package source
+
+import (
+	`context`
+	`fmt`
+	`io`
+	`net/http`
+	`net/url`
+)
+
+func init() {
+	Register("http", newHTTP)
+	Register("https", newHTTP)
+}
+
+// httpSource streams frames from the body of an HTTP response, such as from a reader exposing the
+// serial port over HTTP. The request is made again when the response ends, at most once per
+// DefaultPollInterval, so that endpoints returning a single frame are polled.
+type httpSource struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTP(address string) (Source, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if len(u.Host) == 0 {
+		return nil, fmt.Errorf("address %q has no host", address)
+	}
+	return &httpSource{url: address, client: &http.Client{}}, nil
+}
+
+func (s *httpSource) Open(ctx context.Context) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("GET %s: %s", s.url, resp.Status)
+	}
+	return &httpStream{ReadCloser: resp.Body, cancel: cancel}, nil
+}
+
+// httpStream cancels the request when closed, as closing the body does not interrupt a blocking read.
+// The end of the body ends the poll rather than the source.
+type httpStream struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (s *httpStream) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	if err == io.EOF {
+		err = ErrPolled
+	}
+	return n, err
+}
+
+func (s *httpStream) Close() error {
+	s.cancel()
+	return s.ReadCloser.Close()
+}
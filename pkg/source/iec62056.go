@@ -0,0 +1,451 @@
+package source
+
+import (
+	`context`
+	`errors`
+	`fmt`
+	`io`
+	`net/url`
+	`regexp`
+	`strconv`
+	`strings`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+	"github.com/goburrow/serial"
+	log "github.com/sirupsen/logrus"
+)
+
+// Prefix of serial port addresses denoting a meter read with an optical probe, using IEC 62056-21 mode C.
+const iecAddressPrefix = "iec62056://"
+
+// Baud rates of mode C, indexed by the character the meter identifies its highest rate with, from '0'.
+var iecBaudRates = []int{300, 600, 1200, 2400, 4800, 9600, 19200}
+
+const (
+	iecSTX = 0x02
+	iecETX = 0x03
+	iecACK = 0x06
+)
+
+const (
+	// Time the meter takes to switch baud rate after acknowledging the identification.
+	iecSwitchDelay = 300 * time.Millisecond
+
+	// Time a readout may go without receiving anything before it is given up.
+	iecIdleTimeout = 5 * time.Second
+
+	// Largest frame the readout is encoded in; larger readouts are split into several frames.
+	iecMaxFrame = 1000
+)
+
+// Units of readout values, by their lower case form, and the power of ten they are scaled with.
+var iecUnits = map[string]struct {
+	unit   string
+	scaler int8
+}{
+	"w":     {"W", 0},
+	"kw":    {"W", 3},
+	"wh":    {"Wh", 0},
+	"kwh":   {"Wh", 3},
+	"var":   {"VAr", 0},
+	"kvar":  {"VAr", 3},
+	"varh":  {"VArh", 0},
+	"kvarh": {"VArh", 3},
+	"va":    {"VA", 0},
+	"kva":   {"VA", 3},
+	"vah":   {"VAh", 0},
+	"kvah":  {"VAh", 3},
+	"v":     {"V", 0},
+	"a":     {"A", 0},
+	"hz":    {"Hz", 0},
+}
+
+// Value groups of reduced OBIS codes given as letters.
+var iecLetters = map[string]int{"C": 96, "F": 97, "L": 98, "P": 99}
+
+// A data line holds an identifier followed by one or more values in parentheses, of which the first is used.
+var iecDataLine = regexp.MustCompile(`^([^()]+)\(([^()]*)\)`)
+
+func init() {
+	Register("iec62056", newIEC)
+}
+
+// iecSource reads a meter through an optical probe using the IEC 62056-21 mode C handshake: the
+// exporter requests a readout at 300 baud 7E1, the meter identifies itself along with the highest
+// baud rate it supports, and after acknowledging, both switch to that rate for the data readout.
+// Readouts are repeated at an interval, and passed on as frames in the same form as the HAN port
+// sends, so that they are decoded like any other source.
+//
+// The address is iec62056://DEVICE, with the optional query parameters interval, meter to address
+// a single meter on a shared bus, and max_baud to limit the baud rate of unreliable probes.
+type iecSource struct {
+	device   string
+	meter    string
+	interval time.Duration
+	maxBaud  int
+	open     func(device string, baud int) (io.ReadWriteCloser, error)
+}
+
+func newIEC(address string) (Source, error) {
+	device, query, _ := strings.Cut(strings.TrimPrefix(address, iecAddressPrefix), "?")
+	if len(device) == 0 {
+		return nil, fmt.Errorf("address %q has no device", address)
+	}
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	s := &iecSource{
+		device:   device,
+		meter:    params.Get("meter"),
+		interval: 5 * time.Minute,
+		maxBaud:  iecBaudRates[len(iecBaudRates)-1],
+		open:     openIECPort,
+	}
+	if v := params.Get("interval"); len(v) > 0 {
+		s.interval, err = time.ParseDuration(v)
+		if err != nil || s.interval <= 0 {
+			return nil, fmt.Errorf("interval must be a positive duration")
+		}
+	}
+	if v := params.Get("max_baud"); len(v) > 0 {
+		s.maxBaud, err = strconv.Atoi(v)
+		if err != nil || s.maxBaud < iecBaudRates[0] {
+			return nil, fmt.Errorf("max_baud must be at least %d", iecBaudRates[0])
+		}
+	}
+	if strings.ContainsAny(s.meter, "/?!\r\n") {
+		return nil, fmt.Errorf("invalid meter address %q", s.meter)
+	}
+	return s, nil
+}
+
+func openIECPort(device string, baud int) (io.ReadWriteCloser, error) {
+	address, err := ResolveDevice(device)
+	if err != nil {
+		return nil, err
+	}
+	return serial.Open(&serial.Config{
+		Address:  address,
+		BaudRate: baud,
+		DataBits: 7,
+		StopBits: 1,
+		Parity:   "E",
+		Timeout:  time.Second,
+	})
+}
+
+// PollInterval returns the time between readouts, which the watchdog allows for.
+func (s *iecSource) PollInterval() time.Duration {
+	return s.interval
+}
+
+func (s *iecSource) Open(ctx context.Context) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	stream := &iecStream{MessageStream: NewMessageStream(), cancel: cancel}
+	go s.poll(ctx, stream)
+	return stream, nil
+}
+
+// poll reads the meter at every interval until the stream is closed, or a readout fails.
+func (s *iecSource) poll(ctx context.Context, stream *iecStream) {
+	for {
+		regs, err := s.readout(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			stream.Fail(fmt.Errorf("readout: %w", err))
+			return
+		}
+		frames, err := iecFrames(regs)
+		if err != nil {
+			stream.Fail(err)
+			return
+		}
+		for _, frame := range frames {
+			if err := stream.Send(frame); err != nil {
+				return
+			}
+		}
+
+		t := time.NewTimer(s.interval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+type iecStream struct {
+	*MessageStream
+	cancel context.CancelFunc
+}
+
+func (s *iecStream) Close() error {
+	s.cancel()
+	return s.MessageStream.Close()
+}
+
+// readout performs the mode C handshake and returns the registers of the data readout.
+func (s *iecSource) readout(ctx context.Context) ([]protocol.Register, error) {
+	port, err := s.open(s.device, iecBaudRates[0])
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if port != nil {
+			port.Close()
+		}
+	}()
+
+	if _, err := io.WriteString(port, "/?"+s.meter+"!\r\n"); err != nil {
+		return nil, fmt.Errorf("request: %w", err)
+	}
+	r := &iecReader{ctx: ctx, r: port}
+	ident, err := r.identification()
+	if err != nil {
+		return nil, fmt.Errorf("identification: %w", err)
+	}
+	log.Debugf("Meter identification: %s", ident)
+
+	// Meters supporting mode C give their highest baud rate as a digit; any other character means 300 baud.
+	rate := 0
+	if c := ident[4]; c >= '0' && int(c-'0') < len(iecBaudRates) {
+		rate = int(c - '0')
+	}
+	for rate > 0 && iecBaudRates[rate] > s.maxBaud {
+		rate--
+	}
+	if _, err := port.Write([]byte{iecACK, '0', byte('0' + rate), '0', '\r', '\n'}); err != nil {
+		return nil, fmt.Errorf("acknowledge: %w", err)
+	}
+	if rate > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(iecSwitchDelay):
+		}
+		port.Close()
+		port, err = s.open(s.device, iecBaudRates[rate])
+		if err != nil {
+			port = nil
+			return nil, fmt.Errorf("switch to %d baud: %w", iecBaudRates[rate], err)
+		}
+		r.r = port
+	}
+
+	data, err := r.dataBlock()
+	if err != nil {
+		return nil, fmt.Errorf("data: %w", err)
+	}
+	return parseIECData(data), nil
+}
+
+// iecReader reads the responses of the meter, giving up when nothing arrives for the idle timeout.
+type iecReader struct {
+	ctx context.Context
+	r   io.Reader
+	buf [1]byte
+}
+
+func (r *iecReader) readByte() (byte, error) {
+	deadline := time.Now().Add(iecIdleTimeout)
+	for {
+		if err := r.ctx.Err(); err != nil {
+			return 0, err
+		}
+		n, err := r.r.Read(r.buf[:])
+		if n == 1 {
+			return r.buf[0], nil
+		}
+		if err != nil && !errors.Is(err, serial.ErrTimeout) {
+			return 0, err
+		}
+		if time.Now().After(deadline) {
+			return 0, fmt.Errorf("no response for %s", iecIdleTimeout)
+		}
+	}
+}
+
+// identification returns the identification line of the meter, such as /ABC5\2Meter, without the line end.
+// Lines echoed by the probe, such as the request, are skipped.
+func (r *iecReader) identification() (string, error) {
+	line := &strings.Builder{}
+	for {
+		b, err := r.readByte()
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case b == '/' && line.Len() == 0:
+			line.WriteByte(b)
+		case line.Len() == 0:
+		case b == '\n':
+			ident := strings.TrimRight(line.String(), "\r")
+			if !strings.HasPrefix(ident, "/?") && len(ident) >= 5 {
+				return ident, nil
+			}
+			line.Reset()
+		default:
+			line.WriteByte(b)
+		}
+	}
+}
+
+// dataBlock returns the contents of the data message between STX and ETX, after checking the block check character.
+func (r *iecReader) dataBlock() (string, error) {
+	for {
+		b, err := r.readByte()
+		if err != nil {
+			return "", err
+		}
+		if b == iecSTX {
+			break
+		}
+	}
+	data := &strings.Builder{}
+	var bcc byte
+	for {
+		b, err := r.readByte()
+		if err != nil {
+			return "", err
+		}
+		bcc ^= b
+		if b == iecETX {
+			break
+		}
+		data.WriteByte(b)
+	}
+	b, err := r.readByte()
+	if err != nil {
+		return "", err
+	}
+	if b != bcc {
+		return "", fmt.Errorf("block check character mismatch")
+	}
+	return data.String(), nil
+}
+
+// parseIECData returns the registers of a data readout. Lines without a known OBIS code are left out.
+func parseIECData(data string) []protocol.Register {
+	var regs []protocol.Register
+	for _, line := range strings.Split(data, "\n") {
+		m := iecDataLine.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		code, ok := iecCode(strings.TrimSpace(m[1]))
+		if !ok {
+			log.Debugf("Skipped readout line %q", line)
+			continue
+		}
+		regs = append(regs, iecRegister(code, m[2]))
+	}
+	return regs
+}
+
+// iecRegister converts a readout value, such as 001234.567*kWh, into a register. Numbers are kept
+// as integers with a scaler, so that decimal values are exact. Values of abstract codes, such as
+// the meter ID, and anything that is not a number are kept as strings.
+func iecRegister(code, value string) protocol.Register {
+	reg := protocol.Register{OBIS: code}
+	value, unit, _ := strings.Cut(value, "*")
+	if strings.HasPrefix(code, "0-") {
+		reg.Value = value
+		return reg
+	}
+	var scaler int8
+	if u, ok := iecUnits[strings.ToLower(unit)]; ok {
+		reg.Unit = u.unit
+		scaler = u.scaler
+	}
+	digits := value
+	if i := strings.IndexByte(value, '.'); i >= 0 {
+		digits = value[:i] + value[i+1:]
+		scaler -= int8(len(value) - i - 1)
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || len(value) == 0 {
+		return protocol.Register{OBIS: code, Value: value}
+	}
+	reg.Value = n
+	reg.Scaler = scaler
+	return reg
+}
+
+// iecCode converts an identifier of a readout into a full OBIS code. Identifiers are either full
+// codes such as 1-0:1.8.0*255, or reduced codes such as 1.8.0 or C.1.0, which are taken to be
+// electricity codes, or abstract codes if the value group is a letter.
+func iecCode(id string) (string, bool) {
+	groups := []int{1, 0, 0, 0, 0, 255}
+	full := strings.Contains(id, ":")
+	if full {
+		i := strings.IndexByte(id, ':')
+		a, b, ok := strings.Cut(id[:i], "-")
+		if !ok {
+			return "", false
+		}
+		var err error
+		if groups[0], err = strconv.Atoi(a); err != nil {
+			return "", false
+		}
+		if groups[1], err = strconv.Atoi(b); err != nil {
+			return "", false
+		}
+		id = id[i+1:]
+	}
+	if rest, f, ok := strings.Cut(id, "*"); ok {
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			return "", false
+		}
+		groups[5] = n
+		id = rest
+	}
+	fields := strings.Split(id, ".")
+	if len(fields) < 2 || len(fields) > 4 {
+		return "", false
+	}
+	for i, field := range fields {
+		n, ok := iecLetters[field]
+		if ok && i == 0 && !full {
+			groups[0] = 0
+		}
+		if !ok {
+			var err error
+			if n, err = strconv.Atoi(field); err != nil {
+				return "", false
+			}
+		}
+		groups[2+i] = n
+	}
+	for _, n := range groups {
+		if n < 0 || n > 255 {
+			return "", false
+		}
+	}
+	return fmt.Sprintf("%d-%d:%d.%d.%d.%d", groups[0], groups[1], groups[2], groups[3], groups[4], groups[5]), true
+}
+
+// iecFrames encodes registers in as few frames as the decoder accepts.
+func iecFrames(regs []protocol.Register) ([][]byte, error) {
+	var frames [][]byte
+	for start := 0; start < len(regs); {
+		end := len(regs)
+		frame, err := protocol.EncodeFrame(regs[start:end])
+		for err == nil && len(frame) > iecMaxFrame && end-start > 1 {
+			end = start + (end-start)/2
+			frame, err = protocol.EncodeFrame(regs[start:end])
+		}
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+		start = end
+	}
+	return frames, nil
+}
@@ -0,0 +1,92 @@
+package source
+
+import (
+	`bytes`
+	`io`
+
+	log "github.com/sirupsen/logrus"
+)
+
+// HDLC flag byte delimiting frames.
+const hdlcFlag = 0x7e
+
+// Frame format type 3 in the high nibble of the frame format field, as sent by all DLMS meters.
+const frameFormatType3 = 0xa
+
+// MessageStream turns messages, such as UDP datagrams or MQTT payloads, into a stream of frames for
+// sources whose transport is not a byte stream. A message holds either a single frame without flag
+// bytes, which are added, or one or more frames delimited by flag bytes. A frame cut short at the end
+// of a message is dropped, as it would otherwise swallow the start of the next message.
+type MessageStream struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+}
+
+func NewMessageStream() *MessageStream {
+	r, w := io.Pipe()
+	return &MessageStream{r: r, w: w}
+}
+
+// Send adds a message to the stream, blocking until it has been read. It fails after the stream is closed.
+func (s *MessageStream) Send(msg []byte) error {
+	if len(msg) == 0 {
+		return nil
+	}
+	if msg[0] != hdlcFlag {
+		framed := make([]byte, 0, len(msg)+2)
+		framed = append(framed, hdlcFlag)
+		framed = append(framed, msg...)
+		msg = append(framed, hdlcFlag)
+	}
+	if complete := trimPartial(msg); len(complete) < len(msg) {
+		log.Debugf("Dropped %d bytes of a frame cut short at the end of a message", len(msg)-len(complete))
+		msg = complete
+	}
+	_, err := s.w.Write(msg)
+	return err
+}
+
+// trimPartial returns a message up to and including the opening flag of a frame that does not fit within it,
+// according to the length in its frame format field. Messages ending in complete frames are returned as is.
+func trimPartial(msg []byte) []byte {
+	i := 0
+	for {
+		n := bytes.IndexByte(msg[i:], hdlcFlag)
+		if n < 0 {
+			return msg
+		}
+		start := i + n
+		if start+2 >= len(msg) {
+			return msg[:start+1]
+		}
+		if msg[start+1]>>4 != frameFormatType3 {
+			i = start + 1
+			continue
+		}
+		end := start + 1 + (int(msg[start+1]&0x07)<<8 | int(msg[start+2]))
+		switch {
+		case end >= len(msg):
+			return msg[:start+1]
+		case msg[end] == hdlcFlag:
+			// The closing flag may open the next frame.
+			i = end
+		default:
+			i = start + 1
+		}
+	}
+}
+
+func (s *MessageStream) Read(p []byte) (int, error) {
+	return s.r.Read(p)
+}
+
+// Fail ends the stream, so that reading returns the error once the messages already sent have been read.
+func (s *MessageStream) Fail(err error) {
+	s.w.CloseWithError(err)
+}
+
+// Close ends the stream, interrupting any blocking read or send.
+func (s *MessageStream) Close() error {
+	s.w.Close()
+	return s.r.Close()
+}
@@ -0,0 +1,263 @@
+package source
+
+import (
+	`context`
+	`errors`
+	`fmt`
+	`io`
+	`sync`
+	`time`
+
+	`github.com/prometheus/client_golang/prometheus`
+	log "github.com/sirupsen/logrus"
+)
+
+// Delays before opening a source again after it failed. The delay doubles with every failure
+// until data is read.
+const (
+	minRetryInterval = time.Second
+	maxRetryInterval = 30 * time.Second
+)
+
+// ErrClosed is returned when reading from a closed reader.
+var ErrClosed = errors.New("source closed")
+
+// Metrics counts connections, failures and bytes read for each source.
+type Metrics struct {
+	connects *prometheus.CounterVec
+	failures *prometheus.CounterVec
+	bytes    *prometheus.CounterVec
+	up       *prometheus.GaugeVec
+}
+
+// NewMetrics returns source metrics with names prefixed by the namespace.
+func NewMetrics(namespace string) *Metrics {
+	counter := func(name, help string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      name,
+			Help:      help,
+		}, []string{"source"})
+	}
+	return &Metrics{
+		connects: counter("source_connects_total", "Total number of times an input source was opened"),
+		failures: counter("source_errors_total", "Total number of failures to open or read from an input source"),
+		bytes:    counter("source_read_bytes_total", "Total number of bytes read from an input source"),
+		up: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "source_up",
+			Help:      "Whether an input source is open",
+		}, []string{"source"}),
+	}
+}
+
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.connects.Describe(ch)
+	m.failures.Describe(ch)
+	m.bytes.Describe(ch)
+	m.up.Describe(ch)
+}
+
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.connects.Collect(ch)
+	m.failures.Collect(ch)
+	m.bytes.Collect(ch)
+	m.up.Collect(ch)
+}
+
+// Reader reads a source as a single byte stream. The source is opened on the first read, and again
+// on the next read after the stream fails, waiting longer between each failed attempt. Errors with
+// a Timeout method reporting true, such as serial port read timeouts, leave the stream open.
+// After a stream returns ErrDone, reading returns io.EOF. After a stream returns ErrPolled, the source
+// is opened again once the poll interval has passed since it was last opened.
+type Reader struct {
+	name    string
+	src     Source
+	metrics *Metrics
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	mu      sync.Mutex
+	stream  io.ReadCloser
+	retry   time.Duration
+	opened  time.Time
+	done    bool
+	closed  bool
+	started bool
+}
+
+// NewReader returns a reader of the source. The name identifies the source in logs and metrics.
+func NewReader(name string, src Source, metrics *Metrics) *Reader {
+	ctx, cancel := context.WithCancel(context.Background())
+	metrics.connects.WithLabelValues(name)
+	metrics.failures.WithLabelValues(name)
+	metrics.bytes.WithLabelValues(name)
+	metrics.up.WithLabelValues(name)
+	return &Reader{
+		name:    name,
+		src:     src,
+		metrics: metrics,
+		ctx:     ctx,
+		cancel:  cancel,
+		retry:   minRetryInterval,
+	}
+}
+
+// Connect opens the source unless it is already open.
+func (r *Reader) Connect() error {
+	_, err := r.current()
+	return err
+}
+
+// current returns the open stream, opening the source if necessary.
+func (r *Reader) current() (io.ReadCloser, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case r.closed:
+		return nil, ErrClosed
+	case r.done:
+		return nil, io.EOF
+	case r.stream != nil:
+		return r.stream, nil
+	}
+	stream, err := r.src.Open(r.ctx)
+	r.opened = time.Now()
+	if err != nil {
+		r.metrics.failures.WithLabelValues(r.name).Inc()
+		return nil, fmt.Errorf("open %s: %w", r.name, err)
+	}
+	if r.started {
+		log.Infof("Reopened %s", r.name)
+	}
+	r.started = true
+	r.stream = stream
+	r.metrics.connects.WithLabelValues(r.name).Inc()
+	r.metrics.up.WithLabelValues(r.name).Set(1)
+	return stream, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	stream, err := r.current()
+	if err != nil {
+		if !errors.Is(err, ErrClosed) && !errors.Is(err, io.EOF) {
+			r.wait()
+		}
+		return 0, err
+	}
+
+	n, err := stream.Read(p)
+	if n < 0 {
+		n = 0
+	}
+	r.metrics.bytes.WithLabelValues(r.name).Add(float64(n))
+	if n > 0 {
+		r.mu.Lock()
+		r.retry = minRetryInterval
+		r.mu.Unlock()
+	}
+
+	var timeout interface{ Timeout() bool }
+	switch {
+	case err == nil:
+		return n, nil
+	case errors.Is(err, ErrDone):
+		r.reset(stream, true)
+		log.Infof("Read all of %s", r.name)
+		return n, io.EOF
+	case errors.Is(err, ErrPolled):
+		r.reset(stream, false)
+		r.waitPoll()
+		return n, nil
+	case errors.As(err, &timeout) && timeout.Timeout():
+		return n, err
+	}
+
+	r.mu.Lock()
+	closed := r.closed
+	r.mu.Unlock()
+	if closed {
+		return n, ErrClosed
+	}
+	r.metrics.failures.WithLabelValues(r.name).Inc()
+	r.reset(stream, false)
+	return n, fmt.Errorf("read %s: %w", r.name, err)
+}
+
+// wait delays the next attempt to open the source, unless the reader is closed first.
+func (r *Reader) wait() {
+	r.mu.Lock()
+	delay := r.retry
+	r.retry *= 2
+	if r.retry > maxRetryInterval {
+		r.retry = maxRetryInterval
+	}
+	r.mu.Unlock()
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-r.ctx.Done():
+	}
+}
+
+// waitPoll delays polling the source again until the poll interval has passed since it was last opened,
+// unless the reader is closed first.
+func (r *Reader) waitPoll() {
+	interval := DefaultPollInterval
+	if poller, ok := r.src.(Poller); ok {
+		interval = poller.PollInterval()
+	}
+	r.mu.Lock()
+	delay := time.Until(r.opened.Add(interval))
+	r.mu.Unlock()
+	if delay <= 0 {
+		return
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-r.ctx.Done():
+	}
+}
+
+// reset closes the stream if it is still the current one, and marks the source as done if it has no more data.
+func (r *Reader) reset(stream io.ReadCloser, done bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.done = r.done || done
+	if r.stream == stream {
+		stream.Close()
+		r.stream = nil
+		r.metrics.up.WithLabelValues(r.name).Set(0)
+	}
+}
+
+// Reopen closes the stream, which is opened again on the next read. It is used when
+// the source seems to be connected, but no longer delivers valid frames.
+func (r *Reader) Reopen() {
+	r.mu.Lock()
+	stream := r.stream
+	r.mu.Unlock()
+	if stream != nil {
+		r.reset(stream, false)
+	}
+}
+
+// Close closes the source, interrupting any blocking read.
+func (r *Reader) Close() error {
+	r.cancel()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	if r.stream == nil {
+		return nil
+	}
+	err := r.stream.Close()
+	r.stream = nil
+	r.metrics.up.WithLabelValues(r.name).Set(0)
+	return err
+}
@@ -0,0 +1,120 @@
+// Package source defines the transports delivering HDLC frames from the meter, such as a serial port,
+// a TCP connection or an MQTT topic, and reads from them with reconnection and metrics.
+//
+// Transports are registered by the scheme of their addresses, such as tcp in tcp://host:port,
+// usually from the init function of the package implementing them. The decoder reads every
+// transport as a byte stream, so adding one does not require changes to the decode pipeline.
+package source
+
+import (
+	`context`
+	`errors`
+	`fmt`
+	`io`
+	`sort`
+	`strings`
+	`sync`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+)
+
+// ErrDone is returned by streams that have no more data, such as a file read to the end.
+// The source is not opened again after it.
+var ErrDone = errors.New("no more data")
+
+// ErrPolled is returned by streams that delivered all there is for now, such as the response to a polled
+// HTTP request. The source is opened again after the poll interval of the source, if it is a Poller,
+// or after DefaultPollInterval otherwise.
+var ErrPolled = errors.New("end of poll")
+
+// DefaultPollInterval is the interval the meter sends frames at, which sources are polled at unless they are Pollers.
+const DefaultPollInterval = 2500 * time.Millisecond
+
+// Source is a transport delivering HDLC frames.
+type Source interface {
+	// Open connects to the transport, and returns a stream of bytes carrying frames. Open is called
+	// again after reading from the stream fails, so sources need not reconnect by themselves.
+	// Closing the stream must interrupt a blocking read.
+	Open(ctx context.Context) (io.ReadCloser, error)
+}
+
+// Poller is implemented by sources that deliver frames at long intervals, such as by polling a meter
+// rather than receiving the frames it pushes every few seconds.
+type Poller interface {
+	PollInterval() time.Duration
+}
+
+// Deduplicator is implemented by sources that drop data received more than once, such as retransmitted datagrams.
+type Deduplicator interface {
+	// Duplicates returns the number of times data was dropped.
+	Duplicates() float64
+}
+
+// Reorderer is implemented by sources that may deliver frames in another order than the meter sent them.
+type Reorderer interface {
+	// Late reports whether a decoded frame was overtaken by one the meter sent later, and should be dropped.
+	Late(packet *protocol.Packet) bool
+}
+
+// ResolveDevice maps the device of a source reading a serial port to the path it is opened with, such as
+// a USB adapter given by its position. It returns the device as is unless replaced.
+var ResolveDevice = func(device string) (string, error) {
+	return device, nil
+}
+
+// Factory creates a source from its address. Factories should validate the address, as they are
+// called when the configuration is validated, but should not connect anywhere.
+type Factory func(address string) (Source, error)
+
+var (
+	mu        sync.Mutex
+	factories = make(map[string]Factory)
+)
+
+// Register makes a transport available for addresses with the scheme. It panics if the scheme is already registered.
+func Register(scheme string, factory Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := factories[scheme]; ok {
+		panic(fmt.Sprintf("source: scheme %s registered twice", scheme))
+	}
+	factories[scheme] = factory
+}
+
+// Schemes returns the registered schemes, in alphabetical order.
+func Schemes() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	schemes := make([]string, 0, len(factories))
+	for scheme := range factories {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Scheme returns the scheme of an address, or nothing if it has none, such as for a device file.
+// The address - denotes standard input, with the scheme stdin.
+func Scheme(address string) string {
+	if address == "-" {
+		return "stdin"
+	}
+	i := strings.Index(address, "://")
+	if i <= 0 {
+		return ""
+	}
+	return address[:i]
+}
+
+// New creates a source for an address with a registered scheme.
+func New(address string) (Source, error) {
+	scheme := Scheme(address)
+	mu.Lock()
+	factory, ok := factories[scheme]
+	mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown scheme in address %q", address)
+	}
+	return factory(address)
+}
@@ -0,0 +1,300 @@
+package source
+
+import (
+	`bytes`
+	`context`
+	`fmt`
+	`io`
+	`net`
+	`net/http`
+	`net/http/httptest`
+	`os`
+	`path/filepath`
+	`strings`
+	`sync/atomic`
+	`testing`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/obis`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+	"github.com/goburrow/serial"
+	`github.com/prometheus/client_golang/prometheus/testutil`
+	`github.com/stretchr/testify/assert`
+)
+
+func TestTrimPartial(t *testing.T) {
+	frame := []byte{hdlcFlag, 0xa0, 0x07, 0x01, 0x02, 0x03, 0x04, 0x05, hdlcFlag}
+	assert.Equal(t, frame, trimPartial(frame))
+
+	// A frame cut short is dropped, keeping the flag closing the previous one.
+	msg := append(append([]byte(nil), frame...), 0xa0, 0x07, 0x01)
+	assert.Equal(t, frame, trimPartial(msg))
+	assert.Equal(t, []byte{hdlcFlag}, trimPartial(frame[:5]))
+
+	// Bytes outside of frames are left for the decoder to count.
+	msg = append([]byte{0x01, 0x02}, frame...)
+	assert.Equal(t, msg, trimPartial(msg))
+}
+
+// polled sets the poll interval of a source.
+type polled struct {
+	Source
+	interval time.Duration
+}
+
+func (s polled) PollInterval() time.Duration {
+	return s.interval
+}
+
+func TestHTTPPolling(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "frame %d", atomic.AddInt32(&requests, 1))
+	}))
+	defer server.Close()
+
+	src, err := New(server.URL)
+	assert.NoError(t, err)
+	metrics := NewMetrics("ams")
+	r := NewReader("http", polled{Source: src, interval: 50 * time.Millisecond}, metrics)
+	defer r.Close()
+
+	// The end of each response ends a poll rather than failing the source, and the next poll waits for the interval.
+	start := time.Now()
+	var data []byte
+	for len(data) < len("frame 1frame 2") {
+		buf := make([]byte, 64)
+		n, err := r.Read(buf)
+		assert.NoError(t, err)
+		data = append(data, buf[:n]...)
+	}
+	assert.Equal(t, "frame 1frame 2", string(data))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	err = testutil.CollectAndCompare(metrics, strings.NewReader(`
+# HELP ams_source_errors_total Total number of failures to open or read from an input source
+# TYPE ams_source_errors_total counter
+ams_source_errors_total{source="http"} 0
+`), "ams_source_errors_total")
+	assert.NoError(t, err)
+}
+
+func TestFileSource(t *testing.T) {
+	frame, err := protocol.EncodeFrame([]protocol.Register{
+		{OBIS: "1-0:1.7.0.255", Value: uint32(1234), Unit: "W"},
+	})
+	assert.NoError(t, err)
+	metrics := NewMetrics("ams")
+
+	// Files are read once, and end with EOF.
+	path := filepath.Join(t.TempDir(), "frames")
+	stream := append(append([]byte{hdlcFlag}, frame...), hdlcFlag)
+	assert.NoError(t, os.WriteFile(path, append(stream, stream...), 0o644))
+	src, err := New("file://" + path)
+	assert.NoError(t, err)
+	dec := protocol.NewDecoder(NewReader("file", src, metrics))
+	for i := 0; i < 2; i++ {
+		packet, err := dec.NextPacket()
+		if assert.NoError(t, err) {
+			assert.Equal(t, frame, packet.Frame)
+		}
+	}
+	_, err = dec.NextPacket()
+	assert.Equal(t, io.EOF, err)
+
+	err = testutil.CollectAndCompare(metrics, strings.NewReader(`
+# HELP ams_source_connects_total Total number of times an input source was opened
+# TYPE ams_source_connects_total counter
+ams_source_connects_total{source="file"} 1
+`), "ams_source_connects_total")
+	assert.NoError(t, err)
+
+	_, err = New("gopher://example.com")
+	assert.Error(t, err)
+}
+
+func TestStdinClose(t *testing.T) {
+	r, w, err := os.Pipe()
+	assert.NoError(t, err)
+	defer w.Close()
+	src := &stdinSource{in: r}
+	input := NewReader("stdin", src, NewMetrics("ams"))
+
+	w.Write([]byte("frame"))
+	buf := make([]byte, 3)
+	n, err := input.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "fra", string(buf[:n]))
+	n, err = input.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "me", string(buf[:n]))
+
+	// Closing the reader interrupts a read blocked on input that never comes.
+	read := make(chan error, 1)
+	go func() {
+		_, err := input.Read(buf)
+		read <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	input.Close()
+	select {
+	case <-read:
+	case <-time.After(5 * time.Second):
+		t.Fatal("read was not interrupted")
+	}
+}
+
+func TestDuplicateFilter(t *testing.T) {
+	filter := newDuplicateFilter()
+	now := time.Now()
+	assert.False(t, filter.seen([]byte{1, 2, 3}, now))
+	assert.True(t, filter.seen([]byte{1, 2, 3}, now.Add(100*time.Millisecond)))
+	assert.False(t, filter.seen([]byte{1, 2, 4}, now.Add(200*time.Millisecond)))
+	assert.False(t, filter.seen([]byte{1, 2, 3}, now.Add(DefaultPollInterval)))
+}
+
+func TestClockOrder(t *testing.T) {
+	at := func(hour, minute, second uint8) *protocol.Packet {
+		clock := protocol.DateTime{Year: 2022, Month: 10, Day: 30, Hour: hour, Minute: minute, Second: second, Deviation: protocol.DeviationUnspecified}
+		return &protocol.Packet{Registers: map[string]protocol.Register{obis.Clock: {OBIS: obis.Clock, Value: clock}}}
+	}
+	order := &clockOrder{}
+	assert.False(t, order.late(at(2, 0, 10)))
+	assert.False(t, order.late(at(2, 0, 30)))
+	assert.True(t, order.late(at(2, 0, 20)))
+	assert.False(t, order.late(&protocol.Packet{}))
+	assert.False(t, order.late(at(2, 0, 40)))
+
+	// Clocks set back further, as at the end of daylight saving time, are followed.
+	assert.False(t, order.late(at(1, 0, 50)))
+	assert.True(t, order.late(at(1, 0, 45)))
+}
+
+func TestUDPSource(t *testing.T) {
+	frame, err := protocol.EncodeFrame([]protocol.Register{
+		{OBIS: "1-0:1.7.0.255", Value: uint32(1234), Unit: "W"},
+	})
+	assert.NoError(t, err)
+	metrics := NewMetrics("ams")
+
+	// Datagrams hold frames with or without flags, and retransmissions are dropped.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	address := conn.LocalAddr().String()
+	conn.Close()
+	src, err := New("udp://" + address)
+	assert.NoError(t, err)
+	input := NewReader("udp", src, metrics)
+	defer input.Close()
+	assert.NoError(t, input.Connect())
+	client, err := net.Dial("udp", address)
+	assert.NoError(t, err)
+	defer client.Close()
+	client.Write(frame)
+	client.Write(frame)
+	dec := protocol.NewDecoder(input)
+	packet, err := dec.NextPacket()
+	if assert.NoError(t, err) {
+		assert.Equal(t, frame, packet.Frame)
+	}
+	assert.Eventually(t, func() bool {
+		return src.(Deduplicator).Duplicates() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// A datagram cut short does not corrupt the next one.
+	next, err := protocol.EncodeFrame([]protocol.Register{
+		{OBIS: "1-0:1.7.0.255", Value: uint32(4321), Unit: "W"},
+	})
+	assert.NoError(t, err)
+	client.Write(next[:10])
+	client.Write(next)
+	packet, err = dec.NextPacket()
+	if assert.NoError(t, err) {
+		assert.Equal(t, next, packet.Frame)
+	}
+
+	err = testutil.CollectAndCompare(metrics, strings.NewReader(`
+# HELP ams_source_connects_total Total number of times an input source was opened
+# TYPE ams_source_connects_total counter
+ams_source_connects_total{source="udp"} 1
+`), "ams_source_connects_total")
+	assert.NoError(t, err)
+
+	_, err = New("udp://missing-port")
+	assert.Error(t, err)
+}
+
+// fakeProbe answers IEC 62056-21 mode C requests like a meter behind an optical probe, echoing what is sent.
+type fakeProbe struct {
+	out  bytes.Buffer
+	data string
+}
+
+func (p *fakeProbe) Write(b []byte) (int, error) {
+	p.out.Write(b)
+	switch {
+	case strings.HasPrefix(string(b), "/?"):
+		p.out.WriteString("/ABC5\\2TEST\r\n")
+	case b[0] == iecACK:
+		block := p.data + "!\r\n" + string(rune(iecETX))
+		var bcc byte
+		for i := 0; i < len(block); i++ {
+			bcc ^= block[i]
+		}
+		p.out.WriteByte(iecSTX)
+		p.out.WriteString(block)
+		p.out.WriteByte(bcc)
+	}
+	return len(b), nil
+}
+
+func (p *fakeProbe) Read(b []byte) (int, error) {
+	if p.out.Len() == 0 {
+		return 0, serial.ErrTimeout
+	}
+	return p.out.Read(b)
+}
+
+func (p *fakeProbe) Close() error { return nil }
+
+func TestIECReadout(t *testing.T) {
+	src, err := New("iec62056:///dev/ttyUSB1?interval=1h&max_baud=4800")
+	assert.NoError(t, err)
+	iec := src.(*iecSource)
+	assert.Equal(t, time.Hour, iec.PollInterval())
+
+	probe := &fakeProbe{data: "C.1.0(7359992895803632)\r\n1.8.0(001234.567*kWh)\r\n1-0:2.8.0*255(000012.5*kWh)\r\n32.7.0(230.1*V)\r\nF.F(00000000)\r\n"}
+	var bauds []int
+	iec.open = func(device string, baud int) (io.ReadWriteCloser, error) {
+		assert.Equal(t, "/dev/ttyUSB1", device)
+		bauds = append(bauds, baud)
+		return probe, nil
+	}
+	regs, err := iec.readout(context.Background())
+	assert.NoError(t, err)
+	// The meter offers 9600 baud, limited to 4800 by max_baud.
+	assert.Equal(t, []int{300, 4800}, bauds)
+	assert.Equal(t, []protocol.Register{
+		{OBIS: obis.MeterID, Value: "7359992895803632"},
+		{OBIS: obis.ActiveEnergyImport, Value: int64(1234567), Unit: "Wh"},
+		{OBIS: obis.ActiveEnergyExport, Value: int64(125), Scaler: 2, Unit: "Wh"},
+		{OBIS: "1-0:32.7.0.255", Value: int64(2301), Scaler: -1, Unit: "V"},
+		{OBIS: "0-0:97.97.0.255", Value: "00000000"},
+	}, regs)
+
+	frames, err := iecFrames(regs)
+	assert.NoError(t, err)
+	if assert.Len(t, frames, 1) {
+		packet, err := protocol.DecodeFrame(frames[0])
+		assert.NoError(t, err)
+		energy, err := packet.Registers[obis.ActiveEnergyExport].Float()
+		assert.NoError(t, err)
+		assert.Equal(t, 12500.0, energy)
+	}
+
+	_, err = New("iec62056://")
+	assert.Error(t, err)
+	_, err = New("iec62056:///dev/ttyUSB1?max_baud=100")
+	assert.Error(t, err)
+}
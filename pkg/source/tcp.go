@@ -0,0 +1,40 @@
+package source
+
+import (
+	`context`
+	`fmt`
+	`io`
+	`net`
+	`strings`
+	`time`
+)
+
+// Time allowed for establishing a TCP connection.
+const dialTimeout = 10 * time.Second
+
+func init() {
+	Register("tcp", newTCP)
+}
+
+// tcpSource reads frames from a TCP server, such as the frame relay of another exporter,
+// or a serial-to-network bridge like ser2net.
+type tcpSource struct {
+	address string
+}
+
+func newTCP(address string) (Source, error) {
+	hostport := strings.TrimPrefix(address, "tcp://")
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		return nil, err
+	}
+	return &tcpSource{address: hostport}, nil
+}
+
+func (s *tcpSource) Open(ctx context.Context) (io.ReadCloser, error) {
+	dialer := net.Dialer{Timeout: dialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.address)
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", s.address, err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,149 @@
+package source
+
+import (
+	`context`
+	`hash/fnv`
+	`io`
+	`net`
+	`strings`
+	`sync`
+	`sync/atomic`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/obis`
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/protocol`
+	log "github.com/sirupsen/logrus"
+)
+
+// Identical datagrams arriving closer than this are retransmissions, since the meter
+// never sends frames this often.
+const duplicateWindow = DefaultPollInterval / 2
+
+// Frames with a meter clock at most this far behind the latest one seen were overtaken on the way.
+// Clocks further behind were set back, such as at the end of daylight saving time.
+const reorderWindow = time.Minute
+
+// duplicateFilter recognizes datagrams that have recently been received.
+type duplicateFilter struct {
+	recent map[uint64]time.Time
+}
+
+func newDuplicateFilter() *duplicateFilter {
+	return &duplicateFilter{
+		recent: make(map[uint64]time.Time),
+	}
+}
+
+// seen reports whether the data was received within the duplicate window, and remembers it.
+func (f *duplicateFilter) seen(data []byte, now time.Time) bool {
+	h := fnv.New64a()
+	h.Write(data)
+	sum := h.Sum64()
+
+	for k, t := range f.recent {
+		if now.Sub(t) >= duplicateWindow {
+			delete(f.recent, k)
+		}
+	}
+	_, dup := f.recent[sum]
+	f.recent[sum] = now
+	return dup
+}
+
+// clockOrder recognizes frames overtaken by frames the meter sent later, from the meter clock sent with
+// list2 and list3 messages. Frames without a clock, such as list1 messages, cannot be ordered, and pass.
+type clockOrder struct {
+	mu     sync.Mutex
+	latest time.Time
+}
+
+// late reports whether a packet carries a meter clock behind one already seen, and remembers it otherwise.
+func (o *clockOrder) late(packet *protocol.Packet) bool {
+	clock, ok := packet.Registers[obis.Clock].Value.(protocol.DateTime)
+	if !ok {
+		return false
+	}
+	t := clock.Time(time.UTC)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if behind := o.latest.Sub(t); behind > 0 && behind <= reorderWindow {
+		return true
+	}
+	o.latest = t
+	return false
+}
+
+func init() {
+	Register("udp", newUDP)
+}
+
+// udpSource receives frames from a remote reader as UDP datagrams. Each datagram holds a single frame,
+// with or without flag bytes, or several frames delimited by flags. Retransmitted datagrams are dropped.
+// Frames from the Aidon meter carry no sequence numbers, so datagrams are processed in the order received,
+// except that frames with a meter clock behind an earlier frame are reported as late once decoded.
+type udpSource struct {
+	address    string
+	duplicates uint64
+	order      clockOrder
+}
+
+func newUDP(address string) (Source, error) {
+	hostport := strings.TrimPrefix(address, "udp://")
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		return nil, err
+	}
+	return &udpSource{address: hostport}, nil
+}
+
+func (s *udpSource) Open(ctx context.Context) (io.ReadCloser, error) {
+	conn, err := net.ListenPacket("udp", s.address)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Listening for frames on %s", conn.LocalAddr())
+	stream := &udpStream{MessageStream: NewMessageStream(), conn: conn}
+	go s.receive(stream)
+	return stream, nil
+}
+
+// Duplicates returns the number of retransmitted datagrams dropped.
+func (s *udpSource) Duplicates() float64 {
+	return float64(atomic.LoadUint64(&s.duplicates))
+}
+
+// Late reports whether a decoded frame was overtaken by a frame the meter sent later.
+func (s *udpSource) Late(packet *protocol.Packet) bool {
+	return s.order.late(packet)
+}
+
+// receive passes datagrams on to the stream until the connection is closed.
+func (s *udpSource) receive(stream *udpStream) {
+	buf := make([]byte, 64*1024)
+	filter := newDuplicateFilter()
+	for {
+		n, addr, err := stream.conn.ReadFrom(buf)
+		if err != nil {
+			stream.Fail(err)
+			return
+		}
+		if filter.seen(buf[:n], time.Now()) {
+			log.Debugf("Dropped duplicate datagram from %s", addr)
+			atomic.AddUint64(&s.duplicates, 1)
+			continue
+		}
+		if err := stream.Send(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+type udpStream struct {
+	*MessageStream
+	conn net.PacketConn
+}
+
+func (s *udpStream) Close() error {
+	s.MessageStream.Close()
+	return s.conn.Close()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	`context`
+	`fmt`
+	`os`
+	`os/signal`
+	`strconv`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/exporter`
+)
+
+// Number of frames recorded if no count is given.
+const defaultRecordCount = 10
+
+// runRecord saves frames read from the serial port to a corpus directory, for use as regression
+// fixtures. The arguments are the directory and optionally the number of frames. It returns the exit status.
+func runRecord(args []string) int {
+	w := os.Stdout
+	if len(args) < 1 || len(args) > 2 {
+		commandFlags.Usage()
+		return 2
+	}
+	count := defaultRecordCount
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n <= 0 {
+			fmt.Fprintf(w, "Invalid frame count %q\n", args[1])
+			return 2
+		}
+		count = n
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(w, "Load configuration: %s\n", err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	saved, err := exporter.RecordCorpus(ctx, cfg, args[0], count)
+	fmt.Fprintf(w, "Saved %d frames to %s\n", saved, args[0])
+	if err != nil {
+		fmt.Fprintf(w, "Record: %s\n", err)
+		return 1
+	}
+	if saved < count {
+		return 1
+	}
+	return 0
+}
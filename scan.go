@@ -0,0 +1,55 @@
+package main
+
+import (
+	`context`
+	`fmt`
+	`io`
+	"os"
+	`os/signal`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/exporter`
+)
+
+// runScan probes the given serial devices, or all likely ones, and prints the settings
+// that work as a command line and configuration snippet. It returns the exit status.
+func runScan(devices []string) int {
+	w := os.Stdout
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	results := exporter.Scan(ctx, devices)
+	if len(results) == 0 {
+		fmt.Fprintln(w, "No serial devices found.")
+		return 1
+	}
+
+	found := false
+	for _, result := range results {
+		switch {
+		case result.Found:
+			found = true
+			printSettings(w, result.Settings)
+		case result.Err != nil:
+			fmt.Fprintf(w, "%s: %s\n\n", result.Settings.Address, result.Err)
+		default:
+			fmt.Fprintf(w, "%s: no valid frames received with any common setting\n\n", result.Settings.Address)
+		}
+	}
+	if !found {
+		return 1
+	}
+	return 0
+}
+
+func printSettings(w io.Writer, settings exporter.SerialConfig) {
+	fmt.Fprintf(w, "%s: valid frames received with %s\n\n", settings.Address, settings)
+	fmt.Fprintf(w, "Command line:\n\n    %s -a %s -b %d -d %d -s %d -p %s\n\n",
+		os.Args[0], settings.Address, settings.BaudRate, settings.DataBits, settings.StopBits, settings.Parity)
+	fmt.Fprintf(w, "Configuration file:\n\n")
+	fmt.Fprintf(w, "    serial:\n")
+	fmt.Fprintf(w, "      address: %s\n", settings.Address)
+	fmt.Fprintf(w, "      baud_rate: %d\n", settings.BaudRate)
+	fmt.Fprintf(w, "      data_bits: %d\n", settings.DataBits)
+	fmt.Fprintf(w, "      stop_bits: %d\n", settings.StopBits)
+	fmt.Fprintf(w, "      parity: %s\n\n", settings.Parity)
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+
+package main
+
+import (
+	`errors`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/exporter`
+)
+
+var errNoService = errors.New("services are only supported on Windows")
+
+func installService(args []string) error {
+	return errNoService
+}
+
+func removeService() error {
+	return errNoService
+}
+
+func runService(cfg exporter.Config) (bool, error) {
+	return false, nil
+}
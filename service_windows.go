@@ -0,0 +1,151 @@
+package main
+
+import (
+	`context`
+	`fmt`
+	`os`
+	`path/filepath`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/exporter`
+	log "github.com/sirupsen/logrus"
+	`golang.org/x/sys/windows/svc`
+	`golang.org/x/sys/windows/svc/eventlog`
+	`golang.org/x/sys/windows/svc/mgr`
+)
+
+const (
+	serviceName        = "ams-exporter"
+	serviceDisplayName = "Aidon AMS Prometheus exporter"
+	eventID            = 1
+)
+
+// installService registers the exporter as an automatically started Windows service,
+// passing it the given command line options.
+func installService(args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	exe, err = filepath.Abs(exe)
+	if err != nil {
+		return err
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: serviceDisplayName,
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	err = eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info)
+	if err != nil {
+		s.Delete()
+		return fmt.Errorf("install event log source: %w", err)
+	}
+	return nil
+}
+
+// removeService unregisters the Windows service.
+func removeService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	err = s.Delete()
+	if err != nil {
+		return err
+	}
+	return eventlog.Remove(serviceName)
+}
+
+// runService runs the exporter under the Windows service control manager,
+// returning false if the process was not started as a service.
+func runService(cfg exporter.Config) (bool, error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false, err
+	}
+
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		return true, err
+	}
+	defer elog.Close()
+	log.AddHook(&eventLogHook{elog: elog})
+
+	return true, svc.Run(serviceName, &service{cfg: cfg})
+}
+
+type service struct {
+	cfg exporter.Config
+}
+
+func (s *service) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- exporter.Run(ctx, s.cfg)
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				log.Errorf("%s", err)
+				return true, 1
+			}
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				cancel()
+			}
+		}
+	}
+}
+
+// eventLogHook forwards log messages to the Windows event log.
+type eventLogHook struct {
+	elog *eventlog.Log
+}
+
+func (h *eventLogHook) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel, log.WarnLevel, log.InfoLevel}
+}
+
+func (h *eventLogHook) Fire(entry *log.Entry) error {
+	switch entry.Level {
+	case log.InfoLevel:
+		return h.elog.Info(eventID, entry.Message)
+	case log.WarnLevel:
+		return h.elog.Warning(eventID, entry.Message)
+	default:
+		return h.elog.Error(eventID, entry.Message)
+	}
+}
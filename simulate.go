@@ -0,0 +1,70 @@
+package main
+
+import (
+	`context`
+	`flag`
+	`fmt`
+	`io`
+	`os`
+	`os/signal`
+	`time`
+
+	`github.com/ambientsound/aidon-ams-prometheus-exporter/pkg/exporter`
+)
+
+var (
+	simulateOutput  string
+	simulateMeterID string
+	simulateSeed    int64
+	simulateSpeed   float64
+	simulateCount   int
+)
+
+// simulateOptions adds the options of the simulate command.
+func simulateOptions(fs *flag.FlagSet) {
+	fs.StringVar(&simulateOutput, "o", "-", "file or device receiving the frames, or - for standard output")
+	fs.StringVar(&simulateMeterID, "meter-id", "7359992890000000", "meter ID of the simulated meter")
+	fs.Int64Var(&simulateSeed, "seed", 0, "seed of the simulated power consumption, random if 0")
+	fs.Float64Var(&simulateSpeed, "speed", 1, "how many times faster than a real meter frames are written")
+	fs.IntVar(&simulateCount, "count", 0, "number of frames to write, unlimited if 0")
+}
+
+// runSimulate writes frames from a simulated meter, which the exporter can read in place of a serial port.
+// It returns the exit status.
+func runSimulate(args []string) int {
+	if len(args) > 0 {
+		commandFlags.Usage()
+		return 2
+	}
+
+	var w io.Writer = os.Stdout
+	if simulateOutput != "-" {
+		file, err := os.OpenFile(simulateOutput, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Open output: %s\n", err)
+			return 1
+		}
+		defer file.Close()
+		w = file
+	}
+
+	seed := simulateSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err := exporter.Simulate(ctx, w, exporter.SimulatorConfig{
+		MeterID: simulateMeterID,
+		Seed:    seed,
+		Speed:   simulateSpeed,
+		Count:   simulateCount,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Simulate: %s\n", err)
+		return 1
+	}
+	return 0
+}